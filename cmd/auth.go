@@ -0,0 +1,523 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie   = "listmonk_session"
+	sessionDuration = time.Hour * 24 * 7
+
+	// tokenAuthPrefix is the prefix of the Authorization header
+	// value that carries an API token.
+	tokenAuthPrefix = "token "
+)
+
+// Permissions that are checked against the authenticated user
+// on admin handlers.
+const (
+	permSettingsRead      = "settings:read"
+	permSettingsWrite     = "settings:write"
+	permUsersRead         = "users:read"
+	permUsersWrite        = "users:write"
+	permSubscribersRead   = "subscribers:read"
+	permSubscribersWrite  = "subscribers:write"
+	permSubscribersImport = "subscribers:import"
+	permSubscribersSQL    = "subscribers:sql"
+	permListsRead         = "lists:read"
+	permListsWrite        = "lists:write"
+	permCampaignsRead     = "campaigns:read"
+	permCampaignsWrite    = "campaigns:write"
+	permTemplatesRead     = "templates:read"
+	permTemplatesWrite    = "templates:write"
+	permMediaRead         = "media:read"
+	permMediaWrite        = "media:write"
+	permBouncesRead       = "bounces:read"
+	permBouncesWrite      = "bounces:write"
+	permSegmentsRead      = "segments:read"
+	permSegmentsWrite     = "segments:write"
+	permTxSend            = "tx:send"
+	permWebhooksRead      = "webhooks:read"
+	permWebhooksWrite     = "webhooks:write"
+	permMetricsRead       = "metrics:read"
+)
+
+// allPerms is the list of all available permissions.
+var allPerms = []string{
+	permSettingsRead, permSettingsWrite,
+	permUsersRead, permUsersWrite,
+	permSubscribersRead, permSubscribersWrite, permSubscribersImport, permSubscribersSQL,
+	permListsRead, permListsWrite,
+	permCampaignsRead, permCampaignsWrite,
+	permTemplatesRead, permTemplatesWrite,
+	permMediaRead, permMediaWrite,
+	permBouncesRead, permBouncesWrite,
+	permSegmentsRead, permSegmentsWrite,
+	permTxSend,
+	permWebhooksRead, permWebhooksWrite,
+	permMetricsRead,
+}
+
+// rolePerms maps user roles to the permissions they grant. Superadmins
+// bypass roles and have all permissions.
+var rolePerms = map[string][]string{
+	models.UserRoleAdmin: allPerms,
+
+	models.UserRoleCampaignEditor: {
+		permCampaignsRead, permCampaignsWrite,
+		permTemplatesRead, permTemplatesWrite,
+		permMediaRead, permMediaWrite,
+		permListsRead, permSubscribersRead, permBouncesRead,
+		permSegmentsRead, permTxSend,
+	},
+
+	models.UserRoleListManager: {
+		permListsRead, permListsWrite,
+		permSubscribersRead, permSubscribersWrite, permSubscribersImport,
+		permBouncesRead, permBouncesWrite,
+		permSegmentsRead, permSegmentsWrite,
+		permCampaignsRead,
+	},
+
+	models.UserRoleReadonly: {
+		permListsRead, permSubscribersRead, permCampaignsRead,
+		permTemplatesRead, permMediaRead, permBouncesRead,
+		permSegmentsRead,
+	},
+}
+
+var userRoles = []string{models.UserRoleAdmin, models.UserRoleCampaignEditor,
+	models.UserRoleListManager, models.UserRoleReadonly}
+
+// tokenUser is a user authenticated with an API token.
+type tokenUser struct {
+	models.User
+
+	TokenID     int            `db:"token_id"`
+	TokenScopes pq.StringArray `db:"token_scopes"`
+}
+
+type loginTpl struct {
+	publicTpl
+	Username string
+	Next     string
+	Error    string
+}
+
+// authenticate middleware authenticates admin requests with an API token,
+// a session cookie set by the login page, or HTTP BasicAuth credentials of
+// a user, and sets the user on the request context.
+func authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		app := c.Get("app").(*App)
+
+		u, err := getRequestUser(c)
+		if err != nil {
+			app.log.Printf("error authenticating request: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+		}
+
+		if u == nil {
+			// Send browsers requesting the admin UI to the login page.
+			if c.Request().Method == http.MethodGet &&
+				strings.HasPrefix(c.Request().URL.Path, adminRoot) {
+				return c.Redirect(http.StatusFound,
+					adminRoot+"/login?next="+url.QueryEscape(c.Request().URL.RequestURI()))
+			}
+			return echo.NewHTTPError(http.StatusUnauthorized, app.i18n.T("users.invalidLogin"))
+		}
+
+		c.Set("user", u)
+		return next(c)
+	}
+}
+
+// getRequestToken checks for an API token in the Authorization header and
+// returns the token's user. The token is set on the request context.
+func getRequestToken(c echo.Context) (*models.User, bool, error) {
+	hdr := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(hdr) <= len(tokenAuthPrefix) || !strings.EqualFold(hdr[:len(tokenAuthPrefix)], tokenAuthPrefix) {
+		return nil, false, nil
+	}
+
+	app := c.Get("app").(*App)
+	var t tokenUser
+	if err := app.queries.GetAPITokenUser.Get(&t, hashToken(strings.TrimSpace(hdr[len(tokenAuthPrefix):]))); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, true, nil
+		}
+		return nil, true, err
+	}
+
+	c.Set("token", &t)
+	return &t.User, true, nil
+}
+
+// hashToken returns the SHA-256 hash of an API token or a session ID that's
+// stored in the DB.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// getRequestUser returns the user authenticated by the session cookie or
+// BasicAuth credentials on a request. It returns nil if there's no valid user.
+func getRequestUser(c echo.Context) (*models.User, error) {
+	app := c.Get("app").(*App)
+
+	// API token.
+	if u, ok, err := getRequestToken(c); ok {
+		return u, err
+	}
+
+	// Session cookie.
+	if ck, err := c.Cookie(sessionCookie); err == nil && ck.Value != "" {
+		var u models.User
+		if err := app.queries.GetSessionUser.Get(&u, hashToken(ck.Value)); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return &u, nil
+	}
+
+	// BasicAuth.
+	username, password, ok := c.Request().BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	return checkUserLogin(username, password, app)
+}
+
+// checkUserLogin validates a username and password and returns the user.
+// It returns nil if the credentials are invalid or the user is disabled.
+func checkUserLogin(username, password string, app *App) (*models.User, error) {
+	if username == "" || password == "" {
+		return nil, nil
+	}
+
+	var out []models.User
+	if err := app.queries.GetUsers.Select(&out, 0, username, 0, 1); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		// Compare against a dummy hash anyway to not leak the existence
+		// of usernames via response timing.
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+
+	u := out[0]
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		return nil, nil
+	}
+	if u.Status != models.UserStatusEnabled {
+		return nil, nil
+	}
+
+	return &u, nil
+}
+
+// dummyPasswordHash is used for constant time comparisons for non-existent users.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("listmonk"), bcrypt.DefaultCost)
+
+// hashPassword returns the bcrypt hash of a password.
+func hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// perm middleware checks whether the authenticated user
+// has all of the given permissions.
+func perm(next echo.HandlerFunc, perms ...string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		for _, p := range perms {
+			if err := checkPerm(c, p); err != nil {
+				return err
+			}
+		}
+		return next(c)
+	}
+}
+
+// checkPerm checks whether the authenticated user, and the API token
+// the request was authenticated with, if any, have a permission.
+func checkPerm(c echo.Context, p string) error {
+	var (
+		u = getUser(c)
+		t = getToken(c)
+	)
+
+	// API tokens are further limited to their scopes.
+	if u == nil || !hasPerm(u, p) || (t != nil && !strSliceContains(p, t.TokenScopes)) {
+		app := c.Get("app").(*App)
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", p))
+	}
+	return nil
+}
+
+// getUser returns the authenticated user on a request.
+func getUser(c echo.Context) *models.User {
+	u, _ := c.Get("user").(*models.User)
+	return u
+}
+
+// getToken returns the API token a request was authenticated with, if any.
+func getToken(c echo.Context) *tokenUser {
+	t, _ := c.Get("token").(*tokenUser)
+	return t
+}
+
+// hasPerm checks whether a user has the given permission.
+func hasPerm(u *models.User, p string) bool {
+	if u.Type == models.UserTypeSuperadmin {
+		return true
+	}
+	return strSliceContains(p, rolePerms[u.Role])
+}
+
+// getUserPerms returns all the permissions a user has.
+func getUserPerms(u *models.User) []string {
+	if u.Type == models.UserTypeSuperadmin {
+		return allPerms
+	}
+	return rolePerms[u.Role]
+}
+
+// userListIDs returns the list IDs the authenticated user is restricted to.
+// nil indicates that the user has access to all lists while an empty slice
+// indicates that the user is restricted and has access to none.
+func userListIDs(c echo.Context) pq.Int64Array {
+	u := getUser(c)
+	if u == nil || u.Type == models.UserTypeSuperadmin || !u.RestrictLists {
+		return nil
+	}
+	if u.ListIDs == nil {
+		return pq.Int64Array{}
+	}
+	return u.ListIDs
+}
+
+// filterListIDs validates the given list IDs against the lists the authenticated
+// user is restricted to. If no IDs are given, all the lists the user has access
+// to are returned. A nil slice means that there are no restrictions.
+func filterListIDs(c echo.Context, ids []int64) (pq.Int64Array, error) {
+	allowed := userListIDs(c)
+	if allowed == nil {
+		return ids, nil
+	}
+	if len(ids) == 0 {
+		// An empty slice means no restrictions to queries.
+		if len(allowed) == 0 {
+			app := c.Get("app").(*App)
+			return nil, echo.NewHTTPError(http.StatusForbidden, app.i18n.T("users.listsRequired"))
+		}
+		return allowed, nil
+	}
+	if err := checkListAccess(c, ids...); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// checkListAccess checks whether the authenticated user has
+// access to all the given lists.
+func checkListAccess(c echo.Context, ids ...int64) error {
+	allowed := userListIDs(c)
+	if allowed == nil {
+		return nil
+	}
+
+	app := c.Get("app").(*App)
+	if len(ids) == 0 {
+		return echo.NewHTTPError(http.StatusForbidden, app.i18n.T("users.listsRequired"))
+	}
+	for _, id := range ids {
+		if !inInt64Array(id, allowed) {
+			return echo.NewHTTPError(http.StatusForbidden,
+				app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.list}"))
+		}
+	}
+	return nil
+}
+
+// checkSubscriberAccess checks whether the authenticated user has access to
+// all the given subscribers. Read access requires a subscriber to be subscribed
+// to at least one of the user's lists while write access requires all of a
+// subscriber's subscriptions to be on the user's lists.
+func checkSubscriberAccess(c echo.Context, write bool, ids ...int64) error {
+	allowed := userListIDs(c)
+	if allowed == nil {
+		return nil
+	}
+
+	app := c.Get("app").(*App)
+	var res struct {
+		Outside int `db:"outside"`
+		None    int `db:"none_inside"`
+	}
+	if err := app.queries.CheckSubscriberListScope.Get(&res, pq.Int64Array(ids), allowed); err != nil {
+		app.log.Printf("error checking subscriber lists: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	if res.None > 0 || (write && res.Outside > 0) {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.subscriber}"))
+	}
+	return nil
+}
+
+// checkCampaignAccess checks whether the authenticated user has access to all
+// the lists a campaign targets.
+func checkCampaignAccess(c echo.Context, campID int) error {
+	if userListIDs(c) == nil {
+		return nil
+	}
+
+	app := c.Get("app").(*App)
+	var ids pq.Int64Array
+	if err := app.queries.GetCampaignListIDs.Get(&ids, campID); err != nil {
+		app.log.Printf("error fetching campaign lists: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return checkListAccess(c, ids...)
+}
+
+// checkSegmentAccess checks whether the authenticated user can target
+// segments in campaigns.
+func checkSegmentAccess(c echo.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return checkPerm(c, permSegmentsRead)
+}
+
+// handleLoginPage renders the login page and handles login form submissions.
+func handleLoginPage(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out = loginTpl{Next: c.FormValue("next")}
+	)
+	out.Title = app.i18n.T("users.login")
+
+	// Only allow redirects to the admin.
+	if !strings.HasPrefix(out.Next, adminRoot) || strings.HasPrefix(out.Next, adminRoot+"/login") {
+		out.Next = adminRoot
+	}
+
+	if c.Request().Method != http.MethodPost {
+		return c.Render(http.StatusOK, "login", out)
+	}
+
+	out.Username = strings.TrimSpace(c.FormValue("username"))
+	u, err := checkUserLogin(out.Username, c.FormValue("password"), app)
+	if err != nil {
+		app.log.Printf("error logging in: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("public.errorProcessingRequest")))
+	}
+	if u == nil {
+		out.Error = app.i18n.T("users.invalidLogin")
+		return c.Render(http.StatusUnauthorized, "login", out)
+	}
+
+	// Create a new session.
+	sess, err := generateRandomString(32)
+	if err != nil {
+		app.log.Printf("error generating session ID: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("public.errorProcessingRequest")))
+	}
+	expiry := time.Now().Add(sessionDuration)
+	if _, err := app.queries.CreateSession.Exec(hashToken(sess), u.ID, expiry); err != nil {
+		app.log.Printf("error creating session: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("public.errorProcessingRequest")))
+	}
+	if _, err := app.queries.UpdateUserLogin.Exec(u.ID); err != nil {
+		app.log.Printf("error updating user login: %v", err)
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    sess,
+		Path:     "/",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.constants.RootURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return c.Redirect(http.StatusFound, out.Next)
+}
+
+// handleLogout deletes the current session.
+func handleLogout(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if ck, err := c.Cookie(sessionCookie); err == nil && ck.Value != "" {
+		if _, err := app.queries.DeleteSession.Exec(hashToken(ck.Value)); err != nil {
+			app.log.Printf("error deleting session: %v", err)
+		}
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleGetProfile returns the authenticated user and their permissions.
+func handleGetProfile(c echo.Context) error {
+	u := getUser(c)
+
+	out := struct {
+		models.User
+		Permissions []string `json:"permissions"`
+	}{*u, getUserPerms(u)}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// inInt64Array checks if an int64 exists in a slice of int64s.
+func inInt64Array(v int64, vals []int64) bool {
+	for _, i := range vals {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -13,6 +13,14 @@ import (
 	"github.com/lib/pq"
 )
 
+type failedBouncesWrap struct {
+	Results []models.PendingBounce `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
 type bouncesWrap struct {
 	Results []models.Bounce `json:"results"`
 
@@ -50,7 +58,7 @@ func handleGetBounces(c echo.Context) error {
 	}
 
 	stmt := fmt.Sprintf(app.queries.QueryBounces, orderBy, order)
-	if err := db.Select(&out.Results, stmt, id, campID, 0, source, pg.Offset, pg.Limit); err != nil {
+	if err := db.Select(&out.Results, stmt, id, campID, 0, source, pg.Offset, pg.Limit, userListIDs(c)); err != nil {
 		app.log.Printf("error fetching bounces: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
@@ -84,10 +92,13 @@ func handleGetSubscriberBounces(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkSubscriberAccess(c, false, id); err != nil {
+		return err
+	}
 
 	out := []models.Bounce{}
 	stmt := fmt.Sprintf(app.queries.QueryBounces, "created_at", "ASC")
-	if err := db.Select(&out, stmt, 0, 0, subID, "", 0, 1000); err != nil {
+	if err := db.Select(&out, stmt, 0, 0, subID, "", 0, 1000, nil); err != nil {
 		app.log.Printf("error fetching bounces: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
@@ -128,7 +139,7 @@ func handleDeleteBounces(c echo.Context) error {
 		IDs = i
 	}
 
-	if _, err := app.queries.DeleteBounces.Exec(IDs); err != nil {
+	if _, err := app.queries.DeleteBounces.Exec(IDs, userListIDs(c)); err != nil {
 		app.log.Printf("error deleting bounces: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorDeleting",
@@ -138,6 +149,109 @@ func handleDeleteBounces(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleGetFailedBounces handles retrieval of incoming bounces that couldn't be
+// recorded (dead-letters), eg: when their subscribers don't exist.
+func handleGetFailedBounces(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		pg     = getPagination(c.QueryParams(), 50)
+		source = c.FormValue("source")
+		out    failedBouncesWrap
+	)
+
+	// Failed bounces may not belong to any subscriber, and hence, any list.
+	if userListIDs(c) != nil {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.bounces}"))
+	}
+
+	if err := app.queries.QueryFailedBounces.Select(&out.Results, source, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching failed bounces: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.bounces}", "error", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.PendingBounce{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleReplayFailedBounces moves failed bounces, either the given IDs or all of them,
+// back to the queue to be processed again.
+func handleReplayFailedBounces(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	IDs, err := getFailedBounceIDs(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := app.queries.ReplayFailedBounces.Exec(IDs); err != nil {
+		app.log.Printf("error replaying failed bounces: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.bounces}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleDeleteFailedBounces handles deletion of failed bounces, either the given IDs or all of them.
+func handleDeleteFailedBounces(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	IDs, err := getFailedBounceIDs(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := app.queries.DeleteFailedBounces.Exec(IDs); err != nil {
+		app.log.Printf("error deleting failed bounces: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.bounces}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// getFailedBounceIDs returns the failed bounce IDs in the query params.
+// An empty list (all=true) represents all failed bounces.
+func getFailedBounceIDs(c echo.Context) (pq.Int64Array, error) {
+	var (
+		app    = c.Get("app").(*App)
+		all, _ = strconv.ParseBool(c.QueryParam("all"))
+	)
+
+	if userListIDs(c) != nil {
+		return nil, echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.bounces}"))
+	}
+
+	if all {
+		return pq.Int64Array{}, nil
+	}
+
+	IDs, err := parseStringIDs(c.Request().URL.Query()["id"])
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidID", "error", err.Error()))
+	}
+	if len(IDs) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidID"))
+	}
+
+	return IDs, nil
+}
+
 // handleBounceWebhook renders the HTML preview of a template.
 func handleBounceWebhook(c echo.Context) error {
 	var (
@@ -218,14 +332,51 @@ func handleBounceWebhook(c echo.Context) error {
 		}
 		bounces = append(bounces, bs...)
 
+	// Mailgun.
+	case service == "mailgun" && app.constants.BounceMailgunEnabled && app.bounce.Mailgun != nil:
+		b, ok, err := app.bounce.Mailgun.ProcessBounce(rawReq)
+		if err != nil {
+			app.log.Printf("error processing mailgun notification: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidData"))
+		}
+		if ok {
+			bounces = append(bounces, b)
+		}
+
+	// Postmark.
+	case service == "postmark" && app.constants.BouncePostmarkEnabled && app.bounce.Postmark != nil:
+		user, pwd, _ := c.Request().BasicAuth()
+		b, ok, err := app.bounce.Postmark.ProcessBounce(user, pwd, rawReq)
+		if err != nil {
+			app.log.Printf("error processing postmark notification: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidData"))
+		}
+		if ok {
+			bounces = append(bounces, b)
+		}
+
+	// SparkPost.
+	case service == "sparkpost" && app.constants.BounceSparkPostEnabled && app.bounce.SparkPost != nil:
+		user, pwd, _ := c.Request().BasicAuth()
+
+		// SparkPost sends batches of events.
+		bs, err := app.bounce.SparkPost.ProcessBounce(user, pwd, rawReq)
+		if err != nil {
+			app.log.Printf("error processing sparkpost notification: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidData"))
+		}
+		bounces = append(bounces, bs...)
+
 	default:
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("bounces.unknownService"))
 	}
 
-	// Record bounces if any.
+	// Record bounces if any. Bounces are staged in the DB and if that fails,
+	// an error is returned so that the sender can retry.
 	for _, b := range bounces {
 		if err := app.bounce.Record(b); err != nil {
 			app.log.Printf("error recording bounce: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.Ts("globals.messages.internalError"))
 		}
 	}
 
@@ -15,6 +15,10 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/knadh/listmonk/internal/cron"
+	"github.com/knadh/listmonk/internal/feeds"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/webhooks"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
@@ -35,6 +39,10 @@ type campaignReq struct {
 	// to the outside world.
 	ListIDs pq.Int64Array `db:"-" json:"lists"`
 
+	// IDs of the segments to target, optionally intersected with the lists.
+	// This overrides Campaign.Segments the same way ListIDs does.
+	SegmentIDs pq.Int64Array `db:"-" json:"segments"`
+
 	// This is only relevant to campaign test requests.
 	SubscriberEmails pq.StringArray `json:"subscribers"`
 
@@ -55,6 +63,14 @@ type campCountStats struct {
 	Timestamp  time.Time `db:"timestamp" json:"timestamp"`
 }
 
+// campWave is a wave of timezones of a campaign sent at a local time.
+type campWave struct {
+	SendAt      time.Time      `db:"send_at" json:"send_at"`
+	Timezones   pq.StringArray `db:"timezones" json:"timezones"`
+	Subscribers int            `db:"subscribers" json:"subscribers"`
+	Pending     int            `db:"pending" json:"pending"`
+}
+
 type campTopLinks struct {
 	URL   string `db:"url" json:"url"`
 	Count int    `db:"count" json:"count"`
@@ -69,6 +85,17 @@ type campaignStats struct {
 	UpdatedAt null.Time `db:"updated_at" json:"updated_at"`
 	Rate      int       `json:"rate"`
 	NetRate   int       `json:"net_rate"`
+
+	// Send rates of the throttled recipient domains.
+	Domains []manager.DomainStats `json:"domains"`
+}
+
+type campFailuresWrap struct {
+	Results []models.CampaignFailure `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
 }
 
 type campsWrap struct {
@@ -86,6 +113,9 @@ var (
 
 	campaignQuerySortFields = []string{"name", "status", "created_at", "updated_at"}
 	bounceQuerySortFields   = []string{"email", "campaign_name", "source", "created_at"}
+
+	// Schedule on which the feeds of feed driven campaigns without one are checked.
+	defaultFeedCron = "*/15 * * * *"
 )
 
 // handleGetCampaigns handles retrieval of campaigns.
@@ -112,7 +142,7 @@ func handleGetCampaigns(c echo.Context) error {
 	queryStr, stmt := makeSearchQuery(query, orderBy, order, app.queries.QueryCampaigns)
 
 	// Unsafe to ignore scanning fields not present in models.Campaigns.
-	if err := db.Select(&out.Results, stmt, id, pq.StringArray(status), queryStr, pg.Offset, pg.Limit); err != nil {
+	if err := db.Select(&out.Results, stmt, id, pq.StringArray(status), queryStr, pg.Offset, pg.Limit, userListIDs(c)); err != nil {
 		app.log.Printf("error fetching campaigns: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
@@ -135,6 +165,9 @@ func handleGetCampaigns(c echo.Context) error {
 
 		if noBody {
 			out.Results[i].Body = ""
+			for j := range out.Results[i].Variants {
+				out.Results[i].Variants[j].Body = ""
+			}
 		}
 	}
 
@@ -169,6 +202,9 @@ func handlePreviewCampaign(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkCampaignAccess(c, id); err != nil {
+		return err
+	}
 
 	var camp models.Campaign
 	if err := app.queries.GetCampaignForPreview.Get(&camp, id, tplID); err != nil {
@@ -183,12 +219,26 @@ func handlePreviewCampaign(c echo.Context) error {
 				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
 
+	// Preview an A/B test variant instead of the campaign's body.
+	if varID, _ := strconv.Atoi(c.FormValue("variant_id")); varID > 0 {
+		for _, v := range camp.Variants {
+			if v.ID == varID {
+				camp = *camp.WithVariant(v)
+				break
+			}
+		}
+	}
+
 	// There's a body in the request to preview instead of the body in the DB.
 	if c.Request().Method == http.MethodPost {
 		camp.ContentType = c.FormValue("content_type")
 		camp.Body = c.FormValue("body")
 	}
 
+	if err := loadFeedItems(&camp, app); err != nil {
+		return err
+	}
+
 	// Use a dummy campaign ID to prevent views and clicks from {{ TrackView }}
 	// and {{ TrackLink }} being registered on preview.
 	camp.UUID = dummySubscriber.UUID
@@ -273,6 +323,12 @@ func handleCreateCampaign(c echo.Context) error {
 	} else {
 		o = c
 	}
+	if err := checkListAccess(c, o.ListIDs...); err != nil {
+		return err
+	}
+	if err := checkSegmentAccess(c, o.SegmentIDs); err != nil {
+		return err
+	}
 
 	uu, err := uuid.NewV4()
 	if err != nil {
@@ -298,6 +354,16 @@ func handleCreateCampaign(c echo.Context) error {
 		o.Messenger,
 		o.TemplateID,
 		o.ListIDs,
+		o.ABTestPercent,
+		o.ABTestWaitMins,
+		o.ABTestMetric,
+		o.SegmentIDs,
+		o.SendLocal,
+		o.Timezone,
+		o.Cron,
+		o.SkipEmpty,
+		o.NextRunAt,
+		o.FeedURL,
 	); err != nil {
 		if err == sql.ErrNoRows {
 			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.noSubs"))
@@ -309,6 +375,13 @@ func handleCreateCampaign(c echo.Context) error {
 				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
 
+	if _, err := app.queries.UpdateCampaignVariants.Exec(newID, o.Variants); err != nil {
+		app.log.Printf("error creating campaign variants: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
 	// Hand over to the GET handler to return the last insertion.
 	return handleGetCampaigns(copyEchoCtx(c, map[string]string{
 		"id": fmt.Sprintf("%d", newID),
@@ -327,6 +400,9 @@ func handleUpdateCampaign(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 
 	}
+	if err := checkCampaignAccess(c, id); err != nil {
+		return err
+	}
 
 	var cm models.Campaign
 	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
@@ -353,11 +429,52 @@ func handleUpdateCampaign(c echo.Context) error {
 		return err
 	}
 
+	// The type of a campaign can't be changed.
+	o.Type = cm.Type
+
+	// If segments aren't in the request, retain the existing ones.
+	if o.SegmentIDs == nil {
+		var segs []models.Segment
+		if err := app.queries.GetCampaignSegments.Select(&segs, cm.ID); err != nil {
+			app.log.Printf("error fetching campaign segments: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{globals.terms.segments}", "error", pqErrMsg(err)))
+		}
+
+		o.SegmentIDs = pq.Int64Array{}
+		for _, s := range segs {
+			o.SegmentIDs = append(o.SegmentIDs, int64(s.ID))
+		}
+	}
+
+	// The A/B test of a campaign that has already started can't be changed
+	// as that would change the test batch and the attribution of the variants.
+	if cm.StartedAt.Valid {
+		o.Variants = cm.Variants
+		o.ABTestPercent = cm.ABTestPercent
+		o.ABTestWaitMins = cm.ABTestWaitMins
+		o.ABTestMetric = cm.ABTestMetric
+	}
+
+	// Similarly, the waves of timezones of a campaign sent at a local time
+	// are worked out from its timezone once it's started.
+	if cm.StartedAt.Valid {
+		o.SendLocal = cm.SendLocal
+		o.Timezone = cm.Timezone
+	}
+
 	if c, err := validateCampaignFields(o, app); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	} else {
 		o = c
 	}
+	if err := checkListAccess(c, o.ListIDs...); err != nil {
+		return err
+	}
+	if err := checkSegmentAccess(c, o.SegmentIDs); err != nil {
+		return err
+	}
 
 	_, err := app.queries.UpdateCampaign.Exec(cm.ID,
 		o.Name,
@@ -372,7 +489,17 @@ func handleUpdateCampaign(c echo.Context) error {
 		pq.StringArray(normalizeTags(o.Tags)),
 		o.Messenger,
 		o.TemplateID,
-		o.ListIDs)
+		o.ListIDs,
+		o.ABTestPercent,
+		o.ABTestWaitMins,
+		o.ABTestMetric,
+		o.SegmentIDs,
+		o.SendLocal,
+		o.Timezone,
+		o.Cron,
+		o.SkipEmpty,
+		o.NextRunAt,
+		o.FeedURL)
 	if err != nil {
 		app.log.Printf("error updating campaign: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
@@ -380,6 +507,15 @@ func handleUpdateCampaign(c echo.Context) error {
 				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
 
+	if !cm.StartedAt.Valid {
+		if _, err := app.queries.UpdateCampaignVariants.Exec(cm.ID, o.Variants); err != nil {
+			app.log.Printf("error updating campaign variants: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorUpdating",
+					"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+		}
+	}
+
 	return handleGetCampaigns(c)
 }
 
@@ -393,6 +529,9 @@ func handleUpdateCampaignStatus(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkCampaignAccess(c, id); err != nil {
+		return err
+	}
 
 	var cm models.Campaign
 	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
@@ -431,6 +570,11 @@ func handleUpdateCampaignStatus(c echo.Context) error {
 		if cm.Status != models.CampaignStatusPaused && cm.Status != models.CampaignStatusDraft {
 			errMsg = app.i18n.T("campaigns.onlyPausedDraft")
 		}
+
+		// Recurring campaigns are only ever scheduled. Their runs are sent instead.
+		if cm.Cron != "" {
+			errMsg = app.i18n.T("campaigns.recurringCantStart")
+		}
 	case models.CampaignStatusPaused:
 		if cm.Status != models.CampaignStatusRunning {
 			errMsg = app.i18n.T("campaigns.onlyActivePause")
@@ -460,6 +604,24 @@ func handleUpdateCampaignStatus(c echo.Context) error {
 				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
 
+	// The first run of a recurring campaign is worked out from the time it's scheduled.
+	if o.Status == models.CampaignStatusScheduled && cm.Cron != "" {
+		if _, err := app.queries.UpdateCampaignNextRun.Exec(cm.ID, nextCampaignRun(cm)); err != nil {
+			app.log.Printf("error updating campaign next run: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorUpdating",
+					"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+		}
+	}
+
+	app.webhooks.Trigger(webhooks.EventCampaignStatus, campStatusEvent{
+		ID:     cm.ID,
+		Name:   cm.Name,
+		Status: o.Status,
+		Sent:   cm.Sent,
+		ToSend: cm.ToSend,
+	})
+
 	return handleGetCampaigns(c)
 }
 
@@ -474,6 +636,9 @@ func handleDeleteCampaign(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkCampaignAccess(c, id); err != nil {
+		return err
+	}
 
 	var cm models.Campaign
 	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
@@ -500,6 +665,209 @@ func handleDeleteCampaign(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleGetCampaignFailures handles retrieval of the messages of a campaign
+// that failed to be delivered.
+func handleGetCampaignFailures(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		pg    = getPagination(c.QueryParams(), 50)
+		out   campFailuresWrap
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if err := checkCampaignAccess(c, id); err != nil {
+		return err
+	}
+
+	if err := app.queries.QueryCampaignFailures.Select(&out.Results, id, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching campaign failures: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{campaigns.failures}", "error", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.CampaignFailure{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignWaves returns the waves of timezones of a campaign that's
+// sent at a local time with the number of subscribers pending in each.
+func handleGetCampaignWaves(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if err := checkCampaignAccess(c, id); err != nil {
+		return err
+	}
+
+	out := []campWave{}
+	if err := app.queries.GetCampaignWaves.Select(&out, id); err != nil {
+		app.log.Printf("error fetching campaign waves: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{campaigns.waves}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignRuns returns the runs of a recurring campaign with their stats.
+func handleGetCampaignRuns(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		pg    = getPagination(c.QueryParams(), 20)
+		out   campsWrap
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if err := checkCampaignAccess(c, id); err != nil {
+		return err
+	}
+
+	if err := app.queries.QueryCampaignRuns.Select(&out.Results, id, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching campaign runs: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{campaigns.runs}", "error", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.Campaign{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Lazy load stats.
+	if err := out.Results.LoadStats(app.queries.GetCampaignStats); err != nil {
+		app.log.Printf("error fetching campaign stats: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleRequeueCampaignFailures queues the failed messages of a campaign,
+// either the given IDs or all of them, to be sent again.
+func handleRequeueCampaignFailures(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	IDs, err := getCampaignFailureIDs(c, id)
+	if err != nil {
+		return err
+	}
+
+	var camp models.Campaign
+	if err := app.queries.GetCampaign.Get(&camp, id, nil); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+		}
+
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	// The failures of paused campaigns would wait until they're resumed and
+	// those of cancelled campaigns would never be sent.
+	if camp.Status != models.CampaignStatusRunning && camp.Status != models.CampaignStatusFinished {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.requeueInvalidStatus"))
+	}
+
+	// The queued failures are picked up and sent by the instances that
+	// process campaigns.
+	var n int
+	if err := app.queries.QueueCampaignFailures.Get(&n, id, IDs); err != nil {
+		app.log.Printf("error requeuing campaign failures: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("campaigns.errorRequeue", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{n})
+}
+
+// handleDeleteCampaignFailures handles deletion of the failed messages of a
+// campaign, either the given IDs or all of them.
+func handleDeleteCampaignFailures(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	IDs, err := getCampaignFailureIDs(c, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := app.queries.DeleteCampaignFailures.Exec(id, IDs); err != nil {
+		app.log.Printf("error deleting campaign failures: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{campaigns.failures}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// getCampaignFailureIDs validates the campaign ID and returns the failure IDs
+// in the query params. An empty list (all=true) represents all failures.
+func getCampaignFailureIDs(c echo.Context, campID int) (pq.Int64Array, error) {
+	var (
+		app    = c.Get("app").(*App)
+		all, _ = strconv.ParseBool(c.QueryParam("all"))
+	)
+
+	if campID < 1 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if err := checkCampaignAccess(c, campID); err != nil {
+		return nil, err
+	}
+
+	if all {
+		return pq.Int64Array{}, nil
+	}
+
+	IDs, err := parseStringIDs(c.Request().URL.Query()["id"])
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidID", "error", err.Error()))
+	}
+	if len(IDs) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidID"))
+	}
+
+	return IDs, nil
+}
+
 // handleGetRunningCampaignStats returns stats of a given set of campaign IDs.
 func handleGetRunningCampaignStats(c echo.Context) error {
 	var (
@@ -537,7 +905,9 @@ func handleGetRunningCampaignStats(c echo.Context) error {
 			out[i].NetRate = rate
 
 			// Realtime running rate over the last minute.
-			out[i].Rate = app.manager.GetCampaignStats(c.ID).SendRate
+			st := app.manager.GetCampaignStats(c.ID)
+			out[i].Rate = st.SendRate
+			out[i].Domains = st.Domains
 		}
 	}
 
@@ -557,6 +927,9 @@ func handleTestCampaign(c echo.Context) error {
 	if campID < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.errorID"))
 	}
+	if err := checkCampaignAccess(c, campID); err != nil {
+		return err
+	}
 
 	// Get and validate fields.
 	if err := c.Bind(&req); err != nil {
@@ -613,6 +986,10 @@ func handleTestCampaign(c echo.Context) error {
 	camp.Headers = req.Headers
 	camp.TemplateID = req.TemplateID
 
+	if err := loadFeedItems(&camp, app); err != nil {
+		return err
+	}
+
 	// Send the test messages.
 	for _, s := range subs {
 		sub := s
@@ -724,16 +1101,20 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 	// 	return c,errors.New("invalid length for `body`")
 	// }
 
-	// If there's a "send_at" date, it should be in the future.
-	if c.SendAt.Valid {
+	// If there's a "send_at" date, it should be in the future, except for
+	// the start of a recurring campaign, which may already be under way.
+	if c.SendAt.Valid && strings.TrimSpace(c.Cron) == "" {
 		if c.SendAt.Time.Before(time.Now()) {
 			return c, errors.New(app.i18n.T("campaigns.fieldInvalidSendAt"))
 		}
 	}
 
-	if len(c.ListIDs) == 0 {
+	if len(c.ListIDs) == 0 && len(c.SegmentIDs) == 0 {
 		return c, errors.New(app.i18n.T("campaigns.fieldInvalidListIDs"))
 	}
+	if c.Type == models.CampaignTypeOptin && len(c.SegmentIDs) > 0 {
+		return c, errors.New(app.i18n.T("campaigns.fieldInvalidOptinSegments"))
+	}
 
 	if !app.manager.HasMessenger(c.Messenger) {
 		return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", c.Messenger))
@@ -748,6 +1129,97 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 		c.Headers = make([]map[string]string, 0)
 	}
 
+	// Sending at a local time in subscribers' timezones.
+	c.Timezone = strings.TrimSpace(c.Timezone)
+	if c.Timezone == "" {
+		c.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return c, errors.New(app.i18n.T("campaigns.fieldInvalidTimezone"))
+	}
+	if c.SendLocal {
+		if !c.SendAt.Valid {
+			return c, errors.New(app.i18n.T("campaigns.fieldInvalidSendLocal"))
+		}
+		if len(c.Variants) > 0 {
+			return c, errors.New(app.i18n.T("campaigns.fieldInvalidSendLocalABTest"))
+		}
+	}
+
+	// Feed driven campaigns are recurring campaigns whose schedule is how
+	// often the feed is checked for new items.
+	c.Cron = strings.TrimSpace(c.Cron)
+	c.FeedURL = strings.TrimSpace(c.FeedURL)
+	if c.FeedURL != "" {
+		if err := feeds.ValidateURL(c.FeedURL); err != nil {
+			return c, errors.New(app.i18n.T("campaigns.fieldInvalidFeedURL"))
+		}
+		if c.Cron == "" {
+			c.Cron = defaultFeedCron
+		}
+	}
+
+	// Recurring campaigns. The schedule starts at send_at.
+	c.NextRunAt = null.Time{}
+	if c.Cron != "" {
+		if _, err := cron.Parse(c.Cron); err != nil {
+			return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidCron", "error", err.Error()))
+		}
+		if !c.SendAt.Valid {
+			return c, errors.New(app.i18n.T("campaigns.fieldInvalidCronSendAt"))
+		}
+		if c.SendLocal {
+			return c, errors.New(app.i18n.T("campaigns.fieldInvalidCronSendLocal"))
+		}
+
+		c.NextRunAt = nextCampaignRun(c.Campaign)
+		if !c.NextRunAt.Valid {
+			return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidCron", "error", c.Cron))
+		}
+	}
+
+	// A/B test variants.
+	if c.ABTestMetric == "" {
+		c.ABTestMetric = models.ABTestMetricViews
+	}
+	if len(c.Variants) == 0 {
+		c.ABTestPercent = 0
+		return c, nil
+	}
+
+	if len(c.Variants) < 2 {
+		return c, errors.New(app.i18n.T("campaigns.fieldInvalidVariants"))
+	}
+	for i, v := range c.Variants {
+		c.Variants[i].Name = strings.TrimSpace(v.Name)
+		if !strHasLen(c.Variants[i].Name, 1, stdInputMaxLen) {
+			return c, errors.New(app.i18n.T("campaigns.fieldInvalidName"))
+		}
+		if !strHasLen(v.Subject, 1, stdInputMaxLen) {
+			return c, errors.New(app.i18n.T("campaigns.fieldInvalidSubject"))
+		}
+
+		vc := c.Campaign.WithVariant(v)
+		if err := vc.CompileTemplate(app.manager.TemplateFuncs(vc)); err != nil {
+			return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidBody", "error", err.Error()))
+		}
+	}
+	if c.ABTestPercent < 1 || c.ABTestPercent > 99 {
+		return c, errors.New(app.i18n.T("campaigns.fieldInvalidABTestPercent"))
+	}
+
+	// Every variant needs at least one of the percentage buckets of the test batch.
+	if c.ABTestPercent < len(c.Variants) {
+		return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidABTestPercentVariants",
+			"num", strconv.Itoa(len(c.Variants))))
+	}
+	if c.ABTestWaitMins < 1 {
+		return c, errors.New(app.i18n.T("campaigns.fieldInvalidABTestWait"))
+	}
+	if c.ABTestMetric != models.ABTestMetricViews && c.ABTestMetric != models.ABTestMetricClicks {
+		return c, errors.New(app.i18n.Ts("globals.messages.invalidFields", "name", "ab_test_metric"))
+	}
+
 	return c, nil
 }
 
@@ -759,6 +1231,54 @@ func isCampaignalMutable(status string) bool {
 		status == models.CampaignStatusFinished
 }
 
+// nextCampaignRun returns the first run of a recurring campaign from its
+// start (send_at) or now, whichever is later, in the campaign's timezone.
+// It's null if the campaign isn't recurring or the schedule never occurs.
+func nextCampaignRun(c models.Campaign) null.Time {
+	if c.Cron == "" || !c.SendAt.Valid {
+		return null.Time{}
+	}
+
+	sch, err := cron.Parse(c.Cron)
+	if err != nil {
+		return null.Time{}
+	}
+
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	from := c.SendAt.Time
+	if now := time.Now(); now.After(from) {
+		from = now
+	}
+
+	// The start itself is a run if it's on the schedule.
+	t := sch.Next(from.Add(-time.Minute).In(loc))
+	if t.IsZero() {
+		return null.Time{}
+	}
+	return null.TimeFrom(t)
+}
+
+// loadFeedItems loads the items that are currently in the feed of a feed
+// driven campaign for previewing and testing it.
+func loadFeedItems(camp *models.Campaign, app *App) error {
+	if camp.FeedURL == "" {
+		return nil
+	}
+
+	items, err := app.feeds.Fetch(camp.FeedURL)
+	if err != nil {
+		app.log.Printf("error fetching feed: %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.errorFetching", "name", "{campaigns.feed}", "error", err.Error()))
+	}
+	camp.FeedItems = items
+	return nil
+}
+
 // makeOptinCampaignMessage makes a default opt-in campaign message body.
 func makeOptinCampaignMessage(o campaignReq, app *App) (campaignReq, error) {
 	if len(o.ListIDs) == 0 {
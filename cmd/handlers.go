@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/subtle"
 	"net/http"
 	"net/url"
 	"path"
@@ -39,21 +38,16 @@ var (
 
 // registerHandlers registers HTTP handlers.
 func initHTTPHandlers(e *echo.Echo, app *App) {
-	// Group of private handlers with BasicAuth.
-	var g *echo.Group
-
-	if len(app.constants.AdminUsername) == 0 ||
-		len(app.constants.AdminPassword) == 0 {
-		g = e.Group("")
-	} else {
-		g = e.Group("", middleware.BasicAuth(basicAuth))
-	}
+	// Group of private handlers that require an authenticated user.
+	g := e.Group("", authenticate)
 
 	// Admin JS app views.
 	// /admin/static/* file server is registered in initHTTPServer().
 	e.GET("/", func(c echo.Context) error {
 		return c.Render(http.StatusOK, "home", publicTpl{Title: "listmonk"})
 	})
+	e.GET(path.Join(adminRoot, "/login"), noIndex(handleLoginPage))
+	e.POST(path.Join(adminRoot, "/login"), handleLoginPage)
 	g.GET(path.Join(adminRoot, ""), handleAdminPage)
 	g.GET(path.Join(adminRoot, "/custom.css"), serveCustomApperance("admin.custom_css"))
 	g.GET(path.Join(adminRoot, "/custom.js"), serveCustomApperance("admin.custom_js"))
@@ -63,82 +57,127 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	g.GET("/api/health", handleHealthCheck)
 	g.GET("/api/config", handleGetServerConfig)
 	g.GET("/api/lang/:lang", handleGetI18nLang)
-	g.GET("/api/dashboard/charts", handleGetDashboardCharts)
-	g.GET("/api/dashboard/counts", handleGetDashboardCounts)
-
-	g.GET("/api/settings", handleGetSettings)
-	g.PUT("/api/settings", handleUpdateSettings)
-	g.POST("/api/admin/reload", handleReloadApp)
-	g.GET("/api/logs", handleGetLogs)
-
-	g.GET("/api/subscribers/:id", handleGetSubscriber)
-	g.GET("/api/subscribers/:id/export", handleExportSubscriberData)
-	g.GET("/api/subscribers/:id/bounces", handleGetSubscriberBounces)
-	g.DELETE("/api/subscribers/:id/bounces", handleDeleteSubscriberBounces)
-	g.POST("/api/subscribers", handleCreateSubscriber)
-	g.PUT("/api/subscribers/:id", handleUpdateSubscriber)
-	g.POST("/api/subscribers/:id/optin", handleSubscriberSendOptin)
-	g.PUT("/api/subscribers/blocklist", handleBlocklistSubscribers)
-	g.PUT("/api/subscribers/:id/blocklist", handleBlocklistSubscribers)
-	g.PUT("/api/subscribers/lists/:id", handleManageSubscriberLists)
-	g.PUT("/api/subscribers/lists", handleManageSubscriberLists)
-	g.DELETE("/api/subscribers/:id", handleDeleteSubscribers)
-	g.DELETE("/api/subscribers", handleDeleteSubscribers)
-
-	g.GET("/api/bounces", handleGetBounces)
-	g.DELETE("/api/bounces", handleDeleteBounces)
-	g.DELETE("/api/bounces/:id", handleDeleteBounces)
+	g.GET("/api/dashboard/charts", perm(handleGetDashboardCharts, permCampaignsRead))
+	g.GET("/api/dashboard/counts", perm(handleGetDashboardCounts, permSubscribersRead, permListsRead))
+
+	g.GET("/api/profile", handleGetProfile)
+	g.POST("/api/logout", handleLogout)
+
+	g.GET("/api/settings", perm(handleGetSettings, permSettingsRead))
+	g.PUT("/api/settings", perm(handleUpdateSettings, permSettingsWrite))
+	g.GET("/api/settings/dkim", perm(handleGetDKIMRecords, permSettingsRead))
+	g.POST("/api/admin/reload", perm(handleReloadApp, permSettingsWrite))
+	g.GET("/api/logs", perm(handleGetLogs, permSettingsRead))
+	g.GET("/metrics", perm(handleGetMetrics, permMetricsRead))
+
+	g.GET("/api/tokens", handleGetAPITokens)
+	g.POST("/api/tokens", handleCreateAPIToken)
+	g.DELETE("/api/tokens/:id", handleDeleteAPIToken)
+
+	g.GET("/api/users", perm(handleGetUsers, permUsersRead))
+	g.GET("/api/users/:id", perm(handleGetUsers, permUsersRead))
+	g.POST("/api/users", perm(handleCreateUser, permUsersWrite))
+	g.PUT("/api/users/:id", perm(handleUpdateUser, permUsersWrite))
+	g.DELETE("/api/users/:id", perm(handleDeleteUser, permUsersWrite))
+
+	g.GET("/api/subscribers/:id", perm(handleGetSubscriber, permSubscribersRead))
+	g.GET("/api/subscribers/:id/export", perm(handleExportSubscriberData, permSubscribersRead))
+	g.GET("/api/subscribers/:id/bounces", perm(handleGetSubscriberBounces, permBouncesRead))
+	g.DELETE("/api/subscribers/:id/bounces", perm(handleDeleteSubscriberBounces, permBouncesWrite))
+	g.POST("/api/subscribers", perm(handleCreateSubscriber, permSubscribersWrite))
+	g.PUT("/api/subscribers/:id", perm(handleUpdateSubscriber, permSubscribersWrite))
+	g.POST("/api/subscribers/:id/optin", perm(handleSubscriberSendOptin, permSubscribersWrite))
+	g.PUT("/api/subscribers/blocklist", perm(handleBlocklistSubscribers, permSubscribersWrite))
+	g.PUT("/api/subscribers/:id/blocklist", perm(handleBlocklistSubscribers, permSubscribersWrite))
+	g.PUT("/api/subscribers/lists/:id", perm(handleManageSubscriberLists, permSubscribersWrite))
+	g.PUT("/api/subscribers/lists", perm(handleManageSubscriberLists, permSubscribersWrite))
+	g.DELETE("/api/subscribers/:id", perm(handleDeleteSubscribers, permSubscribersWrite))
+	g.DELETE("/api/subscribers", perm(handleDeleteSubscribers, permSubscribersWrite))
+
+	g.GET("/api/bounces", perm(handleGetBounces, permBouncesRead))
+	g.GET("/api/bounces/failed", perm(handleGetFailedBounces, permBouncesRead))
+	g.PUT("/api/bounces/failed/replay", perm(handleReplayFailedBounces, permBouncesWrite))
+	g.DELETE("/api/bounces/failed", perm(handleDeleteFailedBounces, permBouncesWrite))
+	g.DELETE("/api/bounces", perm(handleDeleteBounces, permBouncesWrite))
+	g.DELETE("/api/bounces/:id", perm(handleDeleteBounces, permBouncesWrite))
 
 	// Subscriber operations based on arbitrary SQL queries.
 	// These aren't very REST-like.
-	g.POST("/api/subscribers/query/delete", handleDeleteSubscribersByQuery)
-	g.PUT("/api/subscribers/query/blocklist", handleBlocklistSubscribersByQuery)
-	g.PUT("/api/subscribers/query/lists", handleManageSubscriberListsByQuery)
-	g.GET("/api/subscribers", handleQuerySubscribers)
+	g.POST("/api/subscribers/query/delete", perm(handleDeleteSubscribersByQuery, permSubscribersWrite))
+	g.PUT("/api/subscribers/query/blocklist", perm(handleBlocklistSubscribersByQuery, permSubscribersWrite))
+	g.PUT("/api/subscribers/query/lists", perm(handleManageSubscriberListsByQuery, permSubscribersWrite))
+	g.GET("/api/subscribers", perm(handleQuerySubscribers, permSubscribersRead))
 	g.GET("/api/subscribers/export",
-		middleware.GzipWithConfig(middleware.GzipConfig{Level: 9})(handleExportSubscribers))
-
-	g.GET("/api/import/subscribers", handleGetImportSubscribers)
-	g.GET("/api/import/subscribers/logs", handleGetImportSubscriberStats)
-	g.POST("/api/import/subscribers", handleImportSubscribers)
-	g.DELETE("/api/import/subscribers", handleStopImportSubscribers)
-
-	g.GET("/api/lists", handleGetLists)
-	g.GET("/api/lists/:id", handleGetLists)
-	g.POST("/api/lists", handleCreateList)
-	g.PUT("/api/lists/:id", handleUpdateList)
-	g.DELETE("/api/lists/:id", handleDeleteLists)
-
-	g.GET("/api/campaigns", handleGetCampaigns)
-	g.GET("/api/campaigns/running/stats", handleGetRunningCampaignStats)
-	g.GET("/api/campaigns/:id", handleGetCampaigns)
-	g.GET("/api/campaigns/analytics/:type", handleGetCampaignViewAnalytics)
-	g.GET("/api/campaigns/:id/preview", handlePreviewCampaign)
-	g.POST("/api/campaigns/:id/preview", handlePreviewCampaign)
-	g.POST("/api/campaigns/:id/content", handleCampaignContent)
-	g.POST("/api/campaigns/:id/text", handlePreviewCampaign)
-	g.POST("/api/campaigns/:id/test", handleTestCampaign)
-	g.POST("/api/campaigns", handleCreateCampaign)
-	g.PUT("/api/campaigns/:id", handleUpdateCampaign)
-	g.PUT("/api/campaigns/:id/status", handleUpdateCampaignStatus)
-	g.DELETE("/api/campaigns/:id", handleDeleteCampaign)
-
-	g.GET("/api/media", handleGetMedia)
-	g.POST("/api/media", handleUploadMedia)
-	g.DELETE("/api/media/:id", handleDeleteMedia)
-
-	g.GET("/api/templates", handleGetTemplates)
-	g.GET("/api/templates/:id", handleGetTemplates)
-	g.GET("/api/templates/:id/preview", handlePreviewTemplate)
-	g.POST("/api/templates/preview", handlePreviewTemplate)
-	g.POST("/api/templates", handleCreateTemplate)
-	g.PUT("/api/templates/:id", handleUpdateTemplate)
-	g.PUT("/api/templates/:id/default", handleTemplateSetDefault)
-	g.DELETE("/api/templates/:id", handleDeleteTemplate)
+		perm(middleware.GzipWithConfig(middleware.GzipConfig{Level: 9})(handleExportSubscribers), permSubscribersRead))
+
+	g.GET("/api/import/subscribers", perm(handleGetImportSubscribers, permSubscribersImport))
+	g.GET("/api/import/subscribers/logs", perm(handleGetImportSubscriberStats, permSubscribersImport))
+	g.POST("/api/import/subscribers", perm(handleImportSubscribers, permSubscribersImport))
+	g.DELETE("/api/import/subscribers", perm(handleStopImportSubscribers, permSubscribersImport))
+
+	g.GET("/api/lists", perm(handleGetLists, permListsRead))
+	g.GET("/api/lists/:id", perm(handleGetLists, permListsRead))
+	g.POST("/api/lists", perm(handleCreateList, permListsWrite))
+	g.PUT("/api/lists/:id", perm(handleUpdateList, permListsWrite))
+	g.DELETE("/api/lists/:id", perm(handleDeleteLists, permListsWrite))
+
+	g.GET("/api/segments", perm(handleGetSegments, permSegmentsRead))
+	g.GET("/api/segments/:id", perm(handleGetSegments, permSegmentsRead))
+	g.POST("/api/segments", perm(handleCreateSegment, permSegmentsWrite))
+	g.PUT("/api/segments/:id", perm(handleUpdateSegment, permSegmentsWrite))
+	g.DELETE("/api/segments/:id", perm(handleDeleteSegment, permSegmentsWrite))
+
+	g.GET("/api/sequences", perm(handleGetSequences, permCampaignsRead))
+	g.GET("/api/sequences/:id", perm(handleGetSequences, permCampaignsRead))
+	g.GET("/api/sequences/:id/subscribers", perm(handleGetSequenceSubscribers, permCampaignsRead))
+	g.POST("/api/sequences", perm(handleCreateSequence, permCampaignsWrite))
+	g.PUT("/api/sequences/:id", perm(handleUpdateSequence, permCampaignsWrite))
+	g.DELETE("/api/sequences/:id", perm(handleDeleteSequence, permCampaignsWrite))
+
+	g.GET("/api/webhooks", perm(handleGetWebhooks, permWebhooksRead))
+	g.GET("/api/webhooks/:id", perm(handleGetWebhooks, permWebhooksRead))
+	g.GET("/api/webhooks/:id/deliveries", perm(handleGetWebhookDeliveries, permWebhooksRead))
+	g.POST("/api/webhooks", perm(handleCreateWebhook, permWebhooksWrite))
+	g.PUT("/api/webhooks/:id", perm(handleUpdateWebhook, permWebhooksWrite))
+	g.DELETE("/api/webhooks/:id", perm(handleDeleteWebhook, permWebhooksWrite))
+
+	g.GET("/api/campaigns", perm(handleGetCampaigns, permCampaignsRead))
+	g.GET("/api/campaigns/running/stats", perm(handleGetRunningCampaignStats, permCampaignsRead))
+	g.GET("/api/campaigns/:id", perm(handleGetCampaigns, permCampaignsRead))
+	g.GET("/api/campaigns/analytics/:type", perm(handleGetCampaignViewAnalytics, permCampaignsRead))
+	g.GET("/api/campaigns/:id/preview", perm(handlePreviewCampaign, permCampaignsRead))
+	g.POST("/api/campaigns/:id/preview", perm(handlePreviewCampaign, permCampaignsRead))
+	g.POST("/api/campaigns/:id/content", perm(handleCampaignContent, permCampaignsWrite))
+	g.POST("/api/campaigns/:id/text", perm(handlePreviewCampaign, permCampaignsRead))
+	g.POST("/api/campaigns/:id/test", perm(handleTestCampaign, permCampaignsWrite))
+	g.POST("/api/campaigns", perm(handleCreateCampaign, permCampaignsWrite))
+	g.PUT("/api/campaigns/:id", perm(handleUpdateCampaign, permCampaignsWrite))
+	g.PUT("/api/campaigns/:id/status", perm(handleUpdateCampaignStatus, permCampaignsWrite))
+	g.GET("/api/campaigns/:id/waves", perm(handleGetCampaignWaves, permCampaignsRead))
+	g.GET("/api/campaigns/:id/runs", perm(handleGetCampaignRuns, permCampaignsRead))
+	g.GET("/api/campaigns/:id/failures", perm(handleGetCampaignFailures, permCampaignsRead))
+	g.PUT("/api/campaigns/:id/failures/requeue", perm(handleRequeueCampaignFailures, permCampaignsWrite))
+	g.DELETE("/api/campaigns/:id/failures", perm(handleDeleteCampaignFailures, permCampaignsWrite))
+	g.DELETE("/api/campaigns/:id", perm(handleDeleteCampaign, permCampaignsWrite))
+
+	g.GET("/api/media", perm(handleGetMedia, permMediaRead))
+	g.POST("/api/media", perm(handleUploadMedia, permMediaWrite))
+	g.DELETE("/api/media/:id", perm(handleDeleteMedia, permMediaWrite))
+
+	g.GET("/api/templates", perm(handleGetTemplates, permTemplatesRead))
+	g.GET("/api/templates/:id", perm(handleGetTemplates, permTemplatesRead))
+	g.GET("/api/templates/:id/preview", perm(handlePreviewTemplate, permTemplatesRead))
+	g.POST("/api/templates/preview", perm(handlePreviewTemplate, permTemplatesRead))
+	g.POST("/api/templates", perm(handleCreateTemplate, permTemplatesWrite))
+	g.PUT("/api/templates/:id", perm(handleUpdateTemplate, permTemplatesWrite))
+	g.PUT("/api/templates/:id/default", perm(handleTemplateSetDefault, permTemplatesWrite))
+	g.DELETE("/api/templates/:id", perm(handleDeleteTemplate, permTemplatesWrite))
+
+	g.POST("/api/tx", perm(handleSendTxMessage, permTxSend))
 
 	if app.constants.BounceWebhooksEnabled {
 		// Private authenticated bounce endpoint.
-		g.POST("/webhooks/bounce", handleBounceWebhook)
+		g.POST("/webhooks/bounce", perm(handleBounceWebhook, permBouncesWrite))
 
 		// Public bounce endpoints for webservices like SES.
 		e.POST("/webhooks/service/:service", handleBounceWebhook)
@@ -222,23 +261,6 @@ func serveCustomApperance(name string) echo.HandlerFunc {
 	}
 }
 
-// basicAuth middleware does an HTTP BasicAuth authentication for admin handlers.
-func basicAuth(username, password string, c echo.Context) (bool, error) {
-	app := c.Get("app").(*App)
-
-	// Auth is disabled.
-	if len(app.constants.AdminUsername) == 0 &&
-		len(app.constants.AdminPassword) == 0 {
-		return true, nil
-	}
-
-	if subtle.ConstantTimeCompare([]byte(username), app.constants.AdminUsername) == 1 &&
-		subtle.ConstantTimeCompare([]byte(password), app.constants.AdminPassword) == 1 {
-		return true, nil
-	}
-	return false, nil
-}
-
 // validateUUID middleware validates the UUID string format for a given set of params.
 func validateUUID(next echo.HandlerFunc, params ...string) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -335,6 +357,8 @@ func copyEchoCtx(c echo.Context, params map[string]string) echo.Context {
 
 	b := c.Echo().NewContext(c.Request(), c.Response())
 	b.Set("app", c.Get("app").(*App))
+	b.Set("user", c.Get("user"))
+	b.Set("token", c.Get("token"))
 	b.SetParamNames(keys...)
 	b.SetParamValues(vals...)
 	return b
@@ -54,6 +54,23 @@ func handleImportSubscribers(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.invalidDelim"))
 	}
 
+	// Users restricted to specific lists can only import into those lists
+	// and can't blocklist or overwrite subscribers globally.
+	if userListIDs(c) != nil {
+		if opt.Mode == subimporter.ModeBlocklist || opt.Overwrite {
+			return echo.NewHTTPError(http.StatusForbidden,
+				app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.subscribers}"))
+		}
+
+		ids := make([]int64, 0, len(opt.ListIDs))
+		for _, id := range opt.ListIDs {
+			ids = append(ids, int64(id))
+		}
+		if err := checkListAccess(c, ids...); err != nil {
+			return err
+		}
+	}
+
 	file, err := c.FormFile("file")
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest,
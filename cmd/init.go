@@ -24,6 +24,7 @@ import (
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/knadh/listmonk/internal/bounce"
 	"github.com/knadh/listmonk/internal/bounce/mailbox"
+	"github.com/knadh/listmonk/internal/feeds"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/internal/media"
@@ -32,7 +33,10 @@ import (
 	"github.com/knadh/listmonk/internal/messenger"
 	"github.com/knadh/listmonk/internal/messenger/email"
 	"github.com/knadh/listmonk/internal/messenger/postback"
+	"github.com/knadh/listmonk/internal/messenger/sendgrid"
+	"github.com/knadh/listmonk/internal/messenger/ses"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhooks"
 	"github.com/knadh/listmonk/models"
 	"github.com/knadh/stuffbin"
 	"github.com/labstack/echo/v4"
@@ -65,8 +69,6 @@ type constants struct {
 		Exportable         map[string]bool `koanf:"-"`
 		DomainBlocklist    map[string]bool `koanf:"-"`
 	} `koanf:"privacy"`
-	AdminUsername []byte `koanf:"admin_username"`
-	AdminPassword []byte `koanf:"admin_password"`
 
 	Appearance struct {
 		AdminCSS  []byte `koanf:"admin.custom_css"`
@@ -82,9 +84,12 @@ type constants struct {
 	MessageURL    string
 	MediaProvider string
 
-	BounceWebhooksEnabled bool
-	BounceSESEnabled      bool
-	BounceSendgridEnabled bool
+	BounceWebhooksEnabled  bool
+	BounceSESEnabled       bool
+	BounceSendgridEnabled  bool
+	BounceMailgunEnabled   bool
+	BouncePostmarkEnabled  bool
+	BounceSparkPostEnabled bool
 }
 
 type notifTpls struct {
@@ -345,6 +350,9 @@ func initConstants() *constants {
 	c.BounceWebhooksEnabled = ko.Bool("bounce.webhooks_enabled")
 	c.BounceSESEnabled = ko.Bool("bounce.ses_enabled")
 	c.BounceSendgridEnabled = ko.Bool("bounce.sendgrid_enabled")
+	c.BounceMailgunEnabled = ko.Bool("bounce.mailgun_enabled")
+	c.BouncePostmarkEnabled = ko.Bool("bounce.postmark_enabled")
+	c.BounceSparkPostEnabled = ko.Bool("bounce.sparkpost_enabled")
 	return &c
 }
 
@@ -367,6 +375,14 @@ func initI18n(lang string, fs stuffbin.FileSystem) *i18n.I18n {
 // initCampaignManager initializes the campaign manager.
 func initCampaignManager(q *Queries, cs *constants, app *App) *manager.Manager {
 	campNotifCB := func(subject string, data interface{}) error {
+		// Status changes made from the API trigger their own webhook events.
+		// Only trigger the ones made by the campaign manager.
+		if ev, err := makeCampStatusEvent(data); err != nil {
+			lo.Printf("error making campaign status webhook event: %v", err)
+		} else if ev.Status == models.CampaignStatusFinished || ev.Reason != "" {
+			app.webhooks.Trigger(webhooks.EventCampaignStatus, ev)
+		}
+
 		return app.sendNotification(cs.NotifyEmails, subject, notifTplCampaign, data)
 	}
 
@@ -381,11 +397,23 @@ func initCampaignManager(q *Queries, cs *constants, app *App) *manager.Manager {
 		lo.Println("running in passive mode. won't process campaigns.")
 	}
 
+	// Per recipient domain throttles.
+	var throttles []manager.DomainThrottle
+	for _, item := range ko.Slices("app.domain_throttles") {
+		var t manager.DomainThrottle
+		if err := item.UnmarshalWithConf("", &t, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading domain throttle config: %v", err)
+		}
+		throttles = append(throttles, t)
+	}
+
 	return manager.New(manager.Config{
 		BatchSize:             ko.Int("app.batch_size"),
 		Concurrency:           ko.Int("app.concurrency"),
 		MessageRate:           ko.Int("app.message_rate"),
 		MaxSendErrors:         ko.Int("app.max_send_errors"),
+		MaxSendErrorRate:      ko.Float64("app.max_send_error_rate"),
+		SendErrorWindow:       ko.Int("app.send_error_window"),
 		FromEmail:             cs.FromEmail,
 		IndividualTracking:    ko.Bool("privacy.individual_tracking"),
 		UnsubURL:              cs.UnsubURL,
@@ -397,9 +425,48 @@ func initCampaignManager(q *Queries, cs *constants, app *App) *manager.Manager {
 		SlidingWindow:         ko.Bool("app.message_sliding_window"),
 		SlidingWindowDuration: ko.Duration("app.message_sliding_window_duration"),
 		SlidingWindowRate:     ko.Int("app.message_sliding_window_rate"),
+		DomainThrottles:       throttles,
+		Feeds:                 app.feeds,
 		ScanInterval:          time.Second * 5,
 		ScanCampaigns:         !ko.Bool("passive"),
-	}, newManagerStore(q), campNotifCB, app.i18n, lo)
+	}, newManagerStore(q, app.db, lo), campNotifCB, app.i18n, lo)
+}
+
+// initFeeds initializes the fetcher of the RSS/Atom feeds of feed driven campaigns.
+func initFeeds() feeds.Fetcher {
+	return feeds.New(feeds.Opt{
+		Timeout: time.Second * 10,
+		MaxSize: 5 * 1024 * 1024,
+	})
+}
+
+// initTxTemplates loads and compiles all transactional templates
+// and caches them in the manager.
+func initTxTemplates(m *manager.Manager, app *App) {
+	if err := loadTxTemplates(m, app); err != nil {
+		lo.Fatalf("error loading transactional templates: %v", err)
+	}
+}
+
+// loadTxTemplates loads and compiles all transactional templates and
+// replaces the templates cached in the manager with them.
+func loadTxTemplates(m *manager.Manager, app *App) error {
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, 0, false, models.TemplateTypeTx); err != nil {
+		return err
+	}
+
+	out := make(map[int]*models.Template, len(tpls))
+	for _, t := range tpls {
+		tpl := t
+		if err := tpl.Compile(m.TxTemplateFuncs(&tpl)); err != nil {
+			app.log.Printf("error compiling transactional template %d: %v", tpl.ID, err)
+			continue
+		}
+		out[tpl.ID] = &tpl
+	}
+	m.CacheTpls(out)
+	return nil
 }
 
 // initImporter initializes the bulk subscriber importer.
@@ -418,7 +485,7 @@ func initImporter(q *Queries, db *sqlx.DB, app *App) *subimporter.Importer {
 }
 
 // initSMTPMessenger initializes the SMTP messenger.
-func initSMTPMessenger(m *manager.Manager) messenger.Messenger {
+func initSMTPMessenger(m *manager.Manager) *email.Emailer {
 	var (
 		mapKeys = ko.MapKeys("smtp")
 		servers = make([]email.Server, 0, len(mapKeys))
@@ -442,8 +509,13 @@ func initSMTPMessenger(m *manager.Manager) messenger.Messenger {
 		}
 
 		servers = append(servers, s)
-		lo.Printf("loaded email (SMTP) messenger: %s@%s",
-			item.String("username"), item.String("host"))
+		if s.Name != "" {
+			lo.Printf("loaded email (SMTP) messenger: %s@%s (%s-%s)",
+				item.String("username"), item.String("host"), emailMsgr, s.Name)
+		} else {
+			lo.Printf("loaded email (SMTP) messenger: %s@%s",
+				item.String("username"), item.String("host"))
+		}
 	}
 	if len(servers) == 0 {
 		lo.Fatalf("no SMTP servers enabled in settings")
@@ -494,6 +566,44 @@ func initPostbackMessengers(m *manager.Manager) []messenger.Messenger {
 	return out
 }
 
+// initAPIMessengers initializes and returns the enabled e-mail API
+// (Amazon SES, SendGrid) messengers.
+func initAPIMessengers(m *manager.Manager) []messenger.Messenger {
+	var out []messenger.Messenger
+
+	if ko.Bool("messenger.ses.enabled") {
+		var o ses.Options
+		if err := ko.UnmarshalWithConf("messenger.ses", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading SES messenger config: %v", err)
+		}
+
+		s, err := ses.New(o)
+		if err != nil {
+			lo.Fatalf("error initializing SES messenger: %v", err)
+		}
+		out = append(out, s)
+
+		lo.Printf("loaded SES messenger: %s", o.Region)
+	}
+
+	if ko.Bool("messenger.sendgrid.enabled") {
+		var o sendgrid.Options
+		if err := ko.UnmarshalWithConf("messenger.sendgrid", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading SendGrid messenger config: %v", err)
+		}
+
+		s, err := sendgrid.New(o)
+		if err != nil {
+			lo.Fatalf("error initializing SendGrid messenger: %v", err)
+		}
+		out = append(out, s)
+
+		lo.Printf("loaded SendGrid messenger")
+	}
+
+	return out
+}
+
 // initMediaStore initializes Upload manager with a custom backend.
 func initMediaStore() media.Store {
 	switch provider := ko.String("upload.provider"); provider {
@@ -579,12 +689,22 @@ func initNotifTemplates(path string, fs stuffbin.FileSystem, i *i18n.I18n, cs *c
 // for incoming bounce events.
 func initBounceManager(app *App) *bounce.Manager {
 	opt := bounce.Opt{
-		BounceCount:     ko.MustInt("bounce.count"),
-		BounceAction:    ko.MustString("bounce.action"),
 		WebhooksEnabled: ko.Bool("bounce.webhooks_enabled"),
 		SESEnabled:      ko.Bool("bounce.ses_enabled"),
 		SendgridEnabled: ko.Bool("bounce.sendgrid_enabled"),
 		SendgridKey:     ko.String("bounce.sendgrid_key"),
+
+		MailgunEnabled:    ko.Bool("bounce.mailgun_enabled"),
+		MailgunKey:        ko.String("bounce.mailgun_key"),
+		PostmarkEnabled:   ko.Bool("bounce.postmark_enabled"),
+		PostmarkUsername:  ko.String("bounce.postmark_username"),
+		PostmarkPassword:  ko.String("bounce.postmark_password"),
+		SparkPostEnabled:  ko.Bool("bounce.sparkpost_enabled"),
+		SparkPostUsername: ko.String("bounce.sparkpost_username"),
+		SparkPostPassword: ko.String("bounce.sparkpost_password"),
+	}
+	if err := ko.UnmarshalWithConf("bounce.actions", &opt.Actions, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+		lo.Fatalf("error reading bounce actions config: %v", err)
 	}
 
 	// For now, only one mailbox is supported.
@@ -604,9 +724,27 @@ func initBounceManager(app *App) *bounce.Manager {
 		break
 	}
 
+	// Trigger webhook events on recorded bounces and the subscribers
+	// deleted by bounce actions.
+	recordCB := func(b models.Bounce, deleted []models.Subscriber) {
+		app.webhooks.Trigger(webhooks.EventBounceRecorded, b)
+		for _, s := range deleted {
+			app.webhooks.Trigger(webhooks.EventSubscriberDeleted, subscriberEvent{
+				ID:    s.ID,
+				UUID:  s.UUID,
+				Email: s.Email,
+				Name:  s.Name,
+			})
+		}
+	}
+
 	b, err := bounce.New(opt, &bounce.Queries{
-		RecordQuery: app.queries.RecordBounce,
-	}, app.log)
+		RecordQuery:        app.queries.RecordBounce,
+		InsertPendingQuery: app.queries.InsertPendingBounce,
+		NextPendingQuery:   app.queries.NextPendingBounces,
+		UpdatePendingQuery: app.queries.UpdatePendingBounce,
+		DeletePendingQuery: app.queries.DeletePendingBounce,
+	}, recordCB, app.log)
 	if err != nil {
 		lo.Fatalf("error initializing bounce manager: %v", err)
 	}
@@ -614,6 +752,26 @@ func initBounceManager(app *App) *bounce.Manager {
 	return b
 }
 
+// initWebhooks initializes the outgoing webhook manager and loads
+// the webhooks from the DB.
+func initWebhooks(app *App) *webhooks.Manager {
+	m := webhooks.New(webhooks.Opt{
+		Concurrency: 4,
+		QueueSize:   10000,
+		Timeout:     time.Second * 10,
+		Backoff:     time.Second * 30,
+		MaxBackoff:  time.Hour * 6,
+	}, &webhookStore{queries: app.queries}, app.log)
+
+	var hooks []models.Webhook
+	if err := app.queries.GetWebhooks.Select(&hooks, 0); err != nil {
+		lo.Fatalf("error loading webhooks: %v", err)
+	}
+	m.Load(hooks)
+
+	return m
+}
+
 // initHTTPServer sets up and runs the app's main HTTP server and blocks forever.
 func initHTTPServer(app *App) *echo.Echo {
 	// Initialize the HTTP server.
@@ -628,6 +786,9 @@ func initHTTPServer(app *App) *echo.Echo {
 		}
 	})
 
+	// Record request latencies.
+	srv.Use(recordHTTPMetrics)
+
 	// Parse and load user facing templates.
 	tpl, err := stuffbin.ParseTemplatesGlob(template.FuncMap{
 		"L": func() *i18n.I18n {
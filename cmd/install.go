@@ -63,6 +63,20 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt, idempo
 	// Load the queries.
 	q := prepareQueries(qMap, db, ko)
 
+	// Superadmin user.
+	user, pwd := ko.String("app.admin_username"), ko.String("app.admin_password")
+	if user == "" || pwd == "" {
+		lo.Fatalf("app.admin_username and app.admin_password are required to create the superadmin user")
+	}
+	pwdHash, err := hashPassword(pwd)
+	if err != nil {
+		lo.Fatalf("error hashing password: %v", err)
+	}
+	if _, err := q.CreateUser.Exec(user, "", "Admin", pwdHash,
+		models.UserTypeSuperadmin, models.UserRoleAdmin, models.UserStatusEnabled, pq.Int64Array{}); err != nil {
+		lo.Fatalf("error creating superadmin user: %v", err)
+	}
+
 	// Sample list.
 	var (
 		defList   int
@@ -118,6 +132,8 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt, idempo
 	var tplID int
 	if err := q.CreateTemplate.Get(&tplID,
 		"Default template",
+		models.TemplateTypeCampaign,
+		"",
 		string(tplBody.ReadBytes()),
 	); err != nil {
 		lo.Fatalf("error creating default template: %v", err)
@@ -47,7 +47,7 @@ func handleGetLists(c echo.Context) error {
 
 	// Minimal query simply returns the list of all lists without JOIN subscriber counts. This is fast.
 	if !single && minimal {
-		if err := app.queries.GetLists.Select(&out.Results, "", "id"); err != nil {
+		if err := app.queries.GetLists.Select(&out.Results, "", "id", userListIDs(c)); err != nil {
 			app.log.Printf("error fetching lists: %v", err)
 			return echo.NewHTTPError(http.StatusInternalServerError,
 				app.i18n.Ts("globals.messages.errorFetching",
@@ -74,7 +74,8 @@ func handleGetLists(c echo.Context) error {
 		listID,
 		queryStr,
 		pg.Offset,
-		pg.Limit); err != nil {
+		pg.Limit,
+		userListIDs(c)); err != nil {
 		app.log.Printf("error fetching lists: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
@@ -126,6 +127,12 @@ func handleCreateList(c echo.Context) error {
 		return err
 	}
 
+	// Users restricted to specific lists can't create new ones.
+	if userListIDs(c) != nil {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.list}"))
+	}
+
 	// Validate.
 	if !strHasLen(o.Name, 1, stdInputMaxLen) {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidName"))
@@ -176,6 +183,9 @@ func handleUpdateList(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkListAccess(c, int64(id)); err != nil {
+		return err
+	}
 
 	// Incoming params.
 	var o models.List
@@ -215,6 +225,9 @@ func handleDeleteLists(c echo.Context) error {
 	if id > 0 {
 		ids = append(ids, id)
 	}
+	if err := checkListAccess(c, ids...); err != nil {
+		return err
+	}
 
 	if _, err := app.queries.DeleteLists.Exec(ids); err != nil {
 		app.log.Printf("error deleting lists: %v", err)
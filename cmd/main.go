@@ -17,11 +17,13 @@ import (
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/listmonk/internal/bounce"
 	"github.com/knadh/listmonk/internal/buflog"
+	"github.com/knadh/listmonk/internal/feeds"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/internal/media"
 	"github.com/knadh/listmonk/internal/messenger"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhooks"
 	"github.com/knadh/stuffbin"
 )
 
@@ -40,8 +42,10 @@ type App struct {
 	importer   *subimporter.Importer
 	messengers map[string]messenger.Messenger
 	media      media.Store
+	feeds      feeds.Fetcher
 	i18n       *i18n.I18n
 	bounce     *bounce.Manager
+	webhooks   *webhooks.Manager
 	notifTpls  *notifTpls
 	log        *log.Logger
 	bufLog     *buflog.BufLog
@@ -160,6 +164,7 @@ func main() {
 		db:         db,
 		constants:  initConstants(),
 		media:      initMediaStore(),
+		feeds:      initFeeds(),
 		messengers: make(map[string]messenger.Messenger),
 		log:        lo,
 		bufLog:     bufLog,
@@ -169,8 +174,14 @@ func main() {
 	app.i18n = initI18n(app.constants.Lang, fs)
 
 	app.queries = queries
+	app.webhooks = initWebhooks(app)
+	go app.webhooks.Run()
+
 	app.manager = initCampaignManager(app.queries, app.constants, app)
+	initTxTemplates(app.manager, app)
+	go watchTxTemplates(time.Second*10, app)
 	app.importer = initImporter(app.queries, db, app)
+	initMetrics(app)
 	app.notifTpls = initNotifTemplates("/email-templates/*.html", fs, app.i18n, app.constants)
 
 	if ko.Bool("bounce.enabled") {
@@ -178,14 +189,24 @@ func main() {
 		go app.bounce.Run()
 	}
 
-	// Initialize the default SMTP (`email`) messenger.
-	app.messengers[emailMsgr] = initSMTPMessenger(app.manager)
+	// Initialize the default SMTP (`email`) messenger and the `email-$name`
+	// messengers for named groups of SMTP servers.
+	em := initSMTPMessenger(app.manager)
+	app.messengers[emailMsgr] = em
+	for _, m := range em.Groups() {
+		app.messengers[m.Name()] = m
+	}
 
 	// Initialize any additional postback messengers.
 	for _, m := range initPostbackMessengers(app.manager) {
 		app.messengers[m.Name()] = m
 	}
 
+	// Initialize the e-mail API messengers.
+	for _, m := range initAPIMessengers(app.manager) {
+		app.messengers[m.Name()] = m
+	}
+
 	// Attach all messengers to the campaign manager.
 	for _, m := range app.messengers {
 		app.manager.AddMessenger(m)
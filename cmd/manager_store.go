@@ -1,38 +1,225 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
 )
 
+// nodeTimeout is the duration after the last heartbeat of an instance after
+// which it's considered gone and the subscriber batches it leased are taken
+// over by other instances. It should be a few times the manager's heartbeat interval.
+const nodeTimeout = time.Minute
+
 // runnerDB implements runner.DataSource over the primary
 // database.
 type runnerDB struct {
 	queries *Queries
+	db      *sqlx.DB
+	log     *log.Logger
+
+	// Unique ID of this instance with which subscriber batches are leased.
+	nodeID   uuid.UUID
+	hostname string
 }
 
-func newManagerStore(q *Queries) *runnerDB {
+func newManagerStore(q *Queries, db *sqlx.DB, lo *log.Logger) *runnerDB {
+	host, _ := os.Hostname()
+
 	return &runnerDB{
-		queries: q,
+		queries:  q,
+		db:       db,
+		log:      lo,
+		nodeID:   uuid.Must(uuid.NewV4()),
+		hostname: host,
 	}
 }
 
 // NextCampaigns retrieves active campaigns ready to be processed.
 func (r *runnerDB) NextCampaigns(excludeIDs []int64) ([]*models.Campaign, error) {
+	// Evaluate the segments of the campaigns that target segments and are
+	// about to start. Campaigns whose segments fail to evaluate are paused.
+	var ids []int64
+	if err := r.queries.GetPendingSegmentCampaigns.Select(&ids, pq.Int64Array(excludeIDs)); err != nil {
+		return nil, err
+	}
+
+	evaluated := make(pq.Int64Array, 0, len(ids))
+	for _, id := range ids {
+		if err := r.evalCampaignSegments(int(id)); err != nil {
+			r.log.Printf("error evaluating segments of campaign %d: %v", id, err)
+			if err := r.UpdateCampaignStatus(int(id), models.CampaignStatusPaused); err != nil {
+				r.log.Printf("error pausing campaign %d: %v", id, err)
+			}
+			continue
+		}
+		evaluated = append(evaluated, id)
+	}
+
 	var out []*models.Campaign
-	err := r.queries.NextCampaigns.Select(&out, pq.Int64Array(excludeIDs))
+	err := r.queries.NextCampaigns.Select(&out, pq.Int64Array(excludeIDs), evaluated)
 	return out, err
 }
 
-// NextSubscribers retrieves a subset of subscribers of a given campaign.
-// Since batches are processed sequentially, the retrieval is ordered by ID,
-// and every batch takes the last ID of the last batch and fetches the next
-// batch above that.
-func (r *runnerDB) NextSubscribers(campID, limit int) ([]models.Subscriber, error) {
+// evalCampaignSegments evaluates the segments of a campaign, intersected with
+// its lists, if any, and records the matching subscribers for the campaign
+// to be sent to.
+func (r *runnerDB) evalCampaignSegments(campID int) error {
+	var segs []models.Segment
+	if err := r.queries.GetCampaignSegments.Select(&segs, campID); err != nil {
+		return err
+	}
+
+	var listIDs pq.Int64Array
+	if err := r.queries.GetCampaignListIDs.Get(&listIDs, campID); err != nil {
+		return err
+	}
+
+	// Deleted segments match no subscribers.
+	subIDs := pq.Int64Array{}
+	if len(segs) > 0 {
+		var (
+			exps = make([]string, 0, len(segs))
+			args = []interface{}{listIDs}
+		)
+		for _, s := range segs {
+			exp, a, err := segmentExp(s, len(args)+1)
+			if err != nil {
+				return err
+			}
+			exps = append(exps, "("+exp+")")
+			args = append(args, a...)
+		}
+
+		// The arbitrary expressions are evaluated in a readonly transaction.
+		tx, err := r.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		stmt := fmt.Sprintf(r.queries.QuerySegmentSubscribers, strings.Join(exps, " OR "))
+		if err := tx.Get(&subIDs, stmt, args...); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.queries.SetCampaignSubscribers.Exec(campID, subIDs)
+	return err
+}
+
+// NextSubscribers retrieves a subset of subscribers of a given campaign
+// and leases them to this instance until they're released. Multiple instances
+// may process the same campaign. Batches are fetched one at a time, ordered by
+// ID, and every batch takes the last ID of the last batch and fetches the next
+// batch above that. Batches leased by instances that are gone are taken over
+// first. It returns the ID of the lease.
+func (r *runnerDB) NextSubscribers(campID, limit int) (int64, []models.Subscriber, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the campaign so that other instances wait for the batch to be leased.
+	var lastID int
+	if err := tx.Stmtx(r.queries.LockCampaignCheckpoint).Get(&lastID, campID); err != nil {
+		// The campaign is no longer running.
+		if err == sql.ErrNoRows {
+			return 0, nil, nil
+		}
+		return 0, nil, err
+	}
+
+	// Take over the batches of instances that are gone.
+	for {
+		var l struct {
+			ID     int64 `db:"id"`
+			FromID int   `db:"from_id"`
+			ToID   int   `db:"to_id"`
+		}
+		if err := tx.Stmtx(r.queries.TakeOverCampaignLease).Get(&l, campID, r.nodeID, nodeTimeout.Seconds()); err != nil {
+			if err == sql.ErrNoRows {
+				break
+			}
+			return 0, nil, err
+		}
+
+		var out []models.Subscriber
+		if err := tx.Stmtx(r.queries.NextCampaignSubscribers).Select(&out, campID, l.ToID-l.FromID, l.FromID, l.ToID); err != nil {
+			return 0, nil, err
+		}
+
+		// None of the subscribers in the range are to be sent to anymore.
+		if len(out) == 0 {
+			if _, err := tx.Stmtx(r.queries.DeleteCampaignLease).Exec(l.ID); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		r.log.Printf("took over %d subscribers of campaign %d from an unresponsive instance", len(out), campID)
+		return l.ID, out, tx.Commit()
+	}
+
 	var out []models.Subscriber
-	err := r.queries.NextCampaignSubscribers.Select(&out, campID, limit)
-	return out, err
+	if err := tx.Stmtx(r.queries.NextCampaignSubscribers).Select(&out, campID, limit, 0, 0); err != nil {
+		return 0, nil, err
+	}
+	if len(out) == 0 {
+		return 0, nil, tx.Commit()
+	}
+
+	var id int64
+	if err := tx.Stmtx(r.queries.CreateCampaignLease).Get(&id, campID, r.nodeID, lastID, out[len(out)-1].ID); err != nil {
+		return 0, nil, err
+	}
+
+	return id, out, tx.Commit()
+}
+
+// CheckpointSubscribers saves the progress of a batch of subscribers leased by
+// NextSubscribers, ie: the last subscriber up to which all of them have been
+// processed, and the number of messages sent with each A/B test variant since
+// the last checkpoint.
+func (r *runnerDB) CheckpointSubscribers(leaseID int64, lastID int, variantSent map[int]int) error {
+	ids, nums := variantCounts(variantSent)
+	_, err := r.queries.CheckpointCampaignLease.Exec(leaseID, r.nodeID, lastID, ids, nums)
+	return err
+}
+
+// ReleaseSubscribers releases a batch of subscribers leased by NextSubscribers
+// once they've all been processed.
+func (r *runnerDB) ReleaseSubscribers(leaseID int64, variantSent map[int]int) error {
+	ids, nums := variantCounts(variantSent)
+	_, err := r.queries.ReleaseCampaignLease.Exec(leaseID, ids, nums)
+	return err
+}
+
+// HasLeasedSubscribers checks if any instance has subscriber batches of a
+// running campaign that are still being processed.
+func (r *runnerDB) HasLeasedSubscribers(campID int) (bool, error) {
+	var has bool
+	err := r.queries.HasCampaignLeases.Get(&has, campID)
+	return has, err
+}
+
+// Heartbeat records that this instance is alive so that its subscriber batches
+// aren't taken over. It returns true if this is the oldest live instance.
+func (r *runnerDB) Heartbeat() (bool, error) {
+	var oldest bool
+	err := r.queries.UpsertNode.Get(&oldest, r.nodeID, r.hostname, nodeTimeout.Seconds())
+	return oldest, err
 }
 
 // GetCampaign fetches a campaign from the database.
@@ -48,6 +235,267 @@ func (r *runnerDB) UpdateCampaignStatus(campID int, status string) error {
 	return err
 }
 
+// PauseCampaign pauses a running campaign with a reason. It returns false if
+// the campaign wasn't running, eg: it's been paused by another instance.
+func (r *runnerDB) PauseCampaign(campID int, reason string) (bool, error) {
+	res, err := r.queries.PauseCampaign.Exec(campID, reason)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// FinishCampaign marks a running campaign as finished. It returns false if
+// the campaign wasn't running, eg: it's been finished by another instance.
+func (r *runnerDB) FinishCampaign(campID int) (bool, error) {
+	res, err := r.queries.FinishCampaign.Exec(campID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// RecordCampaignFailure records a failed delivery of a campaign message to a subscriber.
+func (r *runnerDB) RecordCampaignFailure(campID, subID int, reason string) error {
+	_, err := r.queries.RecordCampaignFailure.Exec(campID, subID, reason)
+	return err
+}
+
+// QueueCampaignRetry records a message of a campaign that couldn't be sent as
+// a failure that's queued to be retried.
+func (r *runnerDB) QueueCampaignRetry(campID, subID int, reason string) error {
+	_, err := r.queries.QueueCampaignRetry.Exec(campID, subID, reason)
+	return err
+}
+
+// DeleteCampaignFailure deletes the failure record of a subscriber in a campaign.
+func (r *runnerDB) DeleteCampaignFailure(campID, subID int) error {
+	_, err := r.queries.DeleteCampaignFailure.Exec(campID, subID)
+	return err
+}
+
+// NextCampaignRetries claims a batch of the requeued failures of campaigns to
+// be retried. It returns the subscribers to be retried by campaign ID.
+func (r *runnerDB) NextCampaignRetries(limit int) (map[int][]models.Subscriber, error) {
+	var res []struct {
+		CampaignID int `db:"retry_campaign_id"`
+		models.Subscriber
+	}
+	if err := r.queries.NextCampaignRetries.Select(&res, limit); err != nil {
+		return nil, err
+	}
+
+	out := make(map[int][]models.Subscriber)
+	for _, s := range res {
+		out[s.CampaignID] = append(out[s.CampaignID], s.Subscriber)
+	}
+	return out, nil
+}
+
+// EndCampaignABTest marks the A/B test batch of a campaign as sent.
+func (r *runnerDB) EndCampaignABTest(campID int) error {
+	_, err := r.queries.EndCampaignABTest.Exec(campID)
+	return err
+}
+
+// NextCampaignWave moves a campaign that's sent at a local time on to its next
+// wave of timezones after the current one. It returns the time of the next wave,
+// which is null if there are no more subscribers to send to.
+func (r *runnerDB) NextCampaignWave(campID int, current time.Time) (null.Time, error) {
+	var out null.Time
+	if err := r.queries.NextCampaignWave.Get(&out, campID, current); err != nil && err != sql.ErrNoRows {
+		return out, err
+	}
+	return out, nil
+}
+
+// SetCampaignABWinner picks the winning A/B test variant of a campaign
+// and applies it to the campaign.
+func (r *runnerDB) SetCampaignABWinner(campID int) (models.CampaignVariant, error) {
+	var out models.CampaignVariant
+	err := r.queries.SetCampaignABWinner.Get(&out, campID)
+	return out, err
+}
+
+// NextRecurringCampaigns fetches the scheduled recurring campaigns whose next run is due.
+func (r *runnerDB) NextRecurringCampaigns() ([]*models.Campaign, error) {
+	var out []*models.Campaign
+	err := r.queries.NextRecurringCampaigns.Select(&out)
+	return out, err
+}
+
+// CreateCampaignRun moves a recurring campaign on from its due run to the next
+// one and, unless the run is skipped, creates the run as a new campaign with
+// the given name and feed items that starts right away. It returns the ID of the
+// run, which is 0 if it's skipped or if the run has already been taken care of,
+// eg: by another instance.
+func (r *runnerDB) CreateCampaignRun(campID int, runAt time.Time, name string, skip bool, next null.Time, items models.FeedItems) (int, error) {
+	uu, err := uuid.NewV4()
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	if err := r.queries.CreateCampaignRun.Get(&id, campID, runAt, uu, name, skip, next, items); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetSentFeedItems returns the GUIDs out of the given ones of the feed items
+// that have been sent in the runs of a campaign.
+func (r *runnerDB) GetSentFeedItems(campID int, guids []string) ([]string, error) {
+	var out []string
+	err := r.queries.GetSentFeedItems.Select(&out, campID, pq.StringArray(guids))
+	return out, err
+}
+
+// NextSequenceMessages enrolls new subscribers into sequences and claims a batch
+// of the steps of sequences that are due to be sent to subscribers, moving the
+// subscribers on to their next steps. Subscribers who have unsubscribed from the
+// lists of the sequences or match their exit segments exit the sequences instead.
+func (r *runnerDB) NextSequenceMessages(limit int) ([]models.SequenceMessage, error) {
+	if _, err := r.queries.EnrollSequenceSubscribers.Exec(); err != nil {
+		return nil, err
+	}
+	if _, err := r.queries.ExitUnsubscribedSequenceSubscribers.Exec(); err != nil {
+		return nil, err
+	}
+
+	var due []struct {
+		SequenceID   int `db:"sequence_id"`
+		SubscriberID int `db:"subscriber_id"`
+		Step         int `db:"step"`
+	}
+	if err := r.queries.NextSequenceMessages.Select(&due, limit); err != nil {
+		return nil, err
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	// Get the sequences and the subscribers.
+	var (
+		seqIDs  = pq.Int64Array{}
+		subIDs  = make(pq.Int64Array, 0, len(due))
+		seqSubs = make(map[int]pq.Int64Array)
+	)
+	for _, d := range due {
+		if _, ok := seqSubs[d.SequenceID]; !ok {
+			seqIDs = append(seqIDs, int64(d.SequenceID))
+		}
+		seqSubs[d.SequenceID] = append(seqSubs[d.SequenceID], int64(d.SubscriberID))
+		subIDs = append(subIDs, int64(d.SubscriberID))
+	}
+
+	var seqList []*models.Sequence
+	if err := r.queries.GetSendingSequences.Select(&seqList, seqIDs); err != nil {
+		return nil, err
+	}
+	seqs := make(map[int]*models.Sequence, len(seqList))
+	for _, s := range seqList {
+		seqs[s.ID] = s
+	}
+
+	var subList []models.Subscriber
+	if err := r.queries.GetSubscribersByIDs.Select(&subList, subIDs); err != nil {
+		return nil, err
+	}
+	subs := make(map[int]models.Subscriber, len(subList))
+	for _, s := range subList {
+		subs[s.ID] = s
+	}
+
+	// Subscribers who match the exit segments of the sequences exit them.
+	exited := make(map[int]map[int]bool)
+	for _, s := range seqList {
+		if !s.ExitSegmentID.Valid {
+			continue
+		}
+
+		ids, err := r.evalExitSegment(s, seqSubs[s.ID])
+		if err != nil {
+			r.log.Printf("error evaluating exit segment of sequence %d: %v", s.ID, err)
+			continue
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		if _, err := r.queries.ExitSequenceSubscribers.Exec(s.ID, ids); err != nil {
+			return nil, err
+		}
+		exited[s.ID] = make(map[int]bool, len(ids))
+		for _, id := range ids {
+			exited[s.ID][int(id)] = true
+		}
+	}
+
+	out := make([]models.SequenceMessage, 0, len(due))
+	for _, d := range due {
+		seq, ok := seqs[d.SequenceID]
+		if !ok || exited[d.SequenceID][d.SubscriberID] {
+			continue
+		}
+
+		sub, ok := subs[d.SubscriberID]
+		if !ok {
+			continue
+		}
+
+		// The steps of the sequence may have been removed since.
+		if d.Step >= len(seq.Steps) {
+			continue
+		}
+
+		out = append(out, models.SequenceMessage{
+			Sequence:   seq,
+			Step:       seq.Steps[d.Step],
+			Subscriber: sub,
+		})
+	}
+
+	return out, nil
+}
+
+// evalExitSegment returns the IDs of the given subscribers of a sequence that
+// match the sequence's exit segment.
+func (r *runnerDB) evalExitSegment(s *models.Sequence, subIDs pq.Int64Array) (pq.Int64Array, error) {
+	var segs []models.Segment
+	if err := r.queries.GetSegments.Select(&segs, s.ExitSegmentID.Int); err != nil {
+		return nil, err
+	}
+
+	// The segment has been deleted.
+	if len(segs) == 0 {
+		return nil, nil
+	}
+
+	exp, args, err := segmentExp(segs[0], 3)
+	if err != nil {
+		return nil, err
+	}
+
+	// The arbitrary expression is evaluated in a readonly transaction.
+	tx, err := r.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		out  pq.Int64Array
+		stmt = fmt.Sprintf(r.queries.QuerySegmentSubscribers, "subscribers.id = ANY($2::INT[]) AND ("+exp+")")
+	)
+	if err := tx.Get(&out, stmt, append([]interface{}{pq.Int64Array{}, subIDs}, args...)...); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
 // CreateLink registers a URL with a UUID for tracking clicks and returns the UUID.
 func (r *runnerDB) CreateLink(url string) (string, error) {
 	// Create a new UUID for the URL. If the URL already exists in the DB
@@ -65,6 +513,19 @@ func (r *runnerDB) CreateLink(url string) (string, error) {
 	return out, nil
 }
 
+// variantCounts returns the IDs of A/B test variants and their counts as arrays.
+func variantCounts(counts map[int]int) (pq.Int64Array, pq.Int64Array) {
+	var (
+		ids  = make(pq.Int64Array, 0, len(counts))
+		nums = make(pq.Int64Array, 0, len(counts))
+	)
+	for id, n := range counts {
+		ids = append(ids, int64(id))
+		nums = append(nums, int64(n))
+	}
+	return ids, nums
+}
+
 // RecordBounce records a bounce event and returns the bounce count.
 func (r *runnerDB) RecordBounce(b models.Bounce) (int64, int, error) {
 	var res = struct {
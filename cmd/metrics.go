@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/knadh/listmonk/internal/metrics"
+	"github.com/labstack/echo/v4"
+)
+
+var httpReqDuration = metrics.NewHistogram("listmonk_http_request_duration_seconds",
+	"HTTP request latencies in seconds.", nil, "method", "path", "code")
+
+// initMetrics registers the metrics that are collected from the
+// app's components when they're scraped.
+func initMetrics(app *App) {
+	metrics.NewGaugeFunc("listmonk_queue_depth",
+		"Number of items waiting in the campaign manager's queues.", []string{"queue"},
+		func() []metrics.Sample {
+			q := app.manager.GetQueueStats()
+			return []metrics.Sample{
+				{Labels: []string{"campaign_messages"}, Value: float64(q.CampMsgs)},
+				{Labels: []string{"subscriber_fetch"}, Value: float64(q.SubFetch)},
+				{Labels: []string{"messages"}, Value: float64(q.Msgs)},
+				{Labels: []string{"message_errors"}, Value: float64(q.MsgErrors)},
+			}
+		})
+
+	metrics.NewGaugeFunc("listmonk_campaign_send_rate",
+		"Messages sent per minute by running campaigns.", []string{"campaign"},
+		func() []metrics.Sample {
+			var out []metrics.Sample
+			for id, s := range app.manager.GetRunningCampaignStats() {
+				out = append(out, metrics.Sample{
+					Labels: []string{strconv.Itoa(id)},
+					Value:  float64(s.SendRate),
+				})
+			}
+			return out
+		})
+
+	metrics.NewGaugeFunc("listmonk_campaign_domain_send_rate",
+		"Messages sent per minute by running campaigns to throttled domains.", []string{"campaign", "domain"},
+		func() []metrics.Sample {
+			var out []metrics.Sample
+			for id, s := range app.manager.GetRunningCampaignStats() {
+				for _, d := range s.Domains {
+					out = append(out, metrics.Sample{
+						Labels: []string{strconv.Itoa(id), d.Domain},
+						Value:  float64(d.SendRate),
+					})
+				}
+			}
+			return out
+		})
+
+	metrics.NewGaugeFunc("listmonk_import_total",
+		"Number of records in the current subscriber import.", nil,
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(app.importer.GetStats().Total)}}
+		})
+
+	metrics.NewGaugeFunc("listmonk_import_imported",
+		"Number of records imported in the current subscriber import.", nil,
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(app.importer.GetStats().Imported)}}
+		})
+
+	metrics.NewGaugeFunc("listmonk_import_status",
+		"Status of the current subscriber import. The value is always 1.", []string{"status"},
+		func() []metrics.Sample {
+			return []metrics.Sample{{Labels: []string{app.importer.GetStats().Status}, Value: 1}}
+		})
+}
+
+// handleGetMetrics renders the app's metrics in the Prometheus text format.
+func handleGetMetrics(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	return metrics.Write(c.Response())
+}
+
+// recordHTTPMetrics is a middleware that records HTTP request latencies.
+// Requests are labelled by their route patterns and not their raw paths
+// to keep the number of series bounded.
+func recordHTTPMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		code := c.Response().Status
+		if err != nil {
+			code = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			}
+		}
+
+		p := c.Path()
+		if p == "" {
+			p = "unknown"
+		}
+
+		httpReqDuration.Observe(time.Since(start).Seconds(), c.Request().Method, p, strconv.Itoa(code))
+		return err
+	}
+}
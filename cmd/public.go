@@ -15,6 +15,7 @@ import (
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/internal/messenger"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhooks"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
@@ -100,6 +101,7 @@ func handleViewCampaignMessage(c echo.Context) error {
 		app      = c.Get("app").(*App)
 		campUUID = c.Param("campUUID")
 		subUUID  = c.Param("subUUID")
+		varID, _ = strconv.Atoi(c.QueryParam("v"))
 	)
 
 	// Get the campaign.
@@ -131,6 +133,14 @@ func handleViewCampaignMessage(c echo.Context) error {
 				app.i18n.Ts("public.errorFetchingCampaign")))
 	}
 
+	// If the message was sent with an A/B test variant, show that.
+	for _, v := range camp.Variants {
+		if v.ID == varID {
+			camp = *camp.WithVariant(v)
+			break
+		}
+	}
+
 	// Compile the template.
 	if err := camp.CompileTemplate(app.manager.TemplateFuncs(&camp)); err != nil {
 		app.log.Printf("error compiling template: %v", err)
@@ -182,6 +192,11 @@ func handleSubscriptionPage(c echo.Context) error {
 				makeMsgTpl(app.i18n.T("public.errorTitle"), "",
 					app.i18n.Ts("public.errorProcessingRequest")))
 		}
+		app.webhooks.Trigger(webhooks.EventSubscriptionUnsubscribed, subscriptionEvent{
+			SubscriberUUID: subUUID,
+			CampaignUUID:   campUUID,
+			Blocklisted:    blocklist,
+		})
 
 		return c.Render(http.StatusOK, tplMessage,
 			makeMsgTpl(app.i18n.T("public.unsubbedTitle"), "",
@@ -247,6 +262,12 @@ func handleOptinPage(c echo.Context) error {
 					app.i18n.Ts("public.errorProcessingRequest")))
 		}
 
+		ev := subscriptionEvent{SubscriberUUID: subUUID}
+		for _, l := range out.Lists {
+			ev.ListUUIDs = append(ev.ListUUIDs, l.UUID)
+		}
+		app.webhooks.Trigger(webhooks.EventSubscriptionConfirmed, ev)
+
 		return c.Render(http.StatusOK, tplMessage,
 			makeMsgTpl(app.i18n.T("public.subConfirmedTitle"), "",
 				app.i18n.Ts("public.subConfirmed")))
@@ -270,7 +291,7 @@ func handleSubscriptionFormPage(c echo.Context) error {
 
 	// Get all public lists.
 	var lists []models.List
-	if err := app.queries.GetLists.Select(&lists, models.ListTypePublic, "name"); err != nil {
+	if err := app.queries.GetLists.Select(&lists, models.ListTypePublic, "name", nil); err != nil {
 		app.log.Printf("error fetching public lists for form: %s", pqErrMsg(err))
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
@@ -357,6 +378,8 @@ func handleLinkRedirect(c echo.Context) error {
 		linkUUID = c.Param("linkUUID")
 		campUUID = c.Param("campUUID")
 		subUUID  = c.Param("subUUID")
+		varID, _ = strconv.Atoi(c.QueryParam("v"))
+		tplID, _ = strconv.Atoi(c.QueryParam("t"))
 	)
 
 	// If individual tracking is disabled, do not record the subscriber ID.
@@ -365,7 +388,7 @@ func handleLinkRedirect(c echo.Context) error {
 	}
 
 	var url string
-	if err := app.queries.RegisterLinkClick.Get(&url, linkUUID, campUUID, subUUID); err != nil {
+	if err := app.queries.RegisterLinkClick.Get(&url, linkUUID, campUUID, subUUID, varID, tplID); err != nil {
 		if pqErr, ok := err.(*pq.Error); ok && pqErr.Column == "link_id" {
 			return c.Render(http.StatusNotFound, tplMessage,
 				makeMsgTpl(app.i18n.T("public.errorTitle"), "",
@@ -378,6 +401,14 @@ func handleLinkRedirect(c echo.Context) error {
 				app.i18n.Ts("public.errorProcessingRequest")))
 	}
 
+	app.webhooks.Trigger(webhooks.EventLinkClicked, trackEvent{
+		CampaignUUID:   campUUID,
+		SubscriberUUID: subUUID,
+		TemplateID:     tplID,
+		LinkUUID:       linkUUID,
+		URL:            url,
+	})
+
 	return c.Redirect(http.StatusTemporaryRedirect, url)
 }
 
@@ -390,6 +421,8 @@ func handleRegisterCampaignView(c echo.Context) error {
 		app      = c.Get("app").(*App)
 		campUUID = c.Param("campUUID")
 		subUUID  = c.Param("subUUID")
+		varID, _ = strconv.Atoi(c.QueryParam("v"))
+		tplID, _ = strconv.Atoi(c.QueryParam("t"))
 	)
 
 	// If individual tracking is disabled, do not record the subscriber ID.
@@ -397,10 +430,22 @@ func handleRegisterCampaignView(c echo.Context) error {
 		subUUID = ""
 	}
 
+	// Views of transactional messages are recorded against their template.
+	if campUUID == dummyUUID && tplID > 0 && subUUID != dummyUUID {
+		if _, err := app.queries.RegisterTxView.Exec(tplID, subUUID); err != nil {
+			app.log.Printf("error registering tx view: %s", err)
+		}
+	}
+
 	// Exclude dummy hits from template previews.
 	if campUUID != dummyUUID && subUUID != dummyUUID {
-		if _, err := app.queries.RegisterCampaignView.Exec(campUUID, subUUID); err != nil {
+		if _, err := app.queries.RegisterCampaignView.Exec(campUUID, subUUID, varID); err != nil {
 			app.log.Printf("error registering campaign view: %s", err)
+		} else {
+			app.webhooks.Trigger(webhooks.EventCampaignViewed, trackEvent{
+				CampaignUUID:   campUUID,
+				SubscriberUUID: subUUID,
+			})
 		}
 	}
 
@@ -487,12 +532,16 @@ func handleWipeSubscriberData(c echo.Context) error {
 				app.i18n.Ts("public.invalidFeature")))
 	}
 
-	if _, err := app.queries.DeleteSubscribers.Exec(nil, pq.StringArray{subUUID}); err != nil {
+	var deleted []subscriberEvent
+	if err := app.queries.DeleteSubscribers.Select(&deleted, nil, pq.StringArray{subUUID}); err != nil {
 		app.log.Printf("error wiping subscriber data: %s", err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
 				app.i18n.Ts("public.errorProcessingRequest")))
 	}
+	for _, s := range deleted {
+		app.webhooks.Trigger(webhooks.EventSubscriberDeleted, s)
+	}
 
 	return c.Render(http.StatusOK, tplMessage,
 		makeMsgTpl(app.i18n.T("public.dataRemovedTitle"), "",
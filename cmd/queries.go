@@ -20,6 +20,7 @@ type Queries struct {
 	UpsertBlocklistSubscriber       *sqlx.Stmt `query:"upsert-blocklist-subscriber"`
 	GetSubscriber                   *sqlx.Stmt `query:"get-subscriber"`
 	GetSubscribersByEmails          *sqlx.Stmt `query:"get-subscribers-by-emails"`
+	GetSubscribersByIDs             *sqlx.Stmt `query:"get-subscribers-by-ids"`
 	GetSubscriberLists              *sqlx.Stmt `query:"get-subscriber-lists"`
 	GetSubscriberListsLazy          *sqlx.Stmt `query:"get-subscriber-lists-lazy"`
 	SubscriberExists                *sqlx.Stmt `query:"subscriber-exists"`
@@ -52,6 +53,13 @@ type Queries struct {
 	UpdateListsDate *sqlx.Stmt `query:"update-lists-date"`
 	DeleteLists     *sqlx.Stmt `query:"delete-lists"`
 
+	GetSegments                  *sqlx.Stmt `query:"get-segments"`
+	CreateSegment                *sqlx.Stmt `query:"create-segment"`
+	UpdateSegment                *sqlx.Stmt `query:"update-segment"`
+	DeleteSegment                *sqlx.Stmt `query:"delete-segment"`
+	QuerySegmentSubscribers      string     `query:"query-segment-subscribers"`
+	QuerySegmentSubscribersCount string     `query:"query-segment-subscribers-count"`
+
 	CreateCampaign           *sqlx.Stmt `query:"create-campaign"`
 	QueryCampaigns           string     `query:"query-campaigns"`
 	GetCampaign              *sqlx.Stmt `query:"get-campaign"`
@@ -67,19 +75,73 @@ type Queries struct {
 	GetOneCampaignSubscriber *sqlx.Stmt `query:"get-one-campaign-subscriber"`
 	UpdateCampaign           *sqlx.Stmt `query:"update-campaign"`
 	UpdateCampaignStatus     *sqlx.Stmt `query:"update-campaign-status"`
+	UpdateCampaignNextRun    *sqlx.Stmt `query:"update-campaign-next-run"`
+	PauseCampaign            *sqlx.Stmt `query:"pause-campaign"`
+	FinishCampaign           *sqlx.Stmt `query:"finish-campaign"`
 	UpdateCampaignCounts     *sqlx.Stmt `query:"update-campaign-counts"`
+	UpdateCampaignVariants   *sqlx.Stmt `query:"update-campaign-variants"`
+	EndCampaignABTest        *sqlx.Stmt `query:"end-campaign-ab-test"`
+	NextCampaignWave         *sqlx.Stmt `query:"next-campaign-wave"`
+	GetCampaignWaves         *sqlx.Stmt `query:"get-campaign-waves"`
+	SetCampaignABWinner      *sqlx.Stmt `query:"set-campaign-ab-winner"`
 	RegisterCampaignView     *sqlx.Stmt `query:"register-campaign-view"`
 	DeleteCampaign           *sqlx.Stmt `query:"delete-campaign"`
 
+	RecordCampaignFailure  *sqlx.Stmt `query:"record-campaign-failure"`
+	QueueCampaignRetry     *sqlx.Stmt `query:"queue-campaign-retry"`
+	DeleteCampaignFailure  *sqlx.Stmt `query:"delete-campaign-failure"`
+	QueryCampaignFailures  *sqlx.Stmt `query:"query-campaign-failures"`
+	QueueCampaignFailures  *sqlx.Stmt `query:"queue-campaign-failures"`
+	NextCampaignRetries    *sqlx.Stmt `query:"next-campaign-retries"`
+	DeleteCampaignFailures *sqlx.Stmt `query:"delete-campaign-failures"`
+
+	LockCampaignCheckpoint  *sqlx.Stmt `query:"lock-campaign-checkpoint"`
+	CreateCampaignLease     *sqlx.Stmt `query:"create-campaign-lease"`
+	TakeOverCampaignLease   *sqlx.Stmt `query:"take-over-campaign-lease"`
+	CheckpointCampaignLease *sqlx.Stmt `query:"checkpoint-campaign-lease"`
+	ReleaseCampaignLease    *sqlx.Stmt `query:"release-campaign-lease"`
+	DeleteCampaignLease     *sqlx.Stmt `query:"delete-campaign-lease"`
+	HasCampaignLeases       *sqlx.Stmt `query:"has-campaign-leases"`
+	UpsertNode              *sqlx.Stmt `query:"upsert-node"`
+
+	GetPendingSegmentCampaigns *sqlx.Stmt `query:"get-pending-segment-campaigns"`
+	GetCampaignSegments        *sqlx.Stmt `query:"get-campaign-segments"`
+	SetCampaignSubscribers     *sqlx.Stmt `query:"set-campaign-subscribers"`
+
+	NextRecurringCampaigns *sqlx.Stmt `query:"next-recurring-campaigns"`
+	CreateCampaignRun      *sqlx.Stmt `query:"create-campaign-run"`
+	GetSentFeedItems       *sqlx.Stmt `query:"get-sent-feed-items"`
+	QueryCampaignRuns      *sqlx.Stmt `query:"query-campaign-runs"`
+
+	GetCampaignListIDs *sqlx.Stmt `query:"get-campaign-list-ids"`
+
+	GetUsers                 *sqlx.Stmt `query:"get-users"`
+	CreateUser               *sqlx.Stmt `query:"create-user"`
+	UpdateUser               *sqlx.Stmt `query:"update-user"`
+	UpdateUserLogin          *sqlx.Stmt `query:"update-user-login"`
+	DeleteUser               *sqlx.Stmt `query:"delete-user"`
+	CreateSession            *sqlx.Stmt `query:"create-session"`
+	GetSessionUser           *sqlx.Stmt `query:"get-session-user"`
+	DeleteSession            *sqlx.Stmt `query:"delete-session"`
+	DeleteUserSessions       *sqlx.Stmt `query:"delete-user-sessions"`
+	CheckSubscriberListScope *sqlx.Stmt `query:"check-subscriber-list-scope"`
+
+	GetAPITokens    *sqlx.Stmt `query:"get-api-tokens"`
+	CreateAPIToken  *sqlx.Stmt `query:"create-api-token"`
+	DeleteAPIToken  *sqlx.Stmt `query:"delete-api-token"`
+	GetAPITokenUser *sqlx.Stmt `query:"get-api-token-user"`
+
 	InsertMedia *sqlx.Stmt `query:"insert-media"`
 	GetMedia    *sqlx.Stmt `query:"get-media"`
 	DeleteMedia *sqlx.Stmt `query:"delete-media"`
 
-	CreateTemplate     *sqlx.Stmt `query:"create-template"`
-	GetTemplates       *sqlx.Stmt `query:"get-templates"`
-	UpdateTemplate     *sqlx.Stmt `query:"update-template"`
-	SetDefaultTemplate *sqlx.Stmt `query:"set-default-template"`
-	DeleteTemplate     *sqlx.Stmt `query:"delete-template"`
+	CreateTemplate        *sqlx.Stmt `query:"create-template"`
+	GetTemplates          *sqlx.Stmt `query:"get-templates"`
+	UpdateTemplate        *sqlx.Stmt `query:"update-template"`
+	SetDefaultTemplate    *sqlx.Stmt `query:"set-default-template"`
+	DeleteTemplate        *sqlx.Stmt `query:"delete-template"`
+	GetTxTemplatesVersion *sqlx.Stmt `query:"get-tx-templates-version"`
+	RegisterTxView        *sqlx.Stmt `query:"register-tx-view"`
 
 	CreateLink        *sqlx.Stmt `query:"create-link"`
 	RegisterLinkClick *sqlx.Stmt `query:"register-link-click"`
@@ -92,6 +154,33 @@ type Queries struct {
 	QueryBounces              string     `query:"query-bounces"`
 	DeleteBounces             *sqlx.Stmt `query:"delete-bounces"`
 	DeleteBouncesBySubscriber *sqlx.Stmt `query:"delete-bounces-by-subscriber"`
+	InsertPendingBounce       *sqlx.Stmt `query:"insert-pending-bounce"`
+	NextPendingBounces        *sqlx.Stmt `query:"next-pending-bounces"`
+	UpdatePendingBounce       *sqlx.Stmt `query:"update-pending-bounce"`
+	DeletePendingBounce       *sqlx.Stmt `query:"delete-pending-bounce"`
+	QueryFailedBounces        *sqlx.Stmt `query:"query-failed-bounces"`
+	ReplayFailedBounces       *sqlx.Stmt `query:"replay-failed-bounces"`
+	DeleteFailedBounces       *sqlx.Stmt `query:"delete-failed-bounces"`
+
+	GetWebhooks            *sqlx.Stmt `query:"get-webhooks"`
+	CreateWebhook          *sqlx.Stmt `query:"create-webhook"`
+	UpdateWebhook          *sqlx.Stmt `query:"update-webhook"`
+	DeleteWebhook          *sqlx.Stmt `query:"delete-webhook"`
+	CreateWebhookDelivery  *sqlx.Stmt `query:"create-webhook-delivery"`
+	NextWebhookDeliveries  *sqlx.Stmt `query:"next-webhook-deliveries"`
+	UpdateWebhookDelivery  *sqlx.Stmt `query:"update-webhook-delivery"`
+	QueryWebhookDeliveries *sqlx.Stmt `query:"query-webhook-deliveries"`
+
+	GetSequences                        *sqlx.Stmt `query:"get-sequences"`
+	CreateSequence                      *sqlx.Stmt `query:"create-sequence"`
+	UpdateSequence                      *sqlx.Stmt `query:"update-sequence"`
+	DeleteSequence                      *sqlx.Stmt `query:"delete-sequence"`
+	QuerySequenceSubscribers            *sqlx.Stmt `query:"query-sequence-subscribers"`
+	GetSendingSequences                 *sqlx.Stmt `query:"get-sending-sequences"`
+	EnrollSequenceSubscribers           *sqlx.Stmt `query:"enroll-sequence-subscribers"`
+	ExitUnsubscribedSequenceSubscribers *sqlx.Stmt `query:"exit-unsubscribed-sequence-subscribers"`
+	ExitSequenceSubscribers             *sqlx.Stmt `query:"exit-sequence-subscribers"`
+	NextSequenceMessages                *sqlx.Stmt `query:"next-sequence-messages"`
 }
 
 // dbConf contains database config required for connecting to a DB.
@@ -121,12 +210,12 @@ func connectDB(c dbConf) (*sqlx.DB, error) {
 	return db, nil
 }
 
-// compileSubscriberQueryTpl takes an arbitrary WHERE expressions
+// compileSubscriberQueryTpl takes an arbitrary WHERE condition
 // to filter subscribers from the subscribers table and prepares a query
 // out of it using the raw `query-subscribers-template` query template.
 // While doing this, a readonly transaction is created and the query is
 // dry run on it to ensure that it is indeed readonly.
-func (q *Queries) compileSubscriberQueryTpl(exp string, db *sqlx.DB) (string, error) {
+func (q *Queries) compileSubscriberQueryTpl(cond string, db *sqlx.DB) (string, error) {
 	tx, err := db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		return "", err
@@ -134,10 +223,7 @@ func (q *Queries) compileSubscriberQueryTpl(exp string, db *sqlx.DB) (string, er
 	defer tx.Rollback()
 
 	// Perform the dry run.
-	if exp != "" {
-		exp = " AND " + exp
-	}
-	stmt := fmt.Sprintf(q.QuerySubscribersTpl, exp)
+	stmt := fmt.Sprintf(q.QuerySubscribersTpl, cond)
 	if _, err := tx.Exec(stmt, true, pq.Int64Array{}); err != nil {
 		return "", err
 	}
@@ -145,25 +231,58 @@ func (q *Queries) compileSubscriberQueryTpl(exp string, db *sqlx.DB) (string, er
 	return stmt, nil
 }
 
-// compileSubscriberQueryTpl takes an arbitrary WHERE expressions and a subscriber
-// query template that depends on the filter (eg: delete by query, blocklist by query etc.)
+// execSubscriberQueryTpl takes a subscriber query and a subscriber query template
+// that depends on the filter (eg: delete by query, blocklist by query etc.)
 // combines and executes them.
-func (q *Queries) execSubscriberQueryTpl(exp, tpl string, listIDs []int64, db *sqlx.DB, args ...interface{}) error {
-	// Perform a dry run.
-	filterExp, err := q.compileSubscriberQueryTpl(exp, db)
+func (q *Queries) execSubscriberQueryTpl(query subQuery, tpl string, listIDs []int64, db *sqlx.DB, args ...interface{}) error {
+	stmt, a, err := q.makeSubscriberQueryTpl(query, tpl, listIDs, db, args...)
 	if err != nil {
 		return err
 	}
 
+	if _, err := db.Exec(stmt, a...); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// selectSubscriberQueryTpl is execSubscriberQueryTpl for templates that return
+// rows (eg: the subscribers that were deleted), which are scanned into dest.
+func (q *Queries) selectSubscriberQueryTpl(dest interface{}, query subQuery, tpl string, listIDs []int64, db *sqlx.DB, args ...interface{}) error {
+	stmt, a, err := q.makeSubscriberQueryTpl(query, tpl, listIDs, db, args...)
+	if err != nil {
+		return err
+	}
+
+	return db.Select(dest, stmt, a...)
+}
+
+// makeSubscriberQueryTpl combines a subscriber query and a subscriber query
+// template into a statement and returns it with its arguments.
+func (q *Queries) makeSubscriberQueryTpl(query subQuery, tpl string, listIDs []int64, db *sqlx.DB, args ...interface{}) (string, []interface{}, error) {
+	// The arguments of the condition follow the dry run flag, the list IDs,
+	// and the arguments of the template.
+	cond, condArgs := query.cond(3 + len(args))
+
+	// Perform a dry run of arbitrary SQL expressions. Filters compile
+	// to readonly expressions.
+	filterExp := fmt.Sprintf(q.QuerySubscribersTpl, cond)
+	if query.exp != "" {
+		stmt, err := q.compileSubscriberQueryTpl(cond, db)
+		if err != nil {
+			return "", nil, err
+		}
+		filterExp = stmt
+	}
+
 	if len(listIDs) == 0 {
 		listIDs = pq.Int64Array{}
 	}
 
 	// First argument is the boolean indicating if the query is a dry run.
 	a := append([]interface{}{false, pq.Int64Array(listIDs)}, args...)
-	if _, err := db.Exec(fmt.Sprintf(tpl, filterExp), a...); err != nil {
-		return err
-	}
+	a = append(a, condArgs...)
 
-	return nil
+	return fmt.Sprintf(tpl, filterExp), a, nil
 }
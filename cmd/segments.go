@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/subfilter"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// handleGetSegments handles retrieval of segments.
+func handleGetSegments(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out = []models.Segment{}
+
+		id, _  = strconv.Atoi(c.Param("id"))
+		single = false
+	)
+
+	// Fetch one segment.
+	if id > 0 {
+		single = true
+	}
+
+	if err := app.queries.GetSegments.Select(&out, id); err != nil {
+		app.log.Printf("error fetching segments: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.segments}", "error", pqErrMsg(err)))
+	}
+	if single && len(out) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.segment}"))
+	}
+
+	if single {
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateSegment handles segment creation.
+func handleCreateSegment(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		o   models.Segment
+	)
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	// Segments span all subscribers, so users restricted to
+	// specific lists can't manage them.
+	if userListIDs(c) != nil {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.segment}"))
+	}
+
+	o, err := validateSegment(o, app)
+	if err != nil {
+		return err
+	}
+	if o.Query != "" {
+		if err := checkPerm(c, permSubscribersSQL); err != nil {
+			return err
+		}
+	}
+
+	// Insert and read ID.
+	var newID int
+	if err := app.queries.CreateSegment.Get(&newID, o.Name, o.Description, o.Query, o.Filter); err != nil {
+		app.log.Printf("error creating segment: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.segment}", "error", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	return handleGetSegments(copyEchoCtx(c, map[string]string{
+		"id": fmt.Sprintf("%d", newID),
+	}))
+}
+
+// handleUpdateSegment handles segment modification.
+func handleUpdateSegment(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if userListIDs(c) != nil {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.segment}"))
+	}
+
+	// Incoming params.
+	var o models.Segment
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	o, err := validateSegment(o, app)
+	if err != nil {
+		return err
+	}
+	if o.Query != "" {
+		if err := checkPerm(c, permSubscribersSQL); err != nil {
+			return err
+		}
+	}
+
+	res, err := app.queries.UpdateSegment.Exec(id, o.Name, o.Description, o.Query, o.Filter)
+	if err != nil {
+		app.log.Printf("error updating segment: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.segment}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.segment}"))
+	}
+
+	return handleGetSegments(c)
+}
+
+// handleDeleteSegment handles segment deletion.
+func handleDeleteSegment(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if userListIDs(c) != nil {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.segment}"))
+	}
+
+	if _, err := app.queries.DeleteSegment.Exec(id); err != nil {
+		app.log.Printf("error deleting segment: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.segment}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateSegment validates a segment's fields and its query expression
+// by evaluating it in a readonly transaction.
+func validateSegment(o models.Segment, app *App) (models.Segment, error) {
+	o.Name = strings.TrimSpace(o.Name)
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return o, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "name"))
+	}
+
+	o.Query = sanitizeSQLExp(o.Query)
+	if len(o.Filter) == 0 || string(o.Filter) == "null" {
+		o.Filter = types.JSONText("{}")
+	}
+
+	exp, args, err := segmentExp(o, 2)
+	if err != nil {
+		return o, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("subscribers.invalidFilter", "error", err.Error()))
+	}
+
+	tx, err := app.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		app.log.Printf("error preparing segment query: %v", err)
+		return o, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	var n int
+	stmt := fmt.Sprintf(app.queries.QuerySegmentSubscribersCount, exp)
+	if err := tx.Get(&n, stmt, append([]interface{}{pq.Int64Array{}}, args...)...); err != nil {
+		return o, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
+	}
+
+	return o, nil
+}
+
+// segmentExp returns the SQL expression of a segment, which is its arbitrary
+// SQL expression and its compiled filter combined, along with the positional
+// arguments of the filter, which start at argStart.
+func segmentExp(s models.Segment, argStart int) (string, []interface{}, error) {
+	f, err := subfilter.Parse(s.Filter)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		exps []string
+		args []interface{}
+	)
+	if s.Query != "" {
+		exps = append(exps, "("+s.Query+")")
+	}
+	if !f.IsEmpty() {
+		exp, a, err := f.Compile(argStart)
+		if err != nil {
+			return "", nil, err
+		}
+		exps = append(exps, exp)
+		args = a
+	}
+
+	if len(exps) == 0 {
+		return "", nil, errors.New("segment has no query or filter")
+	}
+
+	return strings.Join(exps, " AND "), args, nil
+}
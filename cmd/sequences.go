@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+type sequenceSubsWrap struct {
+	Results []models.SequenceSubscriber `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// handleGetSequences handles retrieval of sequences.
+func handleGetSequences(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out = []models.Sequence{}
+
+		id, _  = strconv.Atoi(c.Param("id"))
+		single = false
+	)
+
+	// Fetch one sequence.
+	if id > 0 {
+		single = true
+	}
+
+	if err := app.queries.GetSequences.Select(&out, id, userListIDs(c)); err != nil {
+		app.log.Printf("error fetching sequences: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.sequences}", "error", pqErrMsg(err)))
+	}
+	if single && len(out) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.sequence}"))
+	}
+
+	if single {
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateSequence handles sequence creation.
+func handleCreateSequence(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		o   models.Sequence
+	)
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	o, err := validateSequence(o, app)
+	if err != nil {
+		return err
+	}
+	if err := checkSequenceAccess(c, o); err != nil {
+		return err
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+	}
+
+	// Insert and read ID.
+	var newID int
+	if err := app.queries.CreateSequence.Get(&newID,
+		uu,
+		o.Name,
+		o.ListID,
+		o.ExitSegmentID,
+		o.FromEmail,
+		o.Messenger,
+		o.TemplateID,
+		o.Enabled,
+		o.Steps); err != nil {
+		app.log.Printf("error creating sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.sequence}", "error", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	return handleGetSequences(copyEchoCtx(c, map[string]string{
+		"id": fmt.Sprintf("%d", newID),
+	}))
+}
+
+// handleUpdateSequence handles sequence modification.
+func handleUpdateSequence(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if err := checkSequence(c, id); err != nil {
+		return err
+	}
+
+	// Incoming params.
+	var o models.Sequence
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	o, err := validateSequence(o, app)
+	if err != nil {
+		return err
+	}
+	if err := checkSequenceAccess(c, o); err != nil {
+		return err
+	}
+
+	if err := app.queries.UpdateSequence.Get(&id,
+		id,
+		o.Name,
+		o.ListID,
+		o.ExitSegmentID,
+		o.FromEmail,
+		o.Messenger,
+		o.TemplateID,
+		o.Enabled,
+		o.Steps); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.sequence}"))
+		}
+
+		app.log.Printf("error updating sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.sequence}", "error", pqErrMsg(err)))
+	}
+
+	return handleGetSequences(c)
+}
+
+// handleDeleteSequence handles sequence deletion.
+func handleDeleteSequence(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if err := checkSequence(c, id); err != nil {
+		return err
+	}
+
+	if _, err := app.queries.DeleteSequence.Exec(id); err != nil {
+		app.log.Printf("error deleting sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.sequence}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleGetSequenceSubscribers returns the subscribers of a sequence with their
+// progress through it, optionally filtered by status.
+func handleGetSequenceSubscribers(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		id, _  = strconv.Atoi(c.Param("id"))
+		status = c.QueryParam("status")
+		pg     = getPagination(c.QueryParams(), 50)
+		out    sequenceSubsWrap
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	switch status {
+	case "", models.SequenceSubscriberActive, models.SequenceSubscriberCompleted, models.SequenceSubscriberExited:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "status"))
+	}
+	if err := checkSequence(c, id); err != nil {
+		return err
+	}
+
+	if err := app.queries.QuerySequenceSubscribers.Select(&out.Results, id, status, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching sequence subscribers: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.SequenceSubscriber{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// checkSequence checks whether a sequence exists on a list the authenticated
+// user has access to.
+func checkSequence(c echo.Context, id int) error {
+	var (
+		app = c.Get("app").(*App)
+		out []models.Sequence
+	)
+
+	if err := app.queries.GetSequences.Select(&out, id, userListIDs(c)); err != nil {
+		app.log.Printf("error fetching sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.sequence}", "error", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.sequence}"))
+	}
+
+	return nil
+}
+
+// checkSequenceAccess checks whether the authenticated user has access to the
+// list and the exit segment of a sequence.
+func checkSequenceAccess(c echo.Context, o models.Sequence) error {
+	if err := checkListAccess(c, int64(o.ListID)); err != nil {
+		return err
+	}
+	if o.ExitSegmentID.Valid {
+		return checkSegmentAccess(c, []int64{int64(o.ExitSegmentID.Int)})
+	}
+	return nil
+}
+
+// validateSequence validates a sequence's fields and compiles its steps.
+func validateSequence(o models.Sequence, app *App) (models.Sequence, error) {
+	o.Name = strings.TrimSpace(o.Name)
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return o, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidName"))
+	}
+	if o.ListID < 1 {
+		return o, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "list_id"))
+	}
+
+	if o.FromEmail == "" {
+		o.FromEmail = app.constants.FromEmail
+	} else if !regexFromAddress.Match([]byte(o.FromEmail)) {
+		if _, err := app.importer.SanitizeEmail(o.FromEmail); err != nil {
+			return o, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidFromEmail"))
+		}
+	}
+
+	if o.Messenger == "" {
+		o.Messenger = emailMsgr
+	}
+	if !app.manager.HasMessenger(o.Messenger) {
+		return o, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", o.Messenger))
+	}
+
+	if len(o.Steps) == 0 {
+		return o, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("sequences.fieldInvalidSteps"))
+	}
+
+	// Steps are sent in the order they're given in.
+	o.TemplateBody = tplTag
+	for i, st := range o.Steps {
+		st.Position = i
+		if !strHasLen(st.Subject, 1, stdInputMaxLen) {
+			return o, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidSubject"))
+		}
+		if st.DelayMins < 0 {
+			return o, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("sequences.fieldInvalidDelay"))
+		}
+
+		switch st.ContentType {
+		case "":
+			st.ContentType = models.CampaignContentTypeRichtext
+		case models.CampaignContentTypeRichtext, models.CampaignContentTypeHTML,
+			models.CampaignContentTypeMarkdown, models.CampaignContentTypePlain:
+		default:
+			return o, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "content_type"))
+		}
+
+		camp := o.Campaign(st)
+		if err := camp.CompileTemplate(app.manager.TemplateFuncs(camp)); err != nil {
+			return o, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("campaigns.fieldInvalidBody", "error", err.Error()))
+		}
+
+		o.Steps[i] = st
+	}
+
+	return o, nil
+}
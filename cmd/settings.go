@@ -10,6 +10,13 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/bounce"
+	"github.com/knadh/listmonk/internal/bounce/mailbox"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/knadh/listmonk/internal/messenger/sendgrid"
+	"github.com/knadh/listmonk/internal/messenger/ses"
+	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 )
 
@@ -29,10 +36,15 @@ type settings struct {
 	AppMaxSendErrors int `json:"app.max_send_errors"`
 	AppMessageRate   int `json:"app.message_rate"`
 
+	AppMaxSendErrorRate float64 `json:"app.max_send_error_rate"`
+	AppSendErrorWindow  int     `json:"app.send_error_window"`
+
 	AppMessageSlidingWindow         bool   `json:"app.message_sliding_window"`
 	AppMessageSlidingWindowDuration string `json:"app.message_sliding_window_duration"`
 	AppMessageSlidingWindowRate     int    `json:"app.message_sliding_window_rate"`
 
+	AppDomainThrottles []manager.DomainThrottle `json:"app.domain_throttles"`
+
 	PrivacyIndividualTracking bool     `json:"privacy.individual_tracking"`
 	PrivacyUnsubHeader        bool     `json:"privacy.unsubscribe_header"`
 	PrivacyAllowBlocklist     bool     `json:"privacy.allow_blocklist"`
@@ -58,6 +70,8 @@ type settings struct {
 	SMTP []struct {
 		UUID          string              `json:"uuid"`
 		Enabled       bool                `json:"enabled"`
+		Name          string              `json:"name"`
+		Weight        int                 `json:"weight"`
 		Host          string              `json:"host"`
 		HelloHostname string              `json:"hello_hostname"`
 		Port          int                 `json:"port"`
@@ -71,6 +85,7 @@ type settings struct {
 		WaitTimeout   string              `json:"wait_timeout"`
 		TLSType       string              `json:"tls_type"`
 		TLSSkipVerify bool                `json:"tls_skip_verify"`
+		DKIM          []email.DKIM        `json:"dkim"`
 	} `json:"smtp"`
 
 	Messengers []struct {
@@ -85,26 +100,61 @@ type settings struct {
 		MaxMsgRetries int    `json:"max_msg_retries"`
 	} `json:"messengers"`
 
-	BounceEnabled        bool   `json:"bounce.enabled"`
-	BounceEnableWebhooks bool   `json:"bounce.webhooks_enabled"`
-	BounceCount          int    `json:"bounce.count"`
-	BounceAction         string `json:"bounce.action"`
-	SESEnabled           bool   `json:"bounce.ses_enabled"`
-	SendgridEnabled      bool   `json:"bounce.sendgrid_enabled"`
-	SendgridKey          string `json:"bounce.sendgrid_key"`
-	BounceBoxes          []struct {
-		UUID          string `json:"uuid"`
+	SESMessenger struct {
+		Enabled          bool   `json:"enabled"`
+		Region           string `json:"region"`
+		AccessKey        string `json:"access_key"`
+		SecretKey        string `json:"secret_key,omitempty"`
+		Endpoint         string `json:"endpoint"`
+		ConfigurationSet string `json:"configuration_set"`
+		MaxConns         int    `json:"max_conns"`
+		MaxRate          int    `json:"max_rate"`
+		BatchSize        int    `json:"batch_size"`
+		MaxMsgRetries    int    `json:"max_msg_retries"`
+		Timeout          string `json:"timeout"`
+	} `json:"messenger.ses"`
+
+	SendGridMessenger struct {
 		Enabled       bool   `json:"enabled"`
-		Type          string `json:"type"`
-		Host          string `json:"host"`
-		Port          int    `json:"port"`
-		AuthProtocol  string `json:"auth_protocol"`
-		ReturnPath    string `json:"return_path"`
-		Username      string `json:"username"`
-		Password      string `json:"password,omitempty"`
-		TLSEnabled    bool   `json:"tls_enabled"`
-		TLSSkipVerify bool   `json:"tls_skip_verify"`
-		ScanInterval  string `json:"scan_interval"`
+		APIKey        string `json:"api_key,omitempty"`
+		Endpoint      string `json:"endpoint"`
+		MaxConns      int    `json:"max_conns"`
+		MaxRate       int    `json:"max_rate"`
+		BatchSize     int    `json:"batch_size"`
+		MaxMsgRetries int    `json:"max_msg_retries"`
+		Timeout       string `json:"timeout"`
+	} `json:"messenger.sendgrid"`
+
+	BounceEnabled        bool                     `json:"bounce.enabled"`
+	BounceEnableWebhooks bool                     `json:"bounce.webhooks_enabled"`
+	BounceActions        map[string]bounce.Action `json:"bounce.actions"`
+	SESEnabled           bool                     `json:"bounce.ses_enabled"`
+	SendgridEnabled      bool                     `json:"bounce.sendgrid_enabled"`
+	SendgridKey          string                   `json:"bounce.sendgrid_key"`
+	MailgunEnabled       bool                     `json:"bounce.mailgun_enabled"`
+	MailgunKey           string                   `json:"bounce.mailgun_key"`
+	PostmarkEnabled      bool                     `json:"bounce.postmark_enabled"`
+	PostmarkUsername     string                   `json:"bounce.postmark_username"`
+	PostmarkPassword     string                   `json:"bounce.postmark_password"`
+	SparkPostEnabled     bool                     `json:"bounce.sparkpost_enabled"`
+	SparkPostUsername    string                   `json:"bounce.sparkpost_username"`
+	SparkPostPassword    string                   `json:"bounce.sparkpost_password"`
+	BounceBoxes          []struct {
+		UUID            string `json:"uuid"`
+		Enabled         bool   `json:"enabled"`
+		Type            string `json:"type"`
+		Host            string `json:"host"`
+		Port            int    `json:"port"`
+		AuthProtocol    string `json:"auth_protocol"`
+		ReturnPath      string `json:"return_path"`
+		Username        string `json:"username"`
+		Password        string `json:"password,omitempty"`
+		Folder          string `json:"folder"`
+		ProcessedAction string `json:"processed_action"`
+		ProcessedFolder string `json:"processed_folder"`
+		TLSEnabled      bool   `json:"tls_enabled"`
+		TLSSkipVerify   bool   `json:"tls_skip_verify"`
+		ScanInterval    string `json:"scan_interval"`
 	} `json:"bounce.mailboxes"`
 
 	AdminCustomCSS  string `json:"appearance.admin.custom_css"`
@@ -129,6 +179,9 @@ func handleGetSettings(c echo.Context) error {
 	// Empty out passwords.
 	for i := 0; i < len(s.SMTP); i++ {
 		s.SMTP[i].Password = ""
+		for j := 0; j < len(s.SMTP[i].DKIM); j++ {
+			s.SMTP[i].DKIM[j].PrivateKey = ""
+		}
 	}
 	for i := 0; i < len(s.BounceBoxes); i++ {
 		s.BounceBoxes[i].Password = ""
@@ -136,8 +189,13 @@ func handleGetSettings(c echo.Context) error {
 	for i := 0; i < len(s.Messengers); i++ {
 		s.Messengers[i].Password = ""
 	}
+	s.SESMessenger.SecretKey = ""
+	s.SendGridMessenger.APIKey = ""
 	s.UploadS3AwsSecretAccessKey = ""
 	s.SendgridKey = ""
+	s.MailgunKey = ""
+	s.PostmarkPassword = ""
+	s.SparkPostPassword = ""
 
 	return c.JSON(http.StatusOK, okResp{s})
 }
@@ -161,12 +219,24 @@ func handleUpdateSettings(c echo.Context) error {
 	}
 
 	// There should be at least one SMTP block that's enabled.
-	has := false
+	// Named SMTP server groups are available as "email-$name" messengers.
+	var (
+		has   = false
+		names = map[string]bool{emailMsgr: true, ses.Name: true, sendgrid.Name: true}
+	)
 	for i, s := range set.SMTP {
 		if s.Enabled {
 			has = true
 		}
 
+		set.SMTP[i].Name = reAlphaNum.ReplaceAllString(strings.ToLower(s.Name), "")
+		if set.SMTP[i].Name != "" {
+			names[emailMsgr+"-"+set.SMTP[i].Name] = true
+		}
+		if s.Weight < 1 {
+			set.SMTP[i].Weight = 1
+		}
+
 		// Assign a UUID. The frontend only sends a password when the user explicitly
 		// changes the password. In other cases, the existing password in the DB
 		// is copied while updating the settings and the UUID is used to match
@@ -184,11 +254,47 @@ func handleUpdateSettings(c echo.Context) error {
 				}
 			}
 		}
+
+		// DKIM keys. Similar to passwords, private keys are only sent when
+		// they're changed. Existing keys are matched by the domain and selector.
+		for j, d := range s.DKIM {
+			d.Domain = strings.ToLower(strings.TrimSpace(d.Domain))
+			d.Selector = strings.TrimSpace(d.Selector)
+
+			if d.PrivateKey == "" {
+				for _, c := range cur.SMTP {
+					if s.UUID != c.UUID {
+						continue
+					}
+					for _, cd := range c.DKIM {
+						if cd.Domain == d.Domain && cd.Selector == d.Selector {
+							d.PrivateKey = cd.PrivateKey
+						}
+					}
+				}
+			}
+
+			if err := d.Validate(); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("settings.smtp.invalidDKIM", "name", d.Domain, "error", err.Error()))
+			}
+			set.SMTP[i].DKIM[j] = d
+		}
 	}
 	if !has {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.errorNoSMTP"))
 	}
 
+	// Bounce actions for every bounce type.
+	for _, t := range []string{models.BounceTypeSoft, models.BounceTypeHard, models.BounceTypeComplaint} {
+		a, ok := set.BounceActions[t]
+		if !ok || a.Count < 1 || a.Days < 0 || !strSliceContains(a.Action,
+			[]string{bounce.ActionNone, bounce.ActionUnsubscribe, bounce.ActionBlocklist, bounce.ActionDelete}) {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.bounces.invalidAction", "name", t))
+		}
+	}
+
 	// Bounce boxes.
 	for i, s := range set.BounceBoxes {
 		// Assign a UUID. The frontend only sends a password when the user explicitly
@@ -203,6 +309,18 @@ func handleUpdateSettings(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.bounces.invalidScanInterval"))
 		}
 
+		if s.Type == "imap" {
+			if s.Folder == "" {
+				set.BounceBoxes[i].Folder = "INBOX"
+			}
+			if s.ProcessedAction == "" {
+				set.BounceBoxes[i].ProcessedAction = mailbox.ActionDelete
+			}
+			if s.ProcessedAction == mailbox.ActionMove && strings.TrimSpace(s.ProcessedFolder) == "" {
+				return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.bounces.invalidProcessedFolder"))
+			}
+		}
+
 		// If there's no password coming in from the frontend, copy the existing
 		// password by matching the UUID.
 		if s.Password == "" {
@@ -214,9 +332,43 @@ func handleUpdateSettings(c echo.Context) error {
 		}
 	}
 
+	// Error rate threshold in percent.
+	if set.AppMaxSendErrorRate < 0 || set.AppMaxSendErrorRate > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "max_send_error_rate"))
+	}
+	if set.AppSendErrorWindow < 1 {
+		set.AppSendErrorWindow = 1000
+	}
+
+	// Per domain throttles. Blocks without a domain are dropped.
+	var (
+		throttles = make([]manager.DomainThrottle, 0, len(set.AppDomainThrottles))
+		domains   = make(map[string]bool)
+	)
+	for _, t := range set.AppDomainThrottles {
+		t.Domain = strings.ToLower(strings.TrimSpace(t.Domain))
+		if t.Domain == "" {
+			continue
+		}
+		if domains[t.Domain] {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.performance.duplicateDomain", "name", t.Domain))
+		}
+		domains[t.Domain] = true
+
+		if t.Rate < 0 {
+			t.Rate = 0
+		}
+		if t.Concurrency < 0 {
+			t.Concurrency = 0
+		}
+		throttles = append(throttles, t)
+	}
+	set.AppDomainThrottles = throttles
+
 	// Validate and sanitize postback Messenger names. Duplicates are disallowed
-	// and "email" is a reserved name.
-	names := map[string]bool{emailMsgr: true}
+	// and "email", "email-$name" (SMTP groups), "ses", and "sendgrid" are reserved names.
 
 	for i, m := range set.Messengers {
 		// UUID to keep track of password changes similar to the SMTP logic above.
@@ -245,6 +397,14 @@ func handleUpdateSettings(c echo.Context) error {
 		names[name] = true
 	}
 
+	// API messenger keys.
+	if set.SESMessenger.SecretKey == "" {
+		set.SESMessenger.SecretKey = cur.SESMessenger.SecretKey
+	}
+	if set.SendGridMessenger.APIKey == "" {
+		set.SendGridMessenger.APIKey = cur.SendGridMessenger.APIKey
+	}
+
 	// S3 password?
 	if set.UploadS3AwsSecretAccessKey == "" {
 		set.UploadS3AwsSecretAccessKey = cur.UploadS3AwsSecretAccessKey
@@ -252,6 +412,15 @@ func handleUpdateSettings(c echo.Context) error {
 	if set.SendgridKey == "" {
 		set.SendgridKey = cur.SendgridKey
 	}
+	if set.MailgunKey == "" {
+		set.MailgunKey = cur.MailgunKey
+	}
+	if set.PostmarkPassword == "" {
+		set.PostmarkPassword = cur.PostmarkPassword
+	}
+	if set.SparkPostPassword == "" {
+		set.SparkPostPassword = cur.SparkPostPassword
+	}
 
 	// Domain blocklist.
 	doms := make([]string, 0)
@@ -304,6 +473,40 @@ func handleGetLogs(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{app.bufLog.Lines()})
 }
 
+// handleGetDKIMRecords returns the DNS TXT records to publish for the
+// DKIM keys in the SMTP settings.
+func handleGetDKIMRecords(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	s, err := getSettings(app)
+	if err != nil {
+		return err
+	}
+
+	var (
+		out  = []email.DKIMRecord{}
+		seen = map[string]bool{}
+	)
+	for _, srv := range s.SMTP {
+		for _, d := range srv.DKIM {
+			r, err := email.MakeDKIMRecord(d)
+			if err != nil {
+				app.log.Printf("error reading DKIM key for %s: %v", d.Domain, err)
+				continue
+			}
+
+			// The same key may be configured on multiple SMTP servers.
+			if seen[r.Name+r.Value] {
+				continue
+			}
+			seen[r.Name+r.Value] = true
+			out = append(out, r)
+		}
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 func getSettings(app *App) (settings, error) {
 	var (
 		b   types.JSONText
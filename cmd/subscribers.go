@@ -13,7 +13,9 @@ import (
 	"strings"
 
 	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/subfilter"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhooks"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
@@ -26,12 +28,20 @@ const (
 // subQueryReq is a "catch all" struct for reading various
 // subscriber related requests.
 type subQueryReq struct {
-	Query         string        `json:"query"`
-	ListIDs       pq.Int64Array `json:"list_ids"`
-	TargetListIDs pq.Int64Array `json:"target_list_ids"`
-	SubscriberIDs pq.Int64Array `json:"ids"`
-	Action        string        `json:"action"`
-	Status        string        `json:"status"`
+	Query         string          `json:"query"`
+	Filter        json.RawMessage `json:"filter"`
+	ListIDs       pq.Int64Array   `json:"list_ids"`
+	TargetListIDs pq.Int64Array   `json:"target_list_ids"`
+	SubscriberIDs pq.Int64Array   `json:"ids"`
+	Action        string          `json:"action"`
+	Status        string          `json:"status"`
+}
+
+// subQuery is the condition of a subscriber query, which is either an
+// arbitrary SQL expression or a structured filter.
+type subQuery struct {
+	exp    string
+	filter subfilter.Filter
 }
 
 type subsWrap struct {
@@ -93,6 +103,9 @@ func handleGetSubscriber(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkSubscriberAccess(c, false, int64(id)); err != nil {
+		return err
+	}
 
 	sub, err := getSubscriber(id, "", "", app)
 	if err != nil {
@@ -102,29 +115,34 @@ func handleGetSubscriber(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{sub})
 }
 
-// handleQuerySubscribers handles querying subscribers based on an arbitrary SQL expression.
+// handleQuerySubscribers handles querying subscribers based on an arbitrary SQL
+// expression or a structured filter.
 func handleQuerySubscribers(c echo.Context) error {
 	var (
 		app = c.Get("app").(*App)
 		pg  = getPagination(c.QueryParams(), 30)
 
-		// The "WHERE ?" bit.
-		query   = sanitizeSQLExp(c.FormValue("query"))
 		orderBy = c.FormValue("order_by")
 		order   = c.FormValue("order")
 		out     = subsWrap{Results: make([]models.Subscriber, 0, 1)}
 	)
 
+	// The "WHERE ?" bit.
+	query, err := makeSubQuery(c, c.FormValue("query"), []byte(c.FormValue("filter")))
+	if err != nil {
+		return err
+	}
+
 	// Limit the subscribers to sepcific lists?
 	listIDs, err := getQueryInts("list_id", c.QueryParams())
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	// There's an arbitrary query condition.
-	cond := ""
-	if query != "" {
-		cond = " AND " + query
+	// Limit the subscribers to the lists the user has access to.
+	listIDs, err = filterListIDs(c, listIDs)
+	if err != nil {
+		return err
 	}
 
 	// Sort params.
@@ -137,6 +155,7 @@ func handleQuerySubscribers(c echo.Context) error {
 
 	// Create a readonly transaction that just does COUNT() to obtain the count of results
 	// and to ensure that the arbitrary query is indeed readonly.
+	cond, args := query.cond(2)
 	stmt := fmt.Sprintf(app.queries.QuerySubscribersCount, cond)
 	tx, err := app.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
@@ -148,7 +167,7 @@ func handleQuerySubscribers(c echo.Context) error {
 
 	// Execute the readonly query and get the count of results.
 	var total = 0
-	if err := tx.Get(&total, stmt, listIDs); err != nil {
+	if err := tx.Get(&total, stmt, append([]interface{}{listIDs}, args...)...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
 				"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
@@ -160,8 +179,9 @@ func handleQuerySubscribers(c echo.Context) error {
 	}
 
 	// Run the query again and fetch the actual data. stmt is the raw SQL query.
+	cond, args = query.cond(4)
 	stmt = fmt.Sprintf(app.queries.QuerySubscribers, cond, orderBy, order)
-	if err := tx.Select(&out.Results, stmt, listIDs, pg.Offset, pg.Limit); err != nil {
+	if err := tx.Select(&out.Results, stmt, append([]interface{}{listIDs, pg.Offset, pg.Limit}, args...)...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
 				"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
@@ -175,7 +195,7 @@ func handleQuerySubscribers(c echo.Context) error {
 				"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
-	out.Query = query
+	out.Query = query.exp
 	if len(out.Results) == 0 {
 		out.Results = make(models.Subscribers, 0)
 		return c.JSON(http.StatusOK, okResp{out})
@@ -189,14 +209,16 @@ func handleQuerySubscribers(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
-// handleExportSubscribers handles querying subscribers based on an arbitrary SQL expression.
+// handleExportSubscribers handles querying subscribers based on an arbitrary SQL
+// expression or a structured filter.
 func handleExportSubscribers(c echo.Context) error {
-	var (
-		app = c.Get("app").(*App)
+	app := c.Get("app").(*App)
 
-		// The "WHERE ?" bit.
-		query = sanitizeSQLExp(c.FormValue("query"))
-	)
+	// The "WHERE ?" bit.
+	query, err := makeSubQuery(c, c.FormValue("query"), []byte(c.FormValue("filter")))
+	if err != nil {
+		return err
+	}
 
 	// Limit the subscribers to sepcific lists?
 	listIDs, err := getQueryInts("list_id", c.QueryParams())
@@ -210,16 +232,16 @@ func handleExportSubscribers(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	// There's an arbitrary query condition.
-	cond := ""
-	if query != "" {
-		cond = " AND " + query
+	// Users restricted to specific lists can only export those lists.
+	if err := checkListAccess(c, listIDs...); err != nil {
+		return err
 	}
 
+	cond, args := query.cond(5)
 	stmt := fmt.Sprintf(app.queries.QuerySubscribersForExport, cond)
 
 	// Verify that the arbitrary SQL search expression is read only.
-	if cond != "" {
+	if query.exp != "" {
 		tx, err := app.db.Unsafe().BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
 		if err != nil {
 			app.log.Printf("error preparing subscriber query: %v", err)
@@ -259,7 +281,7 @@ func handleExportSubscribers(c echo.Context) error {
 loop:
 	for {
 		var out []models.SubscriberExport
-		if err := tx.Select(&out, listIDs, id, subIDs, app.constants.DBBatchSize); err != nil {
+		if err := tx.Select(&out, append([]interface{}{listIDs, id, subIDs, app.constants.DBBatchSize}, args...)...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError,
 				app.i18n.Ts("globals.messages.errorFetching",
 					"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
@@ -302,6 +324,10 @@ func handleCreateSubscriber(c echo.Context) error {
 		req = r
 	}
 
+	if err := checkListAccess(c, req.Lists...); err != nil {
+		return err
+	}
+
 	// Insert the subscriber into the DB.
 	sub, isNew, _, err := insertSubscriber(req, app)
 	if err != nil {
@@ -329,6 +355,12 @@ func handleUpdateSubscriber(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkSubscriberAccess(c, true, id); err != nil {
+		return err
+	}
+	if err := checkListAccess(c, req.Lists...); err != nil {
+		return err
+	}
 
 	if em, err := app.importer.SanitizeEmail(req.Email); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
@@ -374,6 +406,7 @@ func handleUpdateSubscriber(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	app.webhooks.Trigger(webhooks.EventSubscriberUpdated, sub)
 
 	return c.JSON(http.StatusOK, okResp{sub})
 }
@@ -388,6 +421,9 @@ func handleSubscriberSendOptin(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkSubscriberAccess(c, true, int64(id)); err != nil {
+		return err
+	}
 
 	// Fetch the subscriber.
 	out, err := getSubscriber(id, "", "", app)
@@ -436,15 +472,31 @@ func handleBlocklistSubscribers(c echo.Context) error {
 		IDs = req.SubscriberIDs
 	}
 
+	if err := checkSubscriberAccess(c, true, IDs...); err != nil {
+		return err
+	}
+
 	if _, err := app.queries.BlocklistSubscribers.Exec(IDs); err != nil {
 		app.log.Printf("error blocklisting subscribers: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("subscribers.errorBlocklisting", "error", err.Error()))
 	}
+	triggerBlocklisted(app, IDs)
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// triggerBlocklisted triggers the unsubscription events of blocklisted
+// subscribers, who are unsubscribed from all their lists.
+func triggerBlocklisted(app *App, IDs []int64) {
+	for _, id := range IDs {
+		app.webhooks.Trigger(webhooks.EventSubscriptionUnsubscribed, subscriptionEvent{
+			SubscriberID: id,
+			Blocklisted:  true,
+		})
+	}
+}
+
 // handleManageSubscriberLists handles bulk addition or removal of subscribers
 // from or to one or more target lists.
 // It takes either an ID in the URI, or a list of IDs in the request body.
@@ -479,6 +531,13 @@ func handleManageSubscriberLists(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.errorNoListsGiven"))
 	}
 
+	if err := checkSubscriberAccess(c, false, IDs...); err != nil {
+		return err
+	}
+	if err := checkListAccess(c, req.TargetListIDs...); err != nil {
+		return err
+	}
+
 	// Action.
 	var err error
 	switch req.Action {
@@ -499,6 +558,15 @@ func handleManageSubscriberLists(c echo.Context) error {
 				"name", "{globals.terms.subscribers}", "error", err.Error()))
 	}
 
+	if req.Action == "unsubscribe" {
+		for _, id := range IDs {
+			app.webhooks.Trigger(webhooks.EventSubscriptionUnsubscribed, subscriptionEvent{
+				SubscriberID: id,
+				ListIDs:      req.TargetListIDs,
+			})
+		}
+	}
+
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
@@ -532,12 +600,20 @@ func handleDeleteSubscribers(c echo.Context) error {
 		IDs = i
 	}
 
-	if _, err := app.queries.DeleteSubscribers.Exec(IDs, nil); err != nil {
+	if err := checkSubscriberAccess(c, true, IDs...); err != nil {
+		return err
+	}
+
+	var deleted []subscriberEvent
+	if err := app.queries.DeleteSubscribers.Select(&deleted, IDs, nil); err != nil {
 		app.log.Printf("error deleting subscribers: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorDeleting",
 				"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
+	for _, s := range deleted {
+		app.webhooks.Trigger(webhooks.EventSubscriberDeleted, s)
+	}
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
@@ -554,7 +630,20 @@ func handleDeleteSubscribersByQuery(c echo.Context) error {
 		return err
 	}
 
-	err := app.queries.execSubscriberQueryTpl(sanitizeSQLExp(req.Query),
+	// Arbitrary queries can match subscribers on lists outside
+	// of the ones a user is restricted to.
+	if userListIDs(c) != nil {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.subscribers}"))
+	}
+
+	query, err := makeSubQuery(c, req.Query, req.Filter)
+	if err != nil {
+		return err
+	}
+
+	var deleted []subscriberEvent
+	err = app.queries.selectSubscriberQueryTpl(&deleted, query,
 		app.queries.DeleteSubscribersByQuery,
 		req.ListIDs, app.db)
 	if err != nil {
@@ -563,6 +652,9 @@ func handleDeleteSubscribersByQuery(c echo.Context) error {
 			app.i18n.Ts("globals.messages.errorDeleting",
 				"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
+	for _, s := range deleted {
+		app.webhooks.Trigger(webhooks.EventSubscriberDeleted, s)
+	}
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
@@ -579,7 +671,20 @@ func handleBlocklistSubscribersByQuery(c echo.Context) error {
 		return err
 	}
 
-	err := app.queries.execSubscriberQueryTpl(sanitizeSQLExp(req.Query),
+	// Arbitrary queries can match subscribers on lists outside
+	// of the ones a user is restricted to.
+	if userListIDs(c) != nil {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.subscribers}"))
+	}
+
+	query, err := makeSubQuery(c, req.Query, req.Filter)
+	if err != nil {
+		return err
+	}
+
+	var IDs []int64
+	err = app.queries.selectSubscriberQueryTpl(&IDs, query,
 		app.queries.BlocklistSubscribersByQuery,
 		req.ListIDs, app.db)
 	if err != nil {
@@ -587,6 +692,7 @@ func handleBlocklistSubscribersByQuery(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("subscribers.errorBlocklisting", "error", pqErrMsg(err)))
 	}
+	triggerBlocklisted(app, IDs)
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
@@ -607,6 +713,13 @@ func handleManageSubscriberListsByQuery(c echo.Context) error {
 			app.i18n.T("subscribers.errorNoListsGiven"))
 	}
 
+	if err := checkListAccess(c, req.ListIDs...); err != nil {
+		return err
+	}
+	if err := checkListAccess(c, req.TargetListIDs...); err != nil {
+		return err
+	}
+
 	// Action.
 	var stmt string
 	switch req.Action {
@@ -620,7 +733,12 @@ func handleManageSubscriberListsByQuery(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.invalidAction"))
 	}
 
-	err := app.queries.execSubscriberQueryTpl(sanitizeSQLExp(req.Query),
+	query, err := makeSubQuery(c, req.Query, req.Filter)
+	if err != nil {
+		return err
+	}
+
+	err = app.queries.execSubscriberQueryTpl(query,
 		stmt, req.ListIDs, app.db, req.TargetListIDs)
 	if err != nil {
 		app.log.Printf("error updating subscriptions: %v", err)
@@ -643,6 +761,9 @@ func handleDeleteSubscriberBounces(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkSubscriberAccess(c, true, id); err != nil {
+		return err
+	}
 
 	if _, err := app.queries.DeleteBouncesBySubscriber.Exec(id, nil); err != nil {
 		app.log.Printf("error deleting bounces: %v", err)
@@ -667,6 +788,9 @@ func handleExportSubscriberData(c echo.Context) error {
 	if id < 1 {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
+	if err := checkSubscriberAccess(c, false, id); err != nil {
+		return err
+	}
 
 	// Get the subscriber's data. A single query that gets the profile,
 	// list subscriptions, campaign views, and link clicks. Names of
@@ -731,6 +855,9 @@ func insertSubscriber(req subimporter.SubReq, app *App) (models.Subscriber, bool
 	if err != nil {
 		return sub, false, false, err
 	}
+	if isNew {
+		app.webhooks.Trigger(webhooks.EventSubscriberCreated, sub)
+	}
 
 	hasOptin := false
 	if !req.PreconfirmSubs && app.constants.SendOptinConfirmation {
@@ -849,6 +976,62 @@ func sendOptinConfirmation(sub models.Subscriber, listIDs []int64, app *App) (in
 	return len(lists), nil
 }
 
+// makeSubQuery prepares the condition of a subscriber query from an arbitrary
+// SQL expression or a JSON filter. Arbitrary SQL expressions are only allowed
+// for users with the permission to run them.
+func makeSubQuery(c echo.Context, exp string, filter []byte) (subQuery, error) {
+	var (
+		app = c.Get("app").(*App)
+		out = subQuery{exp: sanitizeSQLExp(exp)}
+	)
+
+	if len(filter) > 0 && string(filter) != "null" {
+		f, err := subfilter.Parse(filter)
+		if err != nil {
+			return out, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("subscribers.invalidFilter", "error", err.Error()))
+		}
+		out.filter = f
+	}
+
+	if out.exp != "" {
+		if !out.filter.IsEmpty() {
+			return out, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "filter"))
+		}
+		if err := checkPerm(c, permSubscribersSQL); err != nil {
+			return out, err
+		}
+		return out, nil
+	}
+
+	// Validate the filter by compiling it.
+	if !out.filter.IsEmpty() {
+		if _, _, err := out.filter.Compile(1); err != nil {
+			return out, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("subscribers.invalidFilter", "error", err.Error()))
+		}
+	}
+
+	return out, nil
+}
+
+// cond returns the query as a condition to be appended to a WHERE clause
+// along with the positional arguments of the condition, which start at
+// argStart. An empty query returns an empty condition.
+func (s subQuery) cond(argStart int) (string, []interface{}) {
+	if s.exp != "" {
+		return " AND " + s.exp, nil
+	}
+	if s.filter.IsEmpty() {
+		return "", nil
+	}
+
+	// The filter has already been validated by makeSubQuery().
+	exp, args, _ := s.filter.Compile(argStart)
+	return " AND " + exp, args
+}
+
 // sanitizeSQLExp does basic sanitisation on arbitrary
 // SQL query expressions coming from the frontend.
 func sanitizeSQLExp(q string) string {
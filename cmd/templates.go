@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
@@ -39,6 +40,7 @@ func handleGetTemplates(c echo.Context) error {
 		id, _     = strconv.Atoi(c.Param("id"))
 		single    = false
 		noBody, _ = strconv.ParseBool(c.QueryParam("no_body"))
+		typ       = c.QueryParam("type")
 	)
 
 	// Fetch one list.
@@ -46,7 +48,7 @@ func handleGetTemplates(c echo.Context) error {
 		single = true
 	}
 
-	err := app.queries.GetTemplates.Select(&out, id, noBody)
+	err := app.queries.GetTemplates.Select(&out, id, noBody, typ)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
@@ -72,12 +74,13 @@ func handlePreviewTemplate(c echo.Context) error {
 		app   = c.Get("app").(*App)
 		id, _ = strconv.Atoi(c.Param("id"))
 		body  = c.FormValue("body")
+		typ   = c.FormValue("template_type")
 
 		tpls []models.Template
 	)
 
 	if body != "" {
-		if !regexpTplTag.MatchString(body) {
+		if typ != models.TemplateTypeTx && !regexpTplTag.MatchString(body) {
 			return echo.NewHTTPError(http.StatusBadRequest,
 				app.i18n.Ts("templates.placeholderHelp", "placeholder", tplTag))
 		}
@@ -86,7 +89,7 @@ func handlePreviewTemplate(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 		}
 
-		err := app.queries.GetTemplates.Select(&tpls, id, false)
+		err := app.queries.GetTemplates.Select(&tpls, id, false, "")
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError,
 				app.i18n.Ts("globals.messages.errorFetching",
@@ -98,6 +101,25 @@ func handlePreviewTemplate(c echo.Context) error {
 				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
 		}
 		body = tpls[0].Body
+		typ = tpls[0].Type
+	}
+
+	// Transactional templates are rendered standalone with dummy data.
+	if typ == models.TemplateTypeTx {
+		tpl := models.Template{Type: typ, Body: body}
+		tpl.ID = id
+		if err := tpl.Compile(app.manager.TxTemplateFuncs(&tpl)); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("templates.errorCompiling", "error", err.Error()))
+		}
+
+		m := models.TxMessage{Data: map[string]interface{}{}}
+		if err := m.Render(dummySubscriber, &tpl); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("templates.errorRendering", "error", err.Error()))
+		}
+
+		return c.HTML(http.StatusOK, string(m.Body))
 	}
 
 	// Compile the template.
@@ -136,20 +158,40 @@ func handleCreateTemplate(c echo.Context) error {
 		return err
 	}
 
+	if o.Type == "" {
+		o.Type = models.TemplateTypeCampaign
+	}
+
 	if err := validateTemplate(o, app); err != nil {
 		return err
 	}
 
+	// Compile tx templates upfront so that errors are reported before saving.
+	if o.Type == models.TemplateTypeTx {
+		if err := o.Compile(app.manager.TxTemplateFuncs(&o)); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("templates.errorCompiling", "error", err.Error()))
+		}
+	}
+
 	// Insert and read ID.
 	var newID int
 	if err := app.queries.CreateTemplate.Get(&newID,
 		o.Name,
+		o.Type,
+		o.Subject,
 		o.Body); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorCreating",
 				"name", "{globals.terms.template}", "error", pqErrMsg(err)))
 	}
 
+	if o.Type == models.TemplateTypeTx {
+		if err := cacheTxTemplate(newID, app); err != nil {
+			app.log.Printf("error caching transactional template %d: %v", newID, err)
+		}
+	}
+
 	// Hand over to the GET handler to return the last insertion.
 	return handleGetTemplates(copyEchoCtx(c, map[string]string{
 		"id": fmt.Sprintf("%d", newID),
@@ -172,11 +214,31 @@ func handleUpdateTemplate(c echo.Context) error {
 		return err
 	}
 
+	// The type of a template can't be changed. Get the existing one.
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, id, true, ""); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.template}", "error", pqErrMsg(err)))
+	}
+	if len(tpls) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
+	}
+	o.Type = tpls[0].Type
+
 	if err := validateTemplate(o, app); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	res, err := app.queries.UpdateTemplate.Exec(id, o.Name, o.Body)
+	if o.Type == models.TemplateTypeTx {
+		if err := o.Compile(app.manager.TxTemplateFuncs(&o)); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("templates.errorCompiling", "error", err.Error()))
+		}
+	}
+
+	res, err := app.queries.UpdateTemplate.Exec(id, o.Name, o.Subject, o.Body)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorUpdating",
@@ -188,6 +250,12 @@ func handleUpdateTemplate(c echo.Context) error {
 			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
 	}
 
+	if o.Type == models.TemplateTypeTx {
+		if err := cacheTxTemplate(id, app); err != nil {
+			app.log.Printf("error caching transactional template %d: %v", id, err)
+		}
+	}
+
 	return handleGetTemplates(c)
 }
 
@@ -235,6 +303,8 @@ func handleDeleteTemplate(c echo.Context) error {
 			app.i18n.T("templates.cantDeleteDefault"))
 	}
 
+	app.manager.DeleteTpl(id)
+
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
@@ -244,10 +314,70 @@ func validateTemplate(o models.Template, app *App) error {
 		return errors.New(app.i18n.T("campaigns.fieldInvalidName"))
 	}
 
-	if !regexpTplTag.MatchString(o.Body) {
+	switch o.Type {
+	case models.TemplateTypeCampaign:
+		if !regexpTplTag.MatchString(o.Body) {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("templates.placeholderHelp", "placeholder", tplTag))
+		}
+	case models.TemplateTypeTx:
+		if !strHasLen(o.Subject, 1, stdInputMaxLen) {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("templates.fieldInvalidSubject"))
+		}
+	default:
 		return echo.NewHTTPError(http.StatusBadRequest,
-			app.i18n.Ts("templates.placeholderHelp", "placeholder", tplTag))
+			app.i18n.Ts("globals.messages.invalidFields", "name", "type"))
+	}
+
+	return nil
+}
+
+// cacheTxTemplate loads a stored transactional template, compiles it,
+// and caches it in the manager.
+func cacheTxTemplate(id int, app *App) error {
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, id, false, models.TemplateTypeTx); err != nil {
+		return err
+	}
+	if len(tpls) == 0 {
+		app.manager.DeleteTpl(id)
+		return nil
 	}
 
+	tpl := tpls[0]
+	if err := tpl.Compile(app.manager.TxTemplateFuncs(&tpl)); err != nil {
+		return err
+	}
+	app.manager.CacheTpl(tpl.ID, &tpl)
 	return nil
 }
+
+// watchTxTemplates is a blocking function that periodically checks for
+// transactional templates that have been created, updated, or deleted,
+// eg: by other instances of the app, and reloads the cached templates.
+func watchTxTemplates(interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var version string
+	if err := app.queries.GetTxTemplatesVersion.Get(&version); err != nil {
+		app.log.Printf("error checking transactional templates: %v", err)
+	}
+
+	for range ticker.C {
+		var v string
+		if err := app.queries.GetTxTemplatesVersion.Get(&v); err != nil {
+			app.log.Printf("error checking transactional templates: %v", err)
+			continue
+		}
+		if v == version {
+			continue
+		}
+
+		if err := loadTxTemplates(app.manager, app); err != nil {
+			app.log.Printf("error loading transactional templates: %v", err)
+			continue
+		}
+		version = v
+	}
+}
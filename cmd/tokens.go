@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// apiTokenLen is the length of the random API token string.
+const apiTokenLen = 40
+
+// tokenReq represents an API token creation request.
+type tokenReq struct {
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt null.Time `json:"expires_at"`
+}
+
+// handleGetAPITokens retrieves API tokens. Users can only see their own
+// tokens unless they can manage users.
+func handleGetAPITokens(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out = []models.APIToken{}
+	)
+
+	if err := app.queries.GetAPITokens.Select(&out, 0, tokenOwnerFilter(c)); err != nil {
+		app.log.Printf("error fetching API tokens: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.tokens}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateAPIToken creates a new API token for the authenticated user.
+// The raw token is returned only once in the response.
+func handleCreateAPIToken(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		u   = getUser(c)
+		req tokenReq
+	)
+
+	// Tokens can't be used to mint more tokens.
+	if getToken(c) != nil {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.tokens}"))
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "name"))
+	}
+	if len(req.Scopes) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("tokens.noScopes"))
+	}
+
+	// A token's scopes can't exceed the permissions of its user.
+	for _, s := range req.Scopes {
+		if !strSliceContains(s, allPerms) {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("tokens.invalidScope", "name", s))
+		}
+		if !hasPerm(u, s) {
+			return echo.NewHTTPError(http.StatusForbidden, app.i18n.Ts("users.permissionDenied", "name", s))
+		}
+	}
+	if req.ExpiresAt.Valid && req.ExpiresAt.Time.Before(time.Now()) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "expires_at"))
+	}
+
+	tk, err := generateRandomString(apiTokenLen)
+	if err != nil {
+		app.log.Printf("error generating API token: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.token}", "error", err.Error()))
+	}
+
+	var newID int
+	if err := app.queries.CreateAPIToken.Get(&newID, u.ID, req.Name, hashToken(tk),
+		pq.StringArray(req.Scopes), req.ExpiresAt); err != nil {
+		app.log.Printf("error creating API token: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.token}", "error", pqErrMsg(err)))
+	}
+
+	var out []models.APIToken
+	if err := app.queries.GetAPITokens.Select(&out, newID, 0); err != nil || len(out) == 0 {
+		app.log.Printf("error fetching API token: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.token}", "error", pqErrMsg(err)))
+	}
+	out[0].Token = tk
+
+	return c.JSON(http.StatusOK, okResp{out[0]})
+}
+
+// handleDeleteAPIToken revokes an API token.
+func handleDeleteAPIToken(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	res, err := app.queries.DeleteAPIToken.Exec(id, tokenOwnerFilter(c))
+	if err != nil {
+		app.log.Printf("error deleting API token: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.token}", "error", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.token}"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// tokenOwnerFilter returns the user ID to restrict token operations to.
+// Users who can manage other users (0) have access to all tokens.
+func tokenOwnerFilter(c echo.Context) int {
+	u := getUser(c)
+	if hasPerm(u, permUsersWrite) && getToken(c) == nil {
+		return 0
+	}
+	return u.ID
+}
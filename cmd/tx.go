@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// handleSendTxMessage handles the sending of a transactional message.
+func handleSendTxMessage(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		m   models.TxMessage
+	)
+
+	if err := c.Bind(&m); err != nil {
+		return err
+	}
+
+	// Validate input.
+	m, err := validateTxMessage(m, app)
+	if err != nil {
+		return err
+	}
+
+	// Get the cached tx template.
+	tpl, err := app.manager.GetTpl(m.TemplateID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
+	}
+
+	// Get the subscriber.
+	sub, err := getSubscriber(m.SubscriberID, "", m.SubscriberEmail, app)
+	if err != nil {
+		return err
+	}
+	if err := checkSubscriberAccess(c, false, int64(sub.ID)); err != nil {
+		return err
+	}
+
+	// Render the message.
+	if err := m.Render(sub, tpl); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("templates.errorRendering", "error", err.Error()))
+	}
+
+	// Prepare the final message.
+	msg := manager.Message{}
+	msg.Subscriber = sub
+	msg.To = []string{sub.Email}
+	msg.From = m.FromEmail
+	msg.Subject = m.Subject
+	msg.ContentType = m.ContentType
+	msg.Messenger = m.Messenger
+	msg.Body = m.Body
+
+	// Optional headers.
+	if len(m.Headers) != 0 {
+		msg.Headers = make(textproto.MIMEHeader, len(m.Headers))
+		for _, set := range m.Headers {
+			for hdr, val := range set {
+				msg.Headers.Add(hdr, val)
+			}
+		}
+	}
+
+	if err := app.manager.PushMessage(msg); err != nil {
+		app.log.Printf("error sending message (%s): %v", msg.Subject, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateTxMessage validates a tx message and sets defaults.
+func validateTxMessage(m models.TxMessage, app *App) (models.TxMessage, error) {
+	if (m.SubscriberID == 0 && m.SubscriberEmail == "") || (m.SubscriberID > 0 && m.SubscriberEmail != "") {
+		return m, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("tx.invalidSubscriber"))
+	}
+	m.SubscriberEmail = strings.ToLower(strings.TrimSpace(m.SubscriberEmail))
+
+	if m.TemplateID < 1 {
+		return m, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "template_id"))
+	}
+
+	if m.FromEmail == "" {
+		m.FromEmail = app.constants.FromEmail
+	}
+
+	if m.Messenger == "" {
+		m.Messenger = emailMsgr
+	} else if !app.manager.HasMessenger(m.Messenger) {
+		return m, echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", m.Messenger))
+	}
+
+	switch m.ContentType {
+	case "":
+		m.ContentType = models.CampaignContentTypeHTML
+	case models.CampaignContentTypeHTML, models.CampaignContentTypePlain:
+	default:
+		return m, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "content_type"))
+	}
+
+	return m, nil
+}
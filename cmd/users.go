@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+const (
+	minPasswordLen = 8
+	maxPasswordLen = 72
+)
+
+// userReq represents a user creation or update request.
+type userReq struct {
+	Username string        `json:"username"`
+	Email    string        `json:"email"`
+	Name     string        `json:"name"`
+	Password string        `json:"password"`
+	Type     string        `json:"type"`
+	Role     string        `json:"role"`
+	Status   string        `json:"status"`
+	ListIDs  pq.Int64Array `json:"list_ids"`
+
+	// RestrictLists restricts the user to ListIDs. If it's not set, users
+	// with lists are restricted.
+	RestrictLists *bool `json:"restrict_lists"`
+}
+
+// handleGetUsers handles retrieval of users.
+func handleGetUsers(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []models.User
+
+		id, _  = strconv.Atoi(c.Param("id"))
+		single = false
+	)
+
+	// Fetch one user.
+	if id > 0 {
+		single = true
+	}
+
+	if err := app.queries.GetUsers.Select(&out, id, "", 0, 0); err != nil {
+		app.log.Printf("error fetching users: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.users}", "error", pqErrMsg(err)))
+	}
+	if single && len(out) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.user}"))
+	}
+
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+	if single {
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateUser handles user creation.
+func handleCreateUser(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req userReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	// Defaults.
+	if req.Type == "" {
+		req.Type = models.UserTypeUser
+	}
+	if req.Role == "" {
+		req.Role = models.UserRoleReadonly
+	}
+	if req.Status == "" {
+		req.Status = models.UserStatusEnabled
+	}
+	if req.ListIDs == nil {
+		req.ListIDs = pq.Int64Array{}
+	}
+	restrict := len(req.ListIDs) > 0
+	if req.RestrictLists != nil {
+		restrict = *req.RestrictLists
+	}
+
+	if err := validateUserReq(req, true, c); err != nil {
+		return err
+	}
+	if err := checkUserGrants(c, req.Role, restrict, req.ListIDs); err != nil {
+		return err
+	}
+
+	pwd, err := hashPassword(req.Password)
+	if err != nil {
+		app.log.Printf("error hashing password: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.user}", "error", err.Error()))
+	}
+
+	var newID int
+	if err := app.queries.CreateUser.Get(&newID,
+		strings.TrimSpace(req.Username),
+		strings.TrimSpace(req.Email),
+		strings.TrimSpace(req.Name),
+		pwd,
+		req.Type,
+		req.Role,
+		req.Status,
+		req.ListIDs,
+		restrict); err != nil {
+		if isUniqueViolationErr(err) {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("users.usernameExists"))
+		}
+
+		app.log.Printf("error creating user: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	return handleGetUsers(copyEchoCtx(c, map[string]string{
+		"id": fmt.Sprintf("%d", newID),
+	}))
+}
+
+// handleUpdateUser handles user modification.
+func handleUpdateUser(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   userReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if err := validateUserReq(req, false, c); err != nil {
+		return err
+	}
+
+	// Get the existing user.
+	var users []models.User
+	if err := app.queries.GetUsers.Select(&users, id, "", 0, 1); err != nil {
+		app.log.Printf("error fetching user: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+	}
+	if len(users) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.user}"))
+	}
+	old := users[0]
+
+	// Only superadmins can modify other superadmins.
+	if old.Type == models.UserTypeSuperadmin && getUser(c).Type != models.UserTypeSuperadmin {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.user}"))
+	}
+
+	// The primordial superadmin can't be demoted or disabled.
+	if id == 1 && ((req.Type != "" && req.Type != models.UserTypeSuperadmin) ||
+		(req.Status != "" && req.Status != models.UserStatusEnabled)) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("users.cantModifySuperadmin"))
+	}
+
+	// Users can't change their own role or lists.
+	if id == getUser(c).ID && ((req.Role != "" && req.Role != old.Role) ||
+		(req.ListIDs != nil && !sameInt64s(req.ListIDs, old.ListIDs)) ||
+		(req.RestrictLists != nil && *req.RestrictLists != old.RestrictLists)) {
+		return echo.NewHTTPError(http.StatusForbidden, app.i18n.T("users.cantModifySelf"))
+	}
+
+	// Only users whose role and lists are within those of the authenticated
+	// user can be modified, and they can't be granted any more.
+	if err := checkUserGrants(c, old.Role, old.RestrictLists, old.ListIDs); err != nil {
+		return err
+	}
+
+	var pwd string
+	if req.Password != "" {
+		p, err := hashPassword(req.Password)
+		if err != nil {
+			app.log.Printf("error hashing password: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorUpdating",
+					"name", "{globals.terms.user}", "error", err.Error()))
+		}
+		pwd = p
+	}
+
+	// If list IDs aren't sent, retain the existing ones and the restriction.
+	restrict := old.RestrictLists
+	if req.ListIDs == nil {
+		req.ListIDs = old.ListIDs
+		if req.ListIDs == nil {
+			req.ListIDs = pq.Int64Array{}
+		}
+	} else {
+		restrict = len(req.ListIDs) > 0
+	}
+	if req.RestrictLists != nil {
+		restrict = *req.RestrictLists
+	}
+
+	role := req.Role
+	if role == "" {
+		role = old.Role
+	}
+	if err := checkUserGrants(c, role, restrict, req.ListIDs); err != nil {
+		return err
+	}
+
+	if _, err := app.queries.UpdateUser.Exec(id,
+		strings.TrimSpace(req.Email),
+		strings.TrimSpace(req.Name),
+		pwd,
+		req.Type,
+		req.Role,
+		req.Status,
+		req.ListIDs,
+		restrict); err != nil {
+		app.log.Printf("error updating user: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+	}
+
+	// Log the user out of all sessions if the password changed or the user was disabled.
+	if pwd != "" || req.Status == models.UserStatusDisabled {
+		if _, err := app.queries.DeleteUserSessions.Exec(id); err != nil {
+			app.log.Printf("error deleting user sessions: %v", err)
+		}
+	}
+
+	return handleGetUsers(c)
+}
+
+// handleDeleteUser handles user deletion.
+func handleDeleteUser(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	u := getUser(c)
+	if id == 1 || id == u.ID {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("users.cantDelete"))
+	}
+
+	// Only superadmins can delete other superadmins.
+	if u.Type != models.UserTypeSuperadmin {
+		var users []models.User
+		if err := app.queries.GetUsers.Select(&users, id, "", 0, 1); err != nil {
+			app.log.Printf("error fetching user: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+		}
+		if len(users) > 0 && users[0].Type == models.UserTypeSuperadmin {
+			return echo.NewHTTPError(http.StatusForbidden,
+				app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.user}"))
+		}
+		if len(users) > 0 {
+			if err := checkUserGrants(c, users[0].Role, users[0].RestrictLists, users[0].ListIDs); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := app.queries.DeleteUser.Exec(id); err != nil {
+		app.log.Printf("error deleting user: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateUserReq validates user fields. Password and username are
+// only required for new users.
+func validateUserReq(r userReq, isNew bool, c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if isNew && !strHasLen(strings.TrimSpace(r.Username), 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "username"))
+	}
+	if (isNew || r.Password != "") && !strHasLen(r.Password, minPasswordLen, maxPasswordLen) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("users.invalidPassword", "min", strconv.Itoa(minPasswordLen),
+				"max", strconv.Itoa(maxPasswordLen)))
+	}
+	if r.Email != "" {
+		if _, err := app.importer.SanitizeEmail(r.Email); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if r.Name != "" && !strHasLen(r.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "name"))
+	}
+
+	if r.Type != "" && r.Type != models.UserTypeSuperadmin && r.Type != models.UserTypeUser {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "type"))
+	}
+	if r.Role != "" && !strSliceContains(r.Role, userRoles) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "role"))
+	}
+	if r.Status != "" && r.Status != models.UserStatusEnabled && r.Status != models.UserStatusDisabled {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "status"))
+	}
+
+	// Only superadmins can create other superadmins.
+	if r.Type == models.UserTypeSuperadmin && getUser(c).Type != models.UserTypeSuperadmin {
+		return echo.NewHTTPError(http.StatusForbidden,
+			app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.user}"))
+	}
+
+	return nil
+}
+
+// checkUserGrants checks that the permissions of a role and the lists given
+// to a user don't exceed those of the authenticated user. Users that aren't
+// restricted to lists have access to all lists.
+func checkUserGrants(c echo.Context, role string, restrict bool, listIDs []int64) error {
+	var (
+		app = c.Get("app").(*App)
+		u   = getUser(c)
+	)
+	if u.Type == models.UserTypeSuperadmin {
+		return nil
+	}
+
+	for _, p := range rolePerms[role] {
+		if !hasPerm(u, p) {
+			return echo.NewHTTPError(http.StatusForbidden, app.i18n.Ts("users.permissionDenied", "name", p))
+		}
+	}
+
+	// List restricted users can only give access to their own lists.
+	allowed := userListIDs(c)
+	if allowed == nil {
+		return nil
+	}
+	if !restrict {
+		return echo.NewHTTPError(http.StatusForbidden, app.i18n.T("users.listsRequired"))
+	}
+	for _, id := range listIDs {
+		if !inInt64Array(id, allowed) {
+			return echo.NewHTTPError(http.StatusForbidden,
+				app.i18n.Ts("users.permissionDenied", "name", "{globals.terms.list}"))
+		}
+	}
+	return nil
+}
+
+// sameInt64s checks whether two slices have the same set of values.
+func sameInt64s(a, b []int64) bool {
+	for _, v := range a {
+		if !inInt64Array(v, b) {
+			return false
+		}
+	}
+	for _, v := range b {
+		if !inInt64Array(v, a) {
+			return false
+		}
+	}
+	return true
+}
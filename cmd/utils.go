@@ -131,3 +131,12 @@ func strSliceContains(str string, sl []string) bool {
 
 	return false
 }
+
+// isUniqueViolationErr checks if the given error represents a Postgres/pq
+// unique constraint violation error.
+func isUniqueViolationErr(err error) bool {
+	if p, ok := err.(*pq.Error); ok && p.Code == "23505" {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/webhooks"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// webhookSecretLen is the length of the random secret that's generated
+	// for webhooks that are created without one.
+	webhookSecretLen = 32
+
+	webhookMaxRetries = 20
+)
+
+// webhookReq is a webhook in create and update requests. The secret of
+// models.Webhook is write-only and is set from here.
+type webhookReq struct {
+	models.Webhook
+
+	Secret string `json:"secret"`
+}
+
+// webhookSecretResp is a created webhook along with its generated secret.
+type webhookSecretResp struct {
+	models.Webhook
+
+	Secret string `json:"secret,omitempty"`
+}
+
+type webhookDeliveriesWrap struct {
+	Results []models.WebhookDelivery `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// subscriberEvent is the webhook payload of a deleted subscriber.
+type subscriberEvent struct {
+	ID    int    `db:"id" json:"id"`
+	UUID  string `db:"uuid" json:"uuid"`
+	Email string `db:"email" json:"email"`
+	Name  string `db:"name" json:"name"`
+}
+
+// subscriptionEvent is the webhook payload of a subscription
+// confirmation or unsubscription.
+type subscriptionEvent struct {
+	SubscriberID   int64    `json:"subscriber_id,omitempty"`
+	SubscriberUUID string   `json:"subscriber_uuid,omitempty"`
+	CampaignUUID   string   `json:"campaign_uuid,omitempty"`
+	ListIDs        []int64  `json:"list_ids,omitempty"`
+	ListUUIDs      []string `json:"list_uuids,omitempty"`
+	Blocklisted    bool     `json:"blocklisted,omitempty"`
+}
+
+// trackEvent is the webhook payload of a campaign view or a link click.
+// The subscriber is empty if individual tracking is disabled. Clicks in
+// transactional messages have the ID of their tx template.
+type trackEvent struct {
+	CampaignUUID   string `json:"campaign_uuid"`
+	SubscriberUUID string `json:"subscriber_uuid"`
+	TemplateID     int    `json:"template_id,omitempty"`
+	LinkUUID       string `json:"link_uuid,omitempty"`
+	URL            string `json:"url,omitempty"`
+}
+
+// campStatusEvent is the webhook payload of a campaign status change.
+type campStatusEvent struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Sent   int    `json:"sent"`
+	ToSend int    `json:"to_send"`
+	Reason string `json:"reason"`
+}
+
+// handleGetWebhooks handles retrieval of webhooks.
+func handleGetWebhooks(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		out   = []models.Webhook{}
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if err := app.queries.GetWebhooks.Select(&out, id); err != nil {
+		app.log.Printf("error fetching webhooks: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.webhooks}", "error", pqErrMsg(err)))
+	}
+
+	if id > 0 {
+		if len(out) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.webhook}"))
+		}
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateWebhook handles webhook creation. If there's no secret, a random
+// one is generated and returned only once in the response.
+func handleCreateWebhook(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req webhookReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	o, err := validateWebhook(req, app)
+	if err != nil {
+		return err
+	}
+
+	generated := o.Secret == ""
+	if generated {
+		s, err := generateRandomString(webhookSecretLen)
+		if err != nil {
+			app.log.Printf("error generating webhook secret: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorCreating",
+					"name", "{globals.terms.webhook}", "error", err.Error()))
+		}
+		o.Secret = s
+	}
+
+	var newID int
+	if err := app.queries.CreateWebhook.Get(&newID, o.Name, o.URL, o.Secret, o.Events,
+		o.Enabled, o.MaxRetries); err != nil {
+		app.log.Printf("error creating webhook: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.webhook}", "error", pqErrMsg(err)))
+	}
+
+	if err := reloadWebhooks(app); err != nil {
+		return err
+	}
+
+	var out []models.Webhook
+	if err := app.queries.GetWebhooks.Select(&out, newID); err != nil || len(out) == 0 {
+		app.log.Printf("error fetching webhook: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.webhook}", "error", pqErrMsg(err)))
+	}
+
+	resp := webhookSecretResp{Webhook: out[0]}
+	if generated {
+		resp.Secret = o.Secret
+	}
+
+	return c.JSON(http.StatusOK, okResp{resp})
+}
+
+// handleUpdateWebhook handles webhook modification. An empty secret
+// retains the existing secret.
+func handleUpdateWebhook(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req webhookReq
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	o, err := validateWebhook(req, app)
+	if err != nil {
+		return err
+	}
+
+	res, err := app.queries.UpdateWebhook.Exec(id, o.Name, o.URL, o.Secret, o.Events,
+		o.Enabled, o.MaxRetries)
+	if err != nil {
+		app.log.Printf("error updating webhook: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.webhook}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.webhook}"))
+	}
+
+	if err := reloadWebhooks(app); err != nil {
+		return err
+	}
+
+	return handleGetWebhooks(c)
+}
+
+// handleDeleteWebhook handles webhook deletion.
+func handleDeleteWebhook(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if _, err := app.queries.DeleteWebhook.Exec(id); err != nil {
+		app.log.Printf("error deleting webhook: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.webhook}", "error", pqErrMsg(err)))
+	}
+
+	if err := reloadWebhooks(app); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleGetWebhookDeliveries handles retrieval of the delivery log of a webhook.
+func handleGetWebhookDeliveries(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		pg     = getPagination(c.QueryParams(), 50)
+		id, _  = strconv.Atoi(c.Param("id"))
+		status = c.FormValue("status")
+		out    webhookDeliveriesWrap
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if status != "" && status != models.WebhookDeliveryPending &&
+		status != models.WebhookDeliverySuccess && status != models.WebhookDeliveryFailed {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "status"))
+	}
+
+	if err := app.queries.QueryWebhookDeliveries.Select(&out.Results, id, status, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching webhook deliveries: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.webhook}", "error", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.WebhookDelivery{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// validateWebhook validates the fields of a webhook request and returns the webhook.
+func validateWebhook(req webhookReq, app *App) (models.Webhook, error) {
+	o := req.Webhook
+	o.Secret = req.Secret
+
+	o.Name = strings.TrimSpace(o.Name)
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return o, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "name"))
+	}
+
+	o.URL = strings.TrimSpace(o.URL)
+	if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return o, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("webhooks.invalidURL"))
+	}
+
+	if len(o.Events) == 0 {
+		return o, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("webhooks.noEvents"))
+	}
+	for _, e := range o.Events {
+		if !strSliceContains(e, webhooks.Events) {
+			return o, echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("webhooks.invalidEvent", "name", e))
+		}
+	}
+
+	if o.MaxRetries < 0 || o.MaxRetries > webhookMaxRetries {
+		return o, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "max_retries"))
+	}
+
+	return o, nil
+}
+
+// reloadWebhooks loads the webhooks from the DB into the webhook manager.
+func reloadWebhooks(app *App) error {
+	var hooks []models.Webhook
+	if err := app.queries.GetWebhooks.Select(&hooks, 0); err != nil {
+		app.log.Printf("error loading webhooks: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.webhooks}", "error", pqErrMsg(err)))
+	}
+
+	app.webhooks.Load(hooks)
+	return nil
+}
+
+// webhookStore implements webhooks.Store over the primary database.
+type webhookStore struct {
+	queries *Queries
+}
+
+// CreateDelivery records a new pending webhook delivery and returns its ID.
+func (w *webhookStore) CreateDelivery(hookID int, event string, payload []byte, lease time.Duration) (int64, error) {
+	var id int64
+	if err := w.queries.CreateWebhookDelivery.Get(&id, hookID, event, payload, lease.Seconds()); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// NextDeliveries leases and returns a batch of pending webhook deliveries that are due.
+func (w *webhookStore) NextDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	var out []models.WebhookDelivery
+	if err := w.queries.NextWebhookDeliveries.Select(&out, limit, lease.Seconds()); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdateDelivery updates the status of a webhook delivery after an attempt.
+func (w *webhookStore) UpdateDelivery(id int64, status string, attempts, code int, errMsg string, wait time.Duration) error {
+	_, err := w.queries.UpdateWebhookDelivery.Exec(id, status, attempts, code, errMsg, wait.Seconds())
+	return err
+}
+
+// makeCampStatusEvent makes a campaign status webhook payload from
+// the campaign manager's status notification data.
+func makeCampStatusEvent(data interface{}) (campStatusEvent, error) {
+	d, ok := data.(map[string]interface{})
+	if !ok {
+		return campStatusEvent{}, fmt.Errorf("unknown campaign notification data: %T", data)
+	}
+
+	var out campStatusEvent
+	out.ID, _ = d["ID"].(int)
+	out.Name, _ = d["Name"].(string)
+	out.Status, _ = d["Status"].(string)
+	out.Sent, _ = d["Sent"].(int)
+	out.ToSend, _ = d["ToSend"].(int)
+	out.Reason, _ = d["Reason"].(string)
+
+	return out, nil
+}
@@ -10,7 +10,8 @@ describe('Bounces', () => {
     cy.get('.b-tabs nav a').eq(5).click();
     cy.get('[data-cy=btn-enable-bounce] .switch').click();
     cy.get('[data-cy=btn-enable-bounce-webhook] .switch').click();
-    cy.get('[data-cy=btn-bounce-count] .plus').click();
+    cy.get('[data-cy=btn-bounce-count-hard] .plus').click();
+    cy.get('[data-cy=btn-bounce-count-hard] .plus').click();
 
     cy.get('[data-cy=btn-save]').click();
     cy.wait(1000);
@@ -71,6 +71,13 @@ http.interceptors.response.use((resp) => {
     store.commit('setLoading', { model: err.config.loading, status: false });
   }
 
+  // The session has expired or is invalid. Send the user to the login page.
+  if (err.response && err.response.status === 401) {
+    const next = encodeURIComponent(document.location.pathname + document.location.search);
+    document.location.href = `${http.defaults.baseURL.replace(/\/$/, '')}/admin/login?next=${next}`;
+    return Promise.reject(err);
+  }
+
   let msg = '';
   if (err.response.data && err.response.data.message) {
     msg = err.response.data.message;
@@ -196,6 +203,15 @@ export const stopImport = () => http.delete('/api/import/subscribers');
 export const getBounces = async (params) => http.get('/api/bounces',
   { params, loading: models.bounces });
 
+export const getFailedBounces = async (params) => http.get('/api/bounces/failed',
+  { params, loading: models.bounces });
+
+export const replayFailedBounces = async (params) => http.put('/api/bounces/failed/replay', {},
+  { params, loading: models.bounces });
+
+export const deleteFailedBounces = async (params) => http.delete('/api/bounces/failed',
+  { params, loading: models.bounces });
+
 // Campaigns.
 export const getCampaigns = async (params) => http.get('/api/campaigns', {
   params,
@@ -241,6 +257,23 @@ export const changeCampaignStatus = async (id, status) => http.put(`/api/campaig
 export const deleteCampaign = async (id) => http.delete(`/api/campaigns/${id}`,
   { loading: models.campaigns });
 
+export const getCampaignWaves = async (id) => http.get(`/api/campaigns/${id}/waves`,
+  { loading: models.campaigns });
+
+export const getCampaignRuns = async (id) => http.get(`/api/campaigns/${id}/runs`,
+  { loading: models.campaigns });
+
+export const getCampaignFailures = async (id, params) => http.get(`/api/campaigns/${id}/failures`,
+  { params, loading: models.campaigns });
+
+export const requeueCampaignFailures = async (id, params) => http.put(
+  `/api/campaigns/${id}/failures/requeue`, {}, { params, loading: models.campaigns },
+);
+
+export const deleteCampaignFailures = async (id, params) => http.delete(
+  `/api/campaigns/${id}/failures`, { params, loading: models.campaigns },
+);
+
 // Media.
 export const getMedia = async () => http.get('/api/media',
   { loading: models.media, store: models.media });
@@ -277,12 +310,15 @@ export const getSettings = async () => http.get('/api/settings',
 export const updateSettings = async (data) => http.put('/api/settings', data,
   { loading: models.settings });
 
+export const getDKIMRecords = async () => http.get('/api/settings/dkim',
+  { loading: models.settings, camelCase: false });
+
 export const getLogs = async () => http.get('/api/logs',
   { loading: models.logs, camelCase: false });
 
 export const getLang = async (lang) => http.get(`/api/lang/${lang}`,
   { loading: models.lang, camelCase: false });
 
-export const logout = async () => http.get('/api/logout', {
+export const logout = async () => http.post('/api/logout', {}, {
   auth: { username: 'wrong', password: 'wrong' },
 });
@@ -1,6 +1,7 @@
 package bounce
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 	"time"
@@ -8,6 +9,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/listmonk/internal/bounce/mailbox"
 	"github.com/knadh/listmonk/internal/bounce/webhooks"
+	"github.com/knadh/listmonk/internal/metrics"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
 )
@@ -19,16 +21,56 @@ const (
 	campID = "X-Listmonk-Campaign"
 )
 
+const (
+	// pendingBatchSize is the number of staged bounces that are processed at a time.
+	pendingBatchSize = 100
+
+	// pendingLease is the duration for which a batch of staged bounces that
+	// is picked up for processing is hidden from other processors.
+	pendingLease = time.Minute * 5
+
+	// pendingPollInterval is the interval at which staged bounces are checked
+	// for in the absence of new ones.
+	pendingPollInterval = time.Second * 10
+
+	// maxAttempts is the number of times recording a staged bounce is attempted
+	// before it's moved to the dead-letter (failed) state.
+	maxAttempts = 5
+)
+
+var errNoSubscriber = errors.New("bounced subscriber not found")
+
+var bouncesRecorded = metrics.NewCounter("listmonk_bounces_recorded_total",
+	"Number of bounces recorded.", "source", "type")
+
 // Mailbox represents a POP/IMAP mailbox client that can scan messages and pass
-// them to a given channel.
+// them to a given record function.
 type Mailbox interface {
-	Scan(limit int, ch chan models.Bounce) error
+	Scan(limit int, record func(models.Bounce) error) error
+}
+
+// Actions that can be applied to subscribers on bounces.
+const (
+	ActionNone        = "none"
+	ActionUnsubscribe = "unsubscribe"
+	ActionBlocklist   = "blocklist"
+	ActionDelete      = "delete"
+)
+
+// Action represents the action to apply to a subscriber once the number
+// of their bounces of a particular type (soft, hard, complaint) reaches Count.
+type Action struct {
+	Count  int    `json:"count"`
+	Action string `json:"action"`
+
+	// If Days > 0, only the bounces in the last N days are counted.
+	Days int `json:"days"`
 }
 
 // Opt represents bounce processing options.
 type Opt struct {
-	BounceCount  int    `json:"count"`
-	BounceAction string `json:"action"`
+	// Actions are keyed by the bounce type.
+	Actions map[string]Action `json:"actions"`
 
 	MailboxEnabled  bool        `json:"mailbox_enabled"`
 	MailboxType     string      `json:"mailbox_type"`
@@ -37,32 +79,59 @@ type Opt struct {
 	SESEnabled      bool        `json:"ses_enabled"`
 	SendgridEnabled bool        `json:"sendgrid_enabled"`
 	SendgridKey     string      `json:"sendgrid_key"`
+
+	MailgunEnabled    bool   `json:"mailgun_enabled"`
+	MailgunKey        string `json:"mailgun_key"`
+	PostmarkEnabled   bool   `json:"postmark_enabled"`
+	PostmarkUsername  string `json:"postmark_username"`
+	PostmarkPassword  string `json:"postmark_password"`
+	SparkPostEnabled  bool   `json:"sparkpost_enabled"`
+	SparkPostUsername string `json:"sparkpost_username"`
+	SparkPostPassword string `json:"sparkpost_password"`
 }
 
 // Manager handles e-mail bounces.
 type Manager struct {
-	queue    chan models.Bounce
-	mailbox  Mailbox
-	SES      *webhooks.SES
-	Sendgrid *webhooks.Sendgrid
-	queries  *Queries
-	opt      Opt
-	log      *log.Logger
+	notify    chan bool
+	mailbox   Mailbox
+	SES       *webhooks.SES
+	Sendgrid  *webhooks.Sendgrid
+	Mailgun   *webhooks.Mailgun
+	Postmark  *webhooks.Postmark
+	SparkPost *webhooks.SparkPost
+	queries   *Queries
+	opt       Opt
+	recordCB  func(models.Bounce, []models.Subscriber)
+	log       *log.Logger
 }
 
 // Queries contains the queries.
 type Queries struct {
-	DB          *sqlx.DB
-	RecordQuery *sqlx.Stmt
+	DB                 *sqlx.DB
+	RecordQuery        *sqlx.Stmt
+	InsertPendingQuery *sqlx.Stmt
+	NextPendingQuery   *sqlx.Stmt
+	UpdatePendingQuery *sqlx.Stmt
+	DeletePendingQuery *sqlx.Stmt
 }
 
-// New returns a new instance of the bounce manager.
-func New(opt Opt, q *Queries, lo *log.Logger) (*Manager, error) {
+// pendingBounce is a bounce that's staged in the DB for processing.
+type pendingBounce struct {
+	ID       int64  `db:"id"`
+	Payload  []byte `db:"payload"`
+	Attempts int    `db:"attempts"`
+}
+
+// New returns a new instance of the bounce manager. recordCB, if set, is
+// called with every bounce that's successfully recorded, along with the
+// subscribers that were deleted by the bounce's action, if any.
+func New(opt Opt, q *Queries, recordCB func(models.Bounce, []models.Subscriber), lo *log.Logger) (*Manager, error) {
 	m := &Manager{
-		opt:     opt,
-		queries: q,
-		queue:   make(chan models.Bounce, 1000),
-		log:     lo,
+		opt:      opt,
+		queries:  q,
+		notify:   make(chan bool, 1),
+		recordCB: recordCB,
+		log:      lo,
 	}
 
 	// Is there a mailbox?
@@ -70,6 +139,11 @@ func New(opt Opt, q *Queries, lo *log.Logger) (*Manager, error) {
 		switch opt.MailboxType {
 		case "pop":
 			m.mailbox = mailbox.NewPOP(opt.Mailbox)
+		case "imap":
+			if opt.Mailbox.ProcessedAction == mailbox.ActionMove && opt.Mailbox.ProcessedFolder == "" {
+				return nil, errors.New("no folder to move processed bounce e-mails to")
+			}
+			m.mailbox = mailbox.NewIMAP(opt.Mailbox)
 		default:
 			return nil, errors.New("unknown bounce mailbox type")
 		}
@@ -87,66 +161,175 @@ func New(opt Opt, q *Queries, lo *log.Logger) (*Manager, error) {
 				m.Sendgrid = sg
 			}
 		}
+		if opt.MailgunEnabled {
+			mg, err := webhooks.NewMailgun(opt.MailgunKey)
+			if err != nil {
+				lo.Printf("error initializing mailgun webhooks: %v", err)
+			} else {
+				m.Mailgun = mg
+			}
+		}
+		if opt.PostmarkEnabled {
+			pm, err := webhooks.NewPostmark(opt.PostmarkUsername, opt.PostmarkPassword)
+			if err != nil {
+				lo.Printf("error initializing postmark webhooks: %v", err)
+			} else {
+				m.Postmark = pm
+			}
+		}
+		if opt.SparkPostEnabled {
+			sp, err := webhooks.NewSparkPost(opt.SparkPostUsername, opt.SparkPostPassword)
+			if err != nil {
+				lo.Printf("error initializing sparkpost webhooks: %v", err)
+			} else {
+				m.SparkPost = sp
+			}
+		}
 	}
 
 	return m, nil
 }
 
-// Run is a blocking function that listens for bounce events from webhooks and or mailboxes
-// and executes them on the DB.
+// Run is a blocking function that processes the bounces that are staged in the DB
+// by webhooks and or mailboxes and executes them on the DB.
 func (m *Manager) Run() {
 	if m.opt.MailboxEnabled {
 		go m.runMailboxScanner()
 	}
 
+	t := time.NewTicker(pendingPollInterval)
+	defer t.Stop()
+
 	for {
 		select {
-		case b, ok := <-m.queue:
-			if !ok {
-				return
-			}
+		case <-m.notify:
+		case <-t.C:
+		}
 
-			date := b.CreatedAt
-			if date.IsZero() {
-				date = time.Now()
-			}
+		// Process staged bounces until there are none left that are due.
+		for m.processPending() > 0 {
+		}
+	}
+}
 
-			_, err := m.queries.RecordQuery.Exec(b.SubscriberUUID,
-				b.Email,
-				b.CampaignUUID,
-				b.Type,
-				b.Source,
-				b.Meta,
-				date,
-				m.opt.BounceCount,
-				m.opt.BounceAction)
-			if err != nil {
-				// Ignore the error if it complained of no subscriber.
-				if pqErr, ok := err.(*pq.Error); ok && pqErr.Column == "subscriber_id" {
-					m.log.Printf("bounced subscriber (%s / %s) not found", b.SubscriberUUID, b.Email)
-					continue
-				}
-				m.log.Printf("error recording bounce: %v", err)
+// Record stages a new bounce event given the subscriber's email or UUID in the DB
+// for it to be processed asynchronously.
+func (m *Manager) Record(b models.Bounce) error {
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = time.Now()
+	}
+	if len(b.Meta) == 0 {
+		b.Meta = json.RawMessage("{}")
+	}
+
+	p, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if _, err := m.queries.InsertPendingQuery.Exec(p, b.Source); err != nil {
+		return err
+	}
+
+	// Wake up the processor.
+	select {
+	case m.notify <- true:
+	default:
+	}
+
+	return nil
+}
+
+// processPending fetches a batch of staged bounces that are due, records them,
+// and returns the number of bounces that were fetched. Bounces that fail are
+// retried with a backoff and after maxAttempts, or if they're unresolvable,
+// are moved to the dead-letter (failed) state.
+func (m *Manager) processPending() int {
+	var items []pendingBounce
+	if err := m.queries.NextPendingQuery.Select(&items, pendingBatchSize, pendingLease.Seconds()); err != nil {
+		m.log.Printf("error fetching pending bounces: %v", err)
+		return 0
+	}
+
+	for _, p := range items {
+		var b models.Bounce
+		if err := json.Unmarshal(p.Payload, &b); err != nil {
+			m.log.Printf("error unmarshalling pending bounce: %v", err)
+			m.updatePending(p, err, true)
+			continue
+		}
+
+		deleted, err := m.record(b)
+		if err != nil {
+			// Unresolvable bounces are not retried.
+			failed := p.Attempts+1 >= maxAttempts || errors.Is(err, errNoSubscriber)
+			if failed {
+				m.log.Printf("error recording bounce (%s / %s): %v", b.SubscriberUUID, b.Email, err)
 			}
+			m.updatePending(p, err, failed)
+			continue
+		}
+
+		if _, err := m.queries.DeletePendingQuery.Exec(p.ID); err != nil {
+			m.log.Printf("error deleting pending bounce: %v", err)
+		}
+
+		bouncesRecorded.Inc(b.Source, b.Type)
+		if m.recordCB != nil {
+			m.recordCB(b, deleted)
 		}
 	}
+
+	return len(items)
+}
+
+// updatePending records a failed attempt on a staged bounce. If failed is true,
+// it's moved to the dead-letter state, or else, it's retried with an exponential backoff.
+func (m *Manager) updatePending(p pendingBounce, err error, failed bool) {
+	attempts := p.Attempts + 1
+	wait := time.Minute * time.Duration(1<<uint(attempts-1))
+
+	if _, err := m.queries.UpdatePendingQuery.Exec(p.ID, attempts, err.Error(), failed, wait.Seconds()); err != nil {
+		m.log.Printf("error updating pending bounce: %v", err)
+	}
+}
+
+// record records a bounce and applies the action of its type on the DB.
+// It returns the subscribers that were deleted by the action, if any.
+func (m *Manager) record(b models.Bounce) ([]models.Subscriber, error) {
+	act, ok := m.opt.Actions[b.Type]
+	if !ok {
+		act = Action{Count: 1, Action: ActionNone}
+	}
+
+	var deleted []models.Subscriber
+	err := m.queries.RecordQuery.Select(&deleted, b.SubscriberUUID,
+		b.Email,
+		b.CampaignUUID,
+		b.Type,
+		b.Source,
+		b.Meta,
+		b.CreatedAt,
+		act.Count,
+		act.Action,
+		act.Days)
+	if err != nil {
+		// The query complains of a NULL subscriber if there's no subscriber.
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Column == "subscriber_id" {
+			return nil, errNoSubscriber
+		}
+		return nil, err
+	}
+
+	return deleted, nil
 }
 
 // runMailboxScanner runs a blocking loop that scans the mailbox at given intervals.
 func (m *Manager) runMailboxScanner() {
 	for {
-		if err := m.mailbox.Scan(1000, m.queue); err != nil {
+		if err := m.mailbox.Scan(1000, m.Record); err != nil {
 			m.log.Printf("error scanning bounce mailbox: %v", err)
 		}
 
 		time.Sleep(m.opt.Mailbox.ScanInterval)
 	}
 }
-
-// Record records a new bounce event given the subscriber's email or UUID.
-func (m *Manager) Record(b models.Bounce) error {
-	select {
-	case m.queue <- b:
-	}
-	return nil
-}
@@ -0,0 +1,44 @@
+package mailbox
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+// arf represents the relevant fields of an RFC 5965 (ARF) feedback report
+// that ISP feedback loops send when a recipient marks a message as spam.
+type arf struct {
+	FeedbackType     string `json:"feedback_type,omitempty"`
+	UserAgent        string `json:"user_agent,omitempty"`
+	OriginalMailFrom string `json:"original_mail_from,omitempty"`
+	OriginalRcptTo   string `json:"original_rcpt_to,omitempty"`
+	ArrivalDate      string `json:"arrival_date,omitempty"`
+	ReportingMTA     string `json:"reporting_mta,omitempty"`
+	SourceIP         string `json:"source_ip,omitempty"`
+}
+
+// parseFeedbackReport parses the body of a message/feedback-report part.
+func parseFeedbackReport(r io.Reader) (arf, bool) {
+	h, _ := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if h.Get("Feedback-Type") == "" {
+		return arf{}, false
+	}
+
+	return arf{
+		FeedbackType:     strings.ToLower(strings.TrimSpace(h.Get("Feedback-Type"))),
+		UserAgent:        strings.TrimSpace(h.Get("User-Agent")),
+		OriginalMailFrom: strings.TrimSpace(h.Get("Original-Mail-From")),
+		OriginalRcptTo:   strings.TrimSpace(h.Get("Original-Rcpt-To")),
+		ArrivalDate:      strings.TrimSpace(h.Get("Arrival-Date")),
+		ReportingMTA:     stripDSNType(h.Get("Reporting-MTA")),
+		SourceIP:         strings.TrimSpace(h.Get("Source-IP")),
+	}, true
+}
+
+// isComplaint returns false for reports that aren't complaints,
+// eg: "not-spam" reports.
+func (a arf) isComplaint() bool {
+	return a.FeedbackType != "not-spam"
+}
@@ -0,0 +1,105 @@
+package mailbox
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// dsn represents the relevant per-recipient fields of an RFC 3464
+// delivery status notification.
+type dsn struct {
+	FinalRecipient    string `json:"final_recipient,omitempty"`
+	OriginalRecipient string `json:"original_recipient,omitempty"`
+	Action            string `json:"action,omitempty"`
+	Status            string `json:"status,omitempty"`
+	DiagnosticCode    string `json:"diagnostic_code,omitempty"`
+	RemoteMTA         string `json:"remote_mta,omitempty"`
+	ReportingMTA      string `json:"reporting_mta,omitempty"`
+}
+
+// parseDeliveryStatus parses the body of a message/delivery-status part,
+// which is a block of per-message fields followed by one or more blocks of
+// per-recipient fields separated by blank lines. If there are several
+// recipients, the first one that failed is picked.
+func parseDeliveryStatus(r io.Reader) (dsn, bool) {
+	var (
+		tp     = textproto.NewReader(bufio.NewReader(r))
+		msg    textproto.MIMEHeader
+		rcpts  []textproto.MIMEHeader
+		blocks = 0
+	)
+	for {
+		h, err := tp.ReadMIMEHeader()
+		if len(h) > 0 {
+			if blocks == 0 {
+				msg = h
+			} else {
+				rcpts = append(rcpts, h)
+			}
+			blocks++
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Some MTAs skip the per-message block and put everything in a single block.
+	if len(rcpts) == 0 && msg != nil && msg.Get("Final-Recipient") != "" {
+		rcpts = append(rcpts, msg)
+	}
+	if len(rcpts) == 0 {
+		return dsn{}, false
+	}
+
+	rcpt := rcpts[0]
+	for _, h := range rcpts {
+		if strings.EqualFold(strings.TrimSpace(h.Get("Action")), "failed") {
+			rcpt = h
+			break
+		}
+	}
+
+	out := dsn{
+		FinalRecipient:    stripDSNType(rcpt.Get("Final-Recipient")),
+		OriginalRecipient: stripDSNType(rcpt.Get("Original-Recipient")),
+		Action:            strings.ToLower(strings.TrimSpace(rcpt.Get("Action"))),
+		Status:            strings.TrimSpace(rcpt.Get("Status")),
+		DiagnosticCode:    stripDSNType(rcpt.Get("Diagnostic-Code")),
+		RemoteMTA:         stripDSNType(rcpt.Get("Remote-MTA")),
+	}
+	if msg != nil {
+		out.ReportingMTA = stripDSNType(msg.Get("Reporting-MTA"))
+	}
+
+	return out, true
+}
+
+// isBounce returns true if the DSN reports a failed delivery. Delays are
+// still being retried by the MTA, and successful deliveries, relays and
+// expansions aren't failures.
+func (d dsn) isBounce() bool {
+	return d.Action == "failed"
+}
+
+// bounceType classifies the DSN as a soft or hard bounce. Status codes
+// 4.x.x are transient failures (full mailboxes, greylisting etc.) and 5.x.x
+// are permanent ones. Failures without a status code are hard bounces.
+func (d dsn) bounceType() string {
+	if strings.HasPrefix(d.Status, "4") {
+		return models.BounceTypeSoft
+	}
+	return models.BounceTypeHard
+}
+
+// stripDSNType strips the type prefix from DSN fields of the form
+// "type; value", eg: "rfc822; user@example.com" or "smtp; 550 5.1.1 ...".
+func stripDSNType(s string) string {
+	if i := strings.Index(s, ";"); i >= 0 {
+		s = s[i+1:]
+	}
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,174 @@
+package mailbox
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/knadh/listmonk/models"
+)
+
+// IMAP represents an IMAP mailbox.
+type IMAP struct {
+	opt Opt
+}
+
+// NewIMAP returns a new instance of the IMAP mailbox client.
+func NewIMAP(opt Opt) *IMAP {
+	if opt.Folder == "" {
+		opt.Folder = "INBOX"
+	}
+	if opt.ProcessedAction == "" {
+		opt.ProcessedAction = ActionDelete
+	}
+
+	return &IMAP{
+		opt: opt,
+	}
+}
+
+// Scan scans the IMAP folder and passes the downloaded messages to the given
+// record function. Up to limit messages are downloaded, or all of them if
+// limit is 0. The messages that are recorded or aren't bounces are deleted,
+// flagged as seen, or moved to another folder depending on the configuration.
+// Messages that can't be parsed are flagged (\Flagged) and skipped in later
+// scans, and messages that fail to be recorded are left to be retried in the
+// next scan.
+func (m *IMAP) Scan(limit int, record func(models.Bounce) error) error {
+	c, err := m.connect()
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	// Authenticate.
+	if m.opt.AuthProtocol != "none" {
+		if err := c.Login(m.opt.Username, m.opt.Password); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.Select(m.opt.Folder, false); err != nil {
+		return err
+	}
+
+	// Messages that have been flagged as seen have already been processed,
+	// and flagged messages are the ones that couldn't be parsed.
+	crit := imap.NewSearchCriteria()
+	crit.WithoutFlags = []string{imap.DeletedFlag, imap.FlaggedFlag}
+	if m.opt.ProcessedAction == ActionSeen {
+		crit.WithoutFlags = append(crit.WithoutFlags, imap.SeenFlag)
+	}
+
+	uids, err := c.UidSearch(crit)
+	if err != nil {
+		return err
+	}
+
+	// No messages.
+	if len(uids) == 0 {
+		return nil
+	}
+
+	if limit > 0 && len(uids) > limit {
+		uids = uids[:limit]
+	}
+
+	set := new(imap.SeqSet)
+	set.AddNum(uids...)
+
+	// Download messages without implicitly flagging them as seen.
+	var (
+		section = &imap.BodySectionName{Peek: true}
+		msgs    = make(chan *imap.Message, 10)
+		done    = make(chan error, 1)
+	)
+	go func() {
+		done <- c.UidFetch(set, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, msgs)
+	}()
+
+	var (
+		processed = new(imap.SeqSet)
+		bad       = new(imap.SeqSet)
+		errs      scanErrors
+	)
+	for msg := range msgs {
+		r := msg.GetBody(section)
+		if r == nil {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+
+		bn, ok, err := parseBounce(b, m.opt.Host)
+		if err != nil {
+			bad.AddNum(msg.Uid)
+			errs.add(fmt.Errorf("error parsing message %d: %v", msg.Uid, err))
+			continue
+		}
+		if ok {
+			if err := record(bn); err != nil {
+				errs.add(err)
+				continue
+			}
+		}
+		processed.AddNum(msg.Uid)
+	}
+	if err := <-done; err != nil {
+		errs.add(err)
+	}
+
+	if !bad.Empty() {
+		if err := c.UidStore(bad, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.FlaggedFlag}, nil); err != nil {
+			errs.add(err)
+		}
+	}
+
+	// Process the downloaded messages.
+	if !processed.Empty() {
+		if err := m.process(c, processed); err != nil {
+			return err
+		}
+	}
+
+	return errs.err()
+}
+
+// process deletes, flags as seen, or moves the processed messages depending
+// on the configuration.
+func (m *IMAP) process(c *client.Client, set *imap.SeqSet) error {
+	switch m.opt.ProcessedAction {
+	case ActionSeen:
+		return c.UidStore(set, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag}, nil)
+	case ActionMove:
+		return c.UidMove(set, m.opt.ProcessedFolder)
+	default:
+		if err := c.UidStore(set, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+			return err
+		}
+		return c.Expunge(nil)
+	}
+}
+
+// connect connects to the IMAP server.
+func (m *IMAP) connect() (*client.Client, error) {
+	addr := fmt.Sprintf("%s:%d", m.opt.Host, m.opt.Port)
+	if !m.opt.TLSEnabled {
+		return client.Dial(addr)
+	}
+
+	tlsCfg := &tls.Config{}
+	if m.opt.TLSSkipVerify {
+		tlsCfg.InsecureSkipVerify = m.opt.TLSSkipVerify
+	} else {
+		tlsCfg.ServerName = m.opt.Host
+	}
+
+	return client.DialTLS(addr, tlsCfg)
+}
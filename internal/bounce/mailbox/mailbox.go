@@ -0,0 +1,193 @@
+package mailbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"time"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/knadh/listmonk/models"
+)
+
+var (
+	reCampUUID = regexp.MustCompile(`(?m)(?m:^` + models.EmailHeaderCampaignUUID + `:\s+?)([a-z0-9\-]{36})`)
+	reSubUUID  = regexp.MustCompile(`(?m)(?m:^` + models.EmailHeaderSubscriberUUID + `:\s+?)([a-z0-9\-]{36})`)
+)
+
+// report represents the machine readable parts of a multipart/report
+// message; either an RFC 3464 delivery status notification or an
+// RFC 5965 (ARF) feedback report, along with the headers of the
+// original message that's attached to them.
+type report struct {
+	dsn *dsn
+	arf *arf
+
+	campUUID string
+	subUUID  string
+}
+
+// scanErrors collects the errors of the messages in a mailbox scan that can't
+// be processed so that they don't hold up the rest of the messages.
+type scanErrors struct {
+	n     int
+	first error
+}
+
+func (e *scanErrors) add(err error) {
+	if e.first == nil {
+		e.first = err
+	}
+	e.n++
+}
+
+func (e *scanErrors) err() error {
+	switch e.n {
+	case 0:
+		return nil
+	case 1:
+		return e.first
+	}
+	return fmt.Errorf("%d messages couldn't be processed: %v", e.n, e.first)
+}
+
+// parseBounce parses a raw bounce e-mail into a Bounce. The bool is false if
+// the message doesn't carry the campaign and subscriber identifiers.
+func parseBounce(b []byte, source string) (models.Bounce, bool, error) {
+	// Parse the message.
+	m, err := message.Read(bytes.NewReader(b))
+	if err != nil {
+		return models.Bounce{}, false, err
+	}
+
+	// Check if the identifiers are available in the parsed message.
+	var (
+		campUUID = m.Header.Get(models.EmailHeaderCampaignUUID)
+		subUUID  = m.Header.Get(models.EmailHeaderSubscriberUUID)
+		rep      = parseReport(m)
+	)
+
+	// If they are not, look for them in the original message that's attached
+	// to the report, and failing that, try to extract them from the message body.
+	if campUUID == "" {
+		campUUID = rep.campUUID
+	}
+	if subUUID == "" {
+		subUUID = rep.subUUID
+	}
+	if campUUID == "" {
+		if u := reCampUUID.FindSubmatch(b); len(u) == 2 {
+			campUUID = string(u[1])
+		}
+	}
+	if subUUID == "" {
+		if u := reSubUUID.FindSubmatch(b); len(u) == 2 {
+			subUUID = string(u[1])
+		}
+	}
+
+	if campUUID == "" || subUUID == "" {
+		return models.Bounce{}, false, nil
+	}
+
+	date, _ := time.Parse("Mon, 02 Jan 2006 15:04:05 -0700", m.Header.Get("Date"))
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	// Feedback reports are complaints. Delivery status notifications are
+	// classified by their status codes. Messages that are neither are
+	// treated as hard bounces.
+	typ := models.BounceTypeHard
+	switch {
+	case rep.arf != nil:
+		if !rep.arf.isComplaint() {
+			return models.Bounce{}, false, nil
+		}
+		typ = models.BounceTypeComplaint
+	case rep.dsn != nil:
+		// Not a failure (eg: a delivery receipt or a delay).
+		if !rep.dsn.isBounce() {
+			return models.Bounce{}, false, nil
+		}
+		typ = rep.dsn.bounceType()
+	}
+
+	// Additional bounce e-mail metadata.
+	meta, _ := json.Marshal(struct {
+		From        string   `json:"from"`
+		Subject     string   `json:"subject"`
+		MessageID   string   `json:"message_id"`
+		DeliveredTo string   `json:"delivered_to"`
+		Received    []string `json:"received"`
+		DSN         *dsn     `json:"dsn,omitempty"`
+		ARF         *arf     `json:"arf,omitempty"`
+	}{
+		From:        m.Header.Get("From"),
+		Subject:     m.Header.Get("Subject"),
+		MessageID:   m.Header.Get("Message-Id"),
+		DeliveredTo: m.Header.Get("Delivered-To"),
+		Received:    m.Header.Map()["Received"],
+		DSN:         rep.dsn,
+		ARF:         rep.arf,
+	})
+
+	return models.Bounce{
+		Type:           typ,
+		CampaignUUID:   campUUID,
+		SubscriberUUID: subUUID,
+		Source:         source,
+		CreatedAt:      date,
+		Meta:           json.RawMessage(meta),
+	}, true, nil
+}
+
+// parseReport walks a message looking for the parts of a multipart/report
+// (delivery status or feedback report) and the original message that's
+// attached to it. Walking consumes the message body.
+func parseReport(m *message.Entity) report {
+	var out report
+
+	m.Walk(func(path []int, e *message.Entity, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		ct, _, _ := e.Header.ContentType()
+		switch ct {
+		case "message/delivery-status", "message/global-delivery-status":
+			if out.dsn != nil {
+				return nil
+			}
+			if d, ok := parseDeliveryStatus(e.Body); ok {
+				out.dsn = &d
+			}
+
+		case "message/feedback-report":
+			if out.arf != nil {
+				return nil
+			}
+			if a, ok := parseFeedbackReport(e.Body); ok {
+				out.arf = &a
+			}
+
+		case "message/rfc822", "text/rfc822-headers", "message/rfc822-headers":
+			// The original message (or just its headers), which has the identifiers.
+			h, _ := textproto.NewReader(bufio.NewReader(e.Body)).ReadMIMEHeader()
+			if out.campUUID == "" {
+				out.campUUID = h.Get(models.EmailHeaderCampaignUUID)
+			}
+			if out.subUUID == "" {
+				out.subUUID = h.Get(models.EmailHeaderSubscriberUUID)
+			}
+		}
+
+		return nil
+	})
+
+	return out
+}
@@ -0,0 +1,170 @@
+package mailbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	testCampUUID = "6b5d4c3e-2f1a-4b0c-9d8e-7f6a5b4c3d2e"
+	testSubUUID  = "1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d"
+)
+
+func TestParseBounce(t *testing.T) {
+	cases := []struct {
+		file    string
+		ok      bool
+		typ     string
+		subUUID string
+		date    string
+
+		// Expected fields of the DSN or ARF in the bounce's meta.
+		dsn *dsn
+		arf *arf
+	}{
+		{"hard.eml", true, models.BounceTypeHard, testSubUUID, "2022-05-03T10:00:05Z",
+			&dsn{
+				FinalRecipient:    "user@example.org",
+				OriginalRecipient: "user@example.org",
+				Action:            "failed",
+				Status:            "5.1.1",
+				DiagnosticCode:    "550 5.1.1 The email account that you tried to reach does not exist.",
+				RemoteMTA:         "mx.example.org",
+				ReportingMTA:      "mx.example.net",
+			}, nil},
+		{"soft.eml", true, models.BounceTypeSoft, "2b3c4d5e-6f7a-4b8c-9d0e-1f2a3b4c5d6e", "2022-05-04T06:30:00Z",
+			&dsn{
+				FinalRecipient: "full@example.org",
+				Action:         "failed",
+				Status:         "4.2.2",
+				DiagnosticCode: "452 4.2.2 Mailbox full",
+				ReportingMTA:   "mx.example.net",
+			}, nil},
+
+		// A single block with the per-message and per-recipient fields and no
+		// status code. Failures without a status code are hard bounces.
+		{"single-block.eml", true, models.BounceTypeHard, "3c4d5e6f-7a8b-4c9d-8e0f-2a3b4c5d6e7f", "2022-05-04T09:00:00Z",
+			&dsn{
+				FinalRecipient: "gone@example.org",
+				Action:         "failed",
+				ReportingMTA:   "mx.example.net",
+			}, nil},
+
+		{"complaint.eml", true, models.BounceTypeComplaint, testSubUUID, "2022-05-05T12:00:00Z",
+			nil, &arf{
+				FeedbackType:     "abuse",
+				UserAgent:        "SomeGenerator/1.0",
+				OriginalMailFrom: "<bounces@example.com>",
+				OriginalRcptTo:   "<user@example.org>",
+				ArrivalDate:      "Thu, 05 May 2022 11:00:00 +0000",
+				ReportingMTA:     "mail.example.org",
+				SourceIP:         "192.0.2.1",
+			}},
+
+		// Messages that aren't reports, with the identifiers in the body,
+		// are hard bounces.
+		{"plain.eml", true, models.BounceTypeHard, testSubUUID, "2022-05-04T08:30:00Z", nil, nil},
+
+		// Not bounces. Delays are still being retried by the MTA.
+		{"delivered.eml", false, "", "", "", nil, nil},
+		{"delayed.eml", false, "", "", "", nil, nil},
+		{"not-spam.eml", false, "", "", "", nil, nil},
+		{"no-ids.eml", false, "", "", "", nil, nil},
+	}
+
+	for _, c := range cases {
+		b, err := ioutil.ReadFile("testdata/" + c.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, ok, err := parseBounce(b, "test")
+		if err != nil {
+			t.Errorf("%s: %v", c.file, err)
+			continue
+		}
+		if ok != c.ok {
+			t.Errorf("%s: got ok %v, want %v", c.file, ok, c.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if out.Type != c.typ {
+			t.Errorf("%s: got type %s, want %s", c.file, out.Type, c.typ)
+		}
+		if out.CampaignUUID != testCampUUID || out.SubscriberUUID != c.subUUID {
+			t.Errorf("%s: got UUIDs %s, %s", c.file, out.CampaignUUID, out.SubscriberUUID)
+		}
+		if out.Source != "test" {
+			t.Errorf("%s: got source %s", c.file, out.Source)
+		}
+		if d := out.CreatedAt.UTC().Format(time.RFC3339); d != c.date {
+			t.Errorf("%s: got date %s, want %s", c.file, d, c.date)
+		}
+
+		var meta struct {
+			DSN *dsn `json:"dsn"`
+			ARF *arf `json:"arf"`
+		}
+		if err := json.Unmarshal(out.Meta, &meta); err != nil {
+			t.Fatalf("%s: invalid meta: %v", c.file, err)
+		}
+		if (meta.DSN == nil) != (c.dsn == nil) || (meta.DSN != nil && *meta.DSN != *c.dsn) {
+			t.Errorf("%s: got DSN %+v, want %+v", c.file, meta.DSN, c.dsn)
+		}
+		if (meta.ARF == nil) != (c.arf == nil) || (meta.ARF != nil && *meta.ARF != *c.arf) {
+			t.Errorf("%s: got ARF %+v, want %+v", c.file, meta.ARF, c.arf)
+		}
+	}
+}
+
+func TestBounceType(t *testing.T) {
+	cases := []struct {
+		action string
+		status string
+		typ    string
+		bounce bool
+	}{
+		{"failed", "5.1.1", models.BounceTypeHard, true},
+		{"failed", "5.7.1", models.BounceTypeHard, true},
+		{"failed", "4.4.7", models.BounceTypeSoft, true},
+		{"failed", "", models.BounceTypeHard, true},
+		{"delayed", "4.4.1", "", false},
+		{"delayed", "", "", false},
+		{"", "", "", false},
+		{"delivered", "2.0.0", "", false},
+		{"relayed", "", "", false},
+		{"expanded", "", "", false},
+	}
+	for _, c := range cases {
+		d := dsn{Action: c.action, Status: c.status}
+		if d.isBounce() != c.bounce {
+			t.Errorf("%s %s: got bounce %v", c.action, c.status, !c.bounce)
+			continue
+		}
+		if c.bounce && d.bounceType() != c.typ {
+			t.Errorf("%s %s: got %s, want %s", c.action, c.status, d.bounceType(), c.typ)
+		}
+	}
+}
+
+func TestParseDeliveryStatusInvalid(t *testing.T) {
+	for _, in := range []string{"", "\n\n", "Reporting-MTA: dns; mx.example.net\n"} {
+		if d, ok := parseDeliveryStatus(strings.NewReader(in)); ok {
+			t.Errorf("%q: got %+v", in, d)
+		}
+	}
+}
+
+func TestParseFeedbackReportInvalid(t *testing.T) {
+	if a, ok := parseFeedbackReport(strings.NewReader("User-Agent: x\n")); ok {
+		t.Errorf("got %+v without a feedback type", a)
+	}
+}
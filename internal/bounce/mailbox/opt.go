@@ -2,6 +2,13 @@ package mailbox
 
 import "time"
 
+// Actions on processed IMAP messages.
+const (
+	ActionDelete = "delete"
+	ActionSeen   = "seen"
+	ActionMove   = "move"
+)
+
 // Opt represents an e-mail POP/IMAP mailbox configuration.
 type Opt struct {
 	// Host is the server's hostname.
@@ -21,6 +28,12 @@ type Opt struct {
 	// Folder is the name of the IMAP folder to scan for e-mails.
 	Folder string `json:"folder"`
 
+	// ProcessedAction is what's done to scanned IMAP messages: delete them,
+	// flag them as seen, or move them to ProcessedFolder. POP messages
+	// are always deleted.
+	ProcessedAction string `json:"processed_action"`
+	ProcessedFolder string `json:"processed_folder"`
+
 	// Optional TLS settings.
 	TLSEnabled    bool `json:"tls_enabled"`
 	TLSSkipVerify bool `json:"tls_skip_verify"`
@@ -1,12 +1,8 @@
 package mailbox
 
 import (
-	"encoding/json"
-	"regexp"
-	"time"
+	"fmt"
 
-	"github.com/emersion/go-message"
-	_ "github.com/emersion/go-message/charset"
 	"github.com/knadh/go-pop3"
 	"github.com/knadh/listmonk/models"
 )
@@ -17,11 +13,6 @@ type POP struct {
 	client *pop3.Client
 }
 
-var (
-	reCampUUID = regexp.MustCompile(`(?m)(?m:^` + models.EmailHeaderCampaignUUID + `:\s+?)([a-z0-9\-]{36})`)
-	reSubUUID  = regexp.MustCompile(`(?m)(?m:^` + models.EmailHeaderSubscriberUUID + `:\s+?)([a-z0-9\-]{36})`)
-)
-
 // NewPOP returns a new instance of the POP mailbox client.
 func NewPOP(opt Opt) *POP {
 	return &POP{
@@ -35,10 +26,11 @@ func NewPOP(opt Opt) *POP {
 	}
 }
 
-// Scan scans the mailbox and pushes the downloaded messages into the given channel.
-// The messages that are downloaded are deleted from the server. If limit > 0,
-// all messages on the server are downloaded and deleted.
-func (p *POP) Scan(limit int, ch chan models.Bounce) error {
+// Scan scans the mailbox and passes the downloaded messages to the given record
+// function. Up to limit messages are downloaded, or all of them if limit is 0.
+// The messages that are recorded or aren't bounces are deleted from the server.
+// Messages that can't be parsed or recorded are skipped and left on the server.
+func (p *POP) Scan(limit int, record func(models.Bounce) error) error {
 	c, err := p.client.NewConn()
 	if err != nil {
 		return err
@@ -68,80 +60,38 @@ func (p *POP) Scan(limit int, ch chan models.Bounce) error {
 	}
 
 	// Download messages.
+	var (
+		processed []int
+		errs      scanErrors
+	)
 	for id := 1; id <= count; id++ {
 		// Retrieve the raw bytes of the message.
 		b, err := c.RetrRaw(id)
 		if err != nil {
-			return err
+			errs.add(err)
+			continue
 		}
 
-		// Parse the message.
-		m, err := message.Read(b)
+		bn, ok, err := parseBounce(b.Bytes(), p.opt.Host)
 		if err != nil {
-			return err
-		}
-
-		// Check if the identifiers are available in the parsed message.
-		var (
-			campUUID = m.Header.Get(models.EmailHeaderCampaignUUID)
-			subUUID  = m.Header.Get(models.EmailHeaderSubscriberUUID)
-		)
-
-		// If they are not, try to extract them from the message body.
-		if campUUID == "" {
-			if u := reCampUUID.FindSubmatch(b.Bytes()); len(u) == 2 {
-				campUUID = string(u[1])
-			}
-		}
-		if subUUID == "" {
-			if u := reSubUUID.FindSubmatch(b.Bytes()); len(u) == 2 {
-				subUUID = string(u[1])
-			}
-		}
-
-		if campUUID == "" || subUUID == "" {
+			errs.add(fmt.Errorf("error parsing message %d: %v", id, err))
 			continue
 		}
-
-		date, _ := time.Parse("Mon, 02 Jan 2006 15:04:05 -0700", m.Header.Get("Date"))
-		if date.IsZero() {
-			date = time.Now()
-		}
-
-		// Additional bounce e-mail metadata.
-		meta, _ := json.Marshal(struct {
-			From        string   `json:"from"`
-			Subject     string   `json:"subject"`
-			MessageID   string   `json:"message_id"`
-			DeliveredTo string   `json:"delivered_to"`
-			Received    []string `json:"received"`
-		}{
-			From:        m.Header.Get("From"),
-			Subject:     m.Header.Get("Subject"),
-			MessageID:   m.Header.Get("Message-Id"),
-			DeliveredTo: m.Header.Get("Delivered-To"),
-			Received:    m.Header.Map()["Received"],
-		})
-
-		select {
-		case ch <- models.Bounce{
-			Type:           "hard",
-			CampaignUUID:   campUUID,
-			SubscriberUUID: subUUID,
-			Source:         p.opt.Host,
-			CreatedAt:      date,
-			Meta:           json.RawMessage(meta),
-		}:
-		default:
+		if ok {
+			if err := record(bn); err != nil {
+				errs.add(err)
+				continue
+			}
 		}
+		processed = append(processed, id)
 	}
 
-	// Delete the downloaded messages.
-	for id := 1; id <= count; id++ {
+	// Delete the processed messages.
+	for _, id := range processed {
 		if err := c.Dele(id); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return errs.err()
 }
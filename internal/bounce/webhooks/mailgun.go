@@ -0,0 +1,167 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// mailgunMaxAge is the maximum age of a notification's signed timestamp.
+// Older notifications, and tokens that have already been seen within it,
+// are rejected to prevent signed payloads from being replayed.
+const mailgunMaxAge = time.Minute * 5
+
+type mailgunNotif struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+
+	EventData json.RawMessage `json:"event-data"`
+}
+
+type mailgunEvent struct {
+	Event     string  `json:"event"`
+	Severity  string  `json:"severity"`
+	Recipient string  `json:"recipient"`
+	Timestamp float64 `json:"timestamp"`
+	Message   struct {
+		Headers map[string]string `json:"headers"`
+	} `json:"message"`
+	UserVariables map[string]interface{} `json:"user-variables"`
+}
+
+// Mailgun handles Mailgun webhook notifications for failed (bounced)
+// and complained events.
+type Mailgun struct {
+	key []byte
+
+	// Tokens of the notifications received within mailgunMaxAge and the
+	// time at which they expire.
+	mut    sync.Mutex
+	tokens map[string]time.Time
+}
+
+// NewMailgun returns a new Mailgun instance. key is the HTTP webhook
+// signing key from the Mailgun dashboard.
+func NewMailgun(key string) (*Mailgun, error) {
+	if key == "" {
+		return nil, errors.New("empty mailgun webhook signing key")
+	}
+
+	return &Mailgun{
+		key:    []byte(key),
+		tokens: make(map[string]time.Time),
+	}, nil
+}
+
+// ProcessBounce processes a Mailgun webhook notification and returns a Bounce object.
+// The bool is false if the event is not a bounce or a complaint.
+func (m *Mailgun) ProcessBounce(b []byte) (models.Bounce, bool, error) {
+	var n mailgunNotif
+	if err := json.Unmarshal(b, &n); err != nil {
+		return models.Bounce{}, false, fmt.Errorf("error unmarshalling Mailgun notification: %v", err)
+	}
+
+	if err := m.verifyNotif(n); err != nil {
+		return models.Bounce{}, false, err
+	}
+
+	var e mailgunEvent
+	if err := json.Unmarshal(n.EventData, &e); err != nil {
+		return models.Bounce{}, false, fmt.Errorf("error unmarshalling Mailgun event: %v", err)
+	}
+
+	var typ string
+	switch e.Event {
+	case "failed":
+		typ = models.BounceTypeSoft
+		if e.Severity == "permanent" {
+			typ = models.BounceTypeHard
+		}
+	case "complained":
+		typ = models.BounceTypeComplaint
+	default:
+		return models.Bounce{}, false, nil
+	}
+
+	if e.Recipient == "" {
+		return models.Bounce{}, false, errors.New("no recipient found in Mailgun notification")
+	}
+
+	// The campaign UUID may be available as a custom (X-Mailgun-Variables) variable.
+	campUUID, _ := e.UserVariables["campaign_uuid"].(string)
+
+	var date time.Time
+	if e.Timestamp > 0 {
+		sec, frac := math.Modf(e.Timestamp)
+		date = time.Unix(int64(sec), int64(frac*1e9))
+	}
+
+	return models.Bounce{
+		Email:        strings.ToLower(e.Recipient),
+		CampaignUUID: campUUID,
+		Type:         typ,
+		Source:       "mailgun",
+		Meta:         n.EventData,
+		CreatedAt:    date,
+	}, true, nil
+}
+
+// verifyNotif verifies the HMAC-SHA256 signature of the timestamp and token
+// on a notification payload, and that it isn't stale or a replay.
+func (m *Mailgun) verifyNotif(n mailgunNotif) error {
+	sig, err := hex.DecodeString(n.Signature.Signature)
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+
+	h := hmac.New(sha256.New, m.key)
+	h.Write([]byte(n.Signature.Timestamp))
+	h.Write([]byte(n.Signature.Token))
+
+	if !hmac.Equal(h.Sum(nil), sig) {
+		return errors.New("invalid signature")
+	}
+
+	ts, err := strconv.ParseInt(n.Signature.Timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(ts, 0)); d > mailgunMaxAge || d < -mailgunMaxAge {
+		return errors.New("stale timestamp")
+	}
+
+	return m.checkToken(n.Signature.Token, now)
+}
+
+// checkToken records a notification token and errors if it has already been
+// seen. Expired tokens are cleared as they can't pass the timestamp check.
+func (m *Mailgun) checkToken(token string, now time.Time) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	for t, exp := range m.tokens {
+		if now.After(exp) {
+			delete(m.tokens, t)
+		}
+	}
+
+	if _, ok := m.tokens[token]; ok {
+		return errors.New("duplicate token")
+	}
+	m.tokens[token] = now.Add(mailgunMaxAge * 2)
+	return nil
+}
@@ -0,0 +1,97 @@
+package webhooks
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+type postmarkNotif struct {
+	RecordType string    `json:"RecordType"`
+	Type       string    `json:"Type"`
+	Email      string    `json:"Email"`
+	BouncedAt  time.Time `json:"BouncedAt"`
+	Metadata   struct {
+		CampaignUUID string `json:"campaign_uuid"`
+	} `json:"Metadata"`
+}
+
+// Postmark handles Postmark bounce and spam complaint webhook notifications.
+// Postmark doesn't sign its webhooks, so the requests are authenticated with
+// the HTTP BasicAuth credentials that are set on the webhook URL.
+type Postmark struct {
+	username string
+	password string
+}
+
+// NewPostmark returns a new Postmark instance.
+func NewPostmark(username, password string) (*Postmark, error) {
+	if username == "" || password == "" {
+		return nil, errors.New("empty postmark webhook username or password")
+	}
+
+	return &Postmark{username: username, password: password}, nil
+}
+
+// ProcessBounce processes a Postmark webhook notification and returns a Bounce object.
+// The bool is false if the notification is not a bounce or a complaint.
+func (p *Postmark) ProcessBounce(username, password string, b []byte) (models.Bounce, bool, error) {
+	if err := verifyBasicAuth(username, password, p.username, p.password); err != nil {
+		return models.Bounce{}, false, err
+	}
+
+	var n postmarkNotif
+	if err := json.Unmarshal(b, &n); err != nil {
+		return models.Bounce{}, false, fmt.Errorf("error unmarshalling Postmark notification: %v", err)
+	}
+
+	var typ string
+	switch n.RecordType {
+	case "Bounce":
+		switch n.Type {
+		case "HardBounce", "BadEmailAddress":
+			typ = models.BounceTypeHard
+		case "SoftBounce", "Transient", "DnsError", "Blocked":
+			typ = models.BounceTypeSoft
+		case "SpamComplaint":
+			typ = models.BounceTypeComplaint
+		default:
+			// Auto responders, address changes etc.
+			return models.Bounce{}, false, nil
+		}
+	case "SpamComplaint":
+		typ = models.BounceTypeComplaint
+	default:
+		return models.Bounce{}, false, nil
+	}
+
+	if n.Email == "" {
+		return models.Bounce{}, false, errors.New("no e-mail found in Postmark notification")
+	}
+
+	return models.Bounce{
+		Email:        strings.ToLower(n.Email),
+		CampaignUUID: n.Metadata.CampaignUUID,
+		Type:         typ,
+		Source:       "postmark",
+		Meta:         json.RawMessage(b),
+		CreatedAt:    n.BouncedAt,
+	}, true, nil
+}
+
+// verifyBasicAuth compares the HTTP BasicAuth credentials of a request
+// with the expected ones in constant time.
+func verifyBasicAuth(username, password, expUsername, expPassword string) error {
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(expUsername))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(expPassword))
+	if u&p != 1 {
+		return errors.New("invalid credentials")
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// sparkpostHardClasses are the SparkPost bounce classification codes that
+// are permanent failures. The others (soft, block, admin etc.) are treated
+// as soft bounces.
+// https://support.sparkpost.com/docs/deliverability/bounce-classification-codes
+var sparkpostHardClasses = map[string]bool{
+	"10": true, // Invalid recipient.
+	"30": true, // Generic bounce: no RCPT.
+	"90": true, // Unsubscribe.
+}
+
+type sparkpostNotif struct {
+	Msys struct {
+		MessageEvent json.RawMessage `json:"message_event"`
+	} `json:"msys"`
+}
+
+type sparkpostEvent struct {
+	Type        string `json:"type"`
+	BounceClass string `json:"bounce_class"`
+	RcptTo      string `json:"rcpt_to"`
+	Timestamp   string `json:"timestamp"`
+	RcptMeta    struct {
+		CampaignUUID string `json:"campaign_uuid"`
+	} `json:"rcpt_meta"`
+}
+
+// SparkPost handles SparkPost bounce, out of band bounce and spam complaint
+// webhook notifications. SparkPost webhooks are authenticated with the
+// HTTP BasicAuth credentials that are set on the webhook.
+type SparkPost struct {
+	username string
+	password string
+}
+
+// NewSparkPost returns a new SparkPost instance.
+func NewSparkPost(username, password string) (*SparkPost, error) {
+	if username == "" || password == "" {
+		return nil, errors.New("empty sparkpost webhook username or password")
+	}
+
+	return &SparkPost{username: username, password: password}, nil
+}
+
+// ProcessBounce processes a batch of SparkPost webhook notifications
+// and returns zero or more Bounce objects.
+func (s *SparkPost) ProcessBounce(username, password string, b []byte) ([]models.Bounce, error) {
+	if err := verifyBasicAuth(username, password, s.username, s.password); err != nil {
+		return nil, err
+	}
+
+	var notifs []sparkpostNotif
+	if err := json.Unmarshal(b, &notifs); err != nil {
+		return nil, fmt.Errorf("error unmarshalling SparkPost notification: %v", err)
+	}
+
+	out := make([]models.Bounce, 0, len(notifs))
+	for _, n := range notifs {
+		// Other event types (and the empty test ping) don't have a message_event.
+		if len(n.Msys.MessageEvent) == 0 {
+			continue
+		}
+
+		var e sparkpostEvent
+		if err := json.Unmarshal(n.Msys.MessageEvent, &e); err != nil {
+			return nil, fmt.Errorf("error unmarshalling SparkPost event: %v", err)
+		}
+
+		var typ string
+		switch e.Type {
+		case "bounce", "out_of_band":
+			typ = models.BounceTypeSoft
+			if sparkpostHardClasses[e.BounceClass] {
+				typ = models.BounceTypeHard
+			}
+		case "spam_complaint":
+			typ = models.BounceTypeComplaint
+		default:
+			continue
+		}
+
+		if e.RcptTo == "" {
+			continue
+		}
+
+		var date time.Time
+		if ts, _ := strconv.ParseInt(e.Timestamp, 10, 64); ts > 0 {
+			date = time.Unix(ts, 0)
+		}
+
+		out = append(out, models.Bounce{
+			Email:        strings.ToLower(e.RcptTo),
+			CampaignUUID: e.RcptMeta.CampaignUUID,
+			Type:         typ,
+			Source:       "sparkpost",
+			Meta:         n.Msys.MessageEvent,
+			CreatedAt:    date,
+		})
+	}
+
+	return out, nil
+}
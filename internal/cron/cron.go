@@ -0,0 +1,255 @@
+// Package cron parses standard five field cron expressions and computes
+// the times at which they occur. For example:
+//
+//	0 8 * * MON        every Monday at 08:00
+//	30 9 1,15 * *      on the 1st and the 15th of every month at 09:30
+//	0 */6 * * 1-5      every six hours on weekdays
+//
+// The fields are minute, hour, day of month, month and day of week. Each
+// field is a comma separated list of values, ranges (a-b) and wildcards (*),
+// optionally with a step (*/n, a-b/n, a/n). Months and days of the week can
+// be given by their three letter names. The macros @yearly (@annually),
+// @monthly, @weekly, @daily (@midnight) and @hourly are also supported.
+//
+// Like in the classic cron, if both the day of month and the day of week are
+// restricted (neither starts with a *), a day that matches either is a match.
+// Times are local times. Times that are skipped on switching to daylight
+// saving time don't occur, and times at fixed hours that repeat on switching
+// back occur once.
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	// Bitsets of the values of each field.
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	// Whether the day fields are unrestricted (start with a *).
+	domAny bool
+	dowAny bool
+}
+
+type field struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+// allHours is the bitset of the hour field that matches every hour.
+const allHours = 1<<24 - 1
+
+var (
+	fields = []field{
+		{name: "minute", min: 0, max: 59},
+		{name: "hour", min: 0, max: 23},
+		{name: "day of month", min: 1, max: 31},
+		{name: "month", min: 1, max: 12, names: map[string]int{
+			"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+			"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+		}},
+
+		// Both 0 and 7 are Sunday.
+		{name: "day of week", min: 0, max: 7, names: map[string]int{
+			"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+		}},
+	}
+
+	macros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// Parse parses a cron expression.
+func Parse(exp string) (*Schedule, error) {
+	exp = strings.TrimSpace(exp)
+	if m, ok := macros[strings.ToLower(exp)]; ok {
+		exp = m
+	}
+
+	parts := strings.Fields(exp)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("expected %d fields in the expression, got %d", len(fields), len(parts))
+	}
+
+	var sets [5]uint64
+	for i, p := range parts {
+		s, err := fields[i].parse(p)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = s
+	}
+
+	// Fold Sunday as 7 into 0.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] = (sets[4] | 1) &^ (1 << 7)
+	}
+
+	return &Schedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: strings.HasPrefix(parts[2], "*"),
+		dowAny: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// Next returns the first time the schedule occurs after t, in t's location.
+// A zero time is returned if the schedule never occurs, eg: on February 30.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !has(s.month, int(t.Month())) {
+			t = forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !s.matchDay(t) {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		// On switching back from daylight saving time, the local times of an
+		// hour repeat. Like in the classic cron, schedules at fixed hours only
+		// occur on the first pass.
+		if s.hour != allHours && isRepeated(t) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// forward returns n, or t an hour later if n isn't after t. That happens when n
+// falls in a gap in the local time, eg: on switching to daylight saving time,
+// and is normalized to an earlier time.
+func forward(t, n time.Time) time.Time {
+	if n.After(t) {
+		return n
+	}
+	return t.Add(time.Hour)
+}
+
+// isRepeated checks if the local time of t already occurred an hour earlier.
+func isRepeated(t time.Time) bool {
+	p := t.Add(-time.Hour)
+	return p.Day() == t.Day() && p.Hour() == t.Hour() && p.Minute() == t.Minute()
+}
+
+// matchDay checks if the day of t matches the day of month and day of week fields.
+func (s *Schedule) matchDay(t time.Time) bool {
+	var (
+		dom = has(s.dom, t.Day())
+		dow = has(s.dow, int(t.Weekday()))
+	)
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parse parses a field of an expression into a bitset of its values.
+func (f field) parse(exp string) (uint64, error) {
+	var out uint64
+	for _, item := range strings.Split(exp, ",") {
+		var (
+			rng  = item
+			step = 1
+		)
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %s: %s", f.name, item)
+			}
+			rng, step = item[:i], n
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			p := strings.SplitN(rng, "-", 2)
+
+			var err error
+			if lo, err = f.value(p[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(p[1]); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range in %s: %s", f.name, item)
+			}
+		default:
+			v, err := f.value(rng)
+			if err != nil {
+				return 0, err
+			}
+
+			// A single value with a step, eg: 5/10, runs to the end of the range.
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			out |= 1 << uint(v)
+		}
+	}
+
+	if out == 0 {
+		return 0, errors.New("empty " + f.name)
+	}
+	return out, nil
+}
+
+// value parses a single value of a field.
+func (f field) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s: %s", f.name, s)
+	}
+	return v, nil
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
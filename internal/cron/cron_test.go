@@ -0,0 +1,194 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		exp  string
+		want Schedule
+	}{
+		{"* * * * *", Schedule{minute: bits(0, 59, 1), hour: bits(0, 23, 1), dom: bits(1, 31, 1),
+			month: bits(1, 12, 1), dow: bits(0, 6, 1), domAny: true, dowAny: true}},
+		{"0 8 * * MON", Schedule{minute: 1, hour: 1 << 8, dom: bits(1, 31, 1),
+			month: bits(1, 12, 1), dow: 1 << 1, domAny: true}},
+		{"30 9 1,15 * *", Schedule{minute: 1 << 30, hour: 1 << 9, dom: 1<<1 | 1<<15,
+			month: bits(1, 12, 1), dow: bits(0, 6, 1), dowAny: true}},
+		{"*/15 */6 * * 1-5", Schedule{minute: bits(0, 59, 15), hour: bits(0, 23, 6), dom: bits(1, 31, 1),
+			month: bits(1, 12, 1), dow: bits(1, 5, 1), domAny: true}},
+		{"5/20 10-20/5 1-10/3 jan-MAR,Dec sun", Schedule{minute: bits(5, 59, 20), hour: bits(10, 20, 5),
+			dom: bits(1, 10, 3), month: bits(1, 3, 1) | 1<<12, dow: 1}},
+
+		// Sunday as 7 is folded into 0.
+		{"0 0 * * 7", Schedule{minute: 1, hour: 1, dom: bits(1, 31, 1), month: bits(1, 12, 1), dow: 1, domAny: true}},
+		{"0 0 * * 5-7", Schedule{minute: 1, hour: 1, dom: bits(1, 31, 1), month: bits(1, 12, 1),
+			dow: 1 | bits(5, 6, 1), domAny: true}},
+
+		{"@weekly", Schedule{minute: 1, hour: 1, dom: bits(1, 31, 1), month: bits(1, 12, 1), dow: 1, domAny: true}},
+		{" @Yearly ", Schedule{minute: 1, hour: 1, dom: 1 << 1, month: 1 << 1, dow: bits(0, 6, 1), dowAny: true}},
+	}
+
+	for _, c := range cases {
+		s, err := Parse(c.exp)
+		if err != nil {
+			t.Errorf("%s: %v", c.exp, err)
+			continue
+		}
+		if *s != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.exp, *s, c.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@every 5m",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"-1 * * * *",
+		"5-1 * * * *",
+		"1- * * * *",
+		"*/0 * * * *",
+		"*/-1 * * * *",
+		"*/x * * * *",
+		"1,,2 * * * *",
+		"* * * foo *",
+		"* * * * monday",
+		"* * * * MON-",
+		"a * * * *",
+	}
+	for _, c := range cases {
+		if _, err := Parse(c); err == nil {
+			t.Errorf("%q: expected error", c)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	cases := []struct {
+		exp  string
+		from string
+		next []string
+	}{
+		{"* * * * *", "2022-05-03T10:00:30Z", []string{"2022-05-03T10:01:00Z", "2022-05-03T10:02:00Z"}},
+		{"0 8 * * MON", "2022-05-03T10:00:00Z", []string{"2022-05-09T08:00:00Z", "2022-05-16T08:00:00Z"}},
+		{"30 9 1,15 * *", "2022-05-15T09:30:00Z", []string{"2022-06-01T09:30:00Z", "2022-06-15T09:30:00Z"}},
+		{"0 */6 * * 1-5", "2022-05-06T20:00:00Z", []string{"2022-05-09T00:00:00Z", "2022-05-09T06:00:00Z"}},
+		{"@monthly", "2022-12-15T00:00:00Z", []string{"2023-01-01T00:00:00Z", "2023-02-01T00:00:00Z"}},
+		{"0 0 29 2 *", "2022-01-01T00:00:00Z", []string{"2024-02-29T00:00:00Z", "2028-02-29T00:00:00Z"}},
+		{"0 0 31 * *", "2022-04-01T00:00:00Z", []string{"2022-05-31T00:00:00Z", "2022-07-31T00:00:00Z"}},
+
+		// If both day fields are restricted, either matches: the 13th or any
+		// Friday. 2022-05-13 is a Friday.
+		{"0 0 13 * FRI", "2022-05-01T00:00:00Z", []string{"2022-05-06T00:00:00Z", "2022-05-13T00:00:00Z",
+			"2022-05-20T00:00:00Z", "2022-05-27T00:00:00Z", "2022-06-03T00:00:00Z", "2022-06-10T00:00:00Z",
+			"2022-06-13T00:00:00Z"}},
+
+		// If either is a wildcard, both must match, even with a step.
+		{"0 0 13 * *", "2022-05-01T00:00:00Z", []string{"2022-05-13T00:00:00Z", "2022-06-13T00:00:00Z"}},
+		{"0 0 */2 * FRI", "2022-05-01T00:00:00Z", []string{"2022-05-13T00:00:00Z", "2022-05-27T00:00:00Z"}},
+		{"0 0 * * FRI", "2022-05-01T00:00:00Z", []string{"2022-05-06T00:00:00Z", "2022-05-13T00:00:00Z"}},
+
+		// Never occurs.
+		{"0 0 30 2 *", "2022-01-01T00:00:00Z", []string{""}},
+	}
+
+	for _, c := range cases {
+		s, err := Parse(c.exp)
+		if err != nil {
+			t.Fatalf("%s: %v", c.exp, err)
+		}
+
+		from := parseTime(t, c.from, time.UTC)
+		for _, want := range c.next {
+			next := s.Next(from)
+			if want == "" {
+				if !next.IsZero() {
+					t.Errorf("%s: got %v, want zero time", c.exp, next)
+				}
+				break
+			}
+			if got := next.Format(time.RFC3339); got != want {
+				t.Errorf("%s after %s: got %s, want %s", c.exp, from.Format(time.RFC3339), got, want)
+				break
+			}
+			from = next
+		}
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+
+	// On 2022-03-13, 02:00 EST is followed by 03:00 EDT. On 2022-11-06, 02:00 EDT
+	// is followed by 01:00 EST.
+	cases := []struct {
+		exp  string
+		from string
+		next []string
+	}{
+		// Times in the skipped hour don't occur that day.
+		{"30 2 * * *", "2022-03-12T03:00:00-05:00", []string{"2022-03-14T02:30:00-04:00"}},
+		{"0 3 * * *", "2022-03-12T03:00:00-05:00", []string{"2022-03-13T03:00:00-04:00", "2022-03-14T03:00:00-04:00"}},
+		{"0 * * * *", "2022-03-13T00:30:00-05:00", []string{"2022-03-13T01:00:00-05:00", "2022-03-13T03:00:00-04:00"}},
+
+		// Times in the repeated hour at fixed hours occur once.
+		{"30 1 * * *", "2022-11-06T00:00:00-04:00", []string{"2022-11-06T01:30:00-04:00", "2022-11-07T01:30:00-05:00"}},
+
+		// Times in the repeated hour at every hour occur on both passes.
+		{"30 * * * *", "2022-11-06T00:45:00-04:00", []string{"2022-11-06T01:30:00-04:00",
+			"2022-11-06T01:30:00-05:00", "2022-11-06T02:30:00-05:00"}},
+
+		// Days are local days.
+		{"0 0 * * *", "2022-11-05T12:00:00-04:00", []string{"2022-11-06T00:00:00-04:00", "2022-11-07T00:00:00-05:00"}},
+	}
+
+	for _, c := range cases {
+		s, err := Parse(c.exp)
+		if err != nil {
+			t.Fatalf("%s: %v", c.exp, err)
+		}
+
+		from := parseTime(t, c.from, loc)
+		for _, want := range c.next {
+			next := s.Next(from)
+			if next.Location() != loc {
+				t.Errorf("%s: got location %v", c.exp, next.Location())
+			}
+			if got := next.Format(time.RFC3339); got != want {
+				t.Errorf("%s after %s: got %s, want %s", c.exp, from.Format(time.RFC3339), got, want)
+				break
+			}
+			from = next
+		}
+	}
+}
+
+// bits returns a bitset of the values from lo to hi with a step.
+func bits(lo, hi, step int) uint64 {
+	var out uint64
+	for v := lo; v <= hi; v += step {
+		out |= 1 << uint(v)
+	}
+	return out
+}
+
+func parseTime(t *testing.T, s string, loc *time.Location) time.Time {
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm.In(loc)
+}
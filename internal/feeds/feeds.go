@@ -0,0 +1,341 @@
+// Package feeds fetches and parses RSS (0.9x, 1.0 and 2.0) and Atom feeds
+// into a list of items for feed driven campaigns.
+package feeds
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// Fetcher fetches the items of a feed from a URL.
+type Fetcher interface {
+	Fetch(url string) (models.FeedItems, error)
+}
+
+// Opt represents the options of the feed Client.
+type Opt struct {
+	// Timeout of HTTP requests.
+	Timeout time.Duration
+
+	// Maximum size of a feed document in bytes.
+	MaxSize int64
+
+	// AllowPrivate allows fetching feeds from loopback, link-local and
+	// private network addresses, which are blocked by default.
+	AllowPrivate bool
+}
+
+// Client is the default Fetcher that fetches feeds over HTTP(S).
+type Client struct {
+	opt Opt
+	c   *http.Client
+}
+
+// doc represents the elements of RSS and Atom documents that are read.
+// RSS 2.0 items are in the channel whereas RSS 1.0 items are its siblings.
+type doc struct {
+	Channel struct {
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	Items   []rssItem   `xml:"item"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	GUID        string `xml:"guid"`
+	Title       string `xml:"title"`
+	Description string `xml:"description"`
+	Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PubDate     string `xml:"pubDate"`
+	Date        string `xml:"http://purl.org/dc/elements/1.1/ date"`
+
+	// <link> is matched in any namespace, eg: <atom:link href="..." />
+	// which has no text, so there can be more than one.
+	Links []string `xml:"link"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     atomText   `xml:"title"`
+	Summary   atomText   `xml:"summary"`
+	Content   atomText   `xml:"content"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Links     []atomLink `xml:"link"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+// atomText is an Atom text construct, whose XHTML form has markup
+// as child elements.
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Text  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+// blockedNets are the non-public networks feeds can't be fetched from.
+var blockedNets = func() []*net.IPNet {
+	var out []*net.IPNet
+	for _, c := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(c)
+		out = append(out, n)
+	}
+	return out
+}()
+
+var dateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// New returns a new instance of the feed Client.
+func New(o Opt) *Client {
+	d := &net.Dialer{Timeout: o.Timeout}
+	if !o.AllowPrivate {
+		// The check is on the address that's actually dialed, after DNS
+		// resolution and on every redirect.
+		d.Control = checkAddr
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = d.DialContext
+
+	return &Client{
+		opt: o,
+		c:   &http.Client{Timeout: o.Timeout, Transport: tr},
+	}
+}
+
+// Fetch fetches and parses the feed at the given http(s):// URL.
+func (c *Client) Fetch(u string) (models.FeedItems, error) {
+	if err := ValidateURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/xml, text/xml")
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("feed returned status %d", resp.StatusCode)
+	}
+
+	if c.opt.MaxSize > 0 {
+		return Parse(io.LimitReader(resp.Body, c.opt.MaxSize))
+	}
+	return Parse(resp.Body)
+}
+
+// ValidateURL checks if a feed URL is an absolute http(s):// URL.
+func ValidateURL(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if pu.Scheme != "http" && pu.Scheme != "https" {
+		return fmt.Errorf("unsupported feed URL scheme: %s", pu.Scheme)
+	}
+	if pu.Host == "" {
+		return errors.New("feed URL has no host")
+	}
+	return nil
+}
+
+// checkAddr is a net.Dialer control func that rejects connections
+// to non-public addresses.
+func checkAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid feed address: %s", host)
+	}
+	if isBlockedIP(ip) {
+		return fmt.Errorf("feed address %s is not public", ip)
+	}
+	return nil
+}
+
+// isBlockedIP checks if an IP is in one of the non-public networks.
+func isBlockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse parses an RSS or Atom feed document into its items, in the order
+// they're in the document.
+func Parse(r io.Reader) (models.FeedItems, error) {
+	var d doc
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.CharsetReader = charsetReader
+	if err := dec.Decode(&d); err != nil {
+		return nil, fmt.Errorf("error parsing feed: %v", err)
+	}
+
+	out := models.FeedItems{}
+	for _, it := range append(d.Channel.Items, d.Items...) {
+		i := models.FeedItem{
+			GUID:    strings.TrimSpace(it.GUID),
+			Title:   strings.TrimSpace(it.Title),
+			Summary: strings.TrimSpace(it.Description),
+			Date:    parseDate(it.PubDate, it.Date),
+		}
+		for _, l := range it.Links {
+			if l = strings.TrimSpace(l); l != "" {
+				i.Link = l
+				break
+			}
+		}
+		if i.Summary == "" {
+			i.Summary = strings.TrimSpace(it.Content)
+		}
+
+		if i, ok := withGUID(i); ok {
+			out = append(out, i)
+		}
+	}
+
+	for _, e := range d.Entries {
+		i := models.FeedItem{
+			GUID:    strings.TrimSpace(e.ID),
+			Title:   e.Title.value(),
+			Summary: e.Summary.value(),
+			Date:    parseDate(e.Published, e.Updated),
+		}
+		for _, l := range e.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				i.Link = strings.TrimSpace(l.Href)
+				break
+			}
+		}
+		if i.Summary == "" {
+			i.Summary = e.Content.value()
+		}
+
+		if i, ok := withGUID(i); ok {
+			out = append(out, i)
+		}
+	}
+
+	return out, nil
+}
+
+// value returns the text of an Atom text construct.
+func (t atomText) value() string {
+	if t.Type == "xhtml" {
+		return strings.TrimSpace(t.Inner)
+	}
+	return strings.TrimSpace(t.Text)
+}
+
+// withGUID sets the GUID of an item that doesn't have one to its link, or
+// failing that, its title. Items with neither are unidentifiable and are
+// reported as not ok.
+func withGUID(i models.FeedItem) (models.FeedItem, bool) {
+	switch {
+	case i.GUID != "":
+	case i.Link != "":
+		i.GUID = i.Link
+	case i.Title != "":
+		i.GUID = i.Title
+	default:
+		return i, false
+	}
+	return i, true
+}
+
+// parseDate parses the first of the given dates that's in a known layout.
+func parseDate(dates ...string) null.Time {
+	for _, d := range dates {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		for _, l := range dateLayouts {
+			if t, err := time.Parse(l, d); err == nil {
+				return null.TimeFrom(t)
+			}
+		}
+	}
+	return null.Time{}
+}
+
+// charsetReader converts feeds in Latin-1 to UTF-8, which along with
+// US-ASCII, is the only other encoding supported.
+func charsetReader(label string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(label) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return r, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1":
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		var out bytes.Buffer
+		for _, c := range b {
+			out.WriteRune(rune(c))
+		}
+		return &out, nil
+	}
+	return nil, errors.New("unsupported feed encoding: " + label)
+}
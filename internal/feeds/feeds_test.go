@@ -0,0 +1,206 @@
+package feeds
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+func TestParse(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	cases := []struct {
+		file string
+		out  []models.FeedItem
+	}{
+		{"rss2.xml", []models.FeedItem{
+			{GUID: "post-2", Title: "Second post", Link: "https://example.com/2", Summary: "Second summary"},
+			{GUID: "https://example.com/1", Title: "First post", Link: "https://example.com/1", Summary: "<p>First content</p>"},
+		}},
+		{"rss1.xml", []models.FeedItem{
+			{GUID: "https://example.com/caf", Title: "Café", Link: "https://example.com/caf", Summary: "Latin-1 text"},
+		}},
+		{"atom.xml", []models.FeedItem{
+			{GUID: "urn:uuid:entry-1", Title: "Atom entry", Link: "https://example.com/1",
+				Summary: `<div xmlns="http://www.w3.org/1999/xhtml"><p>Rich</p></div>`},
+			{GUID: "https://example.com/2", Title: "Atom without id", Link: "https://example.com/2", Summary: "<p>Body</p>"},
+		}},
+	}
+
+	dates := map[string][]time.Time{
+		"rss2.xml": {date("2022-05-03T10:00:00Z"), date("2022-05-02T09:30:00Z")},
+		"rss1.xml": {date("2022-05-01T08:00:00Z")},
+		"atom.xml": {date("2022-05-04T10:00:00Z"), date("2022-05-06T00:00:00Z")},
+	}
+
+	for _, c := range cases {
+		f, err := os.Open("testdata/" + c.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items, err := Parse(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", c.file, err)
+		}
+
+		if len(items) != len(c.out) {
+			t.Fatalf("%s: got %d items, want %d: %+v", c.file, len(items), len(c.out), items)
+		}
+		for n, i := range items {
+			w := c.out[n]
+			if i.GUID != w.GUID || i.Title != w.Title || i.Link != w.Link || i.Summary != w.Summary {
+				t.Errorf("%s: item %d: got %+v, want %+v", c.file, n, i, w)
+			}
+			if !i.Date.Valid || !i.Date.Time.Equal(dates[c.file][n]) {
+				t.Errorf("%s: item %d: got date %v, want %v", c.file, n, i.Date, dates[c.file][n])
+			}
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []string{
+		"",
+		"not xml",
+		`<?xml version="1.0" encoding="windows-1251"?><rss><channel></channel></rss>`,
+	}
+	for _, c := range cases {
+		if _, err := Parse(strings.NewReader(c)); err == nil {
+			t.Errorf("%q: expected error", c)
+		}
+	}
+}
+
+func TestWithGUID(t *testing.T) {
+	cases := []struct {
+		in   models.FeedItem
+		guid string
+		ok   bool
+	}{
+		{models.FeedItem{GUID: "id", Link: "l", Title: "t"}, "id", true},
+		{models.FeedItem{Link: "l", Title: "t"}, "l", true},
+		{models.FeedItem{Title: "t"}, "t", true},
+		{models.FeedItem{Summary: "s"}, "", false},
+	}
+	for _, c := range cases {
+		i, ok := withGUID(c.in)
+		if ok != c.ok || i.GUID != c.guid {
+			t.Errorf("%+v: got (%q, %v), want (%q, %v)", c.in, i.GUID, ok, c.guid, c.ok)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	cases := []struct {
+		in  []string
+		out string
+	}{
+		{[]string{"Tue, 03 May 2022 10:00:00 +0000"}, "2022-05-03T10:00:00Z"},
+		{[]string{"Tue, 3 May 2022 10:00:00 +0530"}, "2022-05-03T04:30:00Z"},
+		{[]string{"Tue, 3 May 2022 10:00 +0000"}, "2022-05-03T10:00:00Z"},
+		{[]string{"3 May 2022 10:00:00 +0000"}, "2022-05-03T10:00:00Z"},
+		{[]string{"2022-05-03T10:00:00+02:00"}, "2022-05-03T08:00:00Z"},
+		{[]string{"2022-05-03"}, "2022-05-03T00:00:00Z"},
+		{[]string{"", " ", "2022-05-03T10:00:00Z"}, "2022-05-03T10:00:00Z"},
+		{[]string{"yesterday", "2022-05-03"}, "2022-05-03T00:00:00Z"},
+		{[]string{"yesterday"}, ""},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		d := parseDate(c.in...)
+		if c.out == "" {
+			if d.Valid {
+				t.Errorf("%q: got %v, want invalid", c.in, d.Time)
+			}
+			continue
+		}
+		if !d.Valid || d.Time.UTC().Format(time.RFC3339) != c.out {
+			t.Errorf("%q: got %v, want %s", c.in, d, c.out)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	cases := map[string]bool{
+		"https://example.com/feed.xml": true,
+		"http://example.com/rss":       true,
+		"file:///etc/passwd":           false,
+		"ftp://example.com/feed.xml":   false,
+		"/etc/passwd":                  false,
+		"https:///feed.xml":            false,
+		"gopher://example.com":         false,
+	}
+	for u, ok := range cases {
+		if err := ValidateURL(u); (err == nil) != ok {
+			t.Errorf("%s: got %v, want ok=%v", u, err, ok)
+		}
+	}
+}
+
+func TestIsBlockedIP(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1":        true,
+		"10.1.2.3":         true,
+		"172.16.5.4":       true,
+		"192.168.1.1":      true,
+		"169.254.169.254":  true,
+		"100.64.0.1":       true,
+		"0.0.0.0":          true,
+		"::1":              true,
+		"fd00::1":          true,
+		"fe80::1":          true,
+		"::ffff:127.0.0.1": true,
+		"93.184.216.34":    false,
+		"2606:4700::1111":  false,
+	}
+	for ip, blocked := range cases {
+		if got := isBlockedIP(net.ParseIP(ip)); got != blocked {
+			t.Errorf("%s: got %v, want %v", ip, got, blocked)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/feed.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, "testdata/atom.xml")
+	}))
+	defer srv.Close()
+
+	// The test server is on loopback, which is blocked by default.
+	if _, err := New(Opt{Timeout: time.Second}).Fetch(srv.URL + "/feed.xml"); err == nil {
+		t.Error("expected fetching from loopback to fail")
+	}
+
+	c := New(Opt{Timeout: time.Second, AllowPrivate: true})
+	items, err := c.Fetch(srv.URL + "/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Errorf("got %d items, want 2", len(items))
+	}
+
+	if _, err := c.Fetch(srv.URL + "/missing.xml"); err == nil {
+		t.Error("expected error on 404")
+	}
+	if _, err := c.Fetch("file:///etc/passwd"); err == nil {
+		t.Error("expected file:// URLs to be rejected")
+	}
+}
@@ -0,0 +1,169 @@
+package manager
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	// heartbeatInterval is the interval at which the instance records that
+	// it's alive so that the subscriber batches it leases aren't taken over
+	// by other instances.
+	heartbeatInterval = time.Second * 10
+
+	// leaseCheckInterval is the interval at which a campaign that has no more
+	// subscribers to fetch is checked for batches that are still being sent
+	// by this or other instances before it's finished.
+	leaseCheckInterval = time.Second * 5
+
+	// leaseCheckpointInterval is the minimum interval at which the progress of
+	// a leased batch is saved. A batch that's taken over from an instance that's
+	// gone resumes from its last checkpoint.
+	leaseCheckpointInterval = time.Second * 5
+)
+
+// batch is a batch of subscribers of a campaign leased from the store. The
+// lease is released once all of its messages have been processed. If the
+// instance goes away before that, the batch is taken over by another one
+// from the last subscriber up to which all the messages had been processed.
+type batch struct {
+	leaseID int64
+
+	// The batch is an A/B test batch whose messages are counted per variant.
+	isABTest bool
+
+	mut sync.Mutex
+
+	// IDs of the subscribers in the batch in ascending order, the ones whose
+	// messages have been processed out of order, and the position up to
+	// which all of them have been processed.
+	subIDs []int
+	done   map[int]bool
+	next   int
+
+	// Number of messages in the batch that are yet to be processed.
+	pending int
+
+	// The last saved checkpoint and the number of messages processed since,
+	// by A/B test variant ID.
+	saved    int
+	savedAt  time.Time
+	variants map[int]int
+}
+
+// newBatch returns a batch for the leased subscribers.
+func newBatch(leaseID int64, subs []models.Subscriber, isABTest bool) *batch {
+	b := &batch{
+		leaseID:  leaseID,
+		isABTest: isABTest,
+		subIDs:   make([]int, 0, len(subs)),
+		done:     make(map[int]bool),
+		pending:  len(subs),
+		savedAt:  time.Now(),
+		variants: make(map[int]int),
+	}
+	for _, s := range subs {
+		b.subIDs = append(b.subIDs, s.ID)
+	}
+	return b
+}
+
+// doneMessage marks the message of a subscriber in a batch as processed.
+// The progress of the batch is saved at intervals and the batch is released
+// once all of its messages are done.
+func (m *Manager) doneMessage(b *batch, subID, variantID int) {
+	if b == nil {
+		return
+	}
+
+	b.mut.Lock()
+	b.done[subID] = true
+	for b.next < len(b.subIDs) && b.done[b.subIDs[b.next]] {
+		delete(b.done, b.subIDs[b.next])
+		b.next++
+	}
+	if b.isABTest && variantID > 0 {
+		b.variants[variantID]++
+	}
+	b.pending--
+
+	var (
+		release = b.pending <= 0
+		save    = !release && b.next > b.saved && time.Since(b.savedAt) >= leaseCheckpointInterval
+		lastID  int
+		counts  map[int]int
+	)
+	if release || save {
+		if b.next > 0 {
+			lastID = b.subIDs[b.next-1]
+		}
+		counts = b.variants
+		b.variants = make(map[int]int)
+		b.saved = b.next
+		b.savedAt = time.Now()
+	}
+	b.mut.Unlock()
+
+	if release {
+		if err := m.store.ReleaseSubscribers(b.leaseID, counts); err != nil {
+			m.logger.Printf("error releasing subscriber batch %d: %v", b.leaseID, err)
+		}
+		return
+	}
+
+	if save {
+		if err := m.store.CheckpointSubscribers(b.leaseID, lastID, counts); err != nil {
+			m.logger.Printf("error saving progress of subscriber batch %d: %v", b.leaseID, err)
+		}
+	}
+}
+
+// heartbeat records the instance's heartbeat in the store.
+func (m *Manager) heartbeat() {
+	oldest, err := m.store.Heartbeat()
+	if err != nil {
+		m.logger.Printf("error recording heartbeat: %v", err)
+		return
+	}
+
+	var v int32
+	if oldest {
+		v = 1
+	}
+	atomic.StoreInt32(&m.isOldest, v)
+}
+
+// runHeartbeat is a blocking function that periodically records the
+// instance's heartbeat.
+func (m *Manager) runHeartbeat() {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+
+	for range t.C {
+		m.heartbeat()
+	}
+}
+
+// isOldestNode checks if this is the oldest live instance. It sends the
+// notifications for the status changes that aren't made by a particular
+// instance, eg: a campaign paused by a user, so that every instance
+// processing the campaign doesn't send one.
+func (m *Manager) isOldestNode() bool {
+	return atomic.LoadInt32(&m.isOldest) == 1
+}
+
+// hasLeasedSubscribers checks if there are subscriber batches of a campaign
+// that are still being processed by any instance.
+func (m *Manager) hasLeasedSubscribers(c *models.Campaign) bool {
+	has, err := m.store.HasLeasedSubscribers(c.ID)
+	if err != nil {
+		m.logger.Printf("error checking leased subscribers of campaign (%s): %v", c.Name, err)
+
+		// Check again later.
+		return true
+	}
+	return has
+}
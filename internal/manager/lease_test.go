@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// leaseStore is a Store that records the checkpoints and releases of leases.
+type leaseStore struct {
+	Store
+
+	checkpoints []int
+	released    bool
+	variants    map[int]int
+}
+
+func (s *leaseStore) CheckpointSubscribers(leaseID int64, lastID int, variantSent map[int]int) error {
+	s.checkpoints = append(s.checkpoints, lastID)
+	s.addVariants(variantSent)
+	return nil
+}
+
+func (s *leaseStore) ReleaseSubscribers(leaseID int64, variantSent map[int]int) error {
+	s.released = true
+	s.addVariants(variantSent)
+	return nil
+}
+
+func (s *leaseStore) addVariants(v map[int]int) {
+	for id, n := range v {
+		s.variants[id] += n
+	}
+}
+
+func TestDoneMessage(t *testing.T) {
+	st := &leaseStore{variants: make(map[int]int)}
+	m := New(Config{}, st, nil, nil, log.New(ioutil.Discard, "", 0))
+
+	subs := []models.Subscriber{
+		{Base: models.Base{ID: 10}},
+		{Base: models.Base{ID: 20}},
+		{Base: models.Base{ID: 30}},
+		{Base: models.Base{ID: 40}},
+	}
+	b := newBatch(1, subs, true)
+
+	// Messages are done out of order. The checkpoint only moves up to the
+	// last subscriber up to which all of them are done.
+	done := func(subID, variantID int) {
+		b.savedAt = time.Now().Add(-leaseCheckpointInterval)
+		m.doneMessage(b, subID, variantID)
+	}
+
+	done(20, 1)
+	if len(st.checkpoints) != 0 {
+		t.Fatalf("unexpected checkpoint before the first subscriber is done: %v", st.checkpoints)
+	}
+
+	done(10, 2)
+	done(40, 1)
+	if !reflect.DeepEqual(st.checkpoints, []int{20}) {
+		t.Fatalf("got checkpoints %v, want [20]", st.checkpoints)
+	}
+	if st.released {
+		t.Fatal("batch released before all messages are done")
+	}
+
+	done(30, 2)
+	if !st.released {
+		t.Fatal("batch not released after all messages are done")
+	}
+
+	// Every message is counted once against its variant.
+	if want := map[int]int{1: 2, 2: 2}; !reflect.DeepEqual(st.variants, want) {
+		t.Errorf("got variant counts %v, want %v", st.variants, want)
+	}
+}
+
+func TestDoneMessageNotABTest(t *testing.T) {
+	st := &leaseStore{variants: make(map[int]int)}
+	m := New(Config{}, st, nil, nil, log.New(ioutil.Discard, "", 0))
+
+	b := newBatch(1, []models.Subscriber{{Base: models.Base{ID: 1}}, {Base: models.Base{ID: 2}}}, false)
+	m.doneMessage(b, 1, 5)
+	m.doneMessage(b, 2, 5)
+
+	if !st.released {
+		t.Fatal("batch not released")
+	}
+	if len(st.variants) != 0 {
+		t.Errorf("got variant counts %v for a batch that isn't an A/B test", st.variants)
+	}
+
+	// Messages without a batch, eg: retries, are ignored.
+	m.doneMessage(nil, 1, 0)
+}
@@ -7,15 +7,20 @@ import (
 	"html/template"
 	"log"
 	"net/textproto"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Masterminds/sprig/v3"
+	"github.com/knadh/listmonk/internal/feeds"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/metrics"
 	"github.com/knadh/listmonk/models"
 	"github.com/paulbellamy/ratecounter"
+	null "gopkg.in/volatiletech/null.v6"
 )
 
 const (
@@ -28,13 +33,37 @@ const (
 	dummyUUID = "00000000-0000-0000-0000-000000000000"
 )
 
+var (
+	msgsPushed = metrics.NewCounter("listmonk_messages_pushed_total",
+		"Number of messages pushed to messengers.", "messenger", "campaign")
+	msgsFailed = metrics.NewCounter("listmonk_messages_failed_total",
+		"Number of messages that failed to be pushed to messengers.", "messenger", "campaign")
+)
+
 // Store represents a data backend, such as a database,
 // that provides subscriber and campaign records.
 type Store interface {
 	NextCampaigns(excludeIDs []int64) ([]*models.Campaign, error)
-	NextSubscribers(campID, limit int) ([]models.Subscriber, error)
+	NextSubscribers(campID, limit int) (int64, []models.Subscriber, error)
+	CheckpointSubscribers(leaseID int64, lastID int, variantSent map[int]int) error
+	ReleaseSubscribers(leaseID int64, variantSent map[int]int) error
+	HasLeasedSubscribers(campID int) (bool, error)
+	Heartbeat() (bool, error)
 	GetCampaign(campID int) (*models.Campaign, error)
 	UpdateCampaignStatus(campID int, status string) error
+	PauseCampaign(campID int, reason string) (bool, error)
+	FinishCampaign(campID int) (bool, error)
+	RecordCampaignFailure(campID, subID int, reason string) error
+	QueueCampaignRetry(campID, subID int, reason string) error
+	DeleteCampaignFailure(campID, subID int) error
+	NextCampaignRetries(limit int) (map[int][]models.Subscriber, error)
+	EndCampaignABTest(campID int) error
+	NextCampaignWave(campID int, current time.Time) (null.Time, error)
+	SetCampaignABWinner(campID int) (models.CampaignVariant, error)
+	NextRecurringCampaigns() ([]*models.Campaign, error)
+	CreateCampaignRun(campID int, runAt time.Time, name string, skip bool, next null.Time, items models.FeedItems) (int, error)
+	GetSentFeedItems(campID int, guids []string) ([]string, error)
+	NextSequenceMessages(limit int) ([]models.SequenceMessage, error)
 	CreateLink(url string) (string, error)
 	BlocklistSubscriber(id int64) error
 	DeleteSubscriber(id int64) error
@@ -43,6 +72,17 @@ type Store interface {
 // CampStats contains campaign stats like per minute send rate.
 type CampStats struct {
 	SendRate int
+
+	// Stats of the throttled domains the campaign is sending to.
+	Domains []DomainStats
+}
+
+// QueueStats contains the number of items waiting in the manager's queues.
+type QueueStats struct {
+	CampMsgs  int
+	SubFetch  int
+	Msgs      int
+	MsgErrors int
 }
 
 // Manager handles the scheduling, processing, and queuing of campaigns
@@ -60,23 +100,49 @@ type Manager struct {
 	campRates map[int]*ratecounter.RateCounter
 	campsMut  sync.RWMutex
 
+	// Outcomes of the last N messages sent by running campaigns for
+	// pausing them on hitting the error rate threshold.
+	campWindows map[int]*sendWindow
+
+	// Compiled copies of the variants of running campaigns that are
+	// sending out their A/B test batches.
+	campVariants map[int][]*models.Campaign
+
 	// Links generated using Track() are cached here so as to not query
 	// the database for the link UUID for every message sent. This has to
 	// be locked as it may be used externally when previewing campaigns.
 	links    map[string]string
 	linksMut sync.RWMutex
 
+	// Compiled transactional templates that are used to render
+	// one-off messages.
+	tpls    map[int]*models.Template
+	tplsMut sync.RWMutex
+
 	subFetchQueue      chan *models.Campaign
 	campMsgQueue       chan CampaignMessage
 	campMsgErrorQueue  chan msgError
 	campMsgErrorCounts map[int]int
 	msgQueue           chan Message
 
+	// Per recipient domain throttles. Messages to throttled domains that
+	// are over their limits are deferred and released on
+	// campMsgThrottledQueue by runThrottles.
+	throttles             map[string]*throttle
+	campMsgThrottledQueue chan throttledMsg
+	numDeferred           int32
+	maxDeferred           int
+
+	// Set to 1 if this is the oldest live instance among the instances
+	// processing campaigns.
+	isOldest int32
+
 	// Sliding window keeps track of the total number of messages sent in a period
 	// and on reaching the specified limit, waits until the window is over before
 	// sending further messages.
 	slidingWindowNumMsg int
 	slidingWindowStart  time.Time
+	slidingWindowMut    sync.Mutex
 }
 
 // CampaignMessage represents an instance of campaign message to be pushed out,
@@ -91,6 +157,12 @@ type CampaignMessage struct {
 	body     []byte
 	altBody  []byte
 	unsubURL string
+
+	// isRetry indicates that the message is a retry of a failed delivery.
+	isRetry bool
+
+	// The leased subscriber batch the message belongs to.
+	batch *batch
 }
 
 // Message represents a generic message to be pushed to a messenger.
@@ -109,6 +181,8 @@ type Config struct {
 	Concurrency           int
 	MessageRate           int
 	MaxSendErrors         int
+	MaxSendErrorRate      float64
+	SendErrorWindow       int
 	SlidingWindow         bool
 	SlidingWindowDuration time.Duration
 	SlidingWindowRate     int
@@ -122,14 +196,21 @@ type Config struct {
 	ViewTrackURL          string
 	UnsubHeader           bool
 
+	// Per recipient domain rate and concurrency limits.
+	DomainThrottles []DomainThrottle
+
+	// Fetcher of the RSS/Atom feeds of feed driven campaigns.
+	Feeds feeds.Fetcher
+
 	// Interval to scan the DB for active campaign checkpoints.
 	ScanInterval time.Duration
 
 	// ScanCampaigns indicates whether this instance of manager will scan the DB
 	// for active campaigns and process them.
 	// This can be used to run multiple instances of listmonk
-	// (exposed to the internet, private etc.) where only one does campaign
-	// processing while the others handle other kinds of traffic.
+	// (exposed to the internet, private etc.) where only some do campaign
+	// processing while the others handle other kinds of traffic. Instances
+	// that process campaigns share the subscriber batches of running campaigns.
 	ScanCampaigns bool
 }
 
@@ -138,6 +219,13 @@ type msgError struct {
 	err  error
 }
 
+// throttledMsg is a deferred message released by a domain throttle
+// that holds a slot on it.
+type throttledMsg struct {
+	msg CampaignMessage
+	th  *throttle
+}
+
 var pushTimeout = time.Second * 3
 
 // New returns a new instance of Mailer.
@@ -151,6 +239,18 @@ func New(cfg Config, store Store, notifCB models.AdminNotifCallback, i *i18n.I18
 	if cfg.MessageRate < 1 {
 		cfg.MessageRate = 1
 	}
+	if cfg.SendErrorWindow < 1 {
+		cfg.SendErrorWindow = 1000
+	}
+
+	throttles := make(map[string]*throttle, len(cfg.DomainThrottles))
+	for _, d := range cfg.DomainThrottles {
+		d.Domain = strings.ToLower(strings.TrimSpace(d.Domain))
+		if d.Domain == "" || (d.Rate < 1 && d.Concurrency < 1) {
+			continue
+		}
+		throttles[d.Domain] = newThrottle(d)
+	}
 
 	return &Manager{
 		cfg:                cfg,
@@ -161,13 +261,23 @@ func New(cfg Config, store Store, notifCB models.AdminNotifCallback, i *i18n.I18
 		messengers:         make(map[string]messenger.Messenger),
 		camps:              make(map[int]*models.Campaign),
 		campRates:          make(map[int]*ratecounter.RateCounter),
+		campWindows:        make(map[int]*sendWindow),
+		campVariants:       make(map[int][]*models.Campaign),
 		links:              make(map[string]string),
+		tpls:               make(map[int]*models.Template),
 		subFetchQueue:      make(chan *models.Campaign, cfg.Concurrency),
 		campMsgQueue:       make(chan CampaignMessage, cfg.Concurrency*2),
 		msgQueue:           make(chan Message, cfg.Concurrency),
-		campMsgErrorQueue:  make(chan msgError, cfg.MaxSendErrors),
+		campMsgErrorQueue:  make(chan msgError, cfg.Concurrency),
 		campMsgErrorCounts: make(map[int]int),
 		slidingWindowStart: time.Now(),
+
+		throttles:             throttles,
+		campMsgThrottledQueue: make(chan throttledMsg, cfg.Concurrency),
+
+		// Allow a few batches worth of messages to wait on throttled domains
+		// before subscriber fetching is held back.
+		maxDeferred: cfg.BatchSize * 5,
 	}
 }
 
@@ -192,6 +302,39 @@ func (m *Manager) NewCampaignMessage(c *models.Campaign, s models.Subscriber) (C
 	return msg, nil
 }
 
+// CacheTpl caches a compiled transactional template.
+func (m *Manager) CacheTpl(id int, tpl *models.Template) {
+	m.tplsMut.Lock()
+	m.tpls[id] = tpl
+	m.tplsMut.Unlock()
+}
+
+// CacheTpls replaces all the cached transactional templates.
+func (m *Manager) CacheTpls(tpls map[int]*models.Template) {
+	m.tplsMut.Lock()
+	m.tpls = tpls
+	m.tplsMut.Unlock()
+}
+
+// DeleteTpl deletes a cached transactional template.
+func (m *Manager) DeleteTpl(id int) {
+	m.tplsMut.Lock()
+	delete(m.tpls, id)
+	m.tplsMut.Unlock()
+}
+
+// GetTpl returns a cached transactional template.
+func (m *Manager) GetTpl(id int) (*models.Template, error) {
+	m.tplsMut.RLock()
+	tpl, ok := m.tpls[id]
+	m.tplsMut.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("template %d not found", id)
+	}
+	return tpl, nil
+}
+
 // AddMessenger adds a Messenger messaging backend to the manager.
 func (m *Manager) AddMessenger(msg messenger.Messenger) error {
 	id := msg.Name()
@@ -255,7 +398,34 @@ func (m *Manager) GetCampaignStats(id int) CampStats {
 	}
 	m.campsMut.Unlock()
 
-	return CampStats{SendRate: n}
+	return CampStats{SendRate: n, Domains: m.getDomainStats(id)}
+}
+
+// GetRunningCampaignStats returns the stats of all the campaigns
+// that are currently being processed.
+func (m *Manager) GetRunningCampaignStats() map[int]CampStats {
+	m.campsMut.Lock()
+	defer m.campsMut.Unlock()
+
+	out := make(map[int]CampStats, len(m.camps))
+	for id := range m.camps {
+		n := 0
+		if r, ok := m.campRates[id]; ok {
+			n = int(r.Rate())
+		}
+		out[id] = CampStats{SendRate: n, Domains: m.getDomainStats(id)}
+	}
+	return out
+}
+
+// GetQueueStats returns the number of items waiting in the queues.
+func (m *Manager) GetQueueStats() QueueStats {
+	return QueueStats{
+		CampMsgs:  len(m.campMsgQueue),
+		SubFetch:  len(m.subFetchQueue),
+		Msgs:      len(m.msgQueue),
+		MsgErrors: len(m.campMsgErrorQueue),
+	}
 }
 
 // Run is a blocking function (that should be invoked as a goroutine)
@@ -266,7 +436,15 @@ func (m *Manager) GetCampaignStats(id int) CampStats {
 // as "finished".
 func (m *Manager) Run() {
 	if m.cfg.ScanCampaigns {
+		// Register the instance before leasing any subscribers so that
+		// other instances don't take them over.
+		m.heartbeat()
+		go m.runHeartbeat()
+
 		go m.scanCampaigns(m.cfg.ScanInterval)
+		go m.processErrors()
+		go m.scanSequences(m.cfg.ScanInterval)
+		go m.scanRetries(m.cfg.ScanInterval)
 	}
 
 	// Spawn N message workers.
@@ -274,6 +452,10 @@ func (m *Manager) Run() {
 		go m.worker()
 	}
 
+	if len(m.throttles) > 0 {
+		go m.runThrottles()
+	}
+
 	// Fetch the next set of subscribers for a campaign and process them.
 	for c := range m.subFetchQueue {
 		has, err := m.nextSubscribers(c, m.cfg.BatchSize)
@@ -285,15 +467,26 @@ func (m *Manager) Run() {
 		if has {
 			// There are more subscribers to fetch.
 			m.subFetchQueue <- c
+		} else if m.isCampaignProcessing(c.ID) && m.hasLeasedSubscribers(c) {
+			// There are no more subscribers to fetch, but batches leased by
+			// this or other instances are still being sent, or are waiting to
+			// be taken over from instances that are gone. Check again in a bit.
+			go func(c *models.Campaign) {
+				time.Sleep(leaseCheckInterval)
+				m.subFetchQueue <- c
+			}(c)
 		} else if m.isCampaignProcessing(c.ID) {
 			// There are no more subscribers. Either the campaign status
 			// has changed or all subscribers have been processed.
-			newC, err := m.exhaustCampaign(c, "")
+			newC, notify, err := m.exhaustCampaign(c, "")
 			if err != nil {
 				m.logger.Printf("error exhausting campaign (%s): %v", c.Name, err)
 				continue
 			}
-			m.sendNotif(newC, newC.Status, "")
+
+			if notify {
+				m.sendNotif(newC, newC.Status, "")
+			}
 		}
 	}
 }
@@ -311,6 +504,14 @@ func (m *Manager) worker() {
 				return
 			}
 
+			// If the recipient's domain is throttled and over its limits,
+			// defer the message and move on to the next one.
+			th := m.getThrottle(msg.to)
+			if th != nil && !th.admit(msg, time.Now()) {
+				atomic.AddInt32(&m.numDeferred, 1)
+				continue
+			}
+
 			// Pause on hitting the message rate.
 			if numMsg >= m.cfg.MessageRate {
 				time.Sleep(time.Second)
@@ -318,55 +519,23 @@ func (m *Manager) worker() {
 			}
 			numMsg++
 
-			// Outgoing message.
-			out := messenger.Message{
-				From:        msg.from,
-				To:          []string{msg.to},
-				Subject:     msg.subject,
-				ContentType: msg.Campaign.ContentType,
-				Body:        msg.body,
-				AltBody:     msg.altBody,
-				Subscriber:  msg.Subscriber,
-				Campaign:    msg.Campaign,
-			}
-
-			h := textproto.MIMEHeader{}
-			h.Set(models.EmailHeaderCampaignUUID, msg.Campaign.UUID)
-			h.Set(models.EmailHeaderSubscriberUUID, msg.Subscriber.UUID)
-
-			// Attach List-Unsubscribe headers?
-			if m.cfg.UnsubHeader {
-				h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
-				h.Set("List-Unsubscribe", `<`+msg.unsubURL+`>`)
-			}
-
-			// Attach any custom headers.
-			if len(msg.Campaign.Headers) > 0 {
-				for _, set := range msg.Campaign.Headers {
-					for hdr, val := range set {
-						h.Add(hdr, val)
-					}
-				}
+			m.sendCampaignMessage(msg)
+			if th != nil {
+				th.release(msg.Campaign.ID)
 			}
+			m.doneMessage(msg.batch, msg.Subscriber.ID, msg.Campaign.VariantID)
 
-			out.Headers = h
-
-			if err := m.messengers[msg.Campaign.Messenger].Push(out); err != nil {
-				m.logger.Printf("error sending message in campaign %s: subscriber %s: %v",
-					msg.Campaign.Name, msg.Subscriber.UUID, err)
-
-				select {
-				case m.campMsgErrorQueue <- msgError{camp: msg.Campaign, err: err}:
-				default:
-					continue
-				}
+		// Deferred campaign message released by a domain throttle.
+		case t := <-m.campMsgThrottledQueue:
+			if numMsg >= m.cfg.MessageRate {
+				time.Sleep(time.Second)
+				numMsg = 0
 			}
+			numMsg++
 
-			m.campsMut.Lock()
-			if r, ok := m.campRates[msg.Campaign.ID]; ok {
-				r.Incr(1)
-			}
-			m.campsMut.Unlock()
+			m.sendCampaignMessage(t.msg)
+			t.th.release(t.msg.Campaign.ID)
+			m.doneMessage(t.msg.batch, t.msg.Subscriber.ID, t.msg.Campaign.VariantID)
 
 		// Arbitrary message.
 		case msg, ok := <-m.msgQueue:
@@ -381,16 +550,100 @@ func (m *Manager) worker() {
 				ContentType: msg.ContentType,
 				Body:        msg.Body,
 				AltBody:     msg.AltBody,
+				Headers:     msg.Headers,
+				Attachments: msg.Attachments,
 				Subscriber:  msg.Subscriber,
 				Campaign:    msg.Campaign,
 			})
 			if err != nil {
 				m.logger.Printf("error sending message '%s': %v", msg.Subject, err)
+				msgsFailed.Inc(msg.Messenger, "")
+			} else {
+				msgsPushed.Inc(msg.Messenger, "")
 			}
 		}
 	}
 }
 
+// sendCampaignMessage pushes a campaign message to its messenger.
+func (m *Manager) sendCampaignMessage(msg CampaignMessage) {
+	// Outgoing message.
+	out := messenger.Message{
+		From:        msg.from,
+		To:          []string{msg.to},
+		Subject:     msg.subject,
+		ContentType: msg.Campaign.ContentType,
+		Body:        msg.body,
+		AltBody:     msg.altBody,
+		Subscriber:  msg.Subscriber,
+		Campaign:    msg.Campaign,
+	}
+
+	h := textproto.MIMEHeader{}
+	h.Set(models.EmailHeaderCampaignUUID, msg.Campaign.UUID)
+	h.Set(models.EmailHeaderSubscriberUUID, msg.Subscriber.UUID)
+
+	// Attach List-Unsubscribe headers?
+	if m.cfg.UnsubHeader {
+		h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		h.Set("List-Unsubscribe", `<`+msg.unsubURL+`>`)
+	}
+
+	// Attach any custom headers.
+	if len(msg.Campaign.Headers) > 0 {
+		for _, set := range msg.Campaign.Headers {
+			for hdr, val := range set {
+				h.Add(hdr, val)
+			}
+		}
+	}
+
+	out.Headers = h
+
+	campID := strconv.Itoa(msg.Campaign.ID)
+	err := m.messengers[msg.Campaign.Messenger].Push(out)
+
+	// Record the outcome for the campaign's error rate.
+	m.campsMut.RLock()
+	w, ok := m.campWindows[msg.Campaign.ID]
+	m.campsMut.RUnlock()
+	if ok {
+		w.add(err != nil)
+	}
+
+	if err != nil {
+		m.logger.Printf("error sending message in campaign %s: subscriber %s: %v",
+			msg.Campaign.Name, msg.Subscriber.UUID, err)
+		msgsFailed.Inc(msg.Campaign.Messenger, campID)
+
+		// Record the failure so that the message can be retried later.
+		if err := m.store.RecordCampaignFailure(msg.Campaign.ID, msg.Subscriber.ID, err.Error()); err != nil {
+			m.logger.Printf("error recording failed message in campaign %s: %v", msg.Campaign.Name, err)
+		}
+
+		// Errors of campaigns that are being processed, eg: not test messages,
+		// count towards the thresholds for pausing them. Every one counts, so
+		// wait for the queue instead of dropping it.
+		if ok {
+			m.campMsgErrorQueue <- msgError{camp: msg.Campaign, err: err}
+		}
+	} else {
+		msgsPushed.Inc(msg.Campaign.Messenger, campID)
+
+		if msg.isRetry {
+			if err := m.store.DeleteCampaignFailure(msg.Campaign.ID, msg.Subscriber.ID); err != nil {
+				m.logger.Printf("error clearing failed message in campaign %s: %v", msg.Campaign.Name, err)
+			}
+		}
+	}
+
+	m.campsMut.Lock()
+	if r, ok := m.campRates[msg.Campaign.ID]; ok {
+		r.Incr(1)
+	}
+	m.campsMut.Unlock()
+}
+
 // TemplateFuncs returns the template functions to be applied into
 // compiled campaign templates.
 func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
@@ -401,7 +654,7 @@ func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 				subUUID = dummyUUID
 			}
 
-			return m.trackLink(url, msg.Campaign.UUID, subUUID)
+			return m.trackLink(url, msg.Campaign.UUID, subUUID, variantQuery(msg.Campaign))
 		},
 		"TrackView": func(msg *CampaignMessage) template.HTML {
 			subUUID := msg.Subscriber.UUID
@@ -410,7 +663,7 @@ func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 			}
 
 			return template.HTML(fmt.Sprintf(`<img src="%s" alt="" />`,
-				fmt.Sprintf(m.cfg.ViewTrackURL, msg.Campaign.UUID, subUUID)))
+				withQuery(fmt.Sprintf(m.cfg.ViewTrackURL, msg.Campaign.UUID, subUUID), variantQuery(msg.Campaign))))
 		},
 		"UnsubscribeURL": func(msg *CampaignMessage) string {
 			return msg.unsubURL
@@ -421,8 +674,47 @@ func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 			return fmt.Sprintf(m.cfg.OptinURL, msg.Subscriber.UUID, "")
 		},
 		"MessageURL": func(msg *CampaignMessage) string {
-			return fmt.Sprintf(m.cfg.MessageURL, c.UUID, msg.Subscriber.UUID)
+			return withQuery(fmt.Sprintf(m.cfg.MessageURL, c.UUID, msg.Subscriber.UUID), variantQuery(msg.Campaign))
 		},
+	}
+	for k, v := range m.GenericTemplateFuncs() {
+		f[k] = v
+	}
+	return f
+}
+
+// TxTemplateFuncs returns the template functions for the transactional template
+// tpl. Views and clicks tracked in tx messages are attributed to the template.
+func (m *Manager) TxTemplateFuncs(tpl *models.Template) template.FuncMap {
+	f := template.FuncMap{
+		"TrackLink": func(url string, d models.TxTplData) string {
+			subUUID := d.Subscriber.UUID
+			if !m.cfg.IndividualTracking {
+				subUUID = dummyUUID
+			}
+
+			return m.trackLink(url, dummyUUID, subUUID, txQuery(tpl))
+		},
+		"TrackView": func(d models.TxTplData) template.HTML {
+			subUUID := d.Subscriber.UUID
+			if !m.cfg.IndividualTracking {
+				subUUID = dummyUUID
+			}
+
+			return template.HTML(fmt.Sprintf(`<img src="%s" alt="" />`,
+				withQuery(fmt.Sprintf(m.cfg.ViewTrackURL, dummyUUID, subUUID), txQuery(tpl))))
+		},
+	}
+	for k, v := range m.GenericTemplateFuncs() {
+		f[k] = v
+	}
+	return f
+}
+
+// GenericTemplateFuncs returns the template functions that are not specific
+// to campaigns, for instance, for rendering transactional templates.
+func (m *Manager) GenericTemplateFuncs() template.FuncMap {
+	f := template.FuncMap{
 		"Date": func(layout string) string {
 			if layout == "" {
 				layout = time.ANSIC
@@ -455,60 +747,109 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 	t := time.NewTicker(tick)
 	defer t.Stop()
 
-	for {
-		select {
-		// Periodically scan the data source for campaigns to process.
-		case <-t.C:
-			campaigns, err := m.store.NextCampaigns(m.getPendingCampaignIDs())
-			if err != nil {
-				m.logger.Printf("error fetching campaigns: %v", err)
-				continue
-			}
+	// Periodically scan the data source for campaigns to process.
+	for range t.C {
+		// Create the due runs of recurring campaigns so that they're
+		// picked up right away.
+		m.runRecurringCampaigns()
 
-			for _, c := range campaigns {
-				if err := m.addCampaign(c); err != nil {
-					m.logger.Printf("error processing campaign (%s): %v", c.Name, err)
-					continue
-				}
-				m.logger.Printf("start processing campaign (%s)", c.Name)
-
-				// If subscriber processing is busy, move on. Blocking and waiting
-				// can end up in a race condition where the waiting campaign's
-				// state in the data source has changed.
-				select {
-				case m.subFetchQueue <- c:
-				default:
-				}
-			}
+		campaigns, err := m.store.NextCampaigns(m.getPendingCampaignIDs())
+		if err != nil {
+			m.logger.Printf("error fetching campaigns: %v", err)
+			continue
+		}
 
-			// Aggregate errors from sending messages to check against the error threshold
-			// after which a campaign is paused.
-		case e, ok := <-m.campMsgErrorQueue:
-			if !ok {
-				return
-			}
-			if m.cfg.MaxSendErrors < 1 {
+		for _, c := range campaigns {
+			if err := m.addCampaign(c); err != nil {
+				m.logger.Printf("error processing campaign (%s): %v", c.Name, err)
 				continue
 			}
+			m.logger.Printf("start processing campaign (%s)", c.Name)
+
+			// If subscriber processing is busy, move on. Blocking and waiting
+			// can end up in a race condition where the waiting campaign's
+			// state in the data source has changed.
+			select {
+			case m.subFetchQueue <- c:
+			default:
+			}
+		}
+	}
+}
 
-			// If the error threshold is met, pause the campaign.
-			m.campMsgErrorCounts[e.camp.ID]++
-			if m.campMsgErrorCounts[e.camp.ID] >= m.cfg.MaxSendErrors {
-				m.logger.Printf("error counted exceeded %d. pausing campaign %s",
-					m.cfg.MaxSendErrors, e.camp.Name)
+// processErrors is a blocking function that aggregates the errors from sending
+// messages to check against the error thresholds after which a campaign is
+// paused. It runs apart from the campaign scans so that the workers waiting
+// on the error queue aren't held up by them.
+func (m *Manager) processErrors() {
+	for e := range m.campMsgErrorQueue {
+		// If the error threshold is met, pause the campaign.
+		reason := m.checkErrors(e.camp)
+		if reason == "" {
+			continue
+		}
+		delete(m.campMsgErrorCounts, e.camp.ID)
 
-				if m.isCampaignProcessing(e.camp.ID) {
-					m.exhaustCampaign(e.camp, models.CampaignStatusPaused)
-				}
-				delete(m.campMsgErrorCounts, e.camp.ID)
+		if !m.isCampaignProcessing(e.camp.ID) {
+			continue
+		}
+		m.logger.Printf("pausing campaign %s: %s", e.camp.Name, reason)
 
-				// Notify admins.
-				m.sendNotif(e.camp, models.CampaignStatusPaused, "Too many errors")
-			}
+		// Notify admins, unless another instance has paused it already.
+		if m.pauseCampaign(e.camp, reason) {
+			m.sendNotif(e.camp, models.CampaignStatusPaused, reason)
 		}
 	}
 }
 
+// checkErrors counts a send error of a campaign and checks it against the
+// error count and error rate thresholds. If either is met, the reason for
+// pausing the campaign is returned.
+func (m *Manager) checkErrors(c *models.Campaign) string {
+	if m.cfg.MaxSendErrors > 0 {
+		m.campMsgErrorCounts[c.ID]++
+		if n := m.campMsgErrorCounts[c.ID]; n >= m.cfg.MaxSendErrors {
+			return m.i18n.Ts("campaigns.pauseErrorCount", "count", strconv.Itoa(n))
+		}
+	}
+
+	if m.cfg.MaxSendErrorRate <= 0 {
+		return ""
+	}
+
+	m.campsMut.RLock()
+	w, ok := m.campWindows[c.ID]
+	m.campsMut.RUnlock()
+	if !ok {
+		return ""
+	}
+
+	// Wait for a tenth of the window to fill up before judging the rate,
+	// or all the messages of a campaign that's smaller than that.
+	minSends := m.cfg.SendErrorWindow / 10
+	if minSends < 10 {
+		minSends = 10
+	}
+	if c.ToSend > 0 && c.ToSend < minSends {
+		minSends = c.ToSend
+	}
+
+	errs, num := w.stats()
+	if num < minSends {
+		return ""
+	}
+
+	rate := float64(errs) / float64(num) * 100
+	if rate <= m.cfg.MaxSendErrorRate {
+		return ""
+	}
+
+	return m.i18n.Ts("campaigns.pauseErrorRate",
+		"errors", strconv.Itoa(errs),
+		"count", strconv.Itoa(num),
+		"rate", strconv.FormatFloat(rate, 'f', 1, 64))
+}
+
 // addCampaign adds a campaign to the process queue.
 func (m *Manager) addCampaign(c *models.Campaign) error {
 	// Validate messenger.
@@ -517,19 +858,64 @@ func (m *Manager) addCampaign(c *models.Campaign) error {
 		return fmt.Errorf("unknown messenger %s on campaign %s", c.Messenger, c.Name)
 	}
 
+	// An A/B tested campaign whose test window is over. Pick the winning
+	// variant to be sent to the rest of the subscribers.
+	if c.IsABTest() && c.ABTestSentAt.Valid && !c.ABWinnerID.Valid {
+		v, err := m.store.SetCampaignABWinner(c.ID)
+		if err != nil {
+			return fmt.Errorf("error picking A/B test winner: %v", err)
+		}
+		c.Subject = v.Subject
+		c.Body = v.Body
+		c.ABWinnerID = null.IntFrom(v.ID)
+		m.logger.Printf("picked variant (%s) as the A/B test winner of campaign (%s)", v.Name, c.Name)
+	}
+
+	// Views and clicks on messages with the winning variant are attributed to it.
+	if c.ABWinnerID.Valid {
+		c.VariantID = c.ABWinnerID.Int
+	}
+
 	// Load the template.
 	if err := c.CompileTemplate(m.TemplateFuncs(c)); err != nil {
 		return err
 	}
 
+	// Compile the variants that are sent to the A/B test batch.
+	var vars []*models.Campaign
+	if c.IsABTest() && !c.ABTestSentAt.Valid {
+		v, err := m.compileVariants(c)
+		if err != nil {
+			return err
+		}
+		vars = v
+	}
+
 	// Add the campaign to the active map.
 	m.campsMut.Lock()
 	m.camps[c.ID] = c
 	m.campRates[c.ID] = ratecounter.NewRateCounter(time.Minute)
+	m.campWindows[c.ID] = newSendWindow(m.cfg.SendErrorWindow)
+	if vars != nil {
+		m.campVariants[c.ID] = vars
+	}
 	m.campsMut.Unlock()
 	return nil
 }
 
+// compileVariants returns compiled copies of a campaign with its A/B test variants.
+func (m *Manager) compileVariants(c *models.Campaign) ([]*models.Campaign, error) {
+	out := make([]*models.Campaign, 0, len(c.Variants))
+	for _, v := range c.Variants {
+		vc := c.WithVariant(v)
+		if err := vc.CompileTemplate(m.TemplateFuncs(vc)); err != nil {
+			return nil, fmt.Errorf("error compiling variant (%s): %v", v.Name, err)
+		}
+		out = append(out, vc)
+	}
+	return out, nil
+}
+
 // getPendingCampaignIDs returns the IDs of campaigns currently being processed.
 func (m *Manager) getPendingCampaignIDs() []int64 {
 	// Needs to return an empty slice in case there are no campaigns.
@@ -547,8 +933,8 @@ func (m *Manager) getPendingCampaignIDs() []int64 {
 // in the current batch or not. A false indicates that all subscribers
 // have been processed, or that a campaign has been paused or cancelled.
 func (m *Manager) nextSubscribers(c *models.Campaign, batchSize int) (bool, error) {
-	// Fetch a batch of subscribers.
-	subs, err := m.store.NextSubscribers(c.ID, batchSize)
+	// Fetch and lease a batch of subscribers.
+	leaseID, subs, err := m.store.NextSubscribers(c.ID, batchSize)
 	if err != nil {
 		return false, fmt.Errorf("error fetching campaign subscribers (%s): %v", c.Name, err)
 	}
@@ -558,53 +944,86 @@ func (m *Manager) nextSubscribers(c *models.Campaign, batchSize int) (bool, erro
 		return false, nil
 	}
 
-	// Is there a sliding window limit configured?
-	hasSliding := m.cfg.SlidingWindow &&
-		m.cfg.SlidingWindowRate > 0 &&
-		m.cfg.SlidingWindowDuration.Seconds() > 1
+	// If the campaign is sending out its A/B test batch, get its variants.
+	m.campsMut.RLock()
+	vars := m.campVariants[c.ID]
+	m.campsMut.RUnlock()
+
+	// The lease is released once all the messages in the batch are processed.
+	b := newBatch(leaseID, subs, len(vars) > 0)
 
 	// Push messages.
 	for _, s := range subs {
+		camp := c
+		if len(vars) > 0 {
+			camp = vars[c.ABTestVariant(s.ID)]
+		}
+
 		// Send the message.
-		msg, err := m.NewCampaignMessage(c, s)
+		msg, err := m.NewCampaignMessage(camp, s)
 		if err != nil {
 			m.logger.Printf("error rendering message (%s) (%s): %v", c.Name, s.Email, err)
+			if err := m.store.RecordCampaignFailure(c.ID, s.ID, err.Error()); err != nil {
+				m.logger.Printf("error recording failed message in campaign %s: %v", c.Name, err)
+			}
+			m.doneMessage(b, s.ID, camp.VariantID)
 			continue
 		}
+		msg.batch = b
+
+		// Hold back if too many messages are waiting on throttled domains.
+		if len(m.throttles) > 0 {
+			m.waitDeferred()
+		}
 
 		// Push the message to the queue while blocking and waiting until
 		// the queue is drained.
 		m.campMsgQueue <- msg
 
-		// Check if the sliding window is active.
-		if hasSliding {
-			diff := time.Now().Sub(m.slidingWindowStart)
+		m.waitSlidingWindow()
+	}
 
-			// Window has expired. Reset the clock.
-			if diff >= m.cfg.SlidingWindowDuration {
-				m.slidingWindowStart = time.Now()
-				m.slidingWindowNumMsg = 0
-				continue
-			}
+	return true, nil
+}
 
-			// Have the messages exceeded the limit?
-			m.slidingWindowNumMsg++
-			if m.slidingWindowNumMsg >= m.cfg.SlidingWindowRate {
-				wait := m.cfg.SlidingWindowDuration - diff
+// waitSlidingWindow counts a message that's been queued against the sliding
+// window limit, if one is configured, and sleeps until the end of the window
+// once the limit is reached.
+func (m *Manager) waitSlidingWindow() {
+	if !m.cfg.SlidingWindow || m.cfg.SlidingWindowRate <= 0 || m.cfg.SlidingWindowDuration.Seconds() <= 1 {
+		return
+	}
 
-				m.logger.Printf("messages exceeded (%d) for the window (%v since %s). Sleeping for %s.",
-					m.slidingWindowNumMsg,
-					m.cfg.SlidingWindowDuration,
-					m.slidingWindowStart.Format(time.RFC822Z),
-					wait.Round(time.Second)*1)
+	m.slidingWindowMut.Lock()
+	diff := time.Now().Sub(m.slidingWindowStart)
 
-				m.slidingWindowNumMsg = 0
-				time.Sleep(wait)
-			}
-		}
+	// Window has expired. Reset the clock.
+	if diff >= m.cfg.SlidingWindowDuration {
+		m.slidingWindowStart = time.Now()
+		m.slidingWindowNumMsg = 0
+		m.slidingWindowMut.Unlock()
+		return
 	}
 
-	return true, nil
+	// Have the messages exceeded the limit?
+	m.slidingWindowNumMsg++
+	if m.slidingWindowNumMsg < m.cfg.SlidingWindowRate {
+		m.slidingWindowMut.Unlock()
+		return
+	}
+
+	wait := m.cfg.SlidingWindowDuration - diff
+	m.logger.Printf("messages exceeded (%d) for the window (%v since %s). Sleeping for %s.",
+		m.slidingWindowNumMsg,
+		m.cfg.SlidingWindowDuration,
+		m.slidingWindowStart.Format(time.RFC822Z),
+		wait.Round(time.Second)*1)
+	m.slidingWindowNumMsg = 0
+
+	// The lock is held while sleeping so that other message sources, eg:
+	// retries, wait for the window too.
+	time.Sleep(wait)
+	m.slidingWindowMut.Unlock()
 }
 
 // isCampaignProcessing checks if the campaign is being processed.
@@ -615,12 +1034,45 @@ func (m *Manager) isCampaignProcessing(id int) bool {
 	return ok
 }
 
-func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Campaign, error) {
+// removeCampaign removes a campaign from the active map.
+func (m *Manager) removeCampaign(id int) {
 	m.campsMut.Lock()
-	delete(m.camps, c.ID)
-	delete(m.campRates, c.ID)
+	delete(m.camps, id)
+	delete(m.campRates, id)
+	delete(m.campVariants, id)
+	delete(m.campWindows, id)
 	m.campsMut.Unlock()
 
+	for _, th := range m.throttles {
+		msgs := th.removeCamp(id)
+		atomic.AddInt32(&m.numDeferred, -int32(len(msgs)))
+		for _, msg := range msgs {
+			m.dropMessage(msg)
+		}
+	}
+}
+
+// pauseCampaign stops processing a campaign and pauses it with the given reason.
+// It returns true if the campaign was paused by this instance.
+func (m *Manager) pauseCampaign(c *models.Campaign, reason string) bool {
+	m.removeCampaign(c.ID)
+
+	ok, err := m.store.PauseCampaign(c.ID, reason)
+	if err != nil {
+		m.logger.Printf("error pausing campaign (%s): %v", c.Name, err)
+		return false
+	}
+	if ok {
+		m.logger.Printf("set campaign (%s) to %s", c.Name, models.CampaignStatusPaused)
+	}
+	return ok
+}
+
+// exhaustCampaign stops processing a campaign and updates its status. The bool
+// indicates whether admins should be notified of the campaign's new status.
+func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Campaign, bool, error) {
+	m.removeCampaign(c.ID)
+
 	// A status has been passed. Change the campaign's status
 	// without further checks.
 	if status != "" {
@@ -629,37 +1081,85 @@ func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Ca
 		} else {
 			m.logger.Printf("set campaign (%s) to %s", c.Name, status)
 		}
-		return c, nil
+		return c, true, nil
 	}
 
 	// Fetch the up-to-date campaign status from the source.
 	cm, err := m.store.GetCampaign(c.ID)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+
+	// If a running A/B tested campaign has exhausted its test batch, it waits
+	// for the test window to be over before the winner is sent to the rest.
+	if cm.Status == models.CampaignStatusRunning && c.IsABTest() && !c.ABTestSentAt.Valid {
+		if err := m.store.EndCampaignABTest(c.ID); err != nil {
+			m.logger.Printf("error ending A/B test of campaign (%s): %v", c.Name, err)
+		} else {
+			m.logger.Printf("campaign (%s) A/B test batch sent. waiting %d minutes to pick a winner",
+				c.Name, c.ABTestWaitMins)
+		}
+		return cm, false, nil
 	}
 
-	// If a running campaign has exhausted subscribers, it's finished.
+	// If a running campaign that's sent at a local time has exhausted the
+	// subscribers of its current wave of timezones, it waits for the next one.
+	if cm.Status == models.CampaignStatusRunning && cm.SendLocal && cm.WaveTo.Valid {
+		wave := cm.WaveTo.Time
+		next, err := m.store.NextCampaignWave(c.ID, wave)
+		if err != nil {
+			return nil, false, fmt.Errorf("error moving to the next wave: %v", err)
+		}
+		if next.Valid {
+			m.logger.Printf("campaign (%s) wave sent. next wave at %s", c.Name, next.Time.Format(time.RFC822Z))
+			return cm, false, nil
+		}
+
+		// The wave may have been moved on by another instance.
+		if cm, err = m.store.GetCampaign(c.ID); err != nil {
+			return nil, false, err
+		}
+		if cm.Status == models.CampaignStatusRunning && !cm.WaveTo.Time.Equal(wave) {
+			return cm, false, nil
+		}
+	}
+
+	// If a running campaign has exhausted subscribers, it's finished. Only the
+	// instance that marks it as finished sends the notification.
 	if cm.Status == models.CampaignStatusRunning {
-		cm.Status = models.CampaignStatusFinished
-		if err := m.store.UpdateCampaignStatus(c.ID, models.CampaignStatusFinished); err != nil {
+		ok, err := m.store.FinishCampaign(c.ID)
+		if err != nil {
 			m.logger.Printf("error finishing campaign (%s): %v", c.Name, err)
-		} else {
+			return cm, false, nil
+		}
+		if ok {
+			cm.Status = models.CampaignStatusFinished
 			m.logger.Printf("campaign (%s) finished", c.Name)
+			return cm, true, nil
+		}
+
+		// The campaign's status has changed since it was fetched.
+		if cm, err = m.store.GetCampaign(c.ID); err != nil {
+			return nil, false, err
 		}
-	} else {
-		m.logger.Printf("stop processing campaign (%s)", c.Name)
 	}
 
-	return cm, nil
+	// The status has been changed elsewhere, eg: the campaign's been paused
+	// by a user or finished by another instance.
+	m.logger.Printf("stop processing campaign (%s)", c.Name)
+	notify := cm.Status != models.CampaignStatusRunning &&
+		cm.Status != models.CampaignStatusFinished && m.isOldestNode()
+	return cm, notify, nil
 }
 
 // trackLink register a URL and return its UUID to be used in message templates
-// for tracking links.
-func (m *Manager) trackLink(url, campUUID, subUUID string) string {
+// for tracking links. The query, if any, is added to the tracking URL and not to
+// the original URL that's returned if the registration fails.
+func (m *Manager) trackLink(url, campUUID, subUUID, query string) string {
 	m.linksMut.RLock()
 	if uu, ok := m.links[url]; ok {
 		m.linksMut.RUnlock()
-		return fmt.Sprintf(m.cfg.LinkTrackURL, uu, campUUID, subUUID)
+		return withQuery(fmt.Sprintf(m.cfg.LinkTrackURL, uu, campUUID, subUUID), query)
 	}
 	m.linksMut.RUnlock()
 
@@ -676,7 +1176,36 @@ func (m *Manager) trackLink(url, campUUID, subUUID string) string {
 	m.links[url] = uu
 	m.linksMut.Unlock()
 
-	return fmt.Sprintf(m.cfg.LinkTrackURL, uu, campUUID, subUUID)
+	return withQuery(fmt.Sprintf(m.cfg.LinkTrackURL, uu, campUUID, subUUID), query)
+}
+
+// withQuery adds a query to a URL, after its existing query, if any.
+func withQuery(u, query string) string {
+	if query == "" {
+		return u
+	}
+	if strings.Contains(u, "?") {
+		return u + "&" + query
+	}
+	return u + "?" + query
+}
+
+// variantQuery returns the query that's added to tracking URLs
+// to attribute views and clicks to the A/B test variant of a campaign.
+func variantQuery(c *models.Campaign) string {
+	if c.VariantID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("v=%d", c.VariantID)
+}
+
+// txQuery returns the query that's added to tracking URLs
+// to attribute views and clicks to a transactional template.
+func txQuery(tpl *models.Template) string {
+	if tpl.ID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("t=%d", tpl.ID)
 }
 
 // sendNotif sends a notification to registered admin e-mails.
@@ -0,0 +1,87 @@
+package manager
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// linkStore is a Store that registers links with a fixed UUID or fails.
+type linkStore struct {
+	Store
+	err error
+}
+
+func (s *linkStore) CreateLink(url string) (string, error) {
+	return "link-uuid", s.err
+}
+
+func TestTrackLink(t *testing.T) {
+	cases := []struct {
+		trackURL string
+		url      string
+		query    string
+		err      error
+		out      string
+	}{
+		{"https://x.com/link/%s/%s/%s", "https://a.com/?a=1", "", nil,
+			"https://x.com/link/link-uuid/camp/sub"},
+		{"https://x.com/link/%s/%s/%s", "https://a.com/?a=1", "v=2", nil,
+			"https://x.com/link/link-uuid/camp/sub?v=2"},
+		{"https://x.com/link/%s/%s/%s?l=1", "https://a.com/", "v=2", nil,
+			"https://x.com/link/link-uuid/camp/sub?l=1&v=2"},
+
+		// The original URL is returned as is if the link can't be registered.
+		{"https://x.com/link/%s/%s/%s", "https://a.com/?a=1", "v=2", errors.New("fail"),
+			"https://a.com/?a=1"},
+	}
+
+	for _, c := range cases {
+		m := New(Config{LinkTrackURL: c.trackURL}, &linkStore{err: c.err}, nil, nil, log.New(ioutil.Discard, "", 0))
+		if out := m.trackLink(c.url, "camp", "sub", c.query); out != c.out {
+			t.Errorf("%s (%s): got %s, want %s", c.url, c.query, out, c.out)
+		}
+	}
+}
+
+func TestWithQuery(t *testing.T) {
+	cases := []struct {
+		url, query, out string
+	}{
+		{"https://x.com/a", "", "https://x.com/a"},
+		{"https://x.com/a", "v=1", "https://x.com/a?v=1"},
+		{"https://x.com/a?b=2", "v=1", "https://x.com/a?b=2&v=1"},
+	}
+	for _, c := range cases {
+		if out := withQuery(c.url, c.query); out != c.out {
+			t.Errorf("%s (%s): got %s, want %s", c.url, c.query, out, c.out)
+		}
+	}
+}
+
+func TestTxTrackLink(t *testing.T) {
+	var (
+		tpl = &models.Template{Base: models.Base{ID: 3}}
+		d   = models.TxTplData{Subscriber: models.Subscriber{UUID: "sub"}}
+	)
+
+	cases := []struct {
+		err error
+		out string
+	}{
+		{nil, "https://x.com/link/link-uuid/" + dummyUUID + "/sub?t=3"},
+		{errors.New("fail"), "https://a.com/?a=1"},
+	}
+	for _, c := range cases {
+		m := New(Config{LinkTrackURL: "https://x.com/link/%s/%s/%s", IndividualTracking: true},
+			&linkStore{err: c.err}, nil, nil, log.New(ioutil.Discard, "", 0))
+
+		f := m.TxTemplateFuncs(tpl)["TrackLink"].(func(string, models.TxTplData) string)
+		if out := f("https://a.com/?a=1", d); out != c.out {
+			t.Errorf("got %s, want %s", out, c.out)
+		}
+	}
+}
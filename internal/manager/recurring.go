@@ -0,0 +1,147 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/cron"
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+var regexpTags = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// runRecurringCampaigns creates the due runs of recurring campaigns as new
+// campaigns, which are then picked up and sent like any other campaign.
+func (m *Manager) runRecurringCampaigns() {
+	camps, err := m.store.NextRecurringCampaigns()
+	if err != nil {
+		m.logger.Printf("error fetching recurring campaigns: %v", err)
+		return
+	}
+
+	for _, c := range camps {
+		sch, err := cron.Parse(c.Cron)
+		if err != nil {
+			m.logger.Printf("error parsing the schedule of recurring campaign (%s): %v", c.Name, err)
+			continue
+		}
+
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			loc = time.UTC
+		}
+
+		// Runs that were missed, eg: while the app was down, are caught up
+		// on with a single run.
+		var (
+			runAt = c.NextRunAt.Time.In(loc)
+			next  null.Time
+		)
+		if t := sch.Next(time.Now().In(loc)); !t.IsZero() {
+			next = null.TimeFrom(t)
+		}
+
+		// Runs of feed driven campaigns are sent only when there are new
+		// items in the feed.
+		skip := false
+		if c.FeedURL != "" {
+			items, err := m.newFeedItems(c)
+			if err != nil {
+				m.logger.Printf("error fetching feed of recurring campaign (%s): %v", c.Name, err)
+			}
+			c.FeedItems = items
+			skip = len(items) == 0
+		}
+
+		if c.SkipEmpty && !skip {
+			empty, err := m.isEmptyCampaign(c)
+			if err != nil {
+				m.logger.Printf("error rendering recurring campaign (%s): %v", c.Name, err)
+			}
+			skip = empty
+		}
+
+		name := fmt.Sprintf("%s (%s)", c.Name, runAt.Format("2006-01-02 15:04"))
+		id, err := m.store.CreateCampaignRun(c.ID, c.NextRunAt.Time, name, skip, next, c.FeedItems)
+		if err != nil {
+			m.logger.Printf("error creating run of recurring campaign (%s): %v", c.Name, err)
+			continue
+		}
+
+		if skip {
+			m.logger.Printf("skipped empty run (%s) of recurring campaign (%s)", name, c.Name)
+		} else if id > 0 {
+			m.logger.Printf("created run (%s) of recurring campaign (%s)", name, c.Name)
+		}
+	}
+}
+
+// newFeedItems fetches the feed of a campaign and returns the items in it
+// that haven't been sent in its previous runs.
+func (m *Manager) newFeedItems(c *models.Campaign) (models.FeedItems, error) {
+	if m.cfg.Feeds == nil {
+		return nil, errors.New("no feed fetcher")
+	}
+
+	items, err := m.cfg.Feeds.Fetch(c.FeedURL)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+
+	guids := make([]string, 0, len(items))
+	for _, i := range items {
+		guids = append(guids, i.GUID)
+	}
+	sent, err := m.store.GetSentFeedItems(c.ID, guids)
+	if err != nil {
+		return nil, err
+	}
+
+	isSent := make(map[string]bool, len(sent))
+	for _, g := range sent {
+		isSent[g] = true
+	}
+
+	out := models.FeedItems{}
+	for _, i := range items {
+		if !isSent[i.GUID] {
+			// Feeds may have duplicate items.
+			isSent[i.GUID] = true
+			out = append(out, i)
+		}
+	}
+	return out, nil
+}
+
+// isEmptyCampaign checks if the content of a campaign renders to nothing
+// but markup and whitespace, eg: when all of it is in a conditional block.
+func (m *Manager) isEmptyCampaign(c *models.Campaign) (bool, error) {
+	if err := c.CompileTemplate(m.TemplateFuncs(c)); err != nil {
+		return false, err
+	}
+
+	msg := CampaignMessage{
+		Campaign: c,
+		Subscriber: models.Subscriber{
+			UUID:    dummyUUID,
+			Email:   "demo@listmonk.app",
+			Name:    "Demo Subscriber",
+			Attribs: models.SubscriberAttribs{},
+		},
+		unsubURL: fmt.Sprintf(m.cfg.UnsubURL, c.UUID, dummyUUID),
+	}
+
+	var b bytes.Buffer
+	if err := c.Tpl.ExecuteTemplate(&b, models.ContentTpl, &msg); err != nil {
+		return false, err
+	}
+
+	txt := html.UnescapeString(regexpTags.ReplaceAllString(b.String(), ""))
+	return strings.TrimSpace(txt) == "", nil
+}
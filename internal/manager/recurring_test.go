@@ -0,0 +1,79 @@
+package manager
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// stubFeeds is a feeds.Fetcher that returns fixed items.
+type stubFeeds struct {
+	items models.FeedItems
+	err   error
+}
+
+func (f *stubFeeds) Fetch(string) (models.FeedItems, error) {
+	return f.items, f.err
+}
+
+// feedStore is a Store that only implements GetSentFeedItems.
+type feedStore struct {
+	Store
+	sent []string
+}
+
+func (s *feedStore) GetSentFeedItems(campID int, guids []string) ([]string, error) {
+	return s.sent, nil
+}
+
+func TestNewFeedItems(t *testing.T) {
+	items := models.FeedItems{
+		{GUID: "a"}, {GUID: "b"}, {GUID: "a"}, {GUID: "c"}, {GUID: "b"},
+	}
+
+	cases := []struct {
+		name  string
+		feeds *stubFeeds
+		sent  []string
+		out   []string
+		err   bool
+	}{
+		{"all new, duplicates dropped", &stubFeeds{items: items}, nil, []string{"a", "b", "c"}, false},
+		{"some sent", &stubFeeds{items: items}, []string{"b"}, []string{"a", "c"}, false},
+		{"all sent", &stubFeeds{items: items}, []string{"a", "b", "c"}, []string{}, false},
+		{"empty feed", &stubFeeds{}, nil, nil, false},
+		{"fetch error", &stubFeeds{err: errors.New("fail")}, nil, nil, true},
+	}
+
+	for _, c := range cases {
+		m := New(Config{Feeds: c.feeds}, &feedStore{sent: c.sent}, nil, nil, log.New(ioutil.Discard, "", 0))
+
+		got, err := m.newFeedItems(&models.Campaign{FeedURL: "https://example.com/feed"})
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v", c.name, err)
+			continue
+		}
+
+		var guids []string
+		if got != nil {
+			guids = []string{}
+			for _, i := range got {
+				guids = append(guids, i.GUID)
+			}
+		}
+		if !reflect.DeepEqual(guids, c.out) {
+			t.Errorf("%s: got %v, want %v", c.name, guids, c.out)
+		}
+	}
+}
+
+func TestNewFeedItemsNoFetcher(t *testing.T) {
+	m := New(Config{}, &feedStore{}, nil, nil, log.New(ioutil.Discard, "", 0))
+	if _, err := m.newFeedItems(&models.Campaign{FeedURL: "https://example.com/feed"}); err == nil {
+		t.Error("expected error without a feed fetcher")
+	}
+}
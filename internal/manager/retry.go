@@ -0,0 +1,118 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// scanRetries is a blocking function that periodically sends the failed
+// messages of campaigns that have been requeued.
+func (m *Manager) scanRetries(tick time.Duration) {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+
+	for range t.C {
+		// Keep sending until there are no more retries queued.
+		for {
+			if n := m.nextRetries(); n == 0 {
+				break
+			}
+		}
+	}
+}
+
+// nextRetries claims the next batch of requeued failures and queues their
+// messages like the messages of a subscriber batch, subject to the same limits.
+// The batch only has the failures of campaigns that are running or finished,
+// which is checked again for every batch. Failures whose messages can't be
+// prepared are recorded again with the error. It returns the number of
+// messages in the batch.
+func (m *Manager) nextRetries() int {
+	retries, err := m.store.NextCampaignRetries(m.cfg.BatchSize)
+	if err != nil {
+		m.logger.Printf("error fetching campaign retries: %v", err)
+		return 0
+	}
+
+	n := 0
+	for campID, subs := range retries {
+		n += len(subs)
+
+		c, vars, err := m.getRetryCampaign(campID)
+		if err != nil {
+			m.logger.Printf("error preparing retries of campaign %d: %v", campID, err)
+			for _, s := range subs {
+				m.recordRetryFailure(campID, s.ID, err)
+			}
+			continue
+		}
+
+		for _, s := range subs {
+			camp := c
+			if len(vars) > 0 {
+				camp = vars[c.ABTestVariant(s.ID)]
+			}
+
+			msg, err := m.NewCampaignMessage(camp, s)
+			if err != nil {
+				m.logger.Printf("error rendering message (%s) (%s): %v", c.Name, s.Email, err)
+				m.recordRetryFailure(campID, s.ID, err)
+				continue
+			}
+			msg.isRetry = true
+
+			// Hold back if too many messages are waiting on throttled domains.
+			if len(m.throttles) > 0 {
+				m.waitDeferred()
+			}
+
+			m.campMsgQueue <- msg
+			m.waitSlidingWindow()
+		}
+		m.logger.Printf("requeued %d failed messages of campaign (%s)", len(subs), c.Name)
+	}
+
+	return n
+}
+
+// recordRetryFailure records a claimed failure again so that it isn't lost
+// when its message can't be sent.
+func (m *Manager) recordRetryFailure(campID, subID int, err error) {
+	if err := m.store.RecordCampaignFailure(campID, subID, err.Error()); err != nil {
+		m.logger.Printf("error recording failure of campaign %d: %v", campID, err)
+	}
+}
+
+// getRetryCampaign fetches and compiles a campaign whose failures are being
+// retried. Failures from an A/B test batch without a winner yet are retried
+// with the variants the subscribers were assigned, which are also returned.
+func (m *Manager) getRetryCampaign(campID int) (*models.Campaign, []*models.Campaign, error) {
+	c, err := m.store.GetCampaign(campID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, ok := m.messengers[c.Messenger]; !ok {
+		return nil, nil, fmt.Errorf("unknown messenger %s on campaign %s", c.Messenger, c.Name)
+	}
+
+	// Views and clicks on messages with the winning variant are attributed to it.
+	if c.ABWinnerID.Valid {
+		c.VariantID = c.ABWinnerID.Int
+	}
+	if err := c.CompileTemplate(m.TemplateFuncs(c)); err != nil {
+		return nil, nil, err
+	}
+
+	if !c.IsABTest() || c.ABWinnerID.Valid {
+		return c, nil, nil
+	}
+
+	vars, err := m.compileVariants(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, vars, nil
+}
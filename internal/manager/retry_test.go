@@ -0,0 +1,48 @@
+package manager
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// retryStore is a Store that returns a fixed batch of retries and records
+// the failures recorded again.
+type retryStore struct {
+	Store
+
+	retries map[int][]models.Subscriber
+	failed  []int
+}
+
+func (s *retryStore) NextCampaignRetries(limit int) (map[int][]models.Subscriber, error) {
+	return s.retries, nil
+}
+
+func (s *retryStore) GetCampaign(campID int) (*models.Campaign, error) {
+	return nil, errors.New("fail")
+}
+
+func (s *retryStore) RecordCampaignFailure(campID, subID int, reason string) error {
+	s.failed = append(s.failed, subID)
+	return nil
+}
+
+func TestNextRetriesRecordsFailures(t *testing.T) {
+	st := &retryStore{retries: map[int][]models.Subscriber{
+		1: {{Base: models.Base{ID: 10}}, {Base: models.Base{ID: 20}}},
+	}}
+	m := New(Config{}, st, nil, nil, log.New(ioutil.Discard, "", 0))
+
+	// The campaign can't be fetched. Its claimed retries are recorded again.
+	if n := m.nextRetries(); n != 2 {
+		t.Errorf("got %d retries, want 2", n)
+	}
+	if !reflect.DeepEqual(st.failed, []int{10, 20}) {
+		t.Errorf("got recorded failures %v, want [10 20]", st.failed)
+	}
+}
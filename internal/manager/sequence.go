@@ -0,0 +1,100 @@
+package manager
+
+import (
+	"net/textproto"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/models"
+)
+
+// scanSequences is a blocking function that periodically enrolls subscribers
+// into sequences and sends them the steps of the sequences that are due.
+func (m *Manager) scanSequences(tick time.Duration) {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+
+	for range t.C {
+		// Keep sending until there are no more messages due.
+		for {
+			if n := m.nextSequenceMessages(); n == 0 {
+				break
+			}
+		}
+	}
+}
+
+// nextSequenceMessages renders and queues the next batch of sequence messages
+// that are due. It returns the number of messages in the batch.
+func (m *Manager) nextSequenceMessages() int {
+	msgs, err := m.store.NextSequenceMessages(m.cfg.BatchSize)
+	if err != nil {
+		m.logger.Printf("error fetching sequence messages: %v", err)
+		return 0
+	}
+
+	// The steps in the batch are compiled once. A step that fails
+	// to compile is nil.
+	steps := make(map[int]*models.Campaign)
+	for _, sm := range msgs {
+		if _, ok := m.messengers[sm.Sequence.Messenger]; !ok {
+			m.logger.Printf("unknown messenger %s on sequence (%s)", sm.Sequence.Messenger, sm.Sequence.Name)
+			continue
+		}
+
+		c, ok := steps[sm.Step.ID]
+		if !ok {
+			c = sm.Sequence.Campaign(sm.Step)
+			if err := c.CompileTemplate(m.TemplateFuncs(c)); err != nil {
+				m.logger.Printf("error compiling step %d of sequence (%s): %v", sm.Step.Position+1, sm.Sequence.Name, err)
+				c = nil
+			}
+			steps[sm.Step.ID] = c
+		}
+		if c == nil {
+			continue
+		}
+
+		msg, err := m.NewCampaignMessage(c, sm.Subscriber)
+		if err != nil {
+			m.logger.Printf("error rendering message (%s) (%s): %v", sm.Sequence.Name, sm.Subscriber.Email, err)
+			continue
+		}
+
+		// Push the message to the queue while blocking and waiting until
+		// the queue is drained.
+		m.msgQueue <- m.newSequenceMessage(msg)
+	}
+
+	return len(msgs)
+}
+
+// newSequenceMessage returns a Message to be sent out by the workers from
+// a rendered sequence step.
+func (m *Manager) newSequenceMessage(msg CampaignMessage) Message {
+	h := textproto.MIMEHeader{}
+	h.Set(models.EmailHeaderCampaignUUID, msg.Campaign.UUID)
+	h.Set(models.EmailHeaderSubscriberUUID, msg.Subscriber.UUID)
+
+	// Attach List-Unsubscribe headers?
+	if m.cfg.UnsubHeader {
+		h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		h.Set("List-Unsubscribe", `<`+msg.unsubURL+`>`)
+	}
+
+	return Message{
+		Message: messenger.Message{
+			From:        msg.from,
+			To:          []string{msg.to},
+			Subject:     msg.subject,
+			ContentType: msg.Campaign.ContentType,
+			Body:        msg.body,
+			AltBody:     msg.altBody,
+			Headers:     h,
+			Subscriber:  msg.Subscriber,
+			Campaign:    msg.Campaign,
+		},
+		Subscriber: msg.Subscriber,
+		Messenger:  msg.Campaign.Messenger,
+	}
+}
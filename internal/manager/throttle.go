@@ -0,0 +1,286 @@
+package manager
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulbellamy/ratecounter"
+)
+
+// throttleInterval is the interval at which deferred messages of throttled
+// domains are checked for release.
+const throttleInterval = time.Millisecond * 100
+
+// errCampaignStopped is recorded as the failure of deferred messages that are
+// dropped when their campaign stops being processed.
+const errCampaignStopped = "campaign stopped before the message was sent"
+
+// DomainThrottle represents the sending limits for a recipient domain.
+type DomainThrottle struct {
+	Domain string `json:"domain"`
+
+	// Rate is the maximum number of messages sent to the domain per minute.
+	// 0 is unlimited.
+	Rate int `json:"rate"`
+
+	// Concurrency is the maximum number of messages being sent to the domain
+	// at any given time. 0 is unlimited.
+	Concurrency int `json:"concurrency"`
+}
+
+// DomainStats contains the stats of a campaign for a throttled domain.
+type DomainStats struct {
+	Domain string `json:"domain"`
+
+	// Messages sent to the domain over the last minute.
+	SendRate int `json:"rate"`
+
+	// Messages waiting for the domain's limits to free up.
+	Deferred int `json:"deferred"`
+}
+
+// throttle holds the state of a throttled domain. Messages that can't be
+// sent right away are queued on it and released by runThrottles as the
+// limits free up so that the workers are free to send to other domains.
+type throttle struct {
+	DomainThrottle
+
+	mut sync.Mutex
+
+	// Number of messages being sent.
+	active int
+
+	// The earliest time at which the next message can be sent.
+	next time.Time
+
+	// Message send interval derived from the rate.
+	interval time.Duration
+
+	queue []CampaignMessage
+
+	// Per campaign send rates and number of deferred messages.
+	rates    map[int]*ratecounter.RateCounter
+	deferred map[int]int
+}
+
+func newThrottle(d DomainThrottle) *throttle {
+	t := &throttle{
+		DomainThrottle: d,
+		rates:          make(map[int]*ratecounter.RateCounter),
+		deferred:       make(map[int]int),
+	}
+	if d.Rate > 0 {
+		t.interval = time.Minute / time.Duration(d.Rate)
+	}
+	return t
+}
+
+// admit reserves a slot for a message if the domain's limits allow it to be
+// sent right away. Otherwise, the message is queued behind the already
+// deferred messages and false is returned.
+func (t *throttle) admit(msg CampaignMessage, now time.Time) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if len(t.queue) == 0 && t.reserve(now) {
+		return true
+	}
+
+	t.queue = append(t.queue, msg)
+	t.deferred[msg.Campaign.ID]++
+	return false
+}
+
+// pop returns the oldest deferred message if the domain's limits allow it to
+// be sent, reserving a slot for it.
+func (t *throttle) pop(now time.Time) (CampaignMessage, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if len(t.queue) == 0 || !t.reserve(now) {
+		return CampaignMessage{}, false
+	}
+
+	msg := t.queue[0]
+	t.queue[0] = CampaignMessage{}
+	t.queue = t.queue[1:]
+
+	id := msg.Campaign.ID
+	if t.deferred[id]--; t.deferred[id] <= 0 {
+		delete(t.deferred, id)
+	}
+	return msg, true
+}
+
+// reserve takes up a concurrency and rate slot if available.
+// It should be called with the lock held.
+func (t *throttle) reserve(now time.Time) bool {
+	if t.Concurrency > 0 && t.active >= t.Concurrency {
+		return false
+	}
+	if now.Before(t.next) {
+		return false
+	}
+
+	t.active++
+	if t.interval > 0 {
+		// Deferred messages are released every throttleInterval. Allow the
+		// unused time of up to one interval to be made up for, but not more,
+		// so that idle periods don't accumulate into bursts.
+		if floor := now.Add(-throttleInterval); t.next.Before(floor) {
+			t.next = floor
+		}
+		t.next = t.next.Add(t.interval)
+	}
+	return true
+}
+
+// release frees up the concurrency slot taken by a message after it's sent.
+func (t *throttle) release(campID int) {
+	t.mut.Lock()
+	t.active--
+
+	r, ok := t.rates[campID]
+	if !ok {
+		r = ratecounter.NewRateCounter(time.Minute)
+		t.rates[campID] = r
+	}
+	t.mut.Unlock()
+
+	r.Incr(1)
+}
+
+// getStats returns the domain's stats for a campaign.
+func (t *throttle) getStats(campID int) (DomainStats, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	r, ok := t.rates[campID]
+	d := t.deferred[campID]
+	if !ok && d == 0 {
+		return DomainStats{}, false
+	}
+
+	out := DomainStats{Domain: t.Domain, Deferred: d}
+	if ok {
+		out.SendRate = int(r.Rate())
+	}
+	return out, true
+}
+
+// cancel frees up the concurrency slot reserved for a message that's not
+// going to be sent.
+func (t *throttle) cancel() {
+	t.mut.Lock()
+	t.active--
+	t.mut.Unlock()
+}
+
+// removeCamp clears the stats of a campaign and removes its deferred messages
+// from the queue, returning them. Retries aren't tied to the campaign being
+// processed and are left in the queue.
+func (t *throttle) removeCamp(campID int) []CampaignMessage {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	delete(t.rates, campID)
+
+	var (
+		out   []CampaignMessage
+		queue = t.queue[:0]
+	)
+	for _, msg := range t.queue {
+		if msg.Campaign.ID != campID || msg.isRetry {
+			queue = append(queue, msg)
+			continue
+		}
+		out = append(out, msg)
+	}
+	for i := len(queue); i < len(t.queue); i++ {
+		t.queue[i] = CampaignMessage{}
+	}
+	t.queue = queue
+
+	if t.deferred[campID] -= len(out); t.deferred[campID] <= 0 {
+		delete(t.deferred, campID)
+	}
+	return out
+}
+
+// getThrottle returns the throttle for the domain of an e-mail, if there's one.
+func (m *Manager) getThrottle(email string) *throttle {
+	if len(m.throttles) == 0 {
+		return nil
+	}
+
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return nil
+	}
+	return m.throttles[strings.ToLower(strings.TrimSpace(email[i+1:]))]
+}
+
+// runThrottles is a blocking function that periodically releases the deferred
+// messages of throttled domains to the workers as the domains' limits free up.
+func (m *Manager) runThrottles() {
+	t := time.NewTicker(throttleInterval)
+	defer t.Stop()
+
+	for range t.C {
+		for _, th := range m.throttles {
+			for {
+				msg, ok := th.pop(time.Now())
+				if !ok {
+					break
+				}
+				atomic.AddInt32(&m.numDeferred, -1)
+
+				// The campaign may have been paused or cancelled since the
+				// message was deferred.
+				if !msg.isRetry && !m.isCampaignProcessing(msg.Campaign.ID) {
+					th.cancel()
+					m.dropMessage(msg)
+					continue
+				}
+				m.campMsgThrottledQueue <- throttledMsg{msg: msg, th: th}
+			}
+		}
+	}
+}
+
+// dropMessage gives up on a deferred message of a campaign that's no longer
+// being processed. The message is queued as a retry so that it's sent if the
+// campaign is resumed, and its subscriber is marked done in the batch so that
+// the batch's lease can be released.
+func (m *Manager) dropMessage(msg CampaignMessage) {
+	if err := m.store.QueueCampaignRetry(msg.Campaign.ID, msg.Subscriber.ID, errCampaignStopped); err != nil {
+		m.logger.Printf("error queueing retry of campaign (%s): %v", msg.Campaign.Name, err)
+	}
+	m.doneMessage(msg.batch, msg.Subscriber.ID, 0)
+}
+
+// waitDeferred blocks while the number of deferred messages is at the limit
+// so that the subscriber fetching doesn't run away from throttled domains.
+func (m *Manager) waitDeferred() {
+	for atomic.LoadInt32(&m.numDeferred) >= int32(m.maxDeferred) {
+		time.Sleep(throttleInterval)
+	}
+}
+
+// getDomainStats returns the throttled domain stats of a campaign.
+func (m *Manager) getDomainStats(campID int) []DomainStats {
+	var out []DomainStats
+	for _, th := range m.throttles {
+		if s, ok := th.getStats(campID); ok {
+			out = append(out, s)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Domain < out[j].Domain
+	})
+	return out
+}
@@ -0,0 +1,79 @@
+package manager
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// throttleStore is a leaseStore that records the messages queued as retries.
+type throttleStore struct {
+	leaseStore
+
+	retries []int
+}
+
+func (s *throttleStore) QueueCampaignRetry(campID, subID int, reason string) error {
+	s.retries = append(s.retries, subID)
+	return nil
+}
+
+func TestRemoveCampaignDropsDeferred(t *testing.T) {
+	st := &throttleStore{leaseStore: leaseStore{variants: make(map[int]int)}}
+	m := New(Config{
+		DomainThrottles: []DomainThrottle{{Domain: "example.com", Concurrency: 1}},
+	}, st, nil, nil, log.New(ioutil.Discard, "", 0))
+
+	var (
+		th    = m.throttles["example.com"]
+		camp  = &models.Campaign{Base: models.Base{ID: 1}}
+		other = &models.Campaign{Base: models.Base{ID: 2}}
+		subs  = []models.Subscriber{{Base: models.Base{ID: 10}}, {Base: models.Base{ID: 20}}}
+		b     = newBatch(1, subs, false)
+		now   = time.Now()
+	)
+
+	// The first message takes up the only slot and the rest are deferred.
+	msgs := []CampaignMessage{
+		{Campaign: other, Subscriber: models.Subscriber{Base: models.Base{ID: 1}}},
+		{Campaign: camp, Subscriber: subs[0], batch: b},
+		{Campaign: other, Subscriber: models.Subscriber{Base: models.Base{ID: 2}}},
+		{Campaign: camp, Subscriber: models.Subscriber{Base: models.Base{ID: 3}}, isRetry: true},
+		{Campaign: camp, Subscriber: subs[1], batch: b},
+	}
+	for i, msg := range msgs {
+		if ok := th.admit(msg, now); ok != (i == 0) {
+			t.Fatalf("message %d: got admitted %v", i, ok)
+		}
+	}
+	m.numDeferred = int32(len(msgs) - 1)
+
+	m.removeCampaign(camp.ID)
+
+	// The campaign's deferred messages are queued as retries and their batch
+	// is released. Retries and the messages of other campaigns are kept.
+	if !reflect.DeepEqual(st.retries, []int{10, 20}) {
+		t.Errorf("got retries %v, want [10 20]", st.retries)
+	}
+	if !st.released {
+		t.Error("batch of the dropped messages not released")
+	}
+
+	var ids []int
+	for _, msg := range th.queue {
+		ids = append(ids, msg.Subscriber.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{2, 3}) {
+		t.Errorf("got queued subscribers %v, want [2 3]", ids)
+	}
+	if th.deferred[camp.ID] != 1 || th.deferred[other.ID] != 1 {
+		t.Errorf("unexpected deferred counts %v", th.deferred)
+	}
+	if m.numDeferred != 2 {
+		t.Errorf("got %d deferred messages, want 2", m.numDeferred)
+	}
+}
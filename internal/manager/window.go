@@ -0,0 +1,47 @@
+package manager
+
+import "sync"
+
+// sendWindow keeps track of the outcomes of the last N messages sent in a
+// campaign to compute its rolling error rate.
+type sendWindow struct {
+	mut sync.Mutex
+
+	// Ring buffer of the outcomes. true is a failed send.
+	res  []bool
+	pos  int
+	num  int
+	errs int
+}
+
+func newSendWindow(size int) *sendWindow {
+	return &sendWindow{res: make([]bool, size)}
+}
+
+// add records the outcome of a send, dropping the oldest one if the window is full.
+func (w *sendWindow) add(failed bool) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.num == len(w.res) {
+		if w.res[w.pos] {
+			w.errs--
+		}
+	} else {
+		w.num++
+	}
+
+	w.res[w.pos] = failed
+	if failed {
+		w.errs++
+	}
+	w.pos = (w.pos + 1) % len(w.res)
+}
+
+// stats returns the number of failed sends and the total number of sends
+// in the window.
+func (w *sendWindow) stats() (int, int) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return w.errs, w.num
+}
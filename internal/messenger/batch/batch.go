@@ -0,0 +1,212 @@
+// Package batch implements a batching and rate limiting dispatcher that API
+// based messengers use to send messages to providers.
+package batch
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+const defaultWait = time.Millisecond * 100
+
+// ErrClosed is returned when a message is pushed after the dispatcher is closed.
+var ErrClosed = errors.New("messenger is closed")
+
+// Opt represents batching and rate limiting options.
+type Opt struct {
+	// Size is the maximum number of messages in a single batch.
+	Size int
+
+	// Wait is the maximum duration to wait for a batch to fill up before
+	// it's sent.
+	Wait time.Duration
+
+	// Concurrency is the maximum number of batches that are sent concurrently.
+	Concurrency int
+
+	// Rate is the maximum number of messages sent per second. 0 is unlimited.
+	Rate int
+}
+
+// Result is the outcome of sending a single message. ID is the message ID
+// returned by the provider.
+type Result struct {
+	ID  string
+	Err error
+}
+
+// SendFunc sends a batch of messages to a provider and returns one Result
+// for every message in the same order.
+type SendFunc func(msgs []messenger.Message) []Result
+
+type item struct {
+	msg messenger.Message
+	res chan Result
+}
+
+// Batcher collects messages pushed concurrently into batches and dispatches
+// them to a SendFunc while honoring the concurrency and rate limits.
+type Batcher struct {
+	o    Opt
+	send SendFunc
+
+	q   chan item
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	// Pacing for the rate limit. Only accessed by the run goroutine.
+	next time.Time
+
+	mut    sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// New returns a new Batcher and starts its dispatcher.
+func New(o Opt, send SendFunc) *Batcher {
+	if o.Size < 1 {
+		o.Size = 1
+	}
+	if o.Wait <= 0 {
+		o.Wait = defaultWait
+	}
+	if o.Concurrency < 1 {
+		o.Concurrency = 1
+	}
+
+	b := &Batcher{
+		o:    o,
+		send: send,
+		q:    make(chan item, o.Size),
+		sem:  make(chan struct{}, o.Concurrency),
+		done: make(chan struct{}),
+	}
+	go b.run()
+
+	return b
+}
+
+// Push queues a message and blocks until the batch it's a part of is sent.
+// It returns the provider's ID for the message.
+func (b *Batcher) Push(m messenger.Message) (string, error) {
+	it := item{msg: m, res: make(chan Result, 1)}
+
+	b.mut.RLock()
+	if b.closed {
+		b.mut.RUnlock()
+		return "", ErrClosed
+	}
+	b.q <- it
+	b.mut.RUnlock()
+
+	r := <-it.res
+	return r.ID, r.Err
+}
+
+// Close stops accepting messages and waits for the pending batches to be sent.
+func (b *Batcher) Close() {
+	b.mut.Lock()
+	if b.closed {
+		b.mut.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.q)
+	b.mut.Unlock()
+
+	<-b.done
+}
+
+// run collects messages from the queue into batches of up to Size messages,
+// waiting up to Wait for a batch to fill, and sends them.
+func (b *Batcher) run() {
+	defer close(b.done)
+
+	for {
+		it, ok := <-b.q
+		if !ok {
+			break
+		}
+
+		var (
+			items = []item{it}
+			t     = time.NewTimer(b.o.Wait)
+		)
+	loop:
+		for len(items) < b.o.Size {
+			select {
+			case it, ok := <-b.q:
+				if !ok {
+					break loop
+				}
+				items = append(items, it)
+			case <-t.C:
+				break loop
+			}
+		}
+		t.Stop()
+
+		b.wait(len(items))
+
+		b.sem <- struct{}{}
+		b.wg.Add(1)
+		go func(items []item) {
+			defer func() {
+				<-b.sem
+				b.wg.Done()
+			}()
+			b.dispatch(items)
+		}(items)
+	}
+
+	b.wg.Wait()
+}
+
+// dispatch sends a batch and delivers the results to the waiting pushers.
+func (b *Batcher) dispatch(items []item) {
+	msgs := make([]messenger.Message, len(items))
+	for i, it := range items {
+		msgs[i] = it.msg
+	}
+
+	res := b.send(msgs)
+	for i, it := range items {
+		if i < len(res) {
+			it.res <- res[i]
+		} else {
+			it.res <- Result{Err: errors.New("no response for message")}
+		}
+	}
+}
+
+// wait blocks until n messages can be sent without exceeding the rate limit.
+// Messages are paced evenly instead of being sent in bursts every second.
+func (b *Batcher) wait(n int) {
+	if b.o.Rate <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	if d := b.next.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+	b.next = b.next.Add(time.Second * time.Duration(n) / time.Duration(b.o.Rate))
+}
+
+// Backoff returns the duration to wait before a retry attempt (starting at 1)
+// after a provider has throttled or failed a request.
+func Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt > 6 {
+		attempt = 6
+	}
+	return time.Millisecond * 500 << uint(attempt-1)
+}
@@ -0,0 +1,198 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/knadh/smtppool"
+)
+
+// dkimDefaultHeaders are the headers that are signed if none are configured.
+var dkimDefaultHeaders = []string{"From", "To", "Subject", "Date", "Message-Id",
+	"Reply-To", "MIME-Version", "Content-Type", "List-Unsubscribe", "List-Unsubscribe-Post"}
+
+// DKIM represents the DKIM signing configuration of a sender domain.
+type DKIM struct {
+	Domain     string `json:"domain"`
+	Selector   string `json:"selector"`
+	PrivateKey string `json:"private_key"`
+
+	// Headers is the list of headers to sign. From is always signed.
+	Headers []string `json:"headers"`
+
+	// Canonicalization is the header/body canonicalization algorithm,
+	// eg: relaxed/relaxed, relaxed/simple.
+	Canonicalization string `json:"canonicalization"`
+}
+
+// DKIMRecord represents the DNS TXT record that has to be published
+// for a DKIM key.
+type DKIMRecord struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+}
+
+// Validate validates the DKIM configuration and its private key.
+func (d DKIM) Validate() error {
+	_, err := newDKIMOptions(d)
+	return err
+}
+
+// newDKIMOptions validates a DKIM configuration and returns signing options for it.
+func newDKIMOptions(d DKIM) (*dkim.SignOptions, error) {
+	if d.Domain == "" || d.Selector == "" {
+		return nil, errors.New("DKIM domain and selector are required")
+	}
+
+	key, err := ParseDKIMKey(d.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DKIM key for %s: %v", d.Domain, err)
+	}
+
+	// Canonicalization is in the form header/body. If the body algorithm is
+	// omitted, it's "simple" as per RFC 6376.
+	canon := d.Canonicalization
+	if canon == "" {
+		canon = "relaxed/relaxed"
+	}
+	var (
+		c    = strings.SplitN(strings.ToLower(canon), "/", 2)
+		hdr  = dkim.Canonicalization(c[0])
+		body = dkim.CanonicalizationSimple
+	)
+	if len(c) == 2 {
+		body = dkim.Canonicalization(c[1])
+	}
+	for _, v := range []dkim.Canonicalization{hdr, body} {
+		if v != dkim.CanonicalizationSimple && v != dkim.CanonicalizationRelaxed {
+			return nil, fmt.Errorf("unknown DKIM canonicalization: %s", d.Canonicalization)
+		}
+	}
+
+	// From is mandatory.
+	headers := []string{"From"}
+	if len(d.Headers) == 0 {
+		d.Headers = dkimDefaultHeaders
+	}
+	for _, h := range d.Headers {
+		h = strings.TrimSpace(h)
+		if h != "" && !strings.EqualFold(h, "From") {
+			headers = append(headers, h)
+		}
+	}
+
+	return &dkim.SignOptions{
+		Domain:                 strings.ToLower(d.Domain),
+		Selector:               d.Selector,
+		Signer:                 key,
+		HeaderCanonicalization: hdr,
+		BodyCanonicalization:   body,
+		HeaderKeys:             headers,
+	}, nil
+}
+
+// ParseDKIMKey parses a PEM encoded RSA (PKCS #1 or #8) or Ed25519 (PKCS #8) private key.
+func ParseDKIMKey(s string) (crypto.Signer, error) {
+	b, _ := pem.Decode([]byte(strings.TrimSpace(s)))
+	if b == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+
+	if k, err := x509.ParsePKCS1PrivateKey(b.Bytes); err == nil {
+		return k, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := k.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+
+	return nil, errors.New("unsupported key type. Only RSA and Ed25519 keys are supported")
+}
+
+// MakeDKIMRecord returns the DNS TXT record to publish for a DKIM configuration.
+func MakeDKIMRecord(d DKIM) (DKIMRecord, error) {
+	key, err := ParseDKIMKey(d.PrivateKey)
+	if err != nil {
+		return DKIMRecord{}, err
+	}
+
+	var (
+		typ string
+		pub []byte
+	)
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		typ = "rsa"
+		pub, err = x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return DKIMRecord{}, err
+		}
+	case ed25519.PublicKey:
+		typ = "ed25519"
+		pub = k
+	}
+
+	return DKIMRecord{
+		Domain:   d.Domain,
+		Selector: d.Selector,
+		Name:     d.Selector + "._domainkey." + d.Domain,
+		Value:    fmt.Sprintf("v=DKIM1; k=%s; p=%s", typ, base64.StdEncoding.EncodeToString(pub)),
+	}, nil
+}
+
+// sign renders an e-mail into a raw message and signs it if there's a DKIM
+// configuration for the domain in its From address. The bool is false if
+// the message wasn't signed.
+func (s *Server) sign(em smtppool.Email) ([]byte, bool, error) {
+	if len(s.dkim) == 0 {
+		return nil, false, nil
+	}
+
+	from := em.Headers.Get("From")
+	if from == "" {
+		from = em.From
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var (
+		domain = strings.ToLower(addr.Address[strings.LastIndex(addr.Address, "@")+1:])
+		opt    = s.dkim[domain]
+	)
+	if opt == nil {
+		return nil, false, nil
+	}
+
+	raw, err := em.Bytes()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var out bytes.Buffer
+	if err := dkim.Sign(&out, bytes.NewReader(raw), opt); err != nil {
+		return nil, false, err
+	}
+
+	return out.Bytes(), true, nil
+}
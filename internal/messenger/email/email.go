@@ -3,18 +3,44 @@ package email
 import (
 	"crypto/tls"
 	"fmt"
-	"math/rand"
 	"net/smtp"
 	"net/textproto"
+	"time"
 
+	"github.com/emersion/go-msgauth/dkim"
 	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/metrics"
 	"github.com/knadh/smtppool"
 )
 
 const emName = "email"
 
+// SMTP pool metrics labelled by the server's host:port.
+var (
+	smtpSent = metrics.NewCounter("listmonk_smtp_sent_total",
+		"Number of e-mails sent through the SMTP server.", "server")
+	smtpFailed = metrics.NewCounter("listmonk_smtp_failed_total",
+		"Number of e-mails that failed to be sent through the SMTP server.", "server")
+	smtpInFlight = metrics.NewGauge("listmonk_smtp_in_flight",
+		"Number of e-mails that are currently being sent through the SMTP server's pool.", "server")
+	smtpMaxConns = metrics.NewGauge("listmonk_smtp_max_conns",
+		"Maximum number of connections in the SMTP server's pool.", "server")
+	smtpLastError = metrics.NewGauge("listmonk_smtp_last_error_timestamp_seconds",
+		"Unix timestamp of the last error sending through the SMTP server.", "server")
+	smtpDownUntil = metrics.NewGauge("listmonk_smtp_down_until_timestamp_seconds",
+		"Unix timestamp until which the failing SMTP server is out of rotation.", "server")
+)
+
 // Server represents an SMTP server's credentials.
 type Server struct {
+	// Name is the optional name of the group that the server belongs to.
+	// Servers with a name are also available as a separate "email-$name"
+	// messenger that campaigns can be pinned to.
+	Name string `json:"name"`
+
+	// Weight is the server's share of messages relative to other servers.
+	Weight int `json:"weight"`
+
 	Username      string            `json:"username"`
 	Password      string            `json:"password"`
 	AuthProtocol  string            `json:"auth_protocol"`
@@ -22,21 +48,37 @@ type Server struct {
 	TLSSkipVerify bool              `json:"tls_skip_verify"`
 	EmailHeaders  map[string]string `json:"email_headers"`
 
+	// DKIM signing keys for sender (From) domains.
+	DKIM []DKIM `json:"dkim"`
+
 	// Rest of the options are embedded directly from the smtppool lib.
 	// The JSON tag is for config unmarshal to work.
 	smtppool.Opt `json:",squash"`
 
 	pool *smtppool.Pool
+	name string
+
+	// DKIM signing options by domain and the pool for sending signed messages.
+	dkim map[string]*dkim.SignOptions
+	raw  *rawPool
+
+	health *health
 }
 
 // Emailer is the SMTP e-mail messenger.
 type Emailer struct {
+	name    string
 	servers []*Server
+
+	// isGroup indicates that the Emailer is a named group of servers that
+	// share their pools with the parent Emailer.
+	isGroup bool
 }
 
 // New returns an SMTP e-mail Messenger backend with the given SMTP servers.
 func New(servers ...Server) (*Emailer, error) {
 	e := &Emailer{
+		name:    emName,
 		servers: make([]*Server, 0, len(servers)),
 	}
 
@@ -56,6 +98,11 @@ func New(servers ...Server) (*Emailer, error) {
 		}
 		s.Opt.Auth = auth
 
+		if s.Weight < 1 {
+			s.Weight = 1
+		}
+		s.health = &health{}
+
 		// TLS config.
 		if s.TLSType != "none" {
 			s.TLSConfig = &tls.Config{}
@@ -77,31 +124,143 @@ func New(servers ...Server) (*Emailer, error) {
 		}
 
 		s.pool = pool
+
+		// DKIM keys.
+		if len(s.DKIM) > 0 {
+			s.dkim = make(map[string]*dkim.SignOptions, len(s.DKIM))
+			for _, d := range s.DKIM {
+				o, err := newDKIMOptions(d)
+				if err != nil {
+					return nil, err
+				}
+				s.dkim[o.Domain] = o
+			}
+			s.raw = newRawPool(s.Opt)
+		}
+
+		s.name = fmt.Sprintf("%s:%d", s.Host, s.Port)
+		smtpMaxConns.Set(float64(s.MaxConns), s.name)
+
 		e.servers = append(e.servers, &s)
 	}
 
 	return e, nil
 }
 
+// Groups returns an Emailer for every named group of servers.
+func (e *Emailer) Groups() []*Emailer {
+	var (
+		out    []*Emailer
+		groups = map[string]*Emailer{}
+	)
+	for _, s := range e.servers {
+		if s.Name == "" {
+			continue
+		}
+
+		g, ok := groups[s.Name]
+		if !ok {
+			g = &Emailer{name: emName + "-" + s.Name, isGroup: true}
+			groups[s.Name] = g
+			out = append(out, g)
+		}
+		g.servers = append(g.servers, s)
+	}
+
+	return out
+}
+
 // Name returns the Server's name.
 func (e *Emailer) Name() string {
-	return emName
+	return e.name
 }
 
-// Push pushes a message to the server.
+// Push pushes a message to the server. If there are multiple SMTP servers,
+// the message is sent to one picked by weight among the healthy ones. If
+// sending fails because of a server error before the server could have taken
+// the message, it's retried on other servers.
 func (e *Emailer) Push(m messenger.Message) error {
-	// If there are more than one SMTP servers, send to a random
-	// one from the list.
 	var (
-		ln  = len(e.servers)
-		srv *Server
+		tried   = make(map[*Server]bool, len(e.servers))
+		lastErr error
 	)
-	if ln > 1 {
-		srv = e.servers[rand.Intn(ln)]
-	} else {
-		srv = e.servers[0]
+	for len(tried) < len(e.servers) {
+		srv := pick(e.servers, tried)
+		tried[srv] = true
+
+		err := srv.push(m)
+		if err == nil {
+			srv.health.markOK()
+			return nil
+		}
+		lastErr = err
+
+		// The message was rejected. Retrying it on another server won't help.
+		if !isServerErr(err) {
+			return err
+		}
+
+		if srv.health.markErr(time.Now()) {
+			smtpDownUntil.Set(float64(srv.health.downUntil.Unix()), srv.name)
+		}
+
+		// The server may have taken the message before the error. Retrying
+		// it on another server could deliver it twice.
+		if !canFailover(err) {
+			return err
+		}
+	}
+
+	return lastErr
+}
+
+// push sends a message via the server.
+func (s *Server) push(m messenger.Message) error {
+	em := MakeEmail(m)
+
+	// Attach SMTP level headers on a copy of the message headers so that
+	// they don't carry over to other servers on a retry.
+	if len(s.EmailHeaders) > 0 {
+		h := make(textproto.MIMEHeader, len(em.Headers)+len(s.EmailHeaders))
+		for k, v := range em.Headers {
+			h[k] = v
+		}
+		for k, v := range s.EmailHeaders {
+			h.Set(k, v)
+		}
+		em.Headers = h
+	}
+
+	smtpInFlight.Add(1, s.name)
+	err := s.send(em)
+	smtpInFlight.Add(-1, s.name)
+
+	if err != nil {
+		smtpFailed.Inc(s.name)
+		smtpLastError.Set(float64(time.Now().Unix()), s.name)
+		return err
 	}
+	smtpSent.Inc(s.name)
 
+	return nil
+}
+
+// send signs an e-mail if there's a DKIM key for its sender domain and sends it.
+func (s *Server) send(em smtppool.Email) error {
+	raw, ok, err := s.sign(em)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return s.raw.send(em.From, em.To, raw)
+	}
+
+	return s.pool.Send(em)
+}
+
+// MakeEmail converts a Message into an e-mail that can be sent via SMTP or
+// serialized into a raw MIME message.
+func MakeEmail(m messenger.Message) smtppool.Email {
 	// Are there attachments?
 	var files []smtppool.Attachment
 	if m.Attachments != nil {
@@ -130,13 +289,6 @@ func (e *Emailer) Push(m messenger.Message) error {
 		em.Headers = m.Headers
 	}
 
-	// Attach SMTP level headers.
-	if len(srv.EmailHeaders) > 0 {
-		for k, v := range srv.EmailHeaders {
-			em.Headers.Set(k, v)
-		}
-	}
-
 	switch m.ContentType {
 	case "plain":
 		em.Text = []byte(m.Body)
@@ -147,7 +299,7 @@ func (e *Emailer) Push(m messenger.Message) error {
 		}
 	}
 
-	return srv.pool.Send(em)
+	return em
 }
 
 // Flush flushes the message queue to the server.
@@ -157,8 +309,16 @@ func (e *Emailer) Flush() error {
 
 // Close closes the SMTP pools.
 func (e *Emailer) Close() error {
+	// Groups share the pools of the parent Emailer, which closes them.
+	if e.isGroup {
+		return nil
+	}
+
 	for _, s := range e.servers {
 		s.pool.Close()
+		if s.raw != nil {
+			s.raw.close()
+		}
 	}
 	return nil
 }
@@ -0,0 +1,202 @@
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxServerErrors is the number of consecutive errors after which
+	// a server is taken out of rotation.
+	maxServerErrors = 5
+
+	// coolOff is the duration for which a failing server is kept out of
+	// rotation. It doubles every time the server fails again right after
+	// being put back, up to maxCoolOff.
+	coolOff    = time.Second * 30
+	maxCoolOff = time.Minute * 10
+)
+
+// health tracks the errors on a server to take it out of rotation
+// when it keeps failing.
+type health struct {
+	mut sync.Mutex
+
+	// Consecutive errors.
+	errs int
+
+	// Number of consecutive times the server was taken out of rotation
+	// without a successful send in between.
+	trips int
+
+	downUntil time.Time
+}
+
+// isUp returns true if the server is in rotation.
+func (h *health) isUp(now time.Time) bool {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return !now.Before(h.downUntil)
+}
+
+// markOK resets the server's error state after a successful send.
+func (h *health) markOK() {
+	h.mut.Lock()
+	h.errs = 0
+	h.trips = 0
+	h.mut.Unlock()
+}
+
+// markErr records an error. The server is taken out of rotation on hitting
+// maxServerErrors, or on the first error after it's put back in rotation
+// following a cool-off. The bool is true if the server was taken out.
+func (h *health) markErr(now time.Time) bool {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	h.errs++
+	if h.errs < maxServerErrors && h.trips == 0 {
+		return false
+	}
+
+	d := coolOff << uint(h.trips)
+	if d > maxCoolOff || d <= 0 {
+		d = maxCoolOff
+	}
+	h.downUntil = now.Add(d)
+	h.trips++
+	h.errs = 0
+
+	return true
+}
+
+// pick picks a server from the given list weighted by the servers' weights,
+// skipping the ones that have already been tried. Servers that are out of
+// rotation are only picked if all the untried servers are out of rotation.
+func pick(servers []*Server, tried map[*Server]bool) *Server {
+	var (
+		now  = time.Now()
+		up   = make([]*Server, 0, len(servers))
+		down = make([]*Server, 0)
+	)
+	for _, s := range servers {
+		if tried[s] {
+			continue
+		}
+		if s.health.isUp(now) {
+			up = append(up, s)
+		} else {
+			down = append(down, s)
+		}
+	}
+
+	if len(up) == 0 {
+		up = down
+	}
+	if len(up) == 0 {
+		return nil
+	}
+	if len(up) == 1 {
+		return up[0]
+	}
+
+	total := 0
+	for _, s := range up {
+		total += s.Weight
+	}
+	n := rand.Intn(total)
+	for _, s := range up {
+		if n < s.Weight {
+			return s
+		}
+		n -= s.Weight
+	}
+
+	return up[len(up)-1]
+}
+
+// preDataErr is an error that occurred before the data of a message was sent
+// to the server, ie: on connecting, on the TLS and auth setup, or on the MAIL,
+// RCPT and DATA commands.
+type preDataErr struct {
+	err error
+}
+
+func (e *preDataErr) Error() string {
+	return e.err.Error()
+}
+
+func (e *preDataErr) Unwrap() error {
+	return e.err
+}
+
+// Errors from the setup of smtppool connections.
+var poolSetupErrs = []string{
+	"timed out waiting for free conn in pool",
+	"SMTP STARTTLS extension not found",
+	"SMTP AUTH extension not found",
+}
+
+// isServerErr returns true if a send error indicates a problem with the
+// server (connection, timeouts, temporary failures, auth) as opposed to a
+// permanent rejection of the message, eg: an invalid recipient.
+func isServerErr(err error) bool {
+	var e *textproto.Error
+	if !errors.As(err, &e) {
+		return true
+	}
+
+	switch {
+	case e.Code == 530 || e.Code == 535:
+		// Authentication required / failed.
+		return true
+	case e.Code >= 500:
+		return false
+	}
+
+	return true
+}
+
+// canFailover returns true if a message that failed to be sent because of a
+// server error can be retried on another server without the risk of it being
+// delivered twice. That's the case if the error occurred before the message's
+// data was sent, or if the server replied with an error, which means that it
+// didn't take the message. Other errors, eg: a timeout or a reset connection
+// after the data was sent, may have occurred after the server took the message.
+func canFailover(err error) bool {
+	var (
+		pe *preDataErr
+		te *textproto.Error
+	)
+	if errors.As(err, &pe) || errors.As(err, &te) {
+		return true
+	}
+
+	// Errors from smtppool don't say at what stage they occurred. Dial and TLS
+	// errors can only occur on setting up a connection.
+	var (
+		oe *net.OpError
+		he tls.RecordHeaderError
+		ce x509.CertificateInvalidError
+		ue x509.UnknownAuthorityError
+		ne x509.HostnameError
+	)
+	if (errors.As(err, &oe) && oe.Op == "dial") ||
+		errors.As(err, &he) || errors.As(err, &ce) || errors.As(err, &ue) || errors.As(err, &ne) {
+		return true
+	}
+
+	for _, s := range poolSetupErrs {
+		if err.Error() == s {
+			return true
+		}
+	}
+	return strings.HasPrefix(err.Error(), "tls: ")
+}
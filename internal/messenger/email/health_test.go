@@ -0,0 +1,50 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func TestCanFailover(t *testing.T) {
+	var (
+		dialErr = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		readErr = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	)
+
+	cases := []struct {
+		name   string
+		err    error
+		server bool
+		ok     bool
+	}{
+		{"dial", dialErr, true, true},
+		{"wrapped dial", fmt.Errorf("connecting: %w", dialErr), true, true},
+		{"pool timeout", errors.New("timed out waiting for free conn in pool"), true, true},
+		{"no STARTTLS", errors.New("SMTP STARTTLS extension not found"), true, true},
+		{"TLS handshake", errors.New("tls: handshake failure"), true, true},
+		{"auth failed", &textproto.Error{Code: 535, Msg: "auth failed"}, true, true},
+		{"temporary RCPT", &textproto.Error{Code: 451, Msg: "try later"}, true, true},
+		{"before data", &preDataErr{readErr}, true, true},
+
+		// Permanent rejections of the message aren't retried at all.
+		{"rejected recipient", &textproto.Error{Code: 550, Msg: "no such user"}, false, true},
+
+		// The server may have taken the message before these.
+		{"reset after data", readErr, true, false},
+		{"EOF after data", io.ErrUnexpectedEOF, true, false},
+		{"timeout after data", errors.New("i/o timeout"), true, false},
+	}
+
+	for _, c := range cases {
+		if got := isServerErr(c.err); got != c.server {
+			t.Errorf("%s: isServerErr got %v, want %v", c.name, got, c.server)
+		}
+		if got := canFailover(c.err); got != c.ok {
+			t.Errorf("%s: canFailover got %v, want %v", c.name, got, c.ok)
+		}
+	}
+}
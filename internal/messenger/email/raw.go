@@ -0,0 +1,232 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/knadh/smtppool"
+)
+
+// rawPool is a pool of SMTP connections that sends pre-rendered messages
+// as-is. smtppool renders messages itself on every send with new MIME
+// boundaries, which would invalidate DKIM signatures computed beforehand.
+type rawPool struct {
+	opt   smtppool.Opt
+	conns chan *rawConn
+
+	// sem limits the number of open connections.
+	sem chan struct{}
+}
+
+type rawConn struct {
+	c            *smtp.Client
+	lastActivity time.Time
+}
+
+func newRawPool(o smtppool.Opt) *rawPool {
+	if o.MaxConns < 1 {
+		o.MaxConns = 1
+	}
+	if o.MaxMessageRetries < 1 {
+		o.MaxMessageRetries = 2
+	}
+	if o.PoolWaitTimeout.Seconds() < 1 {
+		o.PoolWaitTimeout = time.Second * 2
+	}
+
+	return &rawPool{
+		opt:   o,
+		conns: make(chan *rawConn, o.MaxConns),
+		sem:   make(chan struct{}, o.MaxConns),
+	}
+}
+
+// send sends a raw message. On an error before the message's data is sent, the
+// message is retried on a new connection.
+func (p *rawPool) send(from string, to []string, msg []byte) error {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for i := 0; i < p.opt.MaxMessageRetries; i++ {
+		c, err := p.borrow()
+		if err != nil {
+			return &preDataErr{err}
+		}
+
+		err = c.send(addr.Address, to, msg)
+		if err == nil {
+			p.release(c)
+			return nil
+		}
+		lastErr = err
+
+		// SMTP errors (eg: a rejected recipient) leave the connection usable.
+		// Others are bad connections.
+		if _, ok := err.(*textproto.Error); ok && c.c.Reset() == nil {
+			p.release(c)
+		} else {
+			p.discard(c)
+		}
+
+		// The server may have taken the message before the error.
+		if !canFailover(err) {
+			return err
+		}
+	}
+
+	return lastErr
+}
+
+// close closes all idle connections in the pool.
+func (p *rawPool) close() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.c.Quit()
+			<-p.sem
+		default:
+			return
+		}
+	}
+}
+
+// borrow returns an idle connection from the pool or creates a new one
+// if the pool has room.
+func (p *rawPool) borrow() (*rawConn, error) {
+	for {
+		// Prefer idle connections over new ones.
+		var c *rawConn
+		select {
+		case c = <-p.conns:
+		default:
+			select {
+			case c = <-p.conns:
+			case p.sem <- struct{}{}:
+				c, err := p.dial()
+				if err != nil {
+					<-p.sem
+					return nil, err
+				}
+				return c, nil
+			case <-time.After(p.opt.PoolWaitTimeout):
+				return nil, errors.New("timed out waiting for free conn in pool")
+			}
+		}
+
+		// Discard connections that the server may have already timed out.
+		if p.opt.IdleTimeout > 0 && time.Since(c.lastActivity) > p.opt.IdleTimeout {
+			p.discard(c)
+			continue
+		}
+		return c, nil
+	}
+}
+
+func (p *rawPool) release(c *rawConn) {
+	c.lastActivity = time.Now()
+	p.conns <- c
+}
+
+func (p *rawPool) discard(c *rawConn) {
+	c.c.Close()
+	<-p.sem
+}
+
+// dial creates a new SMTP connection.
+func (p *rawPool) dial() (*rawConn, error) {
+	var (
+		conn net.Conn
+		err  error
+		addr = net.JoinHostPort(p.opt.Host, strconv.Itoa(p.opt.Port))
+	)
+	if p.opt.TLSConfig != nil && p.opt.SSL {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: p.opt.PoolWaitTimeout}, "tcp", addr, p.opt.TLSConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, p.opt.PoolWaitTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, p.opt.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := p.setup(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &rawConn{c: c, lastActivity: time.Now()}, nil
+}
+
+// setup does the HELO, STARTTLS, and AUTH on a new connection. The auth
+// is the one that New() picks for the server's auth protocol.
+func (p *rawPool) setup(c *smtp.Client) error {
+	hostname := p.opt.HelloHostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	if err := c.Hello(hostname); err != nil {
+		return err
+	}
+
+	if p.opt.TLSConfig != nil && !p.opt.SSL {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP STARTTLS extension not found")
+		}
+		if err := c.StartTLS(p.opt.TLSConfig); err != nil {
+			return err
+		}
+	}
+
+	if p.opt.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("SMTP AUTH extension not found")
+		}
+		if err := c.Auth(p.opt.Auth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send sends a message on the connection. Errors that occur before the
+// message's data is sent are returned as preDataErr.
+func (c *rawConn) send(from string, to []string, msg []byte) error {
+	if err := c.c.Mail(from); err != nil {
+		return &preDataErr{err}
+	}
+	for _, r := range to {
+		addr, err := mail.ParseAddress(r)
+		if err != nil {
+			return &preDataErr{err}
+		}
+		if err := c.c.Rcpt(addr.Address); err != nil {
+			return &preDataErr{err}
+		}
+	}
+
+	w, err := c.c.Data()
+	if err != nil {
+		return &preDataErr{err}
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
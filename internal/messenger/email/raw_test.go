@@ -0,0 +1,151 @@
+package email
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knadh/smtppool"
+)
+
+// smtpSession is what a fake SMTP server received in a session.
+type smtpSession struct {
+	hello string
+	from  string
+	rcpts []string
+	data  string
+}
+
+// fakeSMTP starts an SMTP server that accepts every message and sends the
+// sessions to the returned channel. The listener has to be closed.
+func fakeSMTP(t *testing.T) (net.Listener, chan smtpSession) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan smtpSession, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(c, out)
+		}
+	}()
+
+	return ln, out
+}
+
+func serveSMTP(c net.Conn, out chan smtpSession) {
+	defer c.Close()
+
+	var (
+		tp = textproto.NewConn(c)
+		s  smtpSession
+	)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		l, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.SplitN(l, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			s.hello = strings.TrimSpace(l[4:])
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			s.from = l
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			s.rcpts = append(s.rcpts, l)
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.data = string(b)
+			tp.PrintfLine("250 OK")
+			out <- s
+			s = smtpSession{hello: s.hello}
+		case "RSET":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestRawPoolSend(t *testing.T) {
+	ln, sessions := fakeSMTP(t)
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+
+	cases := []struct {
+		hello string
+		want  string
+	}{
+		{"", "localhost"},
+		{"mail.example.com", "mail.example.com"},
+	}
+
+	for _, c := range cases {
+		p := newRawPool(smtppool.Opt{Host: addr.IP.String(), Port: addr.Port, HelloHostname: c.hello, PoolWaitTimeout: time.Second})
+
+		msg := "From: sender@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+		if err := p.send("Sender <sender@example.com>", []string{"Rcpt <rcpt@example.net>"}, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		p.close()
+
+		var s smtpSession
+		select {
+		case s = <-sessions:
+		case <-time.After(time.Second * 2):
+			t.Fatal("message not received")
+		}
+
+		if s.hello != c.want {
+			t.Errorf("got hello %q, want %q", s.hello, c.want)
+		}
+		if s.from != "MAIL FROM:<sender@example.com>" {
+			t.Errorf("got %q", s.from)
+		}
+		if len(s.rcpts) != 1 || s.rcpts[0] != "RCPT TO:<rcpt@example.net>" {
+			t.Errorf("got recipients %q", s.rcpts)
+		}
+
+		// The message is sent as is.
+		if got := strings.Replace(s.data, "\n", "\r\n", -1); got != msg {
+			t.Errorf("got data %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestRawPoolDialErr(t *testing.T) {
+	// Find a port with nothing listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	p := newRawPool(smtppool.Opt{Host: "127.0.0.1", Port: port, PoolWaitTimeout: time.Second})
+	err = p.send("sender@example.com", []string{"rcpt@example.net"}, []byte("x"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !canFailover(err) {
+		t.Errorf("dial error %v can't fail over", err)
+	}
+}
@@ -0,0 +1,355 @@
+// Package sendgrid implements a messenger that sends e-mails via the
+// SendGrid v3 mail send API.
+package sendgrid
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/messenger/batch"
+)
+
+const (
+	// Name is the name of the messenger.
+	Name = "sendgrid"
+
+	defaultEndpoint = "https://api.sendgrid.com"
+	sendPath        = "/v3/mail/send"
+
+	// Maximum number of personalizations (recipients) in a single request.
+	maxPersonalizations = 1000
+
+	// Maximum duration to wait for a rate limit to reset before retrying.
+	maxRateLimitWait = time.Minute
+)
+
+// reservedHeaders are headers that SendGrid rejects in personalizations.
+var reservedHeaders = map[string]bool{
+	"X-Sg-Id":                   true,
+	"X-Sg-Eid":                  true,
+	"Received":                  true,
+	"Dkim-Signature":            true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"To":                        true,
+	"From":                      true,
+	"Subject":                   true,
+	"Reply-To":                  true,
+	"Cc":                        true,
+	"Bcc":                       true,
+}
+
+// Options represents the SendGrid messenger's options.
+type Options struct {
+	APIKey    string        `json:"api_key"`
+	Endpoint  string        `json:"endpoint"`
+	MaxConns  int           `json:"max_conns"`
+	MaxRate   int           `json:"max_rate"`
+	BatchSize int           `json:"batch_size"`
+	Retries   int           `json:"max_msg_retries"`
+	Timeout   time.Duration `json:"timeout"`
+}
+
+type address struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type personalization struct {
+	To      []address         `json:"to"`
+	Subject string            `json:"subject,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type content struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type attachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition,omitempty"`
+}
+
+type mailReq struct {
+	Personalizations []personalization `json:"personalizations"`
+	From             address           `json:"from"`
+	ReplyTo          *address          `json:"reply_to,omitempty"`
+	Subject          string            `json:"subject,omitempty"`
+	Content          []content         `json:"content"`
+	Attachments      []attachment      `json:"attachments,omitempty"`
+}
+
+type errResp struct {
+	Errors []struct {
+		Message string `json:"message"`
+		Field   string `json:"field"`
+	} `json:"errors"`
+}
+
+// SendGrid is the SendGrid API messenger.
+type SendGrid struct {
+	o       Options
+	url     string
+	authStr string
+	c       *http.Client
+	b       *batch.Batcher
+}
+
+// New returns a new instance of the SendGrid messenger.
+func New(o Options) (*SendGrid, error) {
+	if o.APIKey == "" {
+		return nil, errors.New("SendGrid API key is empty")
+	}
+	if o.MaxConns < 1 {
+		o.MaxConns = 1
+	}
+	if o.BatchSize > maxPersonalizations {
+		o.BatchSize = maxPersonalizations
+	}
+
+	// The endpoint is configurable so that a local or a mock server can be used.
+	endpoint := o.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid SendGrid endpoint: %v", err)
+	}
+
+	s := &SendGrid{
+		o:       o,
+		url:     strings.TrimRight(endpoint, "/") + sendPath,
+		authStr: "Bearer " + o.APIKey,
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       o.Timeout,
+			},
+		},
+	}
+
+	s.b = batch.New(batch.Opt{
+		Size:        o.BatchSize,
+		Concurrency: o.MaxConns,
+		Rate:        o.MaxRate,
+	}, s.send)
+
+	return s, nil
+}
+
+// Name returns the messenger's name.
+func (s *SendGrid) Name() string {
+	return Name
+}
+
+// Push sends a message via SendGrid.
+func (s *SendGrid) Push(m messenger.Message) error {
+	_, err := s.PushID(m)
+	return err
+}
+
+// PushID sends a message via SendGrid and returns the SendGrid message ID.
+func (s *SendGrid) PushID(m messenger.Message) (string, error) {
+	return s.b.Push(m)
+}
+
+// Flush flushes the message queue to the server.
+func (s *SendGrid) Flush() error {
+	return nil
+}
+
+// Close waits for pending messages to be sent and closes idle HTTP connections.
+func (s *SendGrid) Close() error {
+	s.b.Close()
+	s.c.CloseIdleConnections()
+	return nil
+}
+
+// send sends a batch of messages. Messages that have identical content
+// (sender, body and no attachments) are sent in a single request with one
+// personalization per message. Others are sent in individual requests.
+func (s *SendGrid) send(msgs []messenger.Message) []batch.Result {
+	var (
+		out    = make([]batch.Result, len(msgs))
+		groups = make(map[string][]int)
+		keys   []string
+	)
+	for i, m := range msgs {
+		key := strconv.Itoa(i)
+		if len(m.Attachments) == 0 {
+			key = strings.Join([]string{m.From, m.ContentType, m.Headers.Get("Reply-To"),
+				string(m.Body), string(m.AltBody)}, "\x00")
+		}
+
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	for _, k := range keys {
+		idx := groups[k]
+		id, err := s.sendGroup(msgs, idx)
+		for _, i := range idx {
+			out[i] = batch.Result{ID: id, Err: err}
+		}
+	}
+
+	return out
+}
+
+// sendGroup sends the messages at the given indices in a single request,
+// retrying when SendGrid rate limits the request.
+func (s *SendGrid) sendGroup(msgs []messenger.Message, idx []int) (string, error) {
+	var (
+		first = msgs[idx[0]]
+		req   = mailReq{
+			From:    makeAddress(first.From),
+			Content: makeContent(first),
+		}
+	)
+	if r := first.Headers.Get("Reply-To"); r != "" {
+		a := makeAddress(r)
+		req.ReplyTo = &a
+	}
+
+	for _, a := range first.Attachments {
+		ct := a.Header.Get("Content-Type")
+		if i := strings.Index(ct, ";"); i > -1 {
+			ct = ct[:i]
+		}
+		req.Attachments = append(req.Attachments, attachment{
+			Content:     base64.StdEncoding.EncodeToString(a.Content),
+			Type:        ct,
+			Filename:    a.Name,
+			Disposition: "attachment",
+		})
+	}
+
+	for _, i := range idx {
+		m := msgs[i]
+
+		p := personalization{
+			Subject: m.Subject,
+			Headers: make(map[string]string),
+		}
+		for _, to := range m.To {
+			p.To = append(p.To, makeAddress(to))
+		}
+		for k := range m.Headers {
+			if !reservedHeaders[k] {
+				p.Headers[k] = m.Headers.Get(k)
+			}
+		}
+		req.Personalizations = append(req.Personalizations, p)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	for n := 0; ; n++ {
+		id, wait, err := s.exec(body)
+		if err == nil {
+			return id, nil
+		}
+		if wait < 0 || n >= s.o.Retries {
+			return "", err
+		}
+		if wait == 0 {
+			wait = batch.Backoff(n + 1)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// exec posts a request to the mail send API and returns the message ID.
+// On error, the duration is the time to wait before retrying, with 0 being
+// the default backoff and -1 being an error that can't be retried.
+func (s *SendGrid) exec(body []byte) (string, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return "", -1, err
+	}
+	req.Header.Set("User-Agent", "listmonk")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", s.authStr)
+
+	r, err := s.c.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		// Drain and close the body to let the Transport reuse the connection
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}()
+
+	switch {
+	case r.StatusCode == http.StatusOK || r.StatusCode == http.StatusAccepted:
+		return r.Header.Get("X-Message-Id"), 0, nil
+
+	case r.StatusCode == http.StatusTooManyRequests:
+		// Wait until the rate limit resets.
+		var wait time.Duration
+		if ts, _ := strconv.ParseInt(r.Header.Get("X-RateLimit-Reset"), 10, 64); ts > 0 {
+			wait = time.Until(time.Unix(ts, 0))
+			if wait > maxRateLimitWait {
+				wait = maxRateLimitWait
+			}
+		}
+		return "", wait, errors.New("SendGrid rate limit exceeded")
+
+	case r.StatusCode >= 500:
+		return "", 0, fmt.Errorf("non-OK response from SendGrid: %d", r.StatusCode)
+	}
+
+	var e errResp
+	if b, _ := ioutil.ReadAll(r.Body); json.Unmarshal(b, &e) == nil && len(e.Errors) > 0 {
+		return "", -1, fmt.Errorf("SendGrid error: %d: %s", r.StatusCode, e.Errors[0].Message)
+	}
+
+	return "", -1, fmt.Errorf("non-OK response from SendGrid: %d", r.StatusCode)
+}
+
+// makeAddress parses an RFC 5322 address, eg: `"Name" <email>`.
+func makeAddress(s string) address {
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		return address{Email: strings.TrimSpace(s)}
+	}
+	return address{Email: a.Address, Name: a.Name}
+}
+
+// makeContent returns the content blocks for a message. SendGrid requires
+// text/plain to precede text/html.
+func makeContent(m messenger.Message) []content {
+	if m.ContentType == "plain" {
+		return []content{{Type: "text/plain", Value: string(m.Body)}}
+	}
+
+	var out []content
+	if len(m.AltBody) > 0 {
+		out = append(out, content{Type: "text/plain", Value: string(m.AltBody)})
+	}
+	return append(out, content{Type: "text/html", Value: string(m.Body)})
+}
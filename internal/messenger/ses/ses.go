@@ -0,0 +1,237 @@
+// Package ses implements a messenger that sends e-mails via the
+// Amazon SES SendRawEmail API.
+package ses
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/messenger/batch"
+	"github.com/knadh/listmonk/internal/messenger/email"
+)
+
+const (
+	// Name is the name of the messenger.
+	Name = "ses"
+
+	apiVersion      = "2010-12-01"
+	defaultEndpoint = "https://email.%s.amazonaws.com"
+)
+
+// Options represents the SES messenger's options.
+type Options struct {
+	Region           string        `json:"region"`
+	AccessKey        string        `json:"access_key"`
+	SecretKey        string        `json:"secret_key"`
+	Endpoint         string        `json:"endpoint"`
+	ConfigurationSet string        `json:"configuration_set"`
+	MaxConns         int           `json:"max_conns"`
+	MaxRate          int           `json:"max_rate"`
+	BatchSize        int           `json:"batch_size"`
+	Retries          int           `json:"max_msg_retries"`
+	Timeout          time.Duration `json:"timeout"`
+}
+
+type sesResp struct {
+	MessageID string `xml:"SendRawEmailResult>MessageId"`
+}
+
+type sesErrResp struct {
+	Type    string `xml:"Error>Type"`
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// SES is the Amazon SES API messenger.
+type SES struct {
+	o        Options
+	endpoint string
+	c        *http.Client
+	b        *batch.Batcher
+}
+
+// New returns a new instance of the SES messenger.
+func New(o Options) (*SES, error) {
+	if o.Region == "" {
+		return nil, errors.New("SES region is empty")
+	}
+	if o.AccessKey == "" || o.SecretKey == "" {
+		return nil, errors.New("SES access key or secret key is empty")
+	}
+	if o.MaxConns < 1 {
+		o.MaxConns = 1
+	}
+
+	// The endpoint is configurable so that a local or a mock server can be used.
+	endpoint := o.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf(defaultEndpoint, o.Region)
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid SES endpoint: %v", err)
+	}
+
+	s := &SES{
+		o:        o,
+		endpoint: strings.TrimRight(endpoint, "/") + "/",
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       o.Timeout,
+			},
+		},
+	}
+
+	// SendRawEmail takes one message per request. Messages in a batch are
+	// sent concurrently over the connection pool.
+	s.b = batch.New(batch.Opt{
+		Size:        o.BatchSize,
+		Concurrency: o.MaxConns,
+		Rate:        o.MaxRate,
+	}, s.send)
+
+	return s, nil
+}
+
+// Name returns the messenger's name.
+func (s *SES) Name() string {
+	return Name
+}
+
+// Push sends a message via SES.
+func (s *SES) Push(m messenger.Message) error {
+	_, err := s.PushID(m)
+	return err
+}
+
+// PushID sends a message via SES and returns the SES message ID.
+func (s *SES) PushID(m messenger.Message) (string, error) {
+	return s.b.Push(m)
+}
+
+// Flush flushes the message queue to the server.
+func (s *SES) Flush() error {
+	return nil
+}
+
+// Close waits for pending messages to be sent and closes idle HTTP connections.
+func (s *SES) Close() error {
+	s.b.Close()
+	s.c.CloseIdleConnections()
+	return nil
+}
+
+// send sends a batch of messages concurrently.
+func (s *SES) send(msgs []messenger.Message) []batch.Result {
+	var (
+		out = make([]batch.Result, len(msgs))
+		wg  sync.WaitGroup
+	)
+	for i, m := range msgs {
+		wg.Add(1)
+		go func(i int, m messenger.Message) {
+			defer wg.Done()
+			id, err := s.sendRaw(m)
+			out[i] = batch.Result{ID: id, Err: err}
+		}(i, m)
+	}
+	wg.Wait()
+
+	return out
+}
+
+// sendRaw sends a single message with SendRawEmail, retrying when
+// SES throttles the request.
+func (s *SES) sendRaw(m messenger.Message) (string, error) {
+	em := email.MakeEmail(m)
+	raw, err := em.Bytes()
+	if err != nil {
+		return "", err
+	}
+
+	p := url.Values{}
+	p.Set("Action", "SendRawEmail")
+	p.Set("Version", apiVersion)
+	p.Set("Source", m.From)
+	p.Set("RawMessage.Data", base64.StdEncoding.EncodeToString(raw))
+	for i, to := range m.To {
+		p.Set("Destinations.member."+strconv.Itoa(i+1), to)
+	}
+	if s.o.ConfigurationSet != "" {
+		p.Set("ConfigurationSetName", s.o.ConfigurationSet)
+	}
+	body := []byte(p.Encode())
+
+	for n := 0; ; n++ {
+		id, retry, err := s.exec(body)
+		if err == nil {
+			return id, nil
+		}
+		if !retry || n >= s.o.Retries {
+			return "", err
+		}
+		time.Sleep(batch.Backoff(n + 1))
+	}
+}
+
+// exec makes a signed request to the SES API. The bool indicates whether
+// the request can be retried.
+func (s *SES) exec(body []byte) (string, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("User-Agent", "listmonk")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	s.sign(req, body, time.Now())
+
+	r, err := s.c.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	defer func() {
+		// Drain and close the body to let the Transport reuse the connection
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}()
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", true, err
+	}
+
+	if r.StatusCode != http.StatusOK {
+		var e sesErrResp
+		if err := xml.Unmarshal(b, &e); err != nil || e.Code == "" {
+			return "", r.StatusCode >= 500, fmt.Errorf("non-OK response from SES: %d", r.StatusCode)
+		}
+
+		// Throttling errors are either the max send rate being exceeded, which
+		// can be retried, or the daily quota being exhausted, which can't.
+		retry := r.StatusCode >= 500 || e.Code == "ServiceUnavailable" ||
+			(e.Code == "Throttling" && !strings.Contains(e.Message, "Daily"))
+		return "", retry, fmt.Errorf("SES error: %s: %s", e.Code, e.Message)
+	}
+
+	var res sesResp
+	if err := xml.Unmarshal(b, &res); err != nil {
+		return "", false, fmt.Errorf("error parsing SES response: %v", err)
+	}
+
+	return res.MessageID, false, nil
+}
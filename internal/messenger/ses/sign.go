@@ -0,0 +1,72 @@
+package ses
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sigAlgo    = "AWS4-HMAC-SHA256"
+	sigService = "ses"
+)
+
+// sign signs an API request with AWS Signature Version 4.
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (s *SES) sign(req *http.Request, body []byte, now time.Time) {
+	var (
+		amzDate = now.UTC().Format("20060102T150405Z")
+		date    = amzDate[:8]
+	)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	// Canonical request.
+	var (
+		signedHeaders = "content-type;host;x-amz-date"
+		headers       = "content-type:" + strings.TrimSpace(req.Header.Get("Content-Type")) + "\n" +
+			"host:" + req.URL.Host + "\n" +
+			"x-amz-date:" + amzDate + "\n"
+	)
+	canonReq := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		headers,
+		signedHeaders,
+		hashHex(body),
+	}, "\n")
+
+	// String to sign.
+	scope := strings.Join([]string{date, s.o.Region, sigService, "aws4_request"}, "/")
+	strToSign := strings.Join([]string{sigAlgo, amzDate, scope, hashHex([]byte(canonReq))}, "\n")
+
+	// Signing key.
+	key := hmacSHA256([]byte("AWS4"+s.o.SecretKey), date)
+	key = hmacSHA256(key, s.o.Region)
+	key = hmacSHA256(key, sigService)
+	key = hmacSHA256(key, "aws4_request")
+
+	sig := hex.EncodeToString(hmacSHA256(key, strToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigAlgo, s.o.AccessKey, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,352 @@
+// Package metrics implements a minimal registry of counters, gauges, and
+// histograms that are exposed in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefBuckets are the default histogram buckets (in seconds) that are
+// suitable for measuring latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample is a single value of a metric with its label values.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// metric is a named metric family that can write itself out.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// desc describes a metric family.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+var (
+	registry []metric
+	regMut   sync.Mutex
+)
+
+func register(m metric) {
+	regMut.Lock()
+	registry = append(registry, m)
+	regMut.Unlock()
+}
+
+// Write writes all the registered metrics to w in the Prometheus text format.
+func Write(w io.Writer) error {
+	regMut.Lock()
+	ms := make([]metric, len(registry))
+	copy(ms, registry)
+	regMut.Unlock()
+
+	b := bufio.NewWriter(w)
+	for _, m := range ms {
+		m.write(b)
+	}
+	return b.Flush()
+}
+
+// Counter is a monotonically increasing value, optionally partitioned by labels.
+type Counter struct {
+	desc
+	vals *values
+}
+
+// NewCounter registers and returns a new Counter.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, typeCounter, labels}, vals: newValues()}
+	register(c)
+	return c
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc(labelVals ...string) {
+	c.vals.add(1, labelVals)
+}
+
+// Add adds v (which should be >= 0) to the counter.
+func (c *Counter) Add(v float64, labelVals ...string) {
+	c.vals.add(v, labelVals)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	for _, s := range c.vals.samples() {
+		writeSample(w, c.name, c.labels, s.Labels, "", "", s.Value)
+	}
+}
+
+// Gauge is a value that can go up and down, optionally partitioned by labels.
+type Gauge struct {
+	desc
+	vals *values
+}
+
+// NewGauge registers and returns a new Gauge.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name, help, typeGauge, labels}, vals: newValues()}
+	register(g)
+	return g
+}
+
+// Set sets the gauge's value.
+func (g *Gauge) Set(v float64, labelVals ...string) {
+	g.vals.set(v, labelVals)
+}
+
+// Add adds v (which can be negative) to the gauge.
+func (g *Gauge) Add(v float64, labelVals ...string) {
+	g.vals.add(v, labelVals)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	for _, s := range g.vals.samples() {
+		writeSample(w, g.name, g.labels, s.Labels, "", "", s.Value)
+	}
+}
+
+// GaugeFunc is a gauge whose samples are collected by calling
+// a function every time the metrics are written.
+type GaugeFunc struct {
+	desc
+	fn func() []Sample
+}
+
+// NewGaugeFunc registers and returns a new GaugeFunc.
+func NewGaugeFunc(name, help string, labels []string, fn func() []Sample) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name, help, typeGauge, labels}, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	for _, s := range g.fn() {
+		writeSample(w, g.name, g.labels, s.Labels, "", "", s.Value)
+	}
+}
+
+// Histogram samples observations (such as request latencies) and counts
+// them in configurable buckets, optionally partitioned by labels.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mut  sync.Mutex
+	hist map[string]*histVal
+}
+
+type histVal struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers and returns a new Histogram. If buckets are
+// not given, DefBuckets are used.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+
+	h := &Histogram{
+		desc:    desc{name, help, typeHistogram, labels},
+		buckets: b,
+		hist:    make(map[string]*histVal),
+	}
+	register(h)
+	return h
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(v float64, labelVals ...string) {
+	key := labelKey(labelVals)
+
+	h.mut.Lock()
+	hv, ok := h.hist[key]
+	if !ok {
+		hv = &histVal{
+			labels: append([]string{}, labelVals...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.hist[key] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+	h.mut.Unlock()
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	keys := make([]string, 0, len(h.hist))
+	for k := range h.hist {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		hv := h.hist[k]
+		for i, b := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, hv.labels, "le", formatFloat(b), float64(hv.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, hv.labels, "le", "+Inf", float64(hv.count))
+		writeSample(w, h.name+"_sum", h.labels, hv.labels, "", "", hv.sum)
+		writeSample(w, h.name+"_count", h.labels, hv.labels, "", "", float64(hv.count))
+	}
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// values holds the values of a metric partitioned by label values.
+type values struct {
+	mut  sync.Mutex
+	vals map[string]*Sample
+}
+
+func newValues() *values {
+	return &values{vals: make(map[string]*Sample)}
+}
+
+func (v *values) add(n float64, labelVals []string) {
+	key := labelKey(labelVals)
+
+	v.mut.Lock()
+	s, ok := v.vals[key]
+	if !ok {
+		s = &Sample{Labels: append([]string{}, labelVals...)}
+		v.vals[key] = s
+	}
+	s.Value += n
+	v.mut.Unlock()
+}
+
+func (v *values) set(n float64, labelVals []string) {
+	key := labelKey(labelVals)
+
+	v.mut.Lock()
+	s, ok := v.vals[key]
+	if !ok {
+		s = &Sample{Labels: append([]string{}, labelVals...)}
+		v.vals[key] = s
+	}
+	s.Value = n
+	v.mut.Unlock()
+}
+
+// samples returns a copy of the values sorted by their label values.
+func (v *values) samples() []Sample {
+	v.mut.Lock()
+	keys := make([]string, 0, len(v.vals))
+	for k := range v.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]Sample, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, *v.vals[k])
+	}
+	v.mut.Unlock()
+
+	return out
+}
+
+func labelKey(labelVals []string) string {
+	return strings.Join(labelVals, "\xff")
+}
+
+// writeSample writes a single sample line. extraName and extraVal are an optional
+// additional label (such as the histogram "le").
+func writeSample(w *bufio.Writer, name string, labels, labelVals []string, extraName, extraVal string, v float64) {
+	w.WriteString(name)
+
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		n := 0
+		for i, l := range labels {
+			val := ""
+			if i < len(labelVals) {
+				val = labelVals[i]
+			}
+			if n > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, l, escapeLabel(val))
+			n++
+		}
+		if extraName != "" {
+			if n > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraName, extraVal)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,470 @@
+package migrations
+
+import (
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/koanf"
+	"github.com/knadh/stuffbin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// V2_2_0 performs the DB migrations for v.2.2.0.
+func V2_2_0(db *sqlx.DB, fs stuffbin.FileSystem, ko *koanf.Koanf) error {
+	// Users, roles, list permissions, sessions, and API tokens.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_type') THEN
+				CREATE TYPE user_type AS ENUM ('superadmin', 'user');
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_role') THEN
+				CREATE TYPE user_role AS ENUM ('admin', 'campaign_editor', 'list_manager', 'readonly');
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_status') THEN
+				CREATE TYPE user_status AS ENUM ('enabled', 'disabled');
+			END IF;
+		END$$;
+
+		CREATE TABLE IF NOT EXISTS users (
+			id              SERIAL PRIMARY KEY,
+			username        TEXT NOT NULL UNIQUE,
+			email           TEXT NOT NULL DEFAULT '',
+			name            TEXT NOT NULL DEFAULT '',
+			password        TEXT NOT NULL,
+			type            user_type NOT NULL DEFAULT 'user',
+			role            user_role NOT NULL DEFAULT 'readonly',
+			status          user_status NOT NULL DEFAULT 'enabled',
+			restrict_lists  BOOLEAN NOT NULL DEFAULT false,
+			loggedin_at     TIMESTAMP WITH TIME ZONE NULL,
+			created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users(LOWER(username));
+
+		CREATE TABLE IF NOT EXISTS user_lists (
+			user_id         INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			list_id         INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			PRIMARY KEY(user_id, list_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS sessions (
+			id              TEXT NOT NULL PRIMARY KEY,
+			user_id         INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			expires_at      TIMESTAMP WITH TIME ZONE NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id              SERIAL PRIMARY KEY,
+			user_id         INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			name            TEXT NOT NULL,
+			token           TEXT NOT NULL UNIQUE,
+			scopes          TEXT[] NOT NULL DEFAULT '{}',
+			expires_at      TIMESTAMP WITH TIME ZONE NULL,
+			last_used_at    TIMESTAMP WITH TIME ZONE NULL,
+			created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+	`); err != nil {
+		return err
+	}
+
+	// Transactional templates.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'template_type') THEN
+				CREATE TYPE template_type AS ENUM ('campaign', 'tx');
+			END IF;
+		END$$;
+
+		ALTER TABLE templates ADD COLUMN IF NOT EXISTS type template_type NOT NULL DEFAULT 'campaign';
+		ALTER TABLE templates ADD COLUMN IF NOT EXISTS subject TEXT NOT NULL DEFAULT '';
+	`); err != nil {
+		return err
+	}
+
+	// A/B testing of campaign variants.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'ab_test_metric') THEN
+				CREATE TYPE ab_test_metric AS ENUM ('views', 'clicks');
+			END IF;
+		END$$;
+
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_test_percent INT NOT NULL DEFAULT 0;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_test_wait_mins INT NOT NULL DEFAULT 0;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_test_metric ab_test_metric NOT NULL DEFAULT 'views';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_test_sent_at TIMESTAMP WITH TIME ZONE NULL;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_winner_id INT NULL;
+
+		CREATE TABLE IF NOT EXISTS campaign_variants (
+			id               SERIAL PRIMARY KEY,
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			name             TEXT NOT NULL,
+			subject          TEXT NOT NULL,
+			body             TEXT NOT NULL,
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_camp_variants_camp_id ON campaign_variants(campaign_id);
+		ALTER TABLE campaign_variants ADD COLUMN IF NOT EXISTS sent INT NOT NULL DEFAULT 0;
+
+		ALTER TABLE campaign_views ADD COLUMN IF NOT EXISTS variant_id INTEGER NULL
+			REFERENCES campaign_variants(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_views_variant_id ON campaign_views(variant_id);
+
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS variant_id INTEGER NULL
+			REFERENCES campaign_variants(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_clicks_variant_id ON link_clicks(variant_id);
+
+		CREATE TABLE IF NOT EXISTS segments (
+			id               SERIAL PRIMARY KEY,
+			name             TEXT NOT NULL,
+			description      TEXT NOT NULL DEFAULT '',
+			query            TEXT NOT NULL DEFAULT '',
+			filter           JSONB NOT NULL DEFAULT '{}',
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE TABLE IF NOT EXISTS campaign_segments (
+			id           BIGSERIAL PRIMARY KEY,
+			campaign_id  INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			segment_id   INTEGER NULL REFERENCES segments(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			segment_name TEXT NOT NULL DEFAULT ''
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS campaign_segments_campaign_id_segment_id_idx ON campaign_segments (campaign_id, segment_id);
+		CREATE INDEX IF NOT EXISTS idx_camp_segments_camp_id ON campaign_segments(campaign_id);
+
+		CREATE TABLE IF NOT EXISTS campaign_subscribers (
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			PRIMARY KEY (campaign_id, subscriber_id)
+		);
+	`); err != nil {
+		return err
+	}
+
+	// Outgoing webhooks and their delivery log.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'webhook_delivery_status') THEN
+				CREATE TYPE webhook_delivery_status AS ENUM ('pending', 'success', 'failed');
+			END IF;
+		END$$;
+
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id               SERIAL PRIMARY KEY,
+			name             TEXT NOT NULL,
+			url              TEXT NOT NULL,
+			secret           TEXT NOT NULL DEFAULT '',
+			events           TEXT[] NOT NULL DEFAULT '{}',
+			enabled          BOOLEAN NOT NULL DEFAULT true,
+			max_retries      INTEGER NOT NULL DEFAULT 5,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id               BIGSERIAL PRIMARY KEY,
+			webhook_id       INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			event            TEXT NOT NULL,
+			payload          JSONB NOT NULL DEFAULT '{}',
+			status           webhook_delivery_status NOT NULL DEFAULT 'pending',
+			attempts         INTEGER NOT NULL DEFAULT 0,
+			response_code    INTEGER NOT NULL DEFAULT 0,
+			error            TEXT NOT NULL DEFAULT '',
+			next_attempt_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_hook_id ON webhook_deliveries(webhook_id);
+		CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status ON webhook_deliveries(status, next_attempt_at);
+		CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_date ON webhook_deliveries((TIMEZONE('UTC', created_at)::DATE));
+	`); err != nil {
+		return err
+	}
+
+	// Per bounce type counts and actions that replace the single bounce count and action.
+	// Hard bounces retain the existing count and action.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES ('bounce.actions', JSONB_BUILD_OBJECT(
+			'soft', JSONB_BUILD_OBJECT('count', 5, 'action', 'unsubscribe', 'days', 30),
+			'hard', JSONB_BUILD_OBJECT(
+				'count', COALESCE((SELECT value FROM settings WHERE key = 'bounce.count'), '1'),
+				'action', COALESCE((SELECT value FROM settings WHERE key = 'bounce.action'), '"blocklist"'),
+				'days', 0
+			),
+			'complaint', JSONB_BUILD_OBJECT('count', 1, 'action', 'unsubscribe', 'days', 0)
+		)) ON CONFLICT DO NOTHING;
+		DELETE FROM settings WHERE key IN ('bounce.count', 'bounce.action');
+	`); err != nil {
+		return err
+	}
+
+	// Mailgun, Postmark, and SparkPost bounce webhooks.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES
+			('bounce.mailgun_enabled', 'false'),
+			('bounce.mailgun_key', '""'),
+			('bounce.postmark_enabled', 'false'),
+			('bounce.postmark_username', '""'),
+			('bounce.postmark_password', '""'),
+			('bounce.sparkpost_enabled', 'false'),
+			('bounce.sparkpost_username', '""'),
+			('bounce.sparkpost_password', '""')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Staging and dead-letter storage for incoming bounces.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'pending_bounce_status') THEN
+				CREATE TYPE pending_bounce_status AS ENUM ('pending', 'failed');
+			END IF;
+		END$$;
+
+		CREATE TABLE IF NOT EXISTS pending_bounces (
+			id               BIGSERIAL PRIMARY KEY,
+			payload          JSONB NOT NULL DEFAULT '{}',
+			source           TEXT NOT NULL DEFAULT '',
+			status           pending_bounce_status NOT NULL DEFAULT 'pending',
+			attempts         INTEGER NOT NULL DEFAULT 0,
+			error            TEXT NOT NULL DEFAULT '',
+			next_attempt_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_pending_bounces_status ON pending_bounces(status, next_attempt_at);
+	`); err != nil {
+		return err
+	}
+
+	// Amazon SES and SendGrid API messengers.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES
+			('messenger.ses', '{"enabled": false, "region": "ap-south-1", "access_key": "", "secret_key": "", "endpoint": "", "configuration_set": "", "max_conns": 10, "max_rate": 14, "batch_size": 10, "max_msg_retries": 2, "timeout": "5s"}'),
+			('messenger.sendgrid', '{"enabled": false, "api_key": "", "endpoint": "", "max_conns": 10, "max_rate": 0, "batch_size": 10, "max_msg_retries": 2, "timeout": "5s"}')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Per recipient domain throttles.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES ('app.domain_throttles', '[]')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Pausing campaigns on the error rate over a window of sends.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS pause_reason TEXT NOT NULL DEFAULT '';
+
+		INSERT INTO settings (key, value) VALUES
+			('app.max_send_error_rate', '0'),
+			('app.send_error_window', '1000')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Failed campaign message deliveries.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS campaign_failures (
+			id               BIGSERIAL PRIMARY KEY,
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			error            TEXT NOT NULL DEFAULT '',
+			attempts         INTEGER NOT NULL DEFAULT 1,
+			queued           BOOLEAN NOT NULL DEFAULT false,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		ALTER TABLE campaign_failures ADD COLUMN IF NOT EXISTS queued BOOLEAN NOT NULL DEFAULT false;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_camp_failures ON campaign_failures(campaign_id, subscriber_id);
+		CREATE INDEX IF NOT EXISTS idx_camp_failures_queued ON campaign_failures(id) WHERE queued = true;
+	`); err != nil {
+		return err
+	}
+
+	// Instances processing campaigns and the subscriber ranges they lease.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS nodes (
+			id               UUID NOT NULL PRIMARY KEY,
+			hostname         TEXT NOT NULL DEFAULT '',
+			started_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			heartbeat_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE TABLE IF NOT EXISTS campaign_leases (
+			id               BIGSERIAL PRIMARY KEY,
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			node_id          UUID NOT NULL,
+			from_id          INTEGER NOT NULL,
+			to_id            INTEGER NOT NULL,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_camp_leases_camp_id ON campaign_leases(campaign_id);
+	`); err != nil {
+		return err
+	}
+
+	// Sending campaigns at a local time in subscribers' timezones.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS send_local BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS wave_from TIMESTAMP WITH TIME ZONE NULL;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS wave_to TIMESTAMP WITH TIME ZONE NULL;
+
+		CREATE OR REPLACE FUNCTION local_send_at(send_at TIMESTAMP WITH TIME ZONE, camp_tz TEXT, sub_tz TEXT)
+		RETURNS TIMESTAMP WITH TIME ZONE AS $$
+		BEGIN
+			IF sub_tz IS NULL OR sub_tz = '' OR sub_tz = camp_tz THEN
+				RETURN send_at;
+			END IF;
+
+			BEGIN
+				RETURN (send_at AT TIME ZONE camp_tz) AT TIME ZONE sub_tz;
+			EXCEPTION WHEN invalid_parameter_value THEN
+				RETURN send_at;
+			END;
+		END;
+		$$ LANGUAGE plpgsql STABLE;
+	`); err != nil {
+		return err
+	}
+
+	// Drip sequences of messages sent to the subscribers of a list.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'sequence_subscriber_status') THEN
+				CREATE TYPE sequence_subscriber_status AS ENUM ('active', 'completed', 'exited');
+			END IF;
+		END$$;
+
+		CREATE TABLE IF NOT EXISTS sequences (
+			id               SERIAL PRIMARY KEY,
+			uuid uuid        NOT NULL UNIQUE,
+			name             TEXT NOT NULL,
+			list_id          INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			exit_segment_id  INTEGER NULL REFERENCES segments(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			from_email       TEXT NOT NULL,
+			messenger        TEXT NOT NULL,
+			template_id      INTEGER REFERENCES templates(id) ON DELETE SET DEFAULT DEFAULT 1,
+			enabled          BOOLEAN NOT NULL DEFAULT true,
+			enrolled_at      TIMESTAMP WITH TIME ZONE NULL,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_sequences_list_id ON sequences(list_id);
+
+		CREATE TABLE IF NOT EXISTS sequence_steps (
+			id               SERIAL PRIMARY KEY,
+			sequence_id      INTEGER NOT NULL REFERENCES sequences(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			position         INTEGER NOT NULL,
+			delay_mins       INTEGER NOT NULL DEFAULT 0,
+			subject          TEXT NOT NULL,
+			body             TEXT NOT NULL,
+			altbody          TEXT NULL,
+			content_type     content_type NOT NULL DEFAULT 'richtext',
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_sequence_steps ON sequence_steps(sequence_id, position);
+
+		CREATE TABLE IF NOT EXISTS sequence_subscribers (
+			sequence_id      INTEGER NOT NULL REFERENCES sequences(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			step             INTEGER NOT NULL DEFAULT 0,
+			next_at          TIMESTAMP WITH TIME ZONE NULL,
+			status           sequence_subscriber_status NOT NULL DEFAULT 'active',
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (sequence_id, subscriber_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_sequence_subs_next_at ON sequence_subscribers(next_at) WHERE status = 'active';
+		CREATE INDEX IF NOT EXISTS idx_sequence_subs_sub_id ON sequence_subscribers(subscriber_id);
+	`); err != nil {
+		return err
+	}
+
+	// Recurring campaigns.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS cron TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS skip_empty BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS next_run_at TIMESTAMP WITH TIME ZONE NULL;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS parent_id INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_camps_parent_id ON campaigns(parent_id);
+	`); err != nil {
+		return err
+	}
+
+	// Feed driven campaigns.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS feed_url TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS feed_items JSONB NOT NULL DEFAULT '[]';
+
+		CREATE TABLE IF NOT EXISTS campaign_feed_items (
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			guid             TEXT NOT NULL,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (campaign_id, guid)
+		);
+	`); err != nil {
+		return err
+	}
+
+	// Tracking of views and clicks in transactional messages.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS tx_views (
+			id               BIGSERIAL PRIMARY KEY,
+			template_id      INTEGER NOT NULL REFERENCES templates(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_tx_views_template_id ON tx_views(template_id);
+		CREATE INDEX IF NOT EXISTS idx_tx_views_subscriber_id ON tx_views(subscriber_id);
+
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS template_id INTEGER NULL
+			REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_clicks_template_id ON link_clicks(template_id);
+	`); err != nil {
+		return err
+	}
+
+	// Create the superadmin user from the admin credentials in the config
+	// that were used for BasicAuth so far.
+	var n int
+	if err := db.Get(&n, `SELECT COUNT(*) FROM users`); err != nil {
+		return err
+	}
+	if n == 0 {
+		user, pwd := ko.String("app.admin_username"), ko.String("app.admin_password")
+		if user == "" || pwd == "" {
+			return errors.New("app.admin_username and app.admin_password are required to create the superadmin user")
+		}
+
+		h, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(`INSERT INTO users (username, name, password, type, role, status)
+			VALUES($1, 'Admin', $2, 'superadmin', 'admin', 'enabled')`, user, string(h)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
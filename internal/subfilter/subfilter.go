@@ -0,0 +1,540 @@
+// Package subfilter compiles structured JSON filters on subscribers into
+// parameterized SQL expressions that can be used in the WHERE clause of
+// queries on the subscribers table. It lets subscribers be filtered
+// without writing arbitrary SQL.
+//
+// A filter is a tree of AND / OR groups of conditions. For example:
+//
+//	{"and": [
+//		{"field": "status", "op": "eq", "value": "enabled"},
+//		{"field": "attribs.city", "op": "eq", "value": "Bengaluru"},
+//		{"or": [
+//			{"field": "list", "op": "in", "value": [1, 2], "status": "confirmed"},
+//			{"field": "clicks", "op": "gte", "value": 1, "since": "2021-01-01"}
+//		]}
+//	]}
+package subfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/lib/pq"
+)
+
+// Operators.
+const (
+	OpEq         = "eq"
+	OpNeq        = "neq"
+	OpGt         = "gt"
+	OpGte        = "gte"
+	OpLt         = "lt"
+	OpLte        = "lte"
+	OpBetween    = "between"
+	OpIn         = "in"
+	OpNotIn      = "not_in"
+	OpContains   = "contains"
+	OpStartsWith = "starts_with"
+	OpEndsWith   = "ends_with"
+	OpExists     = "exists"
+	OpNotExists  = "not_exists"
+)
+
+// Fields. Attributes are filtered with the attribs prefix followed by
+// a dot separated path to the attribute, eg: attribs.location.city
+const (
+	FieldEmail     = "email"
+	FieldName      = "name"
+	FieldStatus    = "status"
+	FieldCreatedAt = "created_at"
+	FieldUpdatedAt = "updated_at"
+	FieldList      = "list"
+	FieldBounces   = "bounces"
+	FieldViews     = "views"
+	FieldClicks    = "clicks"
+
+	attribsPrefix = "attribs."
+)
+
+const (
+	// maxDepth is the maximum nesting depth of groups in a filter.
+	maxDepth = 10
+
+	// maxConditions is the maximum number of conditions in a filter.
+	maxConditions = 100
+)
+
+var (
+	strOps  = []string{OpEq, OpNeq, OpIn, OpNotIn, OpContains, OpStartsWith, OpEndsWith}
+	enumOps = []string{OpEq, OpNeq, OpIn, OpNotIn}
+	dateOps = []string{OpGt, OpGte, OpLt, OpLte, OpBetween}
+	numOps  = []string{OpEq, OpNeq, OpGt, OpGte, OpLt, OpLte}
+	listOps = []string{OpIn, OpNotIn}
+	attrOps = []string{OpEq, OpNeq, OpGt, OpGte, OpLt, OpLte, OpIn, OpNotIn,
+		OpContains, OpStartsWith, OpEndsWith, OpExists, OpNotExists}
+
+	sqlOps = map[string]string{
+		OpEq:  "=",
+		OpNeq: "!=",
+		OpGt:  ">",
+		OpGte: ">=",
+		OpLt:  "<",
+		OpLte: "<=",
+	}
+
+	subStatuses = []string{models.SubscriberStatusEnabled,
+		models.SubscriberStatusDisabled, models.SubscriberStatusBlockListed}
+	subscriptionStatuses = []string{models.SubscriptionStatusUnconfirmed,
+		models.SubscriptionStatusConfirmed, models.SubscriptionStatusUnsubscribed}
+	bounceTypes = []string{models.BounceTypeSoft, models.BounceTypeHard, models.BounceTypeComplaint}
+
+	dateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+	errEmpty = errors.New("empty filter")
+)
+
+// Filter is a node in a filter tree. It is either a group of child nodes
+// that are combined with AND or OR, or a condition on a single field.
+type Filter struct {
+	And []Filter `json:"and,omitempty"`
+	Or  []Filter `json:"or,omitempty"`
+
+	Field string          `json:"field,omitempty"`
+	Op    string          `json:"op,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// Optional qualifiers. Status is the subscription status for the list field.
+	// Type is the bounce type for the bounces field. CampaignID restricts the
+	// views and clicks fields to a campaign. Since restricts the bounces, views,
+	// and clicks fields to the ones recorded from a point in time.
+	Status     string `json:"status,omitempty"`
+	Type       string `json:"type,omitempty"`
+	CampaignID int    `json:"campaign_id,omitempty"`
+	Since      string `json:"since,omitempty"`
+}
+
+// compiler holds the state of a filter being compiled.
+type compiler struct {
+	args     []interface{}
+	argStart int
+	numConds int
+}
+
+// Parse parses a JSON filter.
+func Parse(b []byte) (Filter, error) {
+	var f Filter
+	if err := json.Unmarshal(b, &f); err != nil {
+		return f, fmt.Errorf("invalid filter JSON: %v", err)
+	}
+	return f, nil
+}
+
+// IsEmpty returns true if the filter has no groups or conditions.
+func (f Filter) IsEmpty() bool {
+	return len(f.And) == 0 && len(f.Or) == 0 && f.Field == ""
+}
+
+// Compile compiles the filter into an SQL expression with positional arguments
+// ($n) starting at argStart, and returns the expression and the arguments
+// to be passed to the query along with its other arguments.
+func (f Filter) Compile(argStart int) (string, []interface{}, error) {
+	if f.IsEmpty() {
+		return "", nil, errEmpty
+	}
+
+	c := &compiler{argStart: argStart}
+	exp, err := c.compile(f, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	return exp, c.args, nil
+}
+
+// compile recursively compiles a filter node.
+func (c *compiler) compile(f Filter, depth int) (string, error) {
+	if depth > maxDepth {
+		return "", fmt.Errorf("filter exceeds the maximum depth of %d", maxDepth)
+	}
+
+	var (
+		group []Filter
+		join  string
+	)
+	switch {
+	case len(f.And) > 0 && (len(f.Or) > 0 || f.Field != ""),
+		len(f.Or) > 0 && f.Field != "":
+		return "", errors.New("a filter node should have one of and, or, or field")
+	case len(f.And) > 0:
+		group, join = f.And, " AND "
+	case len(f.Or) > 0:
+		group, join = f.Or, " OR "
+	case f.Field != "":
+		c.numConds++
+		if c.numConds > maxConditions {
+			return "", fmt.Errorf("filter exceeds the maximum of %d conditions", maxConditions)
+		}
+		return c.compileCond(f)
+	default:
+		return "", errEmpty
+	}
+
+	exps := make([]string, 0, len(group))
+	for _, g := range group {
+		exp, err := c.compile(g, depth+1)
+		if err != nil {
+			return "", err
+		}
+		exps = append(exps, exp)
+	}
+
+	return "(" + strings.Join(exps, join) + ")", nil
+}
+
+// compileCond compiles a condition on a single field.
+func (c *compiler) compileCond(f Filter) (string, error) {
+	switch f.Field {
+	case FieldEmail, FieldName:
+		if err := checkOp(f, strOps); err != nil {
+			return "", err
+		}
+		return c.compileStr("subscribers."+f.Field, f)
+
+	case FieldStatus:
+		if err := checkOp(f, enumOps); err != nil {
+			return "", err
+		}
+		return c.compileEnum("subscribers.status", "subscriber_status", subStatuses, f)
+
+	case FieldCreatedAt, FieldUpdatedAt:
+		if err := checkOp(f, dateOps); err != nil {
+			return "", err
+		}
+		return c.compileDate("subscribers."+f.Field, f)
+
+	case FieldList:
+		if err := checkOp(f, listOps); err != nil {
+			return "", err
+		}
+		return c.compileList(f)
+
+	case FieldBounces, FieldViews, FieldClicks:
+		if err := checkOp(f, numOps); err != nil {
+			return "", err
+		}
+		return c.compileCount(f)
+	}
+
+	if strings.HasPrefix(f.Field, attribsPrefix) {
+		if err := checkOp(f, attrOps); err != nil {
+			return "", err
+		}
+		return c.compileAttrib(f)
+	}
+
+	return "", fmt.Errorf("unknown field '%s'", f.Field)
+}
+
+// compileStr compiles a condition on a string column.
+func (c *compiler) compileStr(col string, f Filter) (string, error) {
+	if f.Op == OpIn || f.Op == OpNotIn {
+		var vals []string
+		if err := decodeValue(f, &vals); err != nil {
+			return "", err
+		}
+
+		exp := fmt.Sprintf("%s = ANY(%s::TEXT[])", col, c.arg(pq.StringArray(vals)))
+		if f.Op == OpNotIn {
+			exp = "NOT(" + exp + ")"
+		}
+		return exp, nil
+	}
+
+	var val string
+	if err := decodeValue(f, &val); err != nil {
+		return "", err
+	}
+
+	switch f.Op {
+	case OpContains:
+		return fmt.Sprintf("%s ILIKE %s", col, c.arg("%"+escapeLike(val)+"%")), nil
+	case OpStartsWith:
+		return fmt.Sprintf("%s ILIKE %s", col, c.arg(escapeLike(val)+"%")), nil
+	case OpEndsWith:
+		return fmt.Sprintf("%s ILIKE %s", col, c.arg("%"+escapeLike(val))), nil
+	}
+
+	return fmt.Sprintf("%s %s %s", col, sqlOps[f.Op], c.arg(val)), nil
+}
+
+// compileEnum compiles a condition on an enum column.
+func (c *compiler) compileEnum(col, typ string, valid []string, f Filter) (string, error) {
+	var vals []string
+	if f.Op == OpIn || f.Op == OpNotIn {
+		if err := decodeValue(f, &vals); err != nil {
+			return "", err
+		}
+	} else {
+		var v string
+		if err := decodeValue(f, &v); err != nil {
+			return "", err
+		}
+		vals = []string{v}
+	}
+
+	for _, v := range vals {
+		if !inSlice(v, valid) {
+			return "", fmt.Errorf("invalid value '%s' for field '%s'", v, f.Field)
+		}
+	}
+
+	switch f.Op {
+	case OpIn, OpNotIn:
+		exp := fmt.Sprintf("%s = ANY(%s::%s[])", col, c.arg(pq.StringArray(vals)), typ)
+		if f.Op == OpNotIn {
+			exp = "NOT(" + exp + ")"
+		}
+		return exp, nil
+	}
+
+	return fmt.Sprintf("%s %s %s::%s", col, sqlOps[f.Op], c.arg(vals[0]), typ), nil
+}
+
+// compileDate compiles a condition on a timestamp column.
+func (c *compiler) compileDate(col string, f Filter) (string, error) {
+	if f.Op == OpBetween {
+		var vals []string
+		if err := decodeValue(f, &vals); err != nil {
+			return "", err
+		}
+		if len(vals) != 2 {
+			return "", fmt.Errorf("'%s' on field '%s' requires two values", f.Op, f.Field)
+		}
+
+		from, err := parseDate(vals[0])
+		if err != nil {
+			return "", err
+		}
+		to, err := parseDate(vals[1])
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s BETWEEN %s AND %s", col, c.arg(from), c.arg(to)), nil
+	}
+
+	var val string
+	if err := decodeValue(f, &val); err != nil {
+		return "", err
+	}
+	t, err := parseDate(val)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s %s %s", col, sqlOps[f.Op], c.arg(t)), nil
+}
+
+// compileList compiles a condition on the subscriptions of a subscriber to
+// lists, and optionally, the status of the subscriptions.
+func (c *compiler) compileList(f Filter) (string, error) {
+	var ids []int64
+	if err := decodeValue(f, &ids); err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("no list IDs for field '%s'", f.Field)
+	}
+
+	// The subscriber_lists table is aliased as the expression may be used in
+	// queries that already join subscriber_lists.
+	exp := fmt.Sprintf("SELECT 1 FROM subscriber_lists fsl WHERE fsl.subscriber_id = subscribers.id AND fsl.list_id = ANY(%s::INT[])",
+		c.arg(pq.Int64Array(ids)))
+	if f.Status != "" {
+		if !inSlice(f.Status, subscriptionStatuses) {
+			return "", fmt.Errorf("invalid subscription status '%s'", f.Status)
+		}
+		exp += fmt.Sprintf(" AND fsl.status = %s::subscription_status", c.arg(f.Status))
+	}
+
+	if f.Op == OpNotIn {
+		return "NOT EXISTS (" + exp + ")", nil
+	}
+	return "EXISTS (" + exp + ")", nil
+}
+
+// compileCount compiles a condition on the number of bounces, views,
+// or clicks of a subscriber.
+func (c *compiler) compileCount(f Filter) (string, error) {
+	var val int
+	if err := decodeValue(f, &val); err != nil {
+		return "", err
+	}
+
+	var (
+		table string
+		conds []string
+	)
+	switch f.Field {
+	case FieldBounces:
+		table = "bounces"
+		if f.Type != "" {
+			if !inSlice(f.Type, bounceTypes) {
+				return "", fmt.Errorf("invalid bounce type '%s'", f.Type)
+			}
+			conds = append(conds, fmt.Sprintf("type = %s::bounce_type", c.arg(f.Type)))
+		}
+	case FieldViews:
+		table = "campaign_views"
+	case FieldClicks:
+		table = "link_clicks"
+	}
+
+	if f.CampaignID > 0 {
+		conds = append(conds, fmt.Sprintf("campaign_id = %s", c.arg(f.CampaignID)))
+	}
+	if f.Since != "" {
+		t, err := parseDate(f.Since)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, fmt.Sprintf("created_at >= %s", c.arg(t)))
+	}
+
+	sub := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s.subscriber_id = subscribers.id", table, table)
+	for _, cond := range conds {
+		sub += " AND " + table + "." + cond
+	}
+
+	return fmt.Sprintf("(%s) %s %s", sub, sqlOps[f.Op], c.arg(val)), nil
+}
+
+// compileAttrib compiles a condition on a subscriber attribute. The type of
+// comparison depends on the type of the value. Numbers are compared numerically
+// with attributes that are numbers, and everything else is compared as text,
+// except for equality, which compares the JSON values.
+func (c *compiler) compileAttrib(f Filter) (string, error) {
+	path := strings.Split(strings.TrimPrefix(f.Field, attribsPrefix), ".")
+	for _, p := range path {
+		if p == "" {
+			return "", fmt.Errorf("invalid attribute path '%s'", f.Field)
+		}
+	}
+
+	var (
+		p       = c.arg(pq.StringArray(path))
+		jsonExp = fmt.Sprintf("subscribers.attribs #> %s::TEXT[]", p)
+		textExp = fmt.Sprintf("(subscribers.attribs #>> %s::TEXT[])", p)
+	)
+
+	switch f.Op {
+	case OpExists:
+		return jsonExp + " IS NOT NULL", nil
+	case OpNotExists:
+		return jsonExp + " IS NULL", nil
+
+	case OpEq:
+		if len(f.Value) == 0 {
+			return "", fmt.Errorf("no value for field '%s'", f.Field)
+		}
+		return fmt.Sprintf("%s = %s::JSONB", jsonExp, c.arg(string(f.Value))), nil
+	case OpNeq:
+		if len(f.Value) == 0 {
+			return "", fmt.Errorf("no value for field '%s'", f.Field)
+		}
+		return fmt.Sprintf("%s IS DISTINCT FROM %s::JSONB", jsonExp, c.arg(string(f.Value))), nil
+
+	case OpIn, OpNotIn:
+		var vals []json.RawMessage
+		if err := decodeValue(f, &vals); err != nil {
+			return "", err
+		}
+		exp := fmt.Sprintf("%s IN (SELECT JSONB_ARRAY_ELEMENTS(%s::JSONB))", jsonExp, c.arg(string(f.Value)))
+		if f.Op == OpNotIn {
+			exp = "NOT COALESCE(" + exp + ", false)"
+		}
+		return exp, nil
+
+	case OpContains, OpStartsWith, OpEndsWith:
+		var val string
+		if err := decodeValue(f, &val); err != nil {
+			return "", err
+		}
+		switch f.Op {
+		case OpContains:
+			val = "%" + escapeLike(val) + "%"
+		case OpStartsWith:
+			val = escapeLike(val) + "%"
+		case OpEndsWith:
+			val = "%" + escapeLike(val)
+		}
+		return fmt.Sprintf("%s ILIKE %s", textExp, c.arg(val)), nil
+	}
+
+	// Numbers are compared numerically with attributes that are numbers. The
+	// CASE ensures that non-numeric attributes are never cast.
+	var num float64
+	if err := json.Unmarshal(f.Value, &num); err == nil {
+		return fmt.Sprintf("(CASE WHEN JSONB_TYPEOF(%s) = 'number' THEN %s::NUMERIC END) %s %s",
+			jsonExp, textExp, sqlOps[f.Op], c.arg(num)), nil
+	}
+
+	var val string
+	if err := decodeValue(f, &val); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s", textExp, sqlOps[f.Op], c.arg(val)), nil
+}
+
+// arg adds a positional argument and returns its placeholder.
+func (c *compiler) arg(v interface{}) string {
+	c.args = append(c.args, v)
+	return "$" + strconv.Itoa(c.argStart+len(c.args)-1)
+}
+
+// checkOp checks whether a condition's operator is one of the given operators.
+func checkOp(f Filter, ops []string) error {
+	if !inSlice(f.Op, ops) {
+		return fmt.Errorf("invalid operator '%s' for field '%s'", f.Op, f.Field)
+	}
+	return nil
+}
+
+// decodeValue decodes the JSON value of a condition.
+func decodeValue(f Filter, out interface{}) error {
+	if len(f.Value) == 0 {
+		return fmt.Errorf("no value for field '%s'", f.Field)
+	}
+	if err := json.Unmarshal(f.Value, out); err != nil {
+		return fmt.Errorf("invalid value for field '%s'", f.Field)
+	}
+	return nil
+}
+
+// parseDate parses a date or timestamp.
+func parseDate(s string) (time.Time, error) {
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date '%s'", s)
+}
+
+// escapeLike escapes the wildcard characters in an ILIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func inSlice(s string, sl []string) bool {
+	for _, v := range sl {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
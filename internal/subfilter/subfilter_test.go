@@ -0,0 +1,246 @@
+package subfilter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestCompile(t *testing.T) {
+	date := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name string
+		in   string
+		exp  string
+		args []interface{}
+	}{
+		{"string eq", `{"field": "email", "op": "eq", "value": "a@b.com"}`,
+			"subscribers.email = $1", []interface{}{"a@b.com"}},
+		{"string in", `{"field": "name", "op": "not_in", "value": ["a", "b"]}`,
+			"NOT(subscribers.name = ANY($1::TEXT[]))", []interface{}{pq.StringArray{"a", "b"}}},
+		{"contains escapes wildcards", `{"field": "name", "op": "contains", "value": "50%_\\"}`,
+			"subscribers.name ILIKE $1", []interface{}{`%50\%\_\\%`}},
+		{"starts with", `{"field": "email", "op": "starts_with", "value": "a"}`,
+			"subscribers.email ILIKE $1", []interface{}{"a%"}},
+		{"ends with", `{"field": "email", "op": "ends_with", "value": "@b.com"}`,
+			"subscribers.email ILIKE $1", []interface{}{"%@b.com"}},
+		{"status", `{"field": "status", "op": "eq", "value": "enabled"}`,
+			"subscribers.status = $1::subscriber_status", []interface{}{"enabled"}},
+		{"status in", `{"field": "status", "op": "in", "value": ["enabled", "blocklisted"]}`,
+			"subscribers.status = ANY($1::subscriber_status[])", []interface{}{pq.StringArray{"enabled", "blocklisted"}}},
+		{"date", `{"field": "created_at", "op": "gte", "value": "2021-01-01"}`,
+			"subscribers.created_at >= $1", []interface{}{date}},
+		{"date between", `{"field": "updated_at", "op": "between", "value": ["2021-01-01", "2021-01-01T00:00:00Z"]}`,
+			"subscribers.updated_at BETWEEN $1 AND $2", []interface{}{date, date}},
+		{"list", `{"field": "list", "op": "in", "value": [1, 2], "status": "confirmed"}`,
+			"EXISTS (SELECT 1 FROM subscriber_lists fsl WHERE fsl.subscriber_id = subscribers.id AND fsl.list_id = ANY($1::INT[]) AND fsl.status = $2::subscription_status)",
+			[]interface{}{pq.Int64Array{1, 2}, "confirmed"}},
+		{"not in list", `{"field": "list", "op": "not_in", "value": [3]}`,
+			"NOT EXISTS (SELECT 1 FROM subscriber_lists fsl WHERE fsl.subscriber_id = subscribers.id AND fsl.list_id = ANY($1::INT[]))",
+			[]interface{}{pq.Int64Array{3}}},
+		{"bounces", `{"field": "bounces", "op": "gt", "value": 2, "type": "hard", "since": "2021-01-01"}`,
+			"(SELECT COUNT(*) FROM bounces WHERE bounces.subscriber_id = subscribers.id AND bounces.type = $1::bounce_type AND bounces.created_at >= $2) > $3",
+			[]interface{}{"hard", date, 2}},
+		{"clicks on a campaign", `{"field": "clicks", "op": "gte", "value": 1, "campaign_id": 5}`,
+			"(SELECT COUNT(*) FROM link_clicks WHERE link_clicks.subscriber_id = subscribers.id AND link_clicks.campaign_id = $1) >= $2",
+			[]interface{}{5, 1}},
+		{"attrib eq", `{"field": "attribs.location.city", "op": "eq", "value": "Bengaluru"}`,
+			"subscribers.attribs #> $1::TEXT[] = $2::JSONB", []interface{}{pq.StringArray{"location", "city"}, `"Bengaluru"`}},
+		{"attrib exists", `{"field": "attribs.city", "op": "not_exists"}`,
+			"subscribers.attribs #> $1::TEXT[] IS NULL", []interface{}{pq.StringArray{"city"}}},
+		{"attrib number", `{"field": "attribs.age", "op": "lt", "value": 30}`,
+			"(CASE WHEN JSONB_TYPEOF(subscribers.attribs #> $1::TEXT[]) = 'number' THEN (subscribers.attribs #>> $1::TEXT[])::NUMERIC END) < $2",
+			[]interface{}{pq.StringArray{"age"}, float64(30)}},
+		{"attrib text", `{"field": "attribs.plan", "op": "gt", "value": "b"}`,
+			"(subscribers.attribs #>> $1::TEXT[]) > $2", []interface{}{pq.StringArray{"plan"}, "b"}},
+		{"attrib in", `{"field": "attribs.plan", "op": "not_in", "value": ["a", 1]}`,
+			"NOT COALESCE(subscribers.attribs #> $1::TEXT[] IN (SELECT JSONB_ARRAY_ELEMENTS($2::JSONB)), false)",
+			[]interface{}{pq.StringArray{"plan"}, `["a", 1]`}},
+		{"groups", `{"and": [
+				{"field": "status", "op": "eq", "value": "enabled"},
+				{"or": [
+					{"field": "email", "op": "eq", "value": "a@b.com"},
+					{"field": "name", "op": "eq", "value": "A"}
+				]}
+			]}`,
+			"(subscribers.status = $1::subscriber_status AND (subscribers.email = $2 OR subscribers.name = $3))",
+			[]interface{}{"enabled", "a@b.com", "A"}},
+	}
+
+	for _, c := range cases {
+		f, err := Parse([]byte(c.in))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		exp, args, err := f.Compile(1)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if exp != c.exp {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.name, exp, c.exp)
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%s: got args %#v, want %#v", c.name, args, c.args)
+		}
+	}
+}
+
+func TestCompileArgStart(t *testing.T) {
+	f, err := Parse([]byte(`{"or": [
+		{"field": "email", "op": "eq", "value": "a@b.com"},
+		{"field": "attribs.city", "op": "eq", "value": "X"},
+		{"field": "created_at", "op": "between", "value": ["2021-01-01", "2021-02-01"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every argument has a placeholder that's numbered from argStart.
+	cases := []struct {
+		start int
+		exp   string
+	}{
+		{1, "(subscribers.email = $1 OR subscribers.attribs #> $2::TEXT[] = $3::JSONB OR subscribers.created_at BETWEEN $4 AND $5)"},
+		{3, "(subscribers.email = $3 OR subscribers.attribs #> $4::TEXT[] = $5::JSONB OR subscribers.created_at BETWEEN $6 AND $7)"},
+		{10, "(subscribers.email = $10 OR subscribers.attribs #> $11::TEXT[] = $12::JSONB OR subscribers.created_at BETWEEN $13 AND $14)"},
+	}
+	for _, c := range cases {
+		exp, args, err := f.Compile(c.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp != c.exp {
+			t.Errorf("start %d: got\n%s\nwant\n%s", c.start, exp, c.exp)
+		}
+		if len(args) != 5 {
+			t.Errorf("start %d: got %d args, want 5", c.start, len(args))
+		}
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+	}{
+		{"empty", `{}`},
+		{"empty group", `{"and": []}`},
+		{"group and field", `{"and": [{"field": "email", "op": "eq", "value": "a"}], "field": "email"}`},
+		{"and and or", `{"and": [{"field": "email", "op": "eq", "value": "a"}], "or": [{"field": "email", "op": "eq", "value": "a"}]}`},
+		{"empty child", `{"and": [{}]}`},
+
+		// Only whitelisted fields and operators.
+		{"unknown field", `{"field": "password", "op": "eq", "value": "a"}`},
+		{"column of another table", `{"field": "lists.name", "op": "eq", "value": "a"}`},
+		{"unknown op", `{"field": "email", "op": "like", "value": "a"}`},
+		{"SQL op", `{"field": "email", "op": "=", "value": "a"}`},
+		{"op not allowed on field", `{"field": "status", "op": "contains", "value": "a"}`},
+		{"date op on string", `{"field": "email", "op": "between", "value": ["a", "b"]}`},
+		{"string op on list", `{"field": "list", "op": "eq", "value": 1}`},
+		{"between on number", `{"field": "clicks", "op": "between", "value": [1, 2]}`},
+
+		// Values are validated.
+		{"no value", `{"field": "email", "op": "eq"}`},
+		{"wrong value type", `{"field": "email", "op": "eq", "value": 1}`},
+		{"invalid status", `{"field": "status", "op": "eq", "value": "enabled' OR 1=1 --"}`},
+		{"invalid date", `{"field": "created_at", "op": "gt", "value": "yesterday"}`},
+		{"between with one date", `{"field": "created_at", "op": "between", "value": ["2021-01-01"]}`},
+		{"no lists", `{"field": "list", "op": "in", "value": []}`},
+		{"invalid subscription status", `{"field": "list", "op": "in", "value": [1], "status": "x"}`},
+		{"invalid bounce type", `{"field": "bounces", "op": "gt", "value": 1, "type": "hard'::bounce_type OR 1=1"}`},
+		{"invalid since", `{"field": "views", "op": "gt", "value": 1, "since": "now()"}`},
+		{"non-integer count", `{"field": "views", "op": "gt", "value": "1 OR 1=1"}`},
+		{"empty attribute path", `{"field": "attribs.", "op": "exists"}`},
+		{"empty attribute path segment", `{"field": "attribs.a..b", "op": "exists"}`},
+
+		// Injection attempts in field names.
+		{"injection in field", `{"field": "email = email OR 1=1 --", "op": "eq", "value": "a"}`},
+		{"injection in field case", `{"field": "EMAIL", "op": "eq", "value": "a"}`},
+		{"injection in op", `{"field": "email", "op": "eq OR 1=1", "value": "a"}`},
+	}
+
+	for _, c := range cases {
+		f, err := Parse([]byte(c.in))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if exp, _, err := f.Compile(1); err == nil {
+			t.Errorf("%s: expected error, got %s", c.name, exp)
+		}
+	}
+}
+
+func TestCompileInjection(t *testing.T) {
+	// Values and attribute paths never end up in the SQL expression,
+	// only in the arguments.
+	inj := `x'; DROP TABLE subscribers; --`
+	cases := []string{
+		`{"field": "email", "op": "eq", "value": "` + inj + `"}`,
+		`{"field": "name", "op": "contains", "value": "` + inj + `"}`,
+		`{"field": "email", "op": "in", "value": ["` + inj + `"]}`,
+		`{"field": "attribs.` + inj + `", "op": "exists"}`,
+		`{"field": "attribs.city", "op": "eq", "value": "` + inj + `"}`,
+		`{"field": "attribs.city", "op": "gt", "value": "` + inj + `"}`,
+		`{"field": "attribs.city", "op": "in", "value": ["` + inj + `"]}`,
+	}
+
+	for _, c := range cases {
+		f, err := Parse([]byte(c))
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		exp, args, err := f.Compile(1)
+		if err != nil {
+			t.Errorf("%s: %v", c, err)
+			continue
+		}
+		if strings.Contains(exp, "DROP") || strings.Contains(exp, ";") || strings.Contains(exp, "x'") {
+			t.Errorf("%s: value in expression: %s", c, exp)
+		}
+		if len(args) == 0 {
+			t.Errorf("%s: no args", c)
+		}
+	}
+}
+
+func TestCompileLimits(t *testing.T) {
+	cond := `{"field": "email", "op": "eq", "value": "a"}`
+
+	// Nesting beyond the maximum depth.
+	deep := cond
+	for i := 0; i <= maxDepth; i++ {
+		deep = `{"and": [` + deep + `]}`
+	}
+	f, _ := Parse([]byte(deep))
+	if _, _, err := f.Compile(1); err == nil {
+		t.Error("expected error on exceeding the maximum depth")
+	}
+
+	// Too many conditions.
+	conds := make([]string, maxConditions+1)
+	for i := range conds {
+		conds[i] = cond
+	}
+	f, _ = Parse([]byte(`{"or": [` + strings.Join(conds, ",") + `]}`))
+	if _, _, err := f.Compile(1); err == nil {
+		t.Error("expected error on exceeding the maximum conditions")
+	}
+	f, _ = Parse([]byte(`{"or": [` + strings.Join(conds[1:], ",") + `]}`))
+	if _, _, err := f.Compile(1); err != nil {
+		t.Errorf("unexpected error with the maximum conditions: %v", err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{``, `[]`, `{"and": {}}`, `{"field": 1}`} {
+		if _, err := Parse([]byte(in)); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
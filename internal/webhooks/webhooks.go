@@ -0,0 +1,375 @@
+// Package webhooks posts app events (subscriber, campaign, bounce etc.)
+// to configured outgoing webhook URLs as signed JSON payloads, with
+// retries and a delivery log. Deliveries are recorded in the log before
+// they're attempted and pending ones are retried from it, so that they
+// survive queue overflows and restarts.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// Events that can be subscribed to by webhooks.
+const (
+	EventSubscriberCreated        = "subscriber.created"
+	EventSubscriberUpdated        = "subscriber.updated"
+	EventSubscriberDeleted        = "subscriber.deleted"
+	EventSubscriptionConfirmed    = "subscription.confirmed"
+	EventSubscriptionUnsubscribed = "subscription.unsubscribed"
+	EventCampaignStatus           = "campaign.status"
+	EventCampaignViewed           = "campaign.viewed"
+	EventLinkClicked              = "link.clicked"
+	EventBounceRecorded           = "bounce.recorded"
+)
+
+// Events is the list of all available events.
+var Events = []string{
+	EventSubscriberCreated,
+	EventSubscriberUpdated,
+	EventSubscriberDeleted,
+	EventSubscriptionConfirmed,
+	EventSubscriptionUnsubscribed,
+	EventCampaignStatus,
+	EventCampaignViewed,
+	EventLinkClicked,
+	EventBounceRecorded,
+}
+
+const (
+	// HeaderEvent is the HTTP header that carries the name of the event.
+	HeaderEvent = "X-Listmonk-Event"
+
+	// HeaderSignature is the HTTP header that carries the HMAC-SHA256
+	// signature of the request body, signed with the webhook's secret.
+	HeaderSignature = "X-Listmonk-Signature"
+
+	maxErrLen = 1000
+
+	// deliveryLease is the duration for which a delivery that's queued for
+	// an attempt is hidden from the pending delivery poller. Deliveries that
+	// wait in the queue for longer are left to the poller.
+	deliveryLease = time.Minute * 5
+
+	// pollInterval is the interval at which the log is checked for pending
+	// deliveries that are due for an attempt.
+	pollInterval = time.Second * 10
+)
+
+// Opt represents webhook delivery options.
+type Opt struct {
+	Concurrency int
+	QueueSize   int
+	Timeout     time.Duration
+
+	// Retries are backed off exponentially starting at Backoff,
+	// and are capped at MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Store represents the delivery log. Pending deliveries are leased for the
+// given duration when they're created or fetched, and are retried after
+// the given wait when they're updated.
+type Store interface {
+	CreateDelivery(hookID int, event string, payload []byte, lease time.Duration) (int64, error)
+	NextDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	UpdateDelivery(id int64, status string, attempts, code int, errMsg string, wait time.Duration) error
+}
+
+// payload is the JSON body that's posted to webhooks.
+type payload struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// delivery represents a single event to be posted to a webhook.
+type delivery struct {
+	id       int64
+	hook     models.Webhook
+	event    string
+	body     []byte
+	attempts int
+
+	// The time at which the delivery's lease expires.
+	leasedTill time.Time
+}
+
+// Manager dispatches events to webhooks.
+type Manager struct {
+	opt   Opt
+	store Store
+	log   *log.Logger
+	c     *http.Client
+
+	hooks    []models.Webhook
+	hooksMut sync.RWMutex
+
+	queue chan delivery
+}
+
+// New returns a new instance of the webhook Manager.
+func New(opt Opt, store Store, lo *log.Logger) *Manager {
+	if opt.Concurrency < 1 {
+		opt.Concurrency = 1
+	}
+	if opt.QueueSize < 1 {
+		opt.QueueSize = 1000
+	}
+	if opt.Backoff <= 0 {
+		opt.Backoff = time.Second * 10
+	}
+	if opt.MaxBackoff < opt.Backoff {
+		opt.MaxBackoff = opt.Backoff
+	}
+
+	return &Manager{
+		opt:   opt,
+		store: store,
+		log:   lo,
+		c: &http.Client{
+			Timeout: opt.Timeout,
+		},
+		queue: make(chan delivery, opt.QueueSize),
+	}
+}
+
+// Load loads (or reloads) the webhooks that events are dispatched to.
+func (m *Manager) Load(hooks []models.Webhook) {
+	m.hooksMut.Lock()
+	m.hooks = hooks
+	m.hooksMut.Unlock()
+}
+
+// Run starts the delivery workers and periodically queues the pending
+// deliveries in the log that are due. It's a blocking function.
+func (m *Manager) Run() {
+	for i := 0; i < m.opt.Concurrency; i++ {
+		go m.worker()
+	}
+
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+
+	for range t.C {
+		// Queue pending deliveries until there are none left that are due
+		// or the queue is full.
+		for m.queuePending() > 0 {
+		}
+	}
+}
+
+// Trigger dispatches an event with the given data to all the enabled webhooks
+// that are subscribed to it. The deliveries are recorded in the log and
+// happen in the background.
+func (m *Manager) Trigger(event string, data interface{}) {
+	if m == nil {
+		return
+	}
+
+	m.hooksMut.RLock()
+	var hooks []models.Webhook
+	for _, h := range m.hooks {
+		if h.Enabled && h.HasEvent(event) {
+			hooks = append(hooks, h)
+		}
+	}
+	m.hooksMut.RUnlock()
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(payload{
+		Event:     event,
+		Timestamp: time.Now(),
+		Data:      data,
+	})
+	if err != nil {
+		m.log.Printf("error marshalling webhook payload for %s: %v", event, err)
+		return
+	}
+
+	// Record the deliveries in the log before they're queued so that they're
+	// picked up by the poller if they can't be attempted right away.
+	for _, h := range hooks {
+		d := delivery{hook: h, event: event, body: b, leasedTill: time.Now().Add(deliveryLease)}
+
+		id, err := m.store.CreateDelivery(h.ID, event, b, deliveryLease)
+		if err != nil {
+			m.log.Printf("error recording %s event delivery for webhook (%s): %v", event, h.Name, err)
+		}
+		d.id = id
+
+		m.push(d)
+	}
+}
+
+// queuePending fetches a batch of pending deliveries that are due from the log
+// and queues them. It returns the number of deliveries that were queued.
+func (m *Manager) queuePending() int {
+	limit := cap(m.queue) - len(m.queue)
+	if limit <= 0 {
+		return 0
+	}
+
+	leasedTill := time.Now().Add(deliveryLease)
+	items, err := m.store.NextDeliveries(limit, deliveryLease)
+	if err != nil {
+		m.log.Printf("error fetching pending webhook deliveries: %v", err)
+		return 0
+	}
+
+	m.hooksMut.RLock()
+	hooks := make(map[int]models.Webhook, len(m.hooks))
+	for _, h := range m.hooks {
+		hooks[h.ID] = h
+	}
+	m.hooksMut.RUnlock()
+
+	for _, item := range items {
+		d := delivery{
+			id:         item.ID,
+			event:      item.Event,
+			body:       []byte(item.Payload),
+			attempts:   item.Attempts,
+			leasedTill: leasedTill,
+		}
+
+		// The webhook has been disabled since.
+		h, ok := hooks[item.WebhookID]
+		if !ok || !h.Enabled {
+			m.updateDelivery(d, models.WebhookDeliveryFailed, 0, "webhook disabled", 0)
+			continue
+		}
+		d.hook = h
+
+		m.push(d)
+	}
+
+	return len(items)
+}
+
+// push pushes a delivery to the queue without blocking. If the queue is full,
+// the delivery is left in the log for the poller to pick up once its lease
+// expires.
+func (m *Manager) push(d delivery) {
+	select {
+	case m.queue <- d:
+	default:
+		if d.id > 0 {
+			m.log.Printf("webhook queue full. deferring %s event delivery %d for webhook (%s)", d.event, d.id, d.hook.Name)
+		} else {
+			m.log.Printf("webhook queue full. dropping %s event for webhook (%s)", d.event, d.hook.Name)
+		}
+	}
+}
+
+// worker listens to the delivery queue and posts the events to webhooks.
+func (m *Manager) worker() {
+	for d := range m.queue {
+		// The delivery has waited in the queue for longer than its lease and
+		// may have been picked up by the poller (here or on another instance).
+		if d.id > 0 && time.Now().After(d.leasedTill) {
+			continue
+		}
+
+		d.attempts++
+		code, err := m.post(d)
+		if err == nil {
+			m.updateDelivery(d, models.WebhookDeliverySuccess, code, "", 0)
+			continue
+		}
+
+		// Out of retries. Deliveries that couldn't be recorded in the log
+		// can't be retried.
+		if d.attempts > d.hook.MaxRetries || d.id == 0 {
+			m.log.Printf("error posting %s event to webhook (%s) after %d attempts: %v",
+				d.event, d.hook.Name, d.attempts, err)
+			m.updateDelivery(d, models.WebhookDeliveryFailed, code, err.Error(), 0)
+			continue
+		}
+
+		// Retry with an exponential backoff. The poller picks the delivery
+		// up again once it's due.
+		m.updateDelivery(d, models.WebhookDeliveryPending, code, err.Error(), m.backoff(d.attempts))
+	}
+}
+
+// post posts a delivery's payload to its webhook and returns
+// the HTTP response code.
+func (m *Manager) post(d delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("User-Agent", "listmonk")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, d.event)
+	if d.hook.Secret != "" {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(d.body, d.hook.Secret))
+	}
+
+	r, err := m.c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// Drain and close the body to let the Transport reuse the connection
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}()
+
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return r.StatusCode, fmt.Errorf("non-2xx response from webhook: %d", r.StatusCode)
+	}
+
+	return r.StatusCode, nil
+}
+
+// backoff returns the wait duration before the next attempt.
+func (m *Manager) backoff(attempts int) time.Duration {
+	d := m.opt.Backoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= m.opt.MaxBackoff {
+			return m.opt.MaxBackoff
+		}
+	}
+	return d
+}
+
+// updateDelivery records the outcome of an attempt in the log. Pending
+// deliveries are attempted again after wait.
+func (m *Manager) updateDelivery(d delivery, status string, code int, errMsg string, wait time.Duration) {
+	if d.id == 0 {
+		return
+	}
+	if len(errMsg) > maxErrLen {
+		errMsg = errMsg[:maxErrLen]
+	}
+	if err := m.store.UpdateDelivery(d.id, status, d.attempts, code, errMsg, wait); err != nil {
+		m.log.Printf("error updating webhook delivery: %v", err)
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a body.
+func Sign(body []byte, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -47,6 +47,14 @@ const (
 	CampaignContentTypeMarkdown = "markdown"
 	CampaignContentTypePlain    = "plain"
 
+	// A/B test winner metrics.
+	ABTestMetricViews  = "views"
+	ABTestMetricClicks = "clicks"
+
+	// Template.
+	TemplateTypeCampaign = "campaign"
+	TemplateTypeTx       = "tx"
+
 	// List.
 	ListTypePrivate = "private"
 	ListTypePublic  = "public"
@@ -54,10 +62,14 @@ const (
 	ListOptinDouble = "double"
 
 	// User.
-	UserTypeSuperadmin = "superadmin"
-	UserTypeUser       = "user"
-	UserStatusEnabled  = "enabled"
-	UserStatusDisabled = "disabled"
+	UserTypeSuperadmin     = "superadmin"
+	UserTypeUser           = "user"
+	UserStatusEnabled      = "enabled"
+	UserStatusDisabled     = "disabled"
+	UserRoleAdmin          = "admin"
+	UserRoleCampaignEditor = "campaign_editor"
+	UserRoleListManager    = "list_manager"
+	UserRoleReadonly       = "readonly"
 
 	// BaseTpl is the name of the base template.
 	BaseTpl = "base"
@@ -69,8 +81,19 @@ const (
 	EmailHeaderSubscriberUUID = "X-Listmonk-Subscriber"
 	EmailHeaderCampaignUUID   = "X-Listmonk-Campaign"
 
-	BounceTypeHard = "hard"
-	BounceTypeSoft = "soft"
+	BounceTypeHard      = "hard"
+	BounceTypeSoft      = "soft"
+	BounceTypeComplaint = "complaint"
+
+	// Webhook delivery.
+	WebhookDeliveryPending = "pending"
+	WebhookDeliverySuccess = "success"
+	WebhookDeliveryFailed  = "failed"
+
+	// Sequence subscriber.
+	SequenceSubscriberActive    = "active"
+	SequenceSubscriberCompleted = "completed"
+	SequenceSubscriberExited    = "exited"
 )
 
 // Headers represents an array of string maps used to represent SMTP, HTTP headers etc.
@@ -123,11 +146,34 @@ type Base struct {
 type User struct {
 	Base
 
-	Email    string `json:"email"`
-	Name     string `json:"name"`
-	Password string `json:"-"`
-	Type     string `json:"type"`
-	Status   string `json:"status"`
+	Username string `db:"username" json:"username"`
+	Email    string `db:"email" json:"email"`
+	Name     string `db:"name" json:"name"`
+	Password string `db:"password" json:"-"`
+	Type     string `db:"type" json:"type"`
+	Role     string `db:"role" json:"role"`
+	Status   string `db:"status" json:"status"`
+
+	// RestrictLists restricts the user to the lists in ListIDs. A restricted
+	// user without any lists has access to none.
+	RestrictLists bool          `db:"restrict_lists" json:"restrict_lists"`
+	ListIDs       pq.Int64Array `db:"list_ids" json:"list_ids"`
+	LoggedInAt    null.Time     `db:"loggedin_at" json:"loggedin_at"`
+}
+
+// APIToken represents an API token of a user for machine clients.
+type APIToken struct {
+	Base
+
+	UserID     int            `db:"user_id" json:"user_id"`
+	Username   string         `db:"username" json:"username"`
+	Name       string         `db:"name" json:"name"`
+	Scopes     pq.StringArray `db:"scopes" json:"scopes"`
+	ExpiresAt  null.Time      `db:"expires_at" json:"expires_at"`
+	LastUsedAt null.Time      `db:"last_used_at" json:"last_used_at"`
+
+	// Token is the raw token that is only returned once on creation.
+	Token string `db:"-" json:"token,omitempty"`
 }
 
 // Subscriber represents an e-mail subscriber.
@@ -187,6 +233,18 @@ type List struct {
 	Total int `db:"total" json:"-"`
 }
 
+// Segment represents a saved segment of subscribers described by an
+// arbitrary SQL expression over subscribers and subscriber_lists, and/or
+// a structured filter (subfilter.Filter).
+type Segment struct {
+	Base
+
+	Name        string         `db:"name" json:"name"`
+	Description string         `db:"description" json:"description"`
+	Query       string         `db:"query" json:"query"`
+	Filter      types.JSONText `db:"filter" json:"filter"`
+}
+
 // Campaign represents an e-mail campaign.
 type Campaign struct {
 	Base
@@ -207,6 +265,45 @@ type Campaign struct {
 	TemplateID  int            `db:"template_id" json:"template_id"`
 	Messenger   string         `db:"messenger" json:"messenger"`
 
+	// PauseReason is the reason for which a campaign was paused automatically.
+	PauseReason string `db:"pause_reason" json:"pause_reason"`
+
+	// A/B test variants and settings. ABTestPercent of the subscribers are split
+	// between the variants, and after ABTestWaitMins, the variant with the most
+	// views or clicks (ABTestMetric) is sent to the rest.
+	Variants       CampaignVariants `db:"variants" json:"variants"`
+	ABTestPercent  int              `db:"ab_test_percent" json:"ab_test_percent"`
+	ABTestWaitMins int              `db:"ab_test_wait_mins" json:"ab_test_wait_mins"`
+	ABTestMetric   string           `db:"ab_test_metric" json:"ab_test_metric"`
+	ABTestSentAt   null.Time        `db:"ab_test_sent_at" json:"ab_test_sent_at"`
+	ABWinnerID     null.Int         `db:"ab_winner_id" json:"ab_winner_id"`
+
+	// SendLocal sends the campaign at SendAt's time of day in every subscriber's
+	// timezone (attribs.timezone), with Timezone as the fallback. Subscribers
+	// are sent to in waves of timezones (WaveFrom, WaveTo] as their time comes.
+	SendLocal bool      `db:"send_local" json:"send_local"`
+	Timezone  string    `db:"timezone" json:"timezone"`
+	WaveFrom  null.Time `db:"wave_from" json:"wave_from"`
+	WaveTo    null.Time `db:"wave_to" json:"wave_to"`
+
+	// Cron is the schedule of a recurring campaign. At every occurrence (NextRunAt),
+	// a copy of the campaign is created as a new campaign with ParentID set and sent.
+	// With SkipEmpty, runs whose content renders empty are skipped.
+	Cron      string    `db:"cron" json:"cron"`
+	SkipEmpty bool      `db:"skip_empty" json:"skip_empty"`
+	NextRunAt null.Time `db:"next_run_at" json:"next_run_at"`
+	ParentID  null.Int  `db:"parent_id" json:"parent_id"`
+
+	// FeedURL is the RSS/Atom feed of a recurring campaign. Its runs are sent
+	// when there are new items in the feed, which are in the FeedItems of the
+	// runs for rendering in the body, eg: {{ range .Campaign.FeedItems }}.
+	FeedURL   string    `db:"feed_url" json:"feed_url"`
+	FeedItems FeedItems `db:"feed_items" json:"feed_items"`
+
+	// VariantID is the ID of the A/B test variant whose subject and body
+	// a copy of the campaign carries for rendering messages.
+	VariantID int `db:"-" json:"-"`
+
 	// TemplateBody is joined in from templates by the next-campaigns query.
 	TemplateBody string             `db:"template_body" json:"-"`
 	Tpl          *template.Template `json:"-"`
@@ -225,6 +322,9 @@ type CampaignMeta struct {
 	Clicks     int `db:"clicks" json:"clicks"`
 	Bounces    int `db:"bounces" json:"bounces"`
 
+	// Views and clicks of each A/B test variant.
+	VariantStats types.JSONText `db:"variant_stats" json:"variant_stats"`
+
 	// This is a list of {list_id, name} pairs unlike Subscriber.Lists[]
 	// because lists can be deleted after a campaign is finished, resulting
 	// in null lists data to be returned. For that reason, campaign_lists maintains
@@ -232,6 +332,10 @@ type CampaignMeta struct {
 	// even after a list is deleted.
 	Lists types.JSONText `db:"lists" json:"lists"`
 
+	// {id, name} pairs of the segments the campaign targets, maintained
+	// like Lists as segments can be deleted.
+	Segments types.JSONText `db:"segments" json:"segments"`
+
 	StartedAt null.Time `db:"started_at" json:"started_at"`
 	ToSend    int       `db:"to_send" json:"to_send"`
 	Sent      int       `db:"sent" json:"sent"`
@@ -240,13 +344,204 @@ type CampaignMeta struct {
 // Campaigns represents a slice of Campaigns.
 type Campaigns []Campaign
 
+// CampaignVariant represents an A/B test variant of a campaign's subject and body.
+type CampaignVariant struct {
+	ID      int    `db:"id" json:"id"`
+	Name    string `db:"name" json:"name"`
+	Subject string `db:"subject" json:"subject"`
+	Body    string `db:"body" json:"body"`
+}
+
+// CampaignVariants represents a slice of CampaignVariant.
+type CampaignVariants []CampaignVariant
+
 // Template represents a reusable e-mail template.
 type Template struct {
 	Base
 
 	Name      string `db:"name" json:"name"`
+	Type      string `db:"type" json:"type"`
+	Subject   string `db:"subject" json:"subject"`
 	Body      string `db:"body" json:"body,omitempty"`
 	IsDefault bool   `db:"is_default" json:"is_default"`
+
+	// Only relevant to tx (transactional) templates.
+	SubjectTpl *template.Template `db:"-" json:"-"`
+	Tpl        *template.Template `db:"-" json:"-"`
+}
+
+// TxMessage represents an e-mail or a message sent using a transactional template.
+type TxMessage struct {
+	SubscriberEmail string `json:"subscriber_email"`
+	SubscriberID    int    `json:"subscriber_id"`
+
+	TemplateID  int                    `json:"template_id"`
+	Data        map[string]interface{} `json:"data"`
+	FromEmail   string                 `json:"from_email"`
+	Headers     Headers                `json:"headers"`
+	ContentType string                 `json:"content_type"`
+	Messenger   string                 `json:"messenger"`
+
+	Subject string `json:"-"`
+	Body    []byte `json:"-"`
+}
+
+// TxTplData is the data that transactional templates are rendered with.
+type TxTplData struct {
+	Subscriber Subscriber
+	Tx         *TxMessage
+}
+
+// Compile compiles a template body and subject (only for tx templates) and
+// caches the template references to be executed later.
+func (t *Template) Compile(f template.FuncMap) error {
+	// Expand the tracking shorthands, eg: {{ TrackView }}, in the body.
+	body := t.Body
+	for _, r := range regTplFuncs {
+		body = r.regExp.ReplaceAllString(body, r.replace)
+	}
+
+	tpl, err := template.New(BaseTpl).Funcs(f).Parse(body)
+	if err != nil {
+		return fmt.Errorf("error compiling transactional template: %v", err)
+	}
+	t.Tpl = tpl
+
+	// If the subject line has a template string, compile it.
+	if strings.Contains(t.Subject, "{{") {
+		subj := t.Subject
+		for _, r := range regTplFuncs {
+			subj = r.regExp.ReplaceAllString(subj, r.replace)
+		}
+
+		subjTpl, err := template.New(BaseTpl).Funcs(f).Parse(subj)
+		if err != nil {
+			return fmt.Errorf("error compiling subject: %v", err)
+		}
+		t.SubjectTpl = subjTpl
+	}
+
+	return nil
+}
+
+// Render renders the subject and body of a tx message with the given
+// subscriber and the message's data.
+func (m *TxMessage) Render(sub Subscriber, tpl *Template) error {
+	data := TxTplData{Subscriber: sub, Tx: m}
+
+	// Render the body.
+	b := bytes.Buffer{}
+	if err := tpl.Tpl.ExecuteTemplate(&b, BaseTpl, data); err != nil {
+		return err
+	}
+	m.Body = make([]byte, b.Len())
+	copy(m.Body, b.Bytes())
+	b.Reset()
+
+	// If the subject is also a template, render that.
+	if tpl.SubjectTpl != nil {
+		if err := tpl.SubjectTpl.ExecuteTemplate(&b, BaseTpl, data); err != nil {
+			return err
+		}
+		m.Subject = b.String()
+		b.Reset()
+	} else {
+		m.Subject = tpl.Subject
+	}
+
+	return nil
+}
+
+// CampaignFailure represents a campaign message that failed to be delivered
+// to a subscriber.
+type CampaignFailure struct {
+	ID             int64     `db:"id" json:"id"`
+	CampaignID     int       `db:"campaign_id" json:"campaign_id"`
+	SubscriberID   int       `db:"subscriber_id" json:"subscriber_id"`
+	SubscriberUUID string    `db:"subscriber_uuid" json:"subscriber_uuid"`
+	Email          string    `db:"email" json:"email"`
+	Name           string    `db:"name" json:"name"`
+	Error          string    `db:"error" json:"error"`
+	Attempts       int       `db:"attempts" json:"attempts"`
+	Queued         bool      `db:"queued" json:"queued"`
+	CreatedAt      null.Time `db:"created_at" json:"created_at"`
+	UpdatedAt      null.Time `db:"updated_at" json:"updated_at"`
+
+	Total int `db:"total" json:"-"`
+}
+
+// Sequence represents an ordered set of messages (steps) that are sent to the
+// subscribers of a list one after the other, at intervals, starting from when
+// they subscribe to the list. Subscribers progress through a sequence individually
+// and exit it on unsubscribing from the list or on matching the exit segment.
+type Sequence struct {
+	Base
+
+	UUID          string        `db:"uuid" json:"uuid"`
+	Name          string        `db:"name" json:"name"`
+	ListID        int           `db:"list_id" json:"list_id"`
+	ExitSegmentID null.Int      `db:"exit_segment_id" json:"exit_segment_id"`
+	FromEmail     string        `db:"from_email" json:"from_email"`
+	Messenger     string        `db:"messenger" json:"messenger"`
+	TemplateID    int           `db:"template_id" json:"template_id"`
+	Enabled       bool          `db:"enabled" json:"enabled"`
+	EnrolledAt    null.Time     `db:"enrolled_at" json:"-"`
+	Steps         SequenceSteps `db:"steps" json:"steps"`
+
+	// Number of subscribers in the sequence by their status.
+	SubscriberCounts types.JSONText `db:"subscriber_statuses" json:"subscriber_statuses"`
+
+	// TemplateBody is joined in from templates for sending messages.
+	TemplateBody string `db:"template_body" json:"-"`
+}
+
+// SequenceStep represents a message in a sequence that's sent DelayMins after
+// the previous one, or after the subscription for the first one.
+type SequenceStep struct {
+	ID          int         `db:"id" json:"id"`
+	Position    int         `db:"position" json:"position"`
+	DelayMins   int         `db:"delay_mins" json:"delay_mins"`
+	Subject     string      `db:"subject" json:"subject"`
+	Body        string      `db:"body" json:"body"`
+	AltBody     null.String `db:"altbody" json:"altbody"`
+	ContentType string      `db:"content_type" json:"content_type"`
+}
+
+// SequenceSteps represents a slice of SequenceStep.
+type SequenceSteps []SequenceStep
+
+// FeedItem represents an item in an RSS/Atom feed.
+type FeedItem struct {
+	GUID    string    `json:"guid"`
+	Title   string    `json:"title"`
+	Link    string    `json:"link"`
+	Summary string    `json:"summary"`
+	Date    null.Time `json:"date"`
+}
+
+// FeedItems represents a slice of FeedItem.
+type FeedItems []FeedItem
+
+// SequenceSubscriber represents the progress of a subscriber through a sequence.
+type SequenceSubscriber struct {
+	SubscriberID   int       `db:"subscriber_id" json:"subscriber_id"`
+	SubscriberUUID string    `db:"subscriber_uuid" json:"subscriber_uuid"`
+	Email          string    `db:"email" json:"email"`
+	Name           string    `db:"name" json:"name"`
+	Step           int       `db:"step" json:"step"`
+	Status         string    `db:"status" json:"status"`
+	NextAt         null.Time `db:"next_at" json:"next_at"`
+	CreatedAt      null.Time `db:"created_at" json:"created_at"`
+	UpdatedAt      null.Time `db:"updated_at" json:"updated_at"`
+
+	Total int `db:"total" json:"-"`
+}
+
+// SequenceMessage is a step of a sequence that's due to be sent to a subscriber.
+type SequenceMessage struct {
+	Sequence   *Sequence
+	Step       SequenceStep
+	Subscriber Subscriber
 }
 
 // Bounce represents a single bounce event.
@@ -270,6 +565,64 @@ type Bounce struct {
 	Total int `db:"total" json:"-"`
 }
 
+// PendingBounce represents an incoming bounce that's staged for processing.
+// Bounces that fail to be recorded end up as failed (dead-letter) ones.
+type PendingBounce struct {
+	ID        int64          `db:"id" json:"id"`
+	Payload   types.JSONText `db:"payload" json:"payload"`
+	Source    string         `db:"source" json:"source"`
+	Attempts  int            `db:"attempts" json:"attempts"`
+	Error     string         `db:"error" json:"error"`
+	CreatedAt null.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt null.Time      `db:"updated_at" json:"updated_at"`
+
+	Total int `db:"total" json:"-"`
+}
+
+// Webhook represents an outgoing webhook that app events are posted to.
+type Webhook struct {
+	Base
+
+	Name       string         `db:"name" json:"name"`
+	URL        string         `db:"url" json:"url"`
+	Events     pq.StringArray `db:"events" json:"events"`
+	Enabled    bool           `db:"enabled" json:"enabled"`
+	MaxRetries int            `db:"max_retries" json:"max_retries"`
+
+	// The signing secret is write-only and is never returned.
+	Secret string `db:"secret" json:"-"`
+}
+
+// WebhookDelivery represents a single delivery attempt log of
+// an event to a webhook.
+type WebhookDelivery struct {
+	ID           int64          `db:"id" json:"id"`
+	WebhookID    int            `db:"webhook_id" json:"webhook_id"`
+	Event        string         `db:"event" json:"event"`
+	Payload      types.JSONText `db:"payload" json:"payload"`
+	Status       string         `db:"status" json:"status"`
+	Attempts     int            `db:"attempts" json:"attempts"`
+	ResponseCode int            `db:"response_code" json:"response_code"`
+	Error        string         `db:"error" json:"error"`
+	CreatedAt    null.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt    null.Time      `db:"updated_at" json:"updated_at"`
+
+	// Pending deliveries are attempted once this is due.
+	NextAttemptAt null.Time `db:"next_attempt_at" json:"next_attempt_at"`
+
+	Total int `db:"total" json:"-"`
+}
+
+// HasEvent checks whether the webhook is subscribed to an event.
+func (w Webhook) HasEvent(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
 // markdown is a global instance of Markdown parser and renderer.
 var markdown = goldmark.New(
 	goldmark.WithParserOptions(
@@ -373,15 +726,47 @@ func (camps Campaigns) LoadStats(stmt *sqlx.Stmt) error {
 	for i, c := range meta {
 		if c.CampaignID == camps[i].ID {
 			camps[i].Lists = c.Lists
+			camps[i].Segments = c.Segments
 			camps[i].Views = c.Views
 			camps[i].Clicks = c.Clicks
 			camps[i].Bounces = c.Bounces
+			camps[i].VariantStats = c.VariantStats
 		}
 	}
 
 	return nil
 }
 
+// IsABTest returns true if the campaign's variants are to be A/B tested.
+func (c *Campaign) IsABTest() bool {
+	return c.ABTestPercent > 0 && len(c.Variants) > 1
+}
+
+// ABTestVariant returns the index of the variant that a subscriber in the
+// A/B test batch is sent. It is derived from the subscriber ID the same way
+// the test batch is in the next-campaign-subscribers query. The buckets
+// (0 to ABTestPercent-1) of the batch are split evenly between the variants.
+func (c *Campaign) ABTestVariant(subID int) int {
+	bucket := (subID + c.ID) % 100
+	if v := bucket * len(c.Variants) / c.ABTestPercent; v < len(c.Variants) {
+		return v
+	}
+	return len(c.Variants) - 1
+}
+
+// WithVariant returns a copy of the campaign with the subject and body
+// of the given variant. The copy's templates have to be compiled.
+func (c *Campaign) WithVariant(v CampaignVariant) *Campaign {
+	out := *c
+	out.Subject = v.Subject
+	out.Body = v.Body
+	out.VariantID = v.ID
+	out.Tpl = nil
+	out.SubjectTpl = nil
+	out.AltBodyTpl = nil
+	return &out
+}
+
 // CompileTemplate compiles a campaign body template into its base
 // template and sets the resultant template to Campaign.Tpl.
 func (c *Campaign) CompileTemplate(f template.FuncMap) error {
@@ -521,6 +906,109 @@ func (h *Headers) Scan(src interface{}) error {
 	return nil
 }
 
+// Scan implements the sql.Scanner interface.
+func (v *CampaignVariants) Scan(src interface{}) error {
+	var b []byte
+	switch src := src.(type) {
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	case nil:
+		return nil
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// Value implements the driver.Valuer interface.
+func (v CampaignVariants) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Campaign returns a campaign with the contents of a step of the sequence
+// for compiling and rendering the step's messages like a campaign's. The campaign
+// carries the sequence's UUID.
+func (s *Sequence) Campaign(st SequenceStep) *Campaign {
+	return &Campaign{
+		UUID:         s.UUID,
+		Type:         CampaignTypeRegular,
+		Name:         s.Name,
+		Subject:      st.Subject,
+		FromEmail:    s.FromEmail,
+		Body:         st.Body,
+		AltBody:      st.AltBody,
+		ContentType:  st.ContentType,
+		TemplateID:   s.TemplateID,
+		Messenger:    s.Messenger,
+		TemplateBody: s.TemplateBody,
+	}
+}
+
+// Scan implements the sql.Scanner interface.
+func (s *SequenceSteps) Scan(src interface{}) error {
+	var b []byte
+	switch src := src.(type) {
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	case nil:
+		return nil
+	}
+
+	return json.Unmarshal(b, s)
+}
+
+// Value implements the driver.Valuer interface.
+func (s SequenceSteps) Value() (driver.Value, error) {
+	if len(s) == 0 {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Scan unmarshals JSONB from the DB.
+func (f *FeedItems) Scan(src interface{}) error {
+	var b []byte
+	switch src := src.(type) {
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	case nil:
+		return nil
+	}
+
+	return json.Unmarshal(b, f)
+}
+
+// Value implements the driver.Valuer interface.
+func (f FeedItems) Value() (driver.Value, error) {
+	if len(f) == 0 {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 // Value implements the driver.Valuer interface.
 func (h Headers) Value() (driver.Value, error) {
 	if h == nil {
@@ -145,7 +145,8 @@ INSERT INTO subscriber_lists (subscriber_id, list_id, status)
 
 -- name: delete-subscribers
 -- Delete one or more subscribers by ID or UUID.
-DELETE FROM subscribers WHERE CASE WHEN ARRAY_LENGTH($1::INT[], 1) > 0 THEN id = ANY($1) ELSE uuid = ANY($2::UUID[]) END;
+DELETE FROM subscribers WHERE CASE WHEN ARRAY_LENGTH($1::INT[], 1) > 0 THEN id = ANY($1) ELSE uuid = ANY($2::UUID[]) END
+    RETURNING id, uuid, email, name;
 
 -- name: blocklist-subscribers
 WITH b AS (
@@ -180,12 +181,15 @@ UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
 
 -- name: unsubscribe
 -- Unsubscribes a subscriber given a campaign UUID (from all the lists in the campaign) and the subscriber UUID.
+-- Messages from sequences carry the sequence's UUID in place of the campaign's.
 -- If $3 is TRUE, then all subscriptions of the subscriber is blocklisted
 -- and all existing subscriptions, irrespective of lists, unsubscribed.
 WITH lists AS (
     SELECT list_id FROM campaign_lists
     LEFT JOIN campaigns ON (campaign_lists.campaign_id = campaigns.id)
     WHERE campaigns.uuid = $1
+    UNION
+    SELECT list_id FROM sequences WHERE uuid = $1
 ),
 sub AS (
     UPDATE subscribers SET status = (CASE WHEN $3 IS TRUE THEN 'blocklisted' ELSE status END)
@@ -308,17 +312,23 @@ LIMIT (CASE WHEN $1 THEN 1 END)
 -- name: delete-subscribers-by-query
 -- raw: true
 WITH subs AS (%s)
-DELETE FROM subscribers WHERE id=ANY(SELECT id FROM subs);
+DELETE FROM subscribers WHERE id=ANY(SELECT id FROM subs)
+    RETURNING id, uuid, email, name;
 
 -- name: blocklist-subscribers-by-query
 -- raw: true
+-- Returns the IDs of the blocklisted subscribers.
 WITH subs AS (%s),
 b AS (
     UPDATE subscribers SET status='blocklisted', updated_at=NOW()
     WHERE id = ANY(SELECT id FROM subs)
+    RETURNING id
+),
+u AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
+    WHERE subscriber_id = ANY(SELECT id FROM subs)
 )
-UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
-    WHERE subscriber_id = ANY(SELECT id FROM subs);
+SELECT id FROM b;
 
 -- name: add-subscribers-to-lists-by-query
 -- raw: true
@@ -342,13 +352,16 @@ UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
 
 -- lists
 -- name: get-lists
+-- $3 is an optional list of list IDs a user is restricted to. NULL means all lists.
 SELECT * FROM lists WHERE (CASE WHEN $1 = '' THEN 1=1 ELSE type=$1::list_type END)
+    AND ($3::INT[] IS NULL OR id = ANY($3::INT[]))
     ORDER BY CASE WHEN $2 = 'id' THEN id END, CASE WHEN $2 = 'name' THEN name END;
 
 -- name: query-lists
 WITH ls AS (
 	SELECT COUNT(*) OVER () AS total, lists.* FROM lists
     WHERE ($1 = 0 OR id = $1) AND ($2 = '' OR name ILIKE $2)
+    AND ($5::INT[] IS NULL OR id = ANY($5::INT[]))
     OFFSET $3 LIMIT (CASE WHEN $4 = 0 THEN NULL ELSE $4 END)
 ),
 counts AS (
@@ -388,9 +401,59 @@ UPDATE lists SET updated_at=NOW() WHERE id = ANY($1);
 DELETE FROM lists WHERE id = ALL($1);
 
 
+-- segments
+-- name: get-segments
+SELECT * FROM segments WHERE ($1 = 0 OR id = $1) ORDER BY name;
+
+-- name: create-segment
+INSERT INTO segments (name, description, query, filter) VALUES($1, $2, $3, $4) RETURNING id;
+
+-- name: update-segment
+UPDATE segments SET
+    name=(CASE WHEN $2 != '' THEN $2 ELSE name END),
+    description=$3,
+    query=$4,
+    filter=$5,
+    updated_at=NOW()
+WHERE id = $1;
+
+-- name: delete-segment
+DELETE FROM segments WHERE id = $1;
+
+-- name: query-segment-subscribers
+-- raw: true
+-- Unprepared statement for evaluating arbitrary segment expressions (%s) over subscribers
+-- and their subscriber_lists to the IDs of the matching subscribers. If list IDs ($1) are
+-- given, only subscribers with valid subscriptions on those lists are matched. Positional
+-- arguments of the expressions start from $2.
+SELECT COALESCE(ARRAY_AGG(DISTINCT subscribers.id), '{}') FROM subscribers
+    LEFT JOIN subscriber_lists ON (subscriber_lists.subscriber_id = subscribers.id)
+    WHERE subscribers.status != 'blocklisted' AND (%s)
+    AND (CARDINALITY($1::INT[]) = 0 OR subscribers.id IN (
+        SELECT sl.subscriber_id FROM subscriber_lists sl
+        INNER JOIN lists ON (lists.id = sl.list_id)
+        WHERE sl.list_id = ANY($1::INT[]) AND
+            -- For double opt-in lists, consider only 'confirmed' subscriptions.
+            (CASE WHEN lists.optin = 'double' THEN sl.status = 'confirmed' ELSE sl.status != 'unsubscribed' END)
+    ));
+
+-- name: query-segment-subscribers-count
+-- raw: true
+-- Replica of query-segment-subscribers for obtaining the results count.
+SELECT COUNT(DISTINCT subscribers.id) FROM subscribers
+    LEFT JOIN subscriber_lists ON (subscriber_lists.subscriber_id = subscribers.id)
+    WHERE subscribers.status != 'blocklisted' AND (%s)
+    AND (CARDINALITY($1::INT[]) = 0 OR subscribers.id IN (
+        SELECT sl.subscriber_id FROM subscriber_lists sl
+        INNER JOIN lists ON (lists.id = sl.list_id)
+        WHERE sl.list_id = ANY($1::INT[]) AND
+            (CASE WHEN lists.optin = 'double' THEN sl.status = 'confirmed' ELSE sl.status != 'unsubscribed' END)
+    ));
+
+
 -- campaigns
 -- name: create-campaign
--- This creates the campaign and inserts campaign_lists relationships.
+-- This creates the campaign and inserts campaign_lists and campaign_segments relationships.
 WITH campLists AS (
     -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
     SELECT lists.id AS list_id, campaign_id, optin FROM lists
@@ -418,13 +481,22 @@ counts AS (
     AND subscribers.status='enabled'
 ),
 camp AS (
-    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, headers, tags, messenger, template_id, to_send, max_subscriber_id)
-        SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, (SELECT id FROM tpl), (SELECT to_send FROM counts), (SELECT max_sub_id FROM counts)
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, headers, tags, messenger, template_id, to_send, max_subscriber_id,
+        ab_test_percent, ab_test_wait_mins, ab_test_metric, send_local, timezone, cron, skip_empty, next_run_at, feed_url)
+        SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, (SELECT id FROM tpl), (SELECT to_send FROM counts), (SELECT max_sub_id FROM counts),
+        $15, $16, $17, $19, $20, $21, $22, $23, $24
         RETURNING id
+),
+ls AS (
+    INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+        (SELECT (SELECT id FROM camp), id, name FROM lists WHERE id=ANY($14::INT[]))
+),
+segs AS (
+    INSERT INTO campaign_segments (campaign_id, segment_id, segment_name)
+        (SELECT (SELECT id FROM camp), id, name FROM segments WHERE id=ANY($18::INT[]))
 )
-INSERT INTO campaign_lists (campaign_id, list_id, list_name)
-    (SELECT (SELECT id FROM camp), id, name FROM lists WHERE id=ANY($14::INT[]))
-    RETURNING (SELECT id FROM camp);
+SELECT id FROM camp WHERE EXISTS (SELECT 1 FROM lists WHERE id=ANY($14::INT[]))
+    OR EXISTS (SELECT 1 FROM segments WHERE id=ANY($18::INT[]));
 
 -- name: query-campaigns
 -- Here, 'lists' is returned as an aggregated JSON array from campaign_lists because
@@ -436,7 +508,10 @@ INSERT INTO campaign_lists (campaign_id, list_id, list_name)
 SELECT  c.id, c.uuid, c.name, c.subject, c.from_email,
         c.messenger, c.started_at, c.to_send, c.sent, c.type,
         c.body, c.altbody, c.send_at, c.headers, c.status, c.content_type, c.tags,
-        c.template_id, c.created_at, c.updated_at,
+        c.template_id, c.pause_reason, c.created_at, c.updated_at,
+        c.ab_test_percent, c.ab_test_wait_mins, c.ab_test_metric, c.ab_test_sent_at, c.ab_winner_id,
+        c.send_local, c.timezone, c.wave_from, c.wave_to,
+        c.cron, c.skip_empty, c.next_run_at, c.parent_id, c.feed_url, c.feed_items,
         COUNT(*) OVER () AS total,
         (
             SELECT COALESCE(ARRAY_TO_JSON(ARRAY_AGG(l)), '[]') FROM (
@@ -444,16 +519,33 @@ SELECT  c.id, c.uuid, c.name, c.subject, c.from_email,
                 campaign_lists.list_name AS name
                 FROM campaign_lists WHERE campaign_lists.campaign_id = c.id
         ) l
-    ) AS lists
+    ) AS lists,
+    (
+        SELECT COALESCE(JSON_AGG(v ORDER BY v.id), '[]') FROM (
+            SELECT id, name, subject, body FROM campaign_variants WHERE campaign_id = c.id
+        ) v
+    ) AS variants
 FROM campaigns c
 WHERE ($1 = 0 OR id = $1)
     AND status=ANY(CASE WHEN ARRAY_LENGTH($2::campaign_status[], 1) != 0 THEN $2::campaign_status[] ELSE ARRAY[status] END)
     AND ($3 = '' OR CONCAT(name, subject) ILIKE $3)
+    -- $6 is an optional list of list IDs a user is restricted to. Only campaigns
+    -- that target none other than those lists are returned. NULL means all campaigns.
+    AND ($6::INT[] IS NULL OR (NOT EXISTS (
+        SELECT 1 FROM campaign_lists WHERE campaign_id = c.id
+        AND (list_id IS NULL OR list_id != ALL($6::INT[]))
+    -- Campaigns that only target segments can reach any subscriber.
+    ) AND EXISTS (SELECT 1 FROM campaign_lists WHERE campaign_id = c.id)))
 ORDER BY %s %s OFFSET $4 LIMIT (CASE WHEN $5 = 0 THEN NULL ELSE $5 END);
 
 -- name: get-campaign
 SELECT campaigns.*,
-    COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body
+    COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
+    (
+        SELECT COALESCE(JSON_AGG(v ORDER BY v.id), '[]') FROM (
+            SELECT id, name, subject, body FROM campaign_variants WHERE campaign_id = campaigns.id
+        ) v
+    ) AS variants
     FROM campaigns
     LEFT JOIN templates ON (templates.id = campaigns.template_id)
     WHERE CASE WHEN $1 > 0 THEN campaigns.id = $1 ELSE uuid = $2 END;
@@ -466,6 +558,9 @@ SELECT campaigns.*,
 WITH lists AS (
     SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', list_id, 'name', list_name)) AS lists FROM campaign_lists
     WHERE campaign_id = ANY($1) GROUP BY campaign_id
+), segments AS (
+    SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', segment_id, 'name', segment_name)) AS segments FROM campaign_segments
+    WHERE campaign_id = ANY($1) GROUP BY campaign_id
 ), views AS (
     SELECT campaign_id, COUNT(campaign_id) as num FROM campaign_views
     WHERE campaign_id = ANY($1)
@@ -480,17 +575,31 @@ bounces AS (
     SELECT campaign_id, COUNT(campaign_id) as num FROM bounces
     WHERE campaign_id = ANY($1)
     GROUP BY campaign_id
+),
+variants AS (
+    -- Views and clicks of each A/B test variant of the campaigns.
+    SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', id, 'name', name, 'sent', sent,
+        'views', (SELECT COUNT(*) FROM campaign_views WHERE variant_id = campaign_variants.id),
+        'clicks', (SELECT COUNT(*) FROM link_clicks WHERE variant_id = campaign_variants.id)
+    ) ORDER BY id) AS variants
+    FROM campaign_variants
+    WHERE campaign_id = ANY($1)
+    GROUP BY campaign_id
 )
 SELECT id as campaign_id,
     COALESCE(v.num, 0) AS views,
     COALESCE(c.num, 0) AS clicks,
     COALESCE(b.num, 0) AS bounces,
-    COALESCE(l.lists, '[]') AS lists
+    COALESCE(l.lists, '[]') AS lists,
+    COALESCE(s.segments, '[]') AS segments,
+    COALESCE(va.variants, '[]') AS variant_stats
 FROM (SELECT id FROM UNNEST($1) AS id) x
 LEFT JOIN lists AS l ON (l.campaign_id = id)
+LEFT JOIN segments AS s ON (s.campaign_id = id)
 LEFT JOIN views AS v ON (v.campaign_id = id)
 LEFT JOIN clicks AS c ON (c.campaign_id = id)
 LEFT JOIN bounces AS b ON (b.campaign_id = id)
+LEFT JOIN variants AS va ON (va.campaign_id = id)
 ORDER BY ARRAY_POSITION($1, id);
 
 -- name: get-campaign-for-preview
@@ -501,7 +610,12 @@ SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE i
         campaign_lists.list_name AS name
         FROM campaign_lists WHERE campaign_lists.campaign_id = campaigns.id
 	) l
-) AS lists
+) AS lists,
+(
+    SELECT COALESCE(JSON_AGG(v ORDER BY v.id), '[]') FROM (
+        SELECT id, name, subject, body FROM campaign_variants WHERE campaign_id = campaigns.id
+    ) v
+) AS variants
 FROM campaigns
 LEFT JOIN templates ON (templates.id = (CASE WHEN $2=0 THEN campaigns.template_id ELSE $2 END))
 WHERE campaigns.id = $1;
@@ -518,13 +632,31 @@ SELECT id, status, to_send, sent, started_at, updated_at
 -- Thus, it has a sideaffect.
 -- In addition, it finds the max_subscriber_id, the upper limit across all lists of
 -- a campaign. This is used to fetch and slice subscribers for the campaign in next-subscriber-campaigns.
+-- Campaigns that target segments start only once their segments have been evaluated ($2).
+-- Campaigns sent at a local time start as soon as it's send time in the earliest timezone (UTC+14)
+-- and are skipped while they wait for their next wave of timezones.
 WITH camps AS (
     -- Get all running campaigns and their template bodies (if the template's deleted, the default template body instead)
-    SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body
+    SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
+    (
+        SELECT COALESCE(JSON_AGG(v ORDER BY v.id), '[]') FROM (
+            SELECT id, name, subject, body FROM campaign_variants WHERE campaign_id = campaigns.id
+        ) v
+    ) AS variants
     FROM campaigns
     LEFT JOIN templates ON (templates.id = campaigns.template_id)
-    WHERE (status='running' OR (status='scheduled' AND NOW() >= campaigns.send_at))
+    WHERE (status='running' OR (status='scheduled' AND NOW() >= (CASE WHEN campaigns.send_local
+        THEN local_send_at(campaigns.send_at, campaigns.timezone, 'Etc/GMT-14') ELSE campaigns.send_at END)))
+    -- Recurring campaigns aren't sent themselves, but their runs are.
+    AND campaigns.cron = ''
     AND NOT(campaigns.id = ANY($1::INT[]))
+    AND NOT(campaigns.send_local AND campaigns.wave_to IS NOT NULL AND NOW() < campaigns.wave_to)
+    -- Skip A/B tested campaigns whose test batch has been sent and are waiting
+    -- for the test window to be over before a winner is picked.
+    AND NOT(campaigns.ab_test_sent_at IS NOT NULL AND campaigns.ab_winner_id IS NULL
+        AND NOW() < campaigns.ab_test_sent_at + MAKE_INTERVAL(mins => campaigns.ab_test_wait_mins))
+    AND NOT(campaigns.started_at IS NULL AND NOT(campaigns.id = ANY($2::INT[]))
+        AND EXISTS (SELECT 1 FROM campaign_segments WHERE campaign_id = campaigns.id))
 ),
 campLists AS (
     -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
@@ -556,14 +688,28 @@ counts AS (
     )
     GROUP BY camps.id
 ),
+segCounts AS (
+    -- Campaigns that target segments are sent to the subscribers that were evaluated
+    -- from the segments (and the lists, if any) when the campaigns started.
+    SELECT camps.id AS campaign_id,
+        EXISTS (SELECT 1 FROM campaign_segments WHERE campaign_id = camps.id) AS has_segments,
+        COUNT(campaign_subscribers.subscriber_id) AS to_send,
+        COALESCE(MAX(campaign_subscribers.subscriber_id), 0) AS max_subscriber_id
+    FROM camps
+    LEFT JOIN campaign_subscribers ON (campaign_subscribers.campaign_id = camps.id)
+    GROUP BY camps.id
+),
 u AS (
     -- For each campaign, update the to_send count and set the max_subscriber_id.
     UPDATE campaigns AS ca
-    SET to_send = co.to_send,
+    SET to_send = (CASE WHEN sc.has_segments THEN sc.to_send ELSE co.to_send END),
         status = (CASE WHEN status != 'running' THEN 'running' ELSE status END),
-        max_subscriber_id = co.max_subscriber_id,
-        started_at=(CASE WHEN ca.started_at IS NULL THEN NOW() ELSE ca.started_at END)
+        max_subscriber_id = (CASE WHEN sc.has_segments THEN sc.max_subscriber_id ELSE co.max_subscriber_id END),
+        started_at=(CASE WHEN ca.started_at IS NULL THEN NOW() ELSE ca.started_at END),
+        -- The first wave of a campaign sent at a local time has all the timezones where it's send time already.
+        wave_to=(CASE WHEN ca.send_local AND ca.wave_to IS NULL THEN NOW() ELSE ca.wave_to END)
     FROM (SELECT * FROM counts) co
+    INNER JOIN segCounts sc ON (sc.campaign_id = co.campaign_id)
     WHERE ca.id = co.campaign_id
 )
 SELECT * FROM camps;
@@ -615,8 +761,15 @@ SELECT COUNT(%s) AS "count", url
 -- Returns a batch of subscribers in a given campaign starting from the last checkpoint
 -- (last_subscriber_id). Every fetch updates the checkpoint and the sent count, which means
 -- every fetch returns a new batch of subscribers until all rows are exhausted.
+-- If a subscriber ID range ($3, $4] is given, the subscribers in the range (of a lease
+-- taken over from another instance) are returned without updating the checkpoint.
 WITH camps AS (
-    SELECT last_subscriber_id, max_subscriber_id, type FROM campaigns WHERE id = $1 AND status='running'
+    SELECT last_subscriber_id, max_subscriber_id, type, ab_test_percent, ab_test_sent_at,
+        send_local, send_at, timezone, wave_from, wave_to,
+        (ab_test_percent > 0 AND (SELECT COUNT(*) FROM campaign_variants WHERE campaign_id = $1) > 1) AS is_ab_test,
+        EXISTS (SELECT 1 FROM campaign_segments WHERE campaign_id = $1) AS has_segments,
+        NOT EXISTS (SELECT 1 FROM campaign_lists WHERE campaign_id = $1) AS segments_only
+    FROM campaigns WHERE id = $1 AND status='running'
 ),
 campLists AS (
     SELECT lists.id AS list_id, optin FROM lists
@@ -624,14 +777,44 @@ campLists AS (
     WHERE campaign_lists.campaign_id = $1
 ),
 subIDs AS (
-    SELECT DISTINCT ON (subscriber_lists.subscriber_id) subscriber_id, list_id, status FROM subscriber_lists
+    SELECT DISTINCT ON (subscriber_id) subscriber_id, list_id, status FROM (
+        SELECT subscriber_id, list_id, status FROM subscriber_lists
+        WHERE
+            -- ARRAY_AGG is 20x faster instead of a simple SELECT because the query planner
+            -- understands the CTE's cardinality after the scalar array conversion. Huh.
+            list_id = ANY((SELECT ARRAY_AGG(list_id) FROM campLists)::INT[]) AND
+            status != 'unsubscribed'
+
+        -- Campaigns that only target segments have no lists and are sent to the
+        -- subscribers evaluated from the segments when the campaign started.
+        UNION ALL
+        SELECT subscriber_id, NULL::INT, NULL::subscription_status FROM campaign_subscribers
+        WHERE campaign_id = $1 AND (SELECT segments_only FROM camps)
+    ) s
     WHERE
-        -- ARRAY_AGG is 20x faster instead of a simple SELECT because the query planner
-        -- understands the CTE's cardinality after the scalar array conversion. Huh.
-        list_id = ANY((SELECT ARRAY_AGG(list_id) FROM campLists)::INT[]) AND
-        status != 'unsubscribed' AND
-        subscriber_id > (SELECT last_subscriber_id FROM camps) AND
-        subscriber_id <= (SELECT max_subscriber_id FROM camps)
+        -- Campaigns that target segments and lists are sent to the intersection of both.
+        ((SELECT segments_only FROM camps) OR NOT (SELECT has_segments FROM camps) OR
+            subscriber_id IN (SELECT subscriber_id FROM campaign_subscribers WHERE campaign_id = $1)) AND
+        subscriber_id > (CASE WHEN $4 > 0 THEN $3 ELSE (SELECT last_subscriber_id FROM camps) END) AND
+        subscriber_id <= (CASE WHEN $4 > 0 THEN $4 ELSE (SELECT max_subscriber_id FROM camps) END) AND
+
+        -- Campaigns sent at a local time only go to the subscribers whose send time
+        -- is in the current wave.
+        (NOT (SELECT send_local FROM camps) OR (
+            SELECT t > COALESCE(camps.wave_from, '-infinity') AND t <= camps.wave_to
+            FROM camps, subscribers,
+                LATERAL local_send_at(camps.send_at, camps.timezone, subscribers.attribs->>'timezone') t
+            WHERE subscribers.id = s.subscriber_id
+        )) AND
+
+        -- For A/B tested campaigns, a subscriber belongs to the test batch based on their ID.
+        -- The test batch gets the variants and the rest get the winner once it's picked.
+        -- This should match Campaign.ABTestVariant().
+        (CASE
+            WHEN NOT (SELECT is_ab_test FROM camps) THEN true
+            WHEN (SELECT ab_test_sent_at FROM camps) IS NULL THEN MOD(subscriber_id + $1, 100) < (SELECT ab_test_percent FROM camps)
+            ELSE MOD(subscriber_id + $1, 100) >= (SELECT ab_test_percent FROM camps)
+        END)
     ORDER BY subscriber_id LIMIT $2
 ),
 subs AS (
@@ -642,6 +825,14 @@ subs AS (
         subscribers.id = subIDs.subscriber_id AND
 
         (CASE
+            -- Subscribers of segment-only campaigns need at least one valid subscription.
+            WHEN subIDs.list_id IS NULL THEN EXISTS (
+                SELECT 1 FROM subscriber_lists sl
+                INNER JOIN lists ON (lists.id = sl.list_id)
+                WHERE sl.subscriber_id = subscribers.id AND
+                    (CASE WHEN lists.optin = 'double' THEN sl.status = 'confirmed' ELSE sl.status != 'unsubscribed' END)
+            )
+
             -- For optin campaigns, only e-mail 'unconfirmed' subscribers.
             WHEN (SELECT type FROM camps) = 'optin' THEN subIDs.status = 'unconfirmed' AND campLists.optin = 'double'
 
@@ -659,10 +850,88 @@ u AS (
     SET last_subscriber_id = (SELECT MAX(id) FROM subs),
         sent = sent + (SELECT COUNT(id) FROM subs),
         updated_at = NOW()
-    WHERE (SELECT COUNT(id) FROM subs) > 0 AND id=$1
+    WHERE (SELECT COUNT(id) FROM subs) > 0 AND id=$1 AND $4 = 0
 )
 SELECT * FROM subs;
 
+-- name: lock-campaign-checkpoint
+-- Locks a running campaign's row for the duration of a transaction to serialize the
+-- fetching of subscriber batches across instances and returns its checkpoint.
+SELECT last_subscriber_id FROM campaigns WHERE id = $1 AND status = 'running' FOR UPDATE;
+
+-- name: create-campaign-lease
+INSERT INTO campaign_leases (campaign_id, node_id, from_id, to_id) VALUES($1, $2, $3, $4) RETURNING id;
+
+-- name: take-over-campaign-lease
+-- Takes over a subscriber range leased by an instance that's gone, ie: whose last
+-- heartbeat is older than $3 seconds. The range starts after the last checkpoint
+-- of the instance so that the subscribers it had sent to aren't sent to again.
+UPDATE campaign_leases SET node_id = $2, updated_at = NOW() WHERE id = (
+    SELECT l.id FROM campaign_leases l
+    LEFT JOIN nodes ON (nodes.id = l.node_id)
+    WHERE l.campaign_id = $1 AND (nodes.id IS NULL OR nodes.heartbeat_at < NOW() - MAKE_INTERVAL(secs => $3))
+    ORDER BY l.id LIMIT 1
+    FOR UPDATE OF l SKIP LOCKED
+) RETURNING id, from_id, to_id;
+
+-- name: checkpoint-campaign-lease
+-- Saves the progress of a leased subscriber range by moving its start up to the
+-- last subscriber ($3) up to which all the messages have been sent, as long as
+-- the lease is held by the instance ($2). The number of messages sent with each
+-- A/B test variant (IDs $4, counts $5) since the last checkpoint are added to
+-- the variants.
+WITH l AS (
+    UPDATE campaign_leases SET from_id = GREATEST(from_id, $3), updated_at = NOW()
+    WHERE id = $1 AND node_id = $2
+)
+UPDATE campaign_variants v SET sent = v.sent + c.num
+    FROM UNNEST($4::INT[], $5::INT[]) AS c(id, num)
+    WHERE v.id = c.id;
+
+-- name: release-campaign-lease
+-- Deletes a leased subscriber range that's been sent and adds the number of messages
+-- sent with each A/B test variant (IDs $2, counts $3) since the last checkpoint.
+WITH l AS (
+    DELETE FROM campaign_leases WHERE id = $1
+)
+UPDATE campaign_variants v SET sent = v.sent + c.num
+    FROM UNNEST($2::INT[], $3::INT[]) AS c(id, num)
+    WHERE v.id = c.id;
+
+-- name: delete-campaign-lease
+DELETE FROM campaign_leases WHERE id = $1;
+
+-- name: has-campaign-leases
+-- Checks if a running campaign has subscriber ranges leased by any instance.
+SELECT EXISTS (
+    SELECT 1 FROM campaign_leases
+    INNER JOIN campaigns ON (campaigns.id = campaign_leases.campaign_id)
+    WHERE campaign_leases.campaign_id = $1 AND campaigns.status = 'running'
+);
+
+-- name: upsert-node
+-- Records the heartbeat of an instance and returns whether it's the oldest live
+-- instance (heartbeat within $3 seconds), which sends the notifications that aren't
+-- tied to a particular instance. Leases of campaigns that are done are cleaned up.
+WITH n AS (
+    INSERT INTO nodes (id, hostname) VALUES($1, $2)
+    ON CONFLICT (id) DO UPDATE SET hostname = $2, heartbeat_at = NOW()
+    RETURNING started_at
+),
+d AS (
+    DELETE FROM nodes WHERE heartbeat_at < NOW() - INTERVAL '1 day'
+),
+l AS (
+    DELETE FROM campaign_leases WHERE campaign_id IN (
+        SELECT id FROM campaigns WHERE status IN ('finished', 'cancelled')
+    )
+)
+SELECT NOT EXISTS (
+    SELECT 1 FROM nodes WHERE id != $1
+        AND heartbeat_at > NOW() - MAKE_INTERVAL(secs => $3)
+        AND (started_at, id) < ((SELECT started_at FROM n), $1)
+);
+
 -- name: get-one-campaign-subscriber
 SELECT * FROM subscribers
 LEFT JOIN subscriber_lists ON (subscribers.id = subscriber_lists.subscriber_id AND subscriber_lists.status != 'unsubscribed')
@@ -686,17 +955,73 @@ WITH camp AS (
         tags=$11::VARCHAR(100)[],
         messenger=$12,
         template_id=$13,
+        ab_test_percent=$15,
+        ab_test_wait_mins=$16,
+        ab_test_metric=$17,
+        send_local=$19,
+        timezone=$20,
+        cron=$21,
+        skip_empty=$22,
+        next_run_at=$23,
+        feed_url=$24,
         updated_at=NOW()
     WHERE id = $1 RETURNING id
 ),
 d AS (
     -- Reset list relationships
     DELETE FROM campaign_lists WHERE campaign_id = $1 AND NOT(list_id = ANY($14))
+),
+ds AS (
+    -- Reset segment relationships, including those of deleted segments.
+    DELETE FROM campaign_segments WHERE campaign_id = $1 AND (segment_id IS NULL OR NOT(segment_id = ANY($18::INT[])))
+),
+s AS (
+    INSERT INTO campaign_segments (campaign_id, segment_id, segment_name)
+        (SELECT $1 as campaign_id, id, name FROM segments WHERE id=ANY($18::INT[]))
+        ON CONFLICT (campaign_id, segment_id) DO UPDATE SET segment_name = EXCLUDED.segment_name
 )
 INSERT INTO campaign_lists (campaign_id, list_id, list_name)
     (SELECT $1 as campaign_id, id, name FROM lists WHERE id=ANY($14::INT[]))
     ON CONFLICT (campaign_id, list_id) DO UPDATE SET list_name = EXCLUDED.list_name;
 
+-- name: get-pending-segment-campaigns
+-- Campaigns that target segments and are about to start, whose segments are yet to
+-- be evaluated. $1 is the list of campaign IDs to exclude.
+SELECT id FROM campaigns
+    WHERE (status='running' OR (status='scheduled' AND NOW() >= (CASE WHEN send_local
+        THEN local_send_at(send_at, timezone, 'Etc/GMT-14') ELSE send_at END)))
+    AND cron = ''
+    AND started_at IS NULL
+    AND NOT(id = ANY($1::INT[]))
+    AND EXISTS (SELECT 1 FROM campaign_segments WHERE campaign_id = campaigns.id);
+
+-- name: get-campaign-segments
+SELECT segments.* FROM segments
+    INNER JOIN campaign_segments ON (campaign_segments.segment_id = segments.id)
+    WHERE campaign_segments.campaign_id = $1;
+
+-- name: set-campaign-subscribers
+-- Replaces the subscribers evaluated from the segments of a campaign ($2). Campaigns
+-- without lists only go to the subscribers with at least one valid subscription.
+WITH subs AS (
+    SELECT id FROM subscribers WHERE id = ANY($2::INT[]) AND (
+        EXISTS (SELECT 1 FROM campaign_lists WHERE campaign_id = $1) OR
+        EXISTS (
+            SELECT 1 FROM subscriber_lists sl
+            INNER JOIN lists ON (lists.id = sl.list_id)
+            WHERE sl.subscriber_id = subscribers.id AND
+                (CASE WHEN lists.optin = 'double' THEN sl.status = 'confirmed' ELSE sl.status != 'unsubscribed' END)
+        )
+    )
+),
+d AS (
+    DELETE FROM campaign_subscribers cs WHERE cs.campaign_id = $1
+        AND NOT EXISTS (SELECT 1 FROM subs WHERE subs.id = cs.subscriber_id)
+)
+INSERT INTO campaign_subscribers (campaign_id, subscriber_id)
+    SELECT $1, id FROM subs
+    ON CONFLICT DO NOTHING;
+
 -- name: update-campaign-counts
 UPDATE campaigns SET
     to_send=(CASE WHEN $2 != 0 THEN $2 ELSE to_send END),
@@ -706,65 +1031,449 @@ UPDATE campaigns SET
 WHERE id=$1;
 
 -- name: update-campaign-status
-UPDATE campaigns SET status=$2, updated_at=NOW() WHERE id = $1;
+UPDATE campaigns SET status=$2, pause_reason='', updated_at=NOW() WHERE id = $1;
+
+-- name: update-campaign-next-run
+UPDATE campaigns SET next_run_at=$2 WHERE id = $1;
+
+-- name: next-recurring-campaigns
+-- Scheduled recurring campaigns whose next run is due.
+SELECT campaigns.*,
+    COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
+    (
+        SELECT COALESCE(JSON_AGG(v ORDER BY v.id), '[]') FROM (
+            SELECT id, name, subject, body FROM campaign_variants WHERE campaign_id = campaigns.id
+        ) v
+    ) AS variants
+    FROM campaigns
+    LEFT JOIN templates ON (templates.id = campaigns.template_id)
+    WHERE campaigns.status = 'scheduled' AND campaigns.cron != '' AND campaigns.next_run_at <= NOW();
+
+-- name: create-campaign-run
+-- Moves a recurring campaign ($1) from its due run ($2) on to the next one ($6) and,
+-- unless the run's skipped ($5), creates the run as a copy of the campaign that's
+-- started right away. The check on the due run makes sure that a run is created only
+-- once when there are multiple instances. The feed items of the run ($7) are recorded
+-- as sent. The ID of the run, or 0 if it's skipped, is returned.
+WITH parent AS (
+    UPDATE campaigns SET next_run_at=$6 WHERE id = $1 AND next_run_at = $2 AND status = 'scheduled'
+    RETURNING *
+),
+camp AS (
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, headers, tags,
+        messenger, template_id, status, ab_test_percent, ab_test_wait_mins, ab_test_metric, timezone, parent_id, feed_items)
+        SELECT $3, type, $4, subject, from_email, body, altbody, content_type, NOW(), headers, tags,
+            messenger, template_id, 'running', ab_test_percent, ab_test_wait_mins, ab_test_metric, timezone, id, $7
+        FROM parent WHERE NOT $5
+        RETURNING id
+),
+items AS (
+    INSERT INTO campaign_feed_items (campaign_id, guid)
+        (SELECT $1, item->>'guid' FROM JSONB_ARRAY_ELEMENTS($7::JSONB) item WHERE EXISTS (SELECT 1 FROM camp))
+        ON CONFLICT DO NOTHING
+),
+ls AS (
+    INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+        (SELECT (SELECT id FROM camp), list_id, list_name FROM campaign_lists WHERE campaign_id = $1 AND EXISTS (SELECT 1 FROM camp))
+),
+segs AS (
+    INSERT INTO campaign_segments (campaign_id, segment_id, segment_name)
+        (SELECT (SELECT id FROM camp), segment_id, segment_name FROM campaign_segments WHERE campaign_id = $1 AND EXISTS (SELECT 1 FROM camp))
+),
+vars AS (
+    INSERT INTO campaign_variants (campaign_id, name, subject, body)
+        (SELECT (SELECT id FROM camp), name, subject, body FROM campaign_variants WHERE campaign_id = $1 AND EXISTS (SELECT 1 FROM camp))
+)
+SELECT COALESCE((SELECT id FROM camp), 0) FROM parent;
+
+-- name: get-sent-feed-items
+-- The GUIDs out of the given ones ($2) of the feed items that have been sent
+-- in the runs of a campaign.
+SELECT guid FROM campaign_feed_items WHERE campaign_id = $1 AND guid = ANY($2::TEXT[]);
+
+-- name: query-campaign-runs
+-- The runs of a recurring campaign, latest first.
+SELECT id, uuid, name, subject, status, messenger, send_at, started_at, to_send, sent,
+    content_type, template_id, created_at, updated_at, parent_id,
+    COUNT(*) OVER () AS total
+    FROM campaigns WHERE parent_id = $1
+    ORDER BY created_at DESC OFFSET $2 LIMIT (CASE WHEN $3 = 0 THEN NULL ELSE $3 END);
+
+-- name: pause-campaign
+-- Pauses a running campaign and records the reason, eg: too many errors.
+UPDATE campaigns SET status='paused', pause_reason=$2, updated_at=NOW()
+    WHERE id = $1 AND status='running';
+
+-- name: finish-campaign
+UPDATE campaigns SET status='finished', updated_at=NOW() WHERE id = $1 AND status='running';
 
 -- name: delete-campaign
 DELETE FROM campaigns WHERE id=$1;
 
+-- name: record-campaign-failure
+-- Record a failed delivery of a campaign message to a subscriber. Repeated
+-- failures (retries) increment the attempt count.
+INSERT INTO campaign_failures (campaign_id, subscriber_id, error) VALUES($1, $2, $3)
+    ON CONFLICT (campaign_id, subscriber_id) DO UPDATE
+    SET error = $3, attempts = campaign_failures.attempts + 1, queued = false, updated_at = NOW();
+
+-- name: queue-campaign-retry
+-- Record a message that couldn't be sent as a failure that's already queued
+-- to be retried, eg: a deferred message of a campaign that was paused. It's
+-- retried once the campaign is running again.
+INSERT INTO campaign_failures (campaign_id, subscriber_id, error, queued) VALUES($1, $2, $3, true)
+    ON CONFLICT (campaign_id, subscriber_id) DO UPDATE
+    SET error = $3, queued = true, updated_at = NOW();
+
+-- name: delete-campaign-failure
+-- Delete the failure record of a subscriber once a retry succeeds.
+DELETE FROM campaign_failures WHERE campaign_id = $1 AND subscriber_id = $2;
+
+-- name: query-campaign-failures
+SELECT COUNT(*) OVER () AS total, f.id, f.campaign_id, f.subscriber_id,
+    s.uuid AS subscriber_uuid, s.email, s.name, f.error, f.attempts, f.queued, f.created_at, f.updated_at
+    FROM campaign_failures f
+    INNER JOIN subscribers s ON (s.id = f.subscriber_id)
+    WHERE f.campaign_id = $1
+    ORDER BY f.id DESC OFFSET $2 LIMIT $3;
+
+-- name: queue-campaign-failures
+-- Queue the given failure IDs ($2), or all failures if empty, to be retried by
+-- the instances that process campaigns. Subscribers that have been blocklisted
+-- or no longer have a valid subscription since are skipped.
+WITH f AS (
+    UPDATE campaign_failures f SET queued = true, updated_at = NOW()
+    FROM subscribers s
+    WHERE s.id = f.subscriber_id AND f.campaign_id = $1 AND s.status != 'blocklisted'
+    AND (ARRAY_LENGTH($2::BIGINT[], 1) IS NULL OR f.id = ANY($2))
+    AND EXISTS (
+        SELECT 1 FROM subscriber_lists sl
+        INNER JOIN lists ON (lists.id = sl.list_id)
+        INNER JOIN campaigns c ON (c.id = f.campaign_id)
+        WHERE sl.subscriber_id = s.id
+        -- This should match the subscription checks in next-campaign-subscribers.
+        AND (NOT EXISTS (SELECT 1 FROM campaign_lists WHERE campaign_id = c.id) OR
+            sl.list_id IN (SELECT list_id FROM campaign_lists WHERE campaign_id = c.id))
+        AND (CASE
+            WHEN c.type = 'optin' AND EXISTS (SELECT 1 FROM campaign_lists WHERE campaign_id = c.id)
+                THEN sl.status = 'unconfirmed' AND lists.optin = 'double'
+            WHEN lists.optin = 'double' THEN sl.status = 'confirmed'
+            ELSE sl.status != 'unsubscribed'
+        END)
+    )
+    RETURNING f.id
+)
+SELECT COUNT(*) FROM f;
+
+-- name: next-campaign-retries
+-- Claim a batch of queued failures to be retried. Only the failures of running
+-- and finished campaigns are retried, so the failures of paused campaigns wait
+-- until they're resumed and those of cancelled campaigns are never sent.
+WITH f AS (
+    SELECT f.id FROM campaign_failures f
+    INNER JOIN campaigns c ON (c.id = f.campaign_id)
+    WHERE f.queued = true AND c.status IN ('running', 'finished')
+    ORDER BY f.id LIMIT $1
+    FOR UPDATE OF f SKIP LOCKED
+),
+u AS (
+    UPDATE campaign_failures SET queued = false WHERE id IN (SELECT id FROM f)
+    RETURNING campaign_id, subscriber_id
+)
+SELECT u.campaign_id AS retry_campaign_id, s.* FROM u
+    INNER JOIN subscribers s ON (s.id = u.subscriber_id)
+    INNER JOIN campaigns c ON (c.id = u.campaign_id)
+    WHERE s.status != 'blocklisted'
+    -- Subscribers may have unsubscribed since the failures were queued. This
+    -- should match the subscription checks in next-campaign-subscribers.
+    AND EXISTS (
+        SELECT 1 FROM subscriber_lists sl
+        INNER JOIN lists ON (lists.id = sl.list_id)
+        WHERE sl.subscriber_id = s.id
+        AND (NOT EXISTS (SELECT 1 FROM campaign_lists WHERE campaign_id = c.id) OR
+            sl.list_id IN (SELECT list_id FROM campaign_lists WHERE campaign_id = c.id))
+        AND (CASE
+            WHEN c.type = 'optin' AND EXISTS (SELECT 1 FROM campaign_lists WHERE campaign_id = c.id)
+                THEN sl.status = 'unconfirmed' AND lists.optin = 'double'
+            WHEN lists.optin = 'double' THEN sl.status = 'confirmed'
+            ELSE sl.status != 'unsubscribed'
+        END)
+    )
+    ORDER BY u.campaign_id, s.id;
+
+-- name: delete-campaign-failures
+DELETE FROM campaign_failures WHERE campaign_id = $1
+    AND (ARRAY_LENGTH($2::BIGINT[], 1) IS NULL OR id = ANY($2));
+
 -- name: register-campaign-view
 WITH view AS (
-    SELECT campaigns.id as campaign_id, subscribers.id AS subscriber_id FROM campaigns
+    SELECT campaigns.id as campaign_id, subscribers.id AS subscriber_id,
+        -- $3 is the optional A/B test variant ID the message was sent with.
+        (SELECT id FROM campaign_variants WHERE id = $3 AND campaign_id = campaigns.id) AS variant_id
+    FROM campaigns
     LEFT JOIN subscribers ON (CASE WHEN $2::TEXT != '' THEN subscribers.uuid = $2::UUID ELSE FALSE END)
     WHERE campaigns.uuid = $1
 )
-INSERT INTO campaign_views (campaign_id, subscriber_id)
-    VALUES((SELECT campaign_id FROM view), (SELECT subscriber_id FROM view));
+-- Views of messages that aren't from campaigns, eg: sequences, aren't recorded.
+INSERT INTO campaign_views (campaign_id, subscriber_id, variant_id)
+    SELECT campaign_id, subscriber_id, variant_id FROM view;
+
+-- name: end-campaign-ab-test
+-- Marks the A/B test batch of a running campaign as sent and resets the subscriber
+-- checkpoint so that the rest of the subscribers can be sent the winning variant.
+UPDATE campaigns SET ab_test_sent_at=NOW(), last_subscriber_id=0, updated_at=NOW()
+    WHERE id = $1 AND status = 'running' AND ab_test_sent_at IS NULL;
+
+-- name: next-campaign-wave
+-- Moves a running campaign that's sent at a local time on to its next wave of timezones
+-- once the current wave ($2) has been sent. The subscriber checkpoint is reset so that
+-- the subscribers are scanned again for the ones in the new wave. Returns the time of
+-- the new wave, or nothing if there are no more subscribers to send to.
+WITH camp AS (
+    SELECT id, send_at, timezone, wave_to FROM campaigns
+        WHERE id = $1 AND status = 'running' AND send_local AND wave_to = $2
+),
+subIDs AS (
+    SELECT subscriber_id FROM subscriber_lists
+        WHERE list_id = ANY(SELECT list_id FROM campaign_lists WHERE campaign_id = $1) AND status != 'unsubscribed'
+    UNION
+    SELECT subscriber_id FROM campaign_subscribers WHERE campaign_id = $1
+),
+next AS (
+    SELECT MIN(t) AS t FROM subscribers
+    CROSS JOIN camp
+    CROSS JOIN LATERAL local_send_at(camp.send_at, camp.timezone, subscribers.attribs->>'timezone') t
+    WHERE subscribers.id IN (SELECT subscriber_id FROM subIDs) AND t > camp.wave_to
+)
+UPDATE campaigns SET wave_from = wave_to, wave_to = GREATEST((SELECT t FROM next), NOW()),
+    last_subscriber_id = 0, updated_at = NOW()
+    WHERE id = (SELECT id FROM camp) AND (SELECT t FROM next) IS NOT NULL
+    RETURNING wave_to;
+
+-- name: get-campaign-waves
+-- Returns the waves of timezones of a campaign sent at a local time with the number
+-- of subscribers in each and the number of them that are yet to be sent to.
+WITH camp AS (
+    SELECT id, status, send_at, timezone, wave_from, wave_to, last_subscriber_id FROM campaigns
+        WHERE id = $1 AND send_local AND send_at IS NOT NULL
+),
+subIDs AS (
+    SELECT subscriber_id FROM subscriber_lists
+        WHERE list_id = ANY(SELECT list_id FROM campaign_lists WHERE campaign_id = $1) AND status != 'unsubscribed'
+    UNION
+    SELECT subscriber_id FROM campaign_subscribers WHERE campaign_id = $1
+),
+subs AS (
+    SELECT subscribers.id, COALESCE(NULLIF(subscribers.attribs->>'timezone', ''), camp.timezone) AS timezone,
+        local_send_at(camp.send_at, camp.timezone, subscribers.attribs->>'timezone') AS send_at
+    FROM subscribers
+    CROSS JOIN camp
+    WHERE subscribers.id IN (SELECT subscriber_id FROM subIDs) AND subscribers.status != 'blocklisted'
+)
+SELECT subs.send_at, ARRAY_AGG(DISTINCT subs.timezone ORDER BY subs.timezone) AS timezones, COUNT(*) AS subscribers,
+    COUNT(*) FILTER (WHERE camp.status NOT IN ('finished', 'cancelled') AND (
+        camp.wave_to IS NULL OR subs.send_at > camp.wave_to OR
+        (subs.send_at > COALESCE(camp.wave_from, '-infinity') AND subs.id > camp.last_subscriber_id)
+    )) AS pending
+FROM subs
+CROSS JOIN camp
+GROUP BY subs.send_at ORDER BY subs.send_at;
+
+-- name: set-campaign-ab-winner
+-- Picks the A/B test variant of a campaign with the highest view or click rate (based on
+-- the campaign's test metric), ie: the views or clicks per message sent with the variant,
+-- and applies its subject and body to the campaign so that it is sent to the rest of
+-- the subscribers.
+WITH camp AS (
+    SELECT ab_test_metric FROM campaigns WHERE id = $1
+),
+counts AS (
+    SELECT id, name, subject, body, sent,
+        (CASE WHEN (SELECT ab_test_metric FROM camp) = 'clicks'
+            THEN (SELECT COUNT(*) FROM link_clicks WHERE variant_id = campaign_variants.id)
+            ELSE (SELECT COUNT(*) FROM campaign_views WHERE variant_id = campaign_variants.id)
+        END) AS num
+    FROM campaign_variants WHERE campaign_id = $1
+),
+winner AS (
+    SELECT * FROM counts ORDER BY num::FLOAT / NULLIF(sent, 0) DESC NULLS LAST, num DESC, id ASC LIMIT 1
+),
+u AS (
+    UPDATE campaigns SET subject=winner.subject, body=winner.body, ab_winner_id=winner.id, updated_at=NOW()
+    FROM winner WHERE campaigns.id = $1
+)
+SELECT id, name, subject, body FROM winner;
+
+-- name: update-campaign-variants
+-- Sets the A/B test variants of a campaign from a JSON array of variants. Variants
+-- with an existing ID are updated, new ones inserted, and the missing ones deleted.
+WITH v AS (
+    SELECT * FROM JSONB_TO_RECORDSET($2::JSONB) AS x(id INT, name TEXT, subject TEXT, body TEXT)
+),
+d AS (
+    DELETE FROM campaign_variants WHERE campaign_id = $1 AND id NOT IN (SELECT COALESCE(id, 0) FROM v)
+),
+u AS (
+    UPDATE campaign_variants SET name=v.name, subject=v.subject, body=v.body, updated_at=NOW()
+    FROM v WHERE campaign_variants.id = v.id AND campaign_variants.campaign_id = $1
+)
+INSERT INTO campaign_variants (campaign_id, name, subject, body)
+    SELECT $1, name, subject, body FROM v
+    WHERE NOT EXISTS (SELECT 1 FROM campaign_variants WHERE id = v.id AND campaign_id = $1);
 
 -- users
 -- name: get-users
-SELECT * FROM users WHERE $1 = 0 OR id = $1 OFFSET $2 LIMIT $3;
+SELECT users.*, COALESCE(
+    (SELECT ARRAY_AGG(list_id ORDER BY list_id) FROM user_lists WHERE user_id = users.id), '{}'
+) AS list_ids
+FROM users WHERE ($1 = 0 OR id = $1) AND ($2 = '' OR LOWER(username) = LOWER($2))
+ORDER BY id OFFSET $3 LIMIT (CASE WHEN $4 = 0 THEN NULL ELSE $4 END);
 
 -- name: create-user
-INSERT INTO users (email, name, password, type, status) VALUES($1, $2, $3, $4, $5) RETURNING id;
+WITH u AS (
+    INSERT INTO users (username, email, name, password, type, role, status, restrict_lists)
+        VALUES($1, $2, $3, $4, $5, $6, $7, $9) RETURNING id
+),
+ul AS (
+    INSERT INTO user_lists (user_id, list_id)
+        (SELECT (SELECT id FROM u), id FROM lists WHERE id = ANY($8::INT[]))
+)
+SELECT id FROM u;
 
 -- name: update-user
-UPDATE users SET
-    email=(CASE WHEN $2 != '' THEN $2 ELSE email END),
-    name=(CASE WHEN $3 != '' THEN $3 ELSE name END),
-    password=(CASE WHEN $4 != '' THEN $4 ELSE password END),
-    type=(CASE WHEN $5 != '' THEN $5::user_type ELSE type END),
-    status=(CASE WHEN $6 != '' THEN $6::user_status ELSE status END),
-    updated_at=NOW()
-WHERE id = $1;
+WITH u AS (
+    UPDATE users SET
+        email=(CASE WHEN $2 != '' THEN $2 ELSE email END),
+        name=(CASE WHEN $3 != '' THEN $3 ELSE name END),
+        password=(CASE WHEN $4 != '' THEN $4 ELSE password END),
+        type=(CASE WHEN $5 != '' THEN $5::user_type ELSE type END),
+        role=(CASE WHEN $6 != '' THEN $6::user_role ELSE role END),
+        status=(CASE WHEN $7 != '' THEN $7::user_status ELSE status END),
+        restrict_lists=$9,
+        updated_at=NOW()
+    WHERE id = $1
+),
+d AS (
+    -- Reset the list scope to the given lists.
+    DELETE FROM user_lists WHERE user_id = $1 AND list_id != ALL($8)
+)
+INSERT INTO user_lists (user_id, list_id)
+    (SELECT $1, id FROM lists WHERE id = ANY($8::INT[]))
+    ON CONFLICT DO NOTHING;
+
+-- name: update-user-login
+UPDATE users SET loggedin_at=NOW() WHERE id = $1;
 
 -- name: delete-user
 -- Delete a user, except for the primordial super admin.
 DELETE FROM users WHERE $1 != 1 AND id=$1;
 
+-- name: create-session
+INSERT INTO sessions (id, user_id, expires_at) VALUES($1, $2, $3);
+
+-- name: get-session-user
+SELECT users.*, COALESCE(
+    (SELECT ARRAY_AGG(list_id ORDER BY list_id) FROM user_lists WHERE user_id = users.id), '{}'
+) AS list_ids
+FROM sessions JOIN users ON (users.id = sessions.user_id)
+WHERE sessions.id = $1 AND sessions.expires_at > NOW() AND users.status = 'enabled';
+
+-- name: delete-session
+-- Delete the given session along with any expired ones.
+DELETE FROM sessions WHERE id = $1 OR expires_at <= NOW();
+
+-- name: delete-user-sessions
+DELETE FROM sessions WHERE user_id = $1;
+
+-- api tokens
+-- name: get-api-tokens
+SELECT api_tokens.id, api_tokens.user_id, users.username, api_tokens.name, api_tokens.scopes,
+    api_tokens.expires_at, api_tokens.last_used_at, api_tokens.created_at, api_tokens.updated_at
+    FROM api_tokens JOIN users ON (users.id = api_tokens.user_id)
+    WHERE ($1 = 0 OR api_tokens.id = $1) AND ($2 = 0 OR api_tokens.user_id = $2)
+    ORDER BY api_tokens.id;
+
+-- name: create-api-token
+INSERT INTO api_tokens (user_id, name, token, scopes, expires_at) VALUES($1, $2, $3, $4, $5) RETURNING id;
+
+-- name: delete-api-token
+-- $2 optionally restricts the deletion to the tokens of a particular user.
+DELETE FROM api_tokens WHERE id = $1 AND ($2 = 0 OR user_id = $2);
+
+-- name: get-api-token-user
+-- Gets the user of a valid token and records the token's last usage. The usage
+-- is recorded at most once a minute to not write the row on every request.
+WITH t AS (
+    SELECT id, user_id, scopes FROM api_tokens
+    WHERE token = $1 AND (expires_at IS NULL OR expires_at > NOW())
+),
+u AS (
+    UPDATE api_tokens SET last_used_at=NOW()
+    WHERE id = (SELECT id FROM t) AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+)
+SELECT users.*, t.id AS token_id, t.scopes AS token_scopes, COALESCE(
+    (SELECT ARRAY_AGG(list_id ORDER BY list_id) FROM user_lists WHERE user_id = users.id), '{}'
+) AS list_ids
+FROM t JOIN users ON (users.id = t.user_id)
+WHERE users.status = 'enabled';
+
+-- name: get-campaign-list-ids
+-- Deleted lists are returned as 0.
+SELECT COALESCE(ARRAY_AGG(COALESCE(list_id, 0)), '{}') FROM campaign_lists WHERE campaign_id = $1;
+
+-- name: check-subscriber-list-scope
+-- Given a set of subscriber IDs ($1) and list IDs ($2), returns the number of subscribers
+-- that have subscriptions outside of the lists and the number of subscribers that have none
+-- on the lists.
+SELECT
+    COUNT(*) FILTER (WHERE EXISTS (
+        SELECT 1 FROM subscriber_lists WHERE subscriber_id = s.id AND list_id != ALL($2::INT[])
+    )) AS outside,
+    COUNT(*) FILTER (WHERE NOT EXISTS (
+        SELECT 1 FROM subscriber_lists WHERE subscriber_id = s.id AND list_id = ANY($2::INT[])
+    )) AS none_inside
+FROM UNNEST($1::INT[]) s(id);
+
 
 -- templates
 -- name: get-templates
 -- Only if the second param ($2) is true, body is returned.
-SELECT id, name, (CASE WHEN $2 = false THEN body ELSE '' END) as body,
+-- $3 optionally filters templates by type.
+SELECT id, name, type, subject, (CASE WHEN $2 = false THEN body ELSE '' END) as body,
     is_default, created_at, updated_at
-    FROM templates WHERE $1 = 0 OR id = $1
+    FROM templates WHERE ($1 = 0 OR id = $1) AND ($3 = '' OR type = $3::template_type)
     ORDER BY created_at;
 
 -- name: create-template
-INSERT INTO templates (name, body) VALUES($1, $2) RETURNING id;
+INSERT INTO templates (name, type, subject, body) VALUES($1, $2, $3, $4) RETURNING id;
 
 -- name: update-template
 UPDATE templates SET
     name=(CASE WHEN $2 != '' THEN $2 ELSE name END),
-    body=(CASE WHEN $3 != '' THEN $3 ELSE body END),
+    subject=(CASE WHEN $3 != '' THEN $3 ELSE subject END),
+    body=(CASE WHEN $4 != '' THEN $4 ELSE body END),
     updated_at=NOW()
 WHERE id = $1;
 
+-- name: get-tx-templates-version
+-- A checksum of the IDs and modification dates of all tx templates that changes
+-- whenever one is created, updated, or deleted.
+SELECT COALESCE(MD5(STRING_AGG(id::TEXT || ':' || updated_at::TEXT, ',' ORDER BY id)), '')
+    FROM templates WHERE type = 'tx';
+
+-- name: register-tx-view
+INSERT INTO tx_views (template_id, subscriber_id)
+    SELECT id, (SELECT id FROM subscribers WHERE
+        (CASE WHEN $2::TEXT != '' THEN subscribers.uuid = $2::UUID ELSE FALSE END)
+    )
+    FROM templates WHERE id = $1 AND type = 'tx';
+
 -- name: set-default-template
+-- Only campaign templates can be the default.
 WITH u AS (
-    UPDATE templates SET is_default=true WHERE id=$1 RETURNING id
+    UPDATE templates SET is_default=true WHERE id=$1 AND type='campaign' RETURNING id
 )
-UPDATE templates SET is_default=false WHERE id != $1;
+UPDATE templates SET is_default=false WHERE id != $1 AND EXISTS (SELECT 1 FROM u);
 
 -- name: delete-template
 -- Delete a template as long as there's more than one. One deletion, set all campaigns
@@ -773,10 +1482,12 @@ WITH tpl AS (
     DELETE FROM templates WHERE id = $1 AND (SELECT COUNT(id) FROM templates) > 1 AND is_default = false RETURNING id
 ),
 def AS (
-    SELECT id FROM templates WHERE is_default = true LIMIT 1
+    SELECT id FROM templates WHERE is_default = true AND type = 'campaign' LIMIT 1
+),
+up AS (
+    UPDATE campaigns SET template_id = (SELECT id FROM def) WHERE (SELECT id FROM tpl) > 0 AND template_id = $1
 )
-UPDATE campaigns SET template_id = (SELECT id FROM def) WHERE (SELECT id FROM tpl) > 0 AND template_id = $1
-    RETURNING (SELECT id FROM tpl);
+SELECT COALESCE((SELECT id FROM tpl), 0);
 
 
 -- media
@@ -797,12 +1508,16 @@ INSERT INTO links (uuid, url) VALUES($1, $2) ON CONFLICT (url) DO UPDATE SET url
 WITH link AS(
     SELECT id, url FROM links WHERE uuid = $1
 )
-INSERT INTO link_clicks (campaign_id, subscriber_id, link_id) VALUES(
+INSERT INTO link_clicks (campaign_id, subscriber_id, link_id, variant_id, template_id) VALUES(
     (SELECT id FROM campaigns WHERE uuid = $2),
     (SELECT id FROM subscribers WHERE
         (CASE WHEN $3::TEXT != '' THEN subscribers.uuid = $3::UUID ELSE FALSE END)
     ),
-    (SELECT id FROM link)
+    (SELECT id FROM link),
+    -- $4 is the optional A/B test variant ID the message was sent with.
+    (SELECT id FROM campaign_variants WHERE id = $4 AND campaign_id = (SELECT id FROM campaigns WHERE uuid = $2)),
+    -- $5 is the optional tx template ID of a transactional message.
+    (SELECT id FROM templates WHERE id = $5 AND type = 'tx')
 ) RETURNING (SELECT url FROM link);
 
 -- name: get-dashboard-charts
@@ -878,7 +1593,10 @@ UPDATE settings AS s SET value = c.value
     FROM(SELECT * FROM JSONB_EACH($1)) AS c(key, value) WHERE s.key = c.key;
 
 -- name: record-bounce
--- Insert a bounce and count the bounces for the subscriber and either unsubscribe them,
+-- Insert a bounce and count the bounces of its type for the subscriber and either
+-- unsubscribe them, blocklist them, or delete them ($9) once the count reaches $8.
+-- If $10 > 0, only the bounces in the last $10 days are counted. The subscriber
+-- is returned if they're deleted.
 WITH sub AS (
     SELECT id, status FROM subscribers WHERE CASE WHEN $1 != '' THEN uuid = $1::UUID ELSE email = $2 END
 ),
@@ -891,22 +1609,34 @@ bounce AS (
     SELECT (SELECT id FROM sub), (SELECT id FROM camp), $4, $5, $6, $7
     WHERE NOT EXISTS (SELECT 1 WHERE (SELECT status FROM sub) = 'blocklisted')
 ),
+-- A view or a click implies a successful delivery. Soft bounces before
+-- the subscriber's last one are not counted.
+delivered AS (
+    SELECT GREATEST(
+        (SELECT MAX(created_at) FROM campaign_views WHERE subscriber_id = (SELECT id FROM sub)),
+        (SELECT MAX(created_at) FROM link_clicks WHERE subscriber_id = (SELECT id FROM sub))
+    ) AS at
+),
 num AS (
     -- Add a +1 to include the current insertion that is happening.
-    SELECT COUNT(*) + 1 AS num FROM bounces WHERE subscriber_id = (SELECT id FROM sub)
+    SELECT COUNT(*) + 1 AS num FROM bounces WHERE subscriber_id = (SELECT id FROM sub) AND type = $4
+        AND ($10::INT = 0 OR created_at > NOW() - MAKE_INTERVAL(days => $10::INT))
+        AND ($4 != 'soft' OR (SELECT at FROM delivered) IS NULL OR created_at > (SELECT at FROM delivered))
 ),
--- block1 and block2 will run when $8 = 'blocklist' and the number of bounces exceed $8.
+-- block1 and block2 will run when $9 = 'blocklist' and the number of bounces exceed $8.
 block1 AS (
     UPDATE subscribers SET status='blocklisted'
     WHERE $9 = 'blocklist' AND (SELECT num FROM num) >= $8 AND id = (SELECT id FROM sub) AND (SELECT status FROM sub) != 'blocklisted'
 ),
+-- block2 also unsubscribes the subscriber from all lists when $9 = 'unsubscribe'.
 block2 AS (
     UPDATE subscriber_lists SET status='unsubscribed'
-    WHERE $9 = 'blocklist' AND (SELECT num FROM num) >= $8 AND subscriber_id = (SELECT id FROM sub) AND (SELECT status FROM sub) != 'blocklisted'
+    WHERE $9 IN ('blocklist', 'unsubscribe') AND (SELECT num FROM num) >= $8 AND subscriber_id = (SELECT id FROM sub) AND (SELECT status FROM sub) != 'blocklisted'
 )
 -- This delete  will only run when $9 = 'delete' and the number of bounces exceed $8.
 DELETE FROM subscribers
-    WHERE $9 = 'delete' AND (SELECT num FROM num) >= $8 AND id = (SELECT id FROM sub);
+    WHERE $9 = 'delete' AND (SELECT num FROM num) >= $8 AND id = (SELECT id FROM sub)
+    RETURNING id, uuid, email, name;
 
 -- name: query-bounces
 SELECT COUNT(*) OVER () AS total,
@@ -931,13 +1661,281 @@ WHERE ($1 = 0 OR bounces.id = $1)
     AND ($2 = 0 OR bounces.campaign_id = $2)
     AND ($3 = 0 OR bounces.subscriber_id = $3)
     AND ($4 = '' OR bounces.source = $4)
+    -- $7 is an optional list of list IDs a user is restricted to.
+    AND ($7::INT[] IS NULL OR bounces.subscriber_id IN (
+        SELECT subscriber_id FROM subscriber_lists WHERE list_id = ANY($7::INT[])
+    ))
 ORDER BY %s %s OFFSET $5 LIMIT $6;
 
 -- name: delete-bounces
-DELETE FROM bounces WHERE ARRAY_LENGTH($1::INT[], 1) IS NULL OR id = ANY($1);
+DELETE FROM bounces WHERE (ARRAY_LENGTH($1::INT[], 1) IS NULL OR id = ANY($1))
+    AND ($2::INT[] IS NULL OR subscriber_id IN (
+        SELECT subscriber_id FROM subscriber_lists WHERE list_id = ANY($2::INT[])
+    ));
 
 -- name: delete-bounces-by-subscriber
 WITH sub AS (
     SELECT id FROM subscribers WHERE CASE WHEN $1 > 0 THEN id = $1 ELSE uuid = $2 END
 )
 DELETE FROM bounces WHERE subscriber_id = (SELECT id FROM sub);
+
+-- name: insert-pending-bounce
+INSERT INTO pending_bounces (payload, source) VALUES($1, $2);
+
+-- name: next-pending-bounces
+-- Fetch a batch ($1) of pending bounces that are due and lease them for $2 seconds
+-- so that they're not picked up again (by this or other instances) meanwhile.
+UPDATE pending_bounces SET next_attempt_at = NOW() + MAKE_INTERVAL(secs => $2), updated_at = NOW()
+    WHERE id IN (
+        SELECT id FROM pending_bounces WHERE status = 'pending' AND next_attempt_at <= NOW()
+        ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+    )
+    RETURNING id, payload, attempts;
+
+-- name: update-pending-bounce
+-- Record a failed attempt and either retry the bounce after $5 seconds or mark it as failed ($4).
+UPDATE pending_bounces SET attempts = $2, error = $3,
+    status = (CASE WHEN $4 THEN 'failed' ELSE 'pending' END)::pending_bounce_status,
+    next_attempt_at = NOW() + MAKE_INTERVAL(secs => $5),
+    updated_at = NOW()
+    WHERE id = $1;
+
+-- name: delete-pending-bounce
+DELETE FROM pending_bounces WHERE id = $1;
+
+-- name: query-failed-bounces
+SELECT COUNT(*) OVER () AS total, id, payload, source, attempts, error, created_at, updated_at
+    FROM pending_bounces WHERE status = 'failed'
+    AND ($1 = '' OR source = $1)
+    ORDER BY id DESC OFFSET $2 LIMIT $3;
+
+-- name: replay-failed-bounces
+-- Move failed bounces back to the pending state to be processed again.
+UPDATE pending_bounces SET status = 'pending', attempts = 0, error = '', next_attempt_at = NOW(), updated_at = NOW()
+    WHERE status = 'failed' AND (ARRAY_LENGTH($1::BIGINT[], 1) IS NULL OR id = ANY($1));
+
+-- name: delete-failed-bounces
+DELETE FROM pending_bounces WHERE status = 'failed' AND (ARRAY_LENGTH($1::BIGINT[], 1) IS NULL OR id = ANY($1));
+
+-- webhooks
+-- name: get-webhooks
+SELECT * FROM webhooks WHERE ($1 = 0 OR id = $1) ORDER BY created_at;
+
+-- name: create-webhook
+INSERT INTO webhooks (name, url, secret, events, enabled, max_retries)
+    VALUES($1, $2, $3, $4, $5, $6) RETURNING id;
+
+-- name: update-webhook
+-- An empty secret ($4) retains the existing secret.
+UPDATE webhooks SET
+    name=$2,
+    url=$3,
+    secret=(CASE WHEN $4 != '' THEN $4 ELSE secret END),
+    events=$5,
+    enabled=$6,
+    max_retries=$7,
+    updated_at=NOW()
+WHERE id = $1;
+
+-- name: delete-webhook
+DELETE FROM webhooks WHERE id = $1;
+
+-- name: create-webhook-delivery
+-- Record a pending delivery that's leased for $4 seconds by the instance that attempts it.
+INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt_at)
+    VALUES($1, $2, $3, NOW() + MAKE_INTERVAL(secs => $4)) RETURNING id;
+
+-- name: next-webhook-deliveries
+-- Fetch a batch ($1) of pending deliveries that are due and lease them for $2 seconds
+-- so that they're not picked up again (by this or other instances) meanwhile.
+UPDATE webhook_deliveries SET next_attempt_at = NOW() + MAKE_INTERVAL(secs => $2), updated_at = NOW()
+    WHERE id IN (
+        SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= NOW()
+        ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+    )
+    RETURNING id, webhook_id, event, payload, attempts;
+
+-- name: update-webhook-delivery
+-- Record the outcome of an attempt. Pending deliveries are retried after $6 seconds.
+UPDATE webhook_deliveries SET
+    status=$2,
+    attempts=$3,
+    response_code=$4,
+    error=$5,
+    next_attempt_at=NOW() + MAKE_INTERVAL(secs => $6),
+    updated_at=NOW()
+WHERE id = $1;
+
+-- name: query-webhook-deliveries
+SELECT COUNT(*) OVER () AS total, * FROM webhook_deliveries
+    WHERE webhook_id = $1 AND ($2 = '' OR status = $2::webhook_delivery_status)
+    ORDER BY id DESC OFFSET $3 LIMIT $4;
+
+-- sequences
+-- name: get-sequences
+-- Retrieves sequences with their steps and the number of subscribers in the sequences
+-- by status. All sequences are returned if $1 = 0. If list IDs ($2) are given, only the
+-- sequences on those lists are returned.
+SELECT sequences.*,
+    (
+        SELECT COALESCE(JSON_AGG(s ORDER BY s.position), '[]') FROM (
+            SELECT id, position, delay_mins, subject, body, altbody, content_type
+            FROM sequence_steps WHERE sequence_id = sequences.id
+        ) s
+    ) AS steps,
+    (
+        SELECT JSON_BUILD_OBJECT(
+            'active', COUNT(*) FILTER (WHERE status = 'active'),
+            'completed', COUNT(*) FILTER (WHERE status = 'completed'),
+            'exited', COUNT(*) FILTER (WHERE status = 'exited')
+        ) FROM sequence_subscribers WHERE sequence_id = sequences.id
+    ) AS subscriber_statuses
+FROM sequences
+WHERE ($1 = 0 OR id = $1) AND ($2::INT[] IS NULL OR list_id = ANY($2::INT[]))
+ORDER BY created_at;
+
+-- name: create-sequence
+-- Creates a sequence with its steps from a JSON array ($9).
+WITH tpl AS (
+    -- If there's no template_id given, use the default template.
+    SELECT (CASE WHEN $7 = 0 THEN id ELSE $7 END) AS id FROM templates WHERE is_default IS TRUE
+),
+seq AS (
+    INSERT INTO sequences (uuid, name, list_id, exit_segment_id, from_email, messenger, template_id, enabled)
+        VALUES($1, $2, $3, $4, $5, $6, (SELECT id FROM tpl), $8)
+        RETURNING id
+),
+steps AS (
+    INSERT INTO sequence_steps (sequence_id, position, delay_mins, subject, body, altbody, content_type)
+        SELECT seq.id, x.position, x.delay_mins, x.subject, x.body, x.altbody, x.content_type
+        FROM seq, JSONB_TO_RECORDSET($9::JSONB) AS x(position INT, delay_mins INT, subject TEXT,
+            body TEXT, altbody TEXT, content_type content_type)
+)
+SELECT id FROM seq;
+
+-- name: update-sequence
+-- Updates a sequence and sets its steps from a JSON array ($9). Steps are matched
+-- by their positions, so subscribers in the sequence carry on from where they are.
+WITH seq AS (
+    UPDATE sequences SET
+        name=$2,
+        list_id=$3,
+        exit_segment_id=$4,
+        from_email=$5,
+        messenger=$6,
+        template_id=(CASE WHEN $7 != 0 THEN $7 ELSE template_id END),
+        enabled=$8,
+        updated_at=NOW()
+    WHERE id = $1 RETURNING id
+),
+x AS (
+    SELECT * FROM JSONB_TO_RECORDSET($9::JSONB) AS x(position INT, delay_mins INT, subject TEXT,
+        body TEXT, altbody TEXT, content_type content_type)
+),
+d AS (
+    DELETE FROM sequence_steps WHERE sequence_id = (SELECT id FROM seq)
+        AND position >= (SELECT COUNT(*) FROM x)
+),
+steps AS (
+    INSERT INTO sequence_steps (sequence_id, position, delay_mins, subject, body, altbody, content_type)
+        SELECT seq.id, x.position, x.delay_mins, x.subject, x.body, x.altbody, x.content_type FROM seq, x
+    ON CONFLICT (sequence_id, position) DO UPDATE SET
+        delay_mins=EXCLUDED.delay_mins,
+        subject=EXCLUDED.subject,
+        body=EXCLUDED.body,
+        altbody=EXCLUDED.altbody,
+        content_type=EXCLUDED.content_type,
+        updated_at=NOW()
+)
+SELECT id FROM seq;
+
+-- name: delete-sequence
+DELETE FROM sequences WHERE id = $1;
+
+-- name: query-sequence-subscribers
+SELECT COUNT(*) OVER () AS total, ss.subscriber_id, s.uuid AS subscriber_uuid, s.email, s.name,
+    ss.step, ss.status, ss.next_at, ss.created_at, ss.updated_at
+    FROM sequence_subscribers ss
+    INNER JOIN subscribers s ON (s.id = ss.subscriber_id)
+    WHERE ss.sequence_id = $1 AND ($2 = '' OR ss.status = $2::sequence_subscriber_status)
+    ORDER BY ss.created_at DESC OFFSET $3 LIMIT $4;
+
+-- name: get-sending-sequences
+-- Retrieves sequences by IDs with their steps and template bodies for sending messages.
+SELECT sequences.*,
+    COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
+    (
+        SELECT COALESCE(JSON_AGG(s ORDER BY s.position), '[]') FROM (
+            SELECT id, position, delay_mins, subject, body, altbody, content_type
+            FROM sequence_steps WHERE sequence_id = sequences.id
+        ) s
+    ) AS steps
+FROM sequences
+LEFT JOIN templates ON (templates.id = sequences.template_id)
+WHERE sequences.id = ANY($1::INT[]);
+
+-- name: enroll-sequence-subscribers
+-- Enrolls the subscribers who've subscribed to the lists of enabled sequences since the
+-- sequences were created into them, once. Subscriptions to double opt-in lists are enrolled
+-- on confirmation. Only the subscriptions since the last enrollment are looked at, with a
+-- few minutes of margin for the transactions that were in flight at the time. The first
+-- step is due its delay after the subscription.
+WITH seqs AS (
+    SELECT id, list_id, GREATEST(created_at, COALESCE(enrolled_at - INTERVAL '5 minutes', created_at)) AS since
+    FROM sequences WHERE enabled FOR UPDATE SKIP LOCKED
+),
+u AS (
+    UPDATE sequences SET enrolled_at=NOW() WHERE id = ANY(SELECT id FROM seqs)
+)
+INSERT INTO sequence_subscribers (sequence_id, subscriber_id, next_at)
+    SELECT seqs.id, sl.subscriber_id, sl.updated_at + MAKE_INTERVAL(mins => COALESCE(st.delay_mins, 0))
+    FROM seqs
+    INNER JOIN lists ON (lists.id = seqs.list_id)
+    INNER JOIN subscriber_lists sl ON (sl.list_id = seqs.list_id AND sl.updated_at >= seqs.since)
+    INNER JOIN subscribers s ON (s.id = sl.subscriber_id AND s.status != 'blocklisted')
+    LEFT JOIN sequence_steps st ON (st.sequence_id = seqs.id AND st.position = 0)
+    WHERE (CASE WHEN lists.optin = 'double' THEN sl.status = 'confirmed' ELSE sl.status != 'unsubscribed' END)
+ON CONFLICT (sequence_id, subscriber_id) DO NOTHING;
+
+-- name: exit-unsubscribed-sequence-subscribers
+-- Subscribers who are due their next step but have unsubscribed from (or been removed from)
+-- the list of the sequence, or have been blocklisted, exit the sequence.
+UPDATE sequence_subscribers ss SET status='exited', next_at=NULL, updated_at=NOW()
+    FROM sequences
+    WHERE sequences.id = ss.sequence_id AND ss.status = 'active' AND ss.next_at <= NOW() AND (
+        NOT EXISTS (
+            SELECT 1 FROM subscriber_lists sl WHERE sl.subscriber_id = ss.subscriber_id
+            AND sl.list_id = sequences.list_id AND sl.status != 'unsubscribed'
+        )
+        OR EXISTS (SELECT 1 FROM subscribers WHERE id = ss.subscriber_id AND status = 'blocklisted')
+    );
+
+-- name: exit-sequence-subscribers
+UPDATE sequence_subscribers SET status='exited', next_at=NULL, updated_at=NOW()
+    WHERE sequence_id = $1 AND subscriber_id = ANY($2::INT[]);
+
+-- name: next-sequence-messages
+-- Claims a batch of the steps of enabled sequences that are due to be sent to subscribers
+-- and moves the subscribers on to their next steps, which are due their delay after now,
+-- or marks them as having completed the sequences if there are no more steps.
+WITH due AS (
+    SELECT ss.sequence_id, ss.subscriber_id, ss.step FROM sequence_subscribers ss
+    INNER JOIN sequences ON (sequences.id = ss.sequence_id)
+    WHERE sequences.enabled AND ss.status = 'active' AND ss.next_at <= NOW()
+    ORDER BY ss.next_at LIMIT $1
+    FOR UPDATE OF ss SKIP LOCKED
+),
+u AS (
+    UPDATE sequence_subscribers ss SET
+        step=due.step + 1,
+        status=(CASE WHEN st.id IS NULL THEN 'completed' ELSE 'active' END)::sequence_subscriber_status,
+        next_at=(CASE WHEN st.id IS NULL THEN NULL ELSE NOW() + MAKE_INTERVAL(mins => st.delay_mins) END),
+        updated_at=NOW()
+    FROM due
+    LEFT JOIN sequence_steps st ON (st.sequence_id = due.sequence_id AND st.position = due.step + 1)
+    WHERE ss.sequence_id = due.sequence_id AND ss.subscriber_id = due.subscriber_id
+)
+SELECT * FROM due;
+
+-- name: get-subscribers-by-ids
+SELECT * FROM subscribers WHERE id = ANY($1::INT[]);
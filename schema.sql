@@ -6,6 +6,32 @@ DROP TYPE IF EXISTS campaign_status CASCADE; CREATE TYPE campaign_status AS ENUM
 DROP TYPE IF EXISTS campaign_type CASCADE; CREATE TYPE campaign_type AS ENUM ('regular', 'optin');
 DROP TYPE IF EXISTS content_type CASCADE; CREATE TYPE content_type AS ENUM ('richtext', 'html', 'plain', 'markdown');
 DROP TYPE IF EXISTS bounce_type CASCADE; CREATE TYPE bounce_type AS ENUM ('soft', 'hard', 'complaint');
+DROP TYPE IF EXISTS template_type CASCADE; CREATE TYPE template_type AS ENUM ('campaign', 'tx');
+DROP TYPE IF EXISTS ab_test_metric CASCADE; CREATE TYPE ab_test_metric AS ENUM ('views', 'clicks');
+DROP TYPE IF EXISTS user_type CASCADE; CREATE TYPE user_type AS ENUM ('superadmin', 'user');
+DROP TYPE IF EXISTS user_role CASCADE; CREATE TYPE user_role AS ENUM ('admin', 'campaign_editor', 'list_manager', 'readonly');
+DROP TYPE IF EXISTS user_status CASCADE; CREATE TYPE user_status AS ENUM ('enabled', 'disabled');
+DROP TYPE IF EXISTS webhook_delivery_status CASCADE; CREATE TYPE webhook_delivery_status AS ENUM ('pending', 'success', 'failed');
+DROP TYPE IF EXISTS pending_bounce_status CASCADE; CREATE TYPE pending_bounce_status AS ENUM ('pending', 'failed');
+DROP TYPE IF EXISTS sequence_subscriber_status CASCADE; CREATE TYPE sequence_subscriber_status AS ENUM ('active', 'completed', 'exited');
+
+-- Returns the time at which a campaign scheduled at send_at in the campaign's timezone
+-- is sent to a subscriber in the given timezone, ie: the same time of day in the subscriber's
+-- timezone. Subscribers without a (valid) timezone are sent to at send_at.
+CREATE OR REPLACE FUNCTION local_send_at(send_at TIMESTAMP WITH TIME ZONE, camp_tz TEXT, sub_tz TEXT)
+RETURNS TIMESTAMP WITH TIME ZONE AS $$
+BEGIN
+    IF sub_tz IS NULL OR sub_tz = '' OR sub_tz = camp_tz THEN
+        RETURN send_at;
+    END IF;
+
+    BEGIN
+        RETURN (send_at AT TIME ZONE camp_tz) AT TIME ZONE sub_tz;
+    EXCEPTION WHEN invalid_parameter_value THEN
+        RETURN send_at;
+    END;
+END;
+$$ LANGUAGE plpgsql STABLE;
 
 -- subscribers
 DROP TABLE IF EXISTS subscribers CASCADE;
@@ -52,11 +78,71 @@ DROP INDEX IF EXISTS idx_sub_lists_sub_id; CREATE INDEX idx_sub_lists_sub_id ON
 DROP INDEX IF EXISTS idx_sub_lists_list_id; CREATE INDEX idx_sub_lists_list_id ON subscriber_lists(list_id);
 DROP INDEX IF EXISTS idx_sub_lists_status; CREATE INDEX idx_sub_lists_status ON subscriber_lists(status);
 
+-- users
+DROP TABLE IF EXISTS users CASCADE;
+CREATE TABLE users (
+    id              SERIAL PRIMARY KEY,
+    username        TEXT NOT NULL UNIQUE,
+    email           TEXT NOT NULL DEFAULT '',
+    name            TEXT NOT NULL DEFAULT '',
+    password        TEXT NOT NULL,
+
+    -- superadmins have all permissions. Regular users are limited
+    -- by their role and, if restrict_lists is set, to the lists in user_lists.
+    type            user_type NOT NULL DEFAULT 'user',
+    role            user_role NOT NULL DEFAULT 'readonly',
+    status          user_status NOT NULL DEFAULT 'enabled',
+    restrict_lists  BOOLEAN NOT NULL DEFAULT false,
+
+    loggedin_at     TIMESTAMP WITH TIME ZONE NULL,
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_users_username; CREATE UNIQUE INDEX idx_users_username ON users(LOWER(username));
+
+-- Lists a user with restrict_lists is restricted to. Such a user without any
+-- rows here can't access any list.
+DROP TABLE IF EXISTS user_lists CASCADE;
+CREATE TABLE user_lists (
+    user_id         INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    list_id         INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY(user_id, list_id)
+);
+
+-- admin login sessions. Only the SHA-256 hash of a session ID is stored.
+DROP TABLE IF EXISTS sessions CASCADE;
+CREATE TABLE sessions (
+    id              TEXT NOT NULL PRIMARY KEY,
+    user_id         INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    expires_at      TIMESTAMP WITH TIME ZONE NOT NULL
+);
+DROP INDEX IF EXISTS idx_sessions_user_id; CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+
+-- API tokens for machine clients. Only the SHA-256 hash of a token is stored.
+DROP TABLE IF EXISTS api_tokens CASCADE;
+CREATE TABLE api_tokens (
+    id              SERIAL PRIMARY KEY,
+    user_id         INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    name            TEXT NOT NULL,
+    token           TEXT NOT NULL UNIQUE,
+    scopes          TEXT[] NOT NULL DEFAULT '{}',
+    expires_at      TIMESTAMP WITH TIME ZONE NULL,
+    last_used_at    TIMESTAMP WITH TIME ZONE NULL,
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_api_tokens_user_id; CREATE INDEX idx_api_tokens_user_id ON api_tokens(user_id);
+
 -- templates
 DROP TABLE IF EXISTS templates CASCADE;
 CREATE TABLE templates (
     id              SERIAL PRIMARY KEY,
     name            TEXT NOT NULL,
+    type            template_type NOT NULL DEFAULT 'campaign',
+
+    -- Subject is only used by transactional (tx) templates.
+    subject         TEXT NOT NULL DEFAULT '',
     body            TEXT NOT NULL,
     is_default      BOOLEAN NOT NULL DEFAULT false,
 
@@ -96,10 +182,54 @@ CREATE TABLE campaigns (
     max_subscriber_id  INT NOT NULL DEFAULT 0,
     last_subscriber_id INT NOT NULL DEFAULT 0,
 
+    -- Reason for which a campaign was paused automatically, eg: too many errors.
+    pause_reason       TEXT NOT NULL DEFAULT '',
+
+    -- A/B testing of variants. The test batch (ab_test_percent of the subscribers)
+    -- is split between the variants, and after ab_test_wait_mins, the variant with
+    -- the most views or clicks is sent to the rest of the subscribers.
+    ab_test_percent    INT NOT NULL DEFAULT 0,
+    ab_test_wait_mins  INT NOT NULL DEFAULT 0,
+    ab_test_metric     ab_test_metric NOT NULL DEFAULT 'views',
+    ab_test_sent_at    TIMESTAMP WITH TIME ZONE NULL,
+    ab_winner_id       INT NULL,
+
+    -- Sending at send_at's time of day in every subscriber's timezone (attribs.timezone),
+    -- with the campaign's timezone as the fallback. Subscribers are sent to in waves,
+    -- each one covering the subscribers whose send time is in (wave_from, wave_to].
+    send_local         BOOLEAN NOT NULL DEFAULT false,
+    timezone           TEXT NOT NULL DEFAULT 'UTC',
+    wave_from          TIMESTAMP WITH TIME ZONE NULL,
+    wave_to            TIMESTAMP WITH TIME ZONE NULL,
+
+    -- Recurring campaigns. A campaign with a cron expression isn't sent itself.
+    -- At every occurrence of the schedule (from send_at on), a copy of it is created
+    -- as a new campaign (a run) with parent_id set, and sent. Runs whose content is
+    -- empty are skipped if skip_empty is set.
+    cron               TEXT NOT NULL DEFAULT '',
+    skip_empty         BOOLEAN NOT NULL DEFAULT false,
+    next_run_at        TIMESTAMP WITH TIME ZONE NULL,
+    parent_id          INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- Feed driven recurring campaigns are sent when there are new items in the RSS/Atom
+    -- feed at feed_url, which are copied to feed_items of the runs for rendering.
+    feed_url           TEXT NOT NULL DEFAULT '',
+    feed_items         JSONB NOT NULL DEFAULT '[]',
+
     started_at       TIMESTAMP WITH TIME ZONE,
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
+DROP INDEX IF EXISTS idx_camps_parent_id; CREATE INDEX idx_camps_parent_id ON campaigns(parent_id);
+
+-- feed items that have been sent in the runs of feed driven campaigns
+DROP TABLE IF EXISTS campaign_feed_items CASCADE;
+CREATE TABLE campaign_feed_items (
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    guid             TEXT NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (campaign_id, guid)
+);
 
 DROP TABLE IF EXISTS campaign_lists CASCADE;
 CREATE TABLE campaign_lists (
@@ -115,10 +245,63 @@ CREATE UNIQUE INDEX ON campaign_lists (campaign_id, list_id);
 DROP INDEX IF EXISTS idx_camp_lists_camp_id; CREATE INDEX idx_camp_lists_camp_id ON campaign_lists(campaign_id);
 DROP INDEX IF EXISTS idx_camp_lists_list_id; CREATE INDEX idx_camp_lists_list_id ON campaign_lists(list_id);
 
+-- segments
+DROP TABLE IF EXISTS segments CASCADE;
+CREATE TABLE segments (
+    id               SERIAL PRIMARY KEY,
+    name             TEXT NOT NULL,
+    description      TEXT NOT NULL DEFAULT '',
+
+    -- Arbitrary SQL expression over subscribers and subscriber_lists, and/or
+    -- a structured filter that's compiled to an SQL expression.
+    query            TEXT NOT NULL DEFAULT '',
+    filter           JSONB NOT NULL DEFAULT '{}',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+DROP TABLE IF EXISTS campaign_segments CASCADE;
+CREATE TABLE campaign_segments (
+    id           BIGSERIAL PRIMARY KEY,
+    campaign_id  INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- Segments may be deleted, so segment_id is nullable
+    -- and a copy of the original segment name is maintained here.
+    segment_id   INTEGER NULL REFERENCES segments(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    segment_name TEXT NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX ON campaign_segments (campaign_id, segment_id);
+DROP INDEX IF EXISTS idx_camp_segments_camp_id; CREATE INDEX idx_camp_segments_camp_id ON campaign_segments(campaign_id);
+
+-- Subscribers of a campaign's segments, evaluated when the campaign starts.
+DROP TABLE IF EXISTS campaign_subscribers CASCADE;
+CREATE TABLE campaign_subscribers (
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    PRIMARY KEY (campaign_id, subscriber_id)
+);
+
+DROP TABLE IF EXISTS campaign_variants CASCADE;
+CREATE TABLE campaign_variants (
+    id               SERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    name             TEXT NOT NULL,
+    subject          TEXT NOT NULL,
+    body             TEXT NOT NULL,
+
+    -- The number of subscribers in the A/B test batch sent the variant.
+    sent             INT NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_camp_variants_camp_id; CREATE INDEX idx_camp_variants_camp_id ON campaign_variants(campaign_id);
+
 DROP TABLE IF EXISTS campaign_views CASCADE;
 CREATE TABLE campaign_views (
     id               BIGSERIAL PRIMARY KEY,
     campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    variant_id       INTEGER NULL REFERENCES campaign_variants(id) ON DELETE SET NULL ON UPDATE CASCADE,
 
     -- Subscribers may be deleted, but the view counts should remain.
     subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
@@ -126,8 +309,121 @@ CREATE TABLE campaign_views (
 );
 DROP INDEX IF EXISTS idx_views_camp_id; CREATE INDEX idx_views_camp_id ON campaign_views(campaign_id);
 DROP INDEX IF EXISTS idx_views_subscriber_id; CREATE INDEX idx_views_subscriber_id ON campaign_views(subscriber_id);
+DROP INDEX IF EXISTS idx_views_variant_id; CREATE INDEX idx_views_variant_id ON campaign_views(variant_id);
 DROP INDEX IF EXISTS idx_views_date; CREATE INDEX idx_views_date ON campaign_views((TIMEZONE('UTC', created_at)::DATE));
 
+-- Views of transactional messages, recorded against their tx template.
+DROP TABLE IF EXISTS tx_views CASCADE;
+CREATE TABLE tx_views (
+    id               BIGSERIAL PRIMARY KEY,
+    template_id      INTEGER NOT NULL REFERENCES templates(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_tx_views_template_id; CREATE INDEX idx_tx_views_template_id ON tx_views(template_id);
+DROP INDEX IF EXISTS idx_tx_views_subscriber_id; CREATE INDEX idx_tx_views_subscriber_id ON tx_views(subscriber_id);
+
+-- campaign messages that failed to be delivered to subscribers
+DROP TABLE IF EXISTS campaign_failures CASCADE;
+CREATE TABLE campaign_failures (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    error            TEXT NOT NULL DEFAULT '',
+    attempts         INTEGER NOT NULL DEFAULT 1,
+
+    -- The failure has been requeued and is waiting to be retried.
+    queued           BOOLEAN NOT NULL DEFAULT false,
+
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_camp_failures; CREATE UNIQUE INDEX idx_camp_failures ON campaign_failures(campaign_id, subscriber_id);
+DROP INDEX IF EXISTS idx_camp_failures_queued; CREATE INDEX idx_camp_failures_queued ON campaign_failures(id) WHERE queued = true;
+
+-- instances processing campaigns
+DROP TABLE IF EXISTS nodes CASCADE;
+CREATE TABLE nodes (
+    id               UUID NOT NULL PRIMARY KEY,
+    hostname         TEXT NOT NULL DEFAULT '',
+    started_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    heartbeat_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- subscriber ID ranges of campaigns leased by instances that are being sent
+DROP TABLE IF EXISTS campaign_leases CASCADE;
+CREATE TABLE campaign_leases (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    node_id          UUID NOT NULL,
+
+    -- The range of subscriber IDs (from_id, to_id]. from_id is moved up as the
+    -- subscribers in the range are sent to.
+    from_id          INTEGER NOT NULL,
+    to_id            INTEGER NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_camp_leases_camp_id; CREATE INDEX idx_camp_leases_camp_id ON campaign_leases(campaign_id);
+
+-- sequences of messages sent to the subscribers of a list at intervals after they subscribe
+DROP TABLE IF EXISTS sequences CASCADE;
+CREATE TABLE sequences (
+    id               SERIAL PRIMARY KEY,
+    uuid uuid        NOT NULL UNIQUE,
+    name             TEXT NOT NULL,
+    list_id          INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- Subscribers that match the segment exit the sequence before their next message.
+    exit_segment_id  INTEGER NULL REFERENCES segments(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    from_email       TEXT NOT NULL,
+    messenger        TEXT NOT NULL,
+    template_id      INTEGER REFERENCES templates(id) ON DELETE SET DEFAULT DEFAULT 1,
+    enabled          BOOLEAN NOT NULL DEFAULT true,
+
+    -- The time up to which subscriptions to the list have been enrolled.
+    enrolled_at      TIMESTAMP WITH TIME ZONE NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_sequences_list_id; CREATE INDEX idx_sequences_list_id ON sequences(list_id);
+
+DROP TABLE IF EXISTS sequence_steps CASCADE;
+CREATE TABLE sequence_steps (
+    id               SERIAL PRIMARY KEY,
+    sequence_id      INTEGER NOT NULL REFERENCES sequences(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    position         INTEGER NOT NULL,
+
+    -- Minutes after the previous message (or the subscription for the first one)
+    -- after which the step is sent.
+    delay_mins       INTEGER NOT NULL DEFAULT 0,
+    subject          TEXT NOT NULL,
+    body             TEXT NOT NULL,
+    altbody          TEXT NULL,
+    content_type     content_type NOT NULL DEFAULT 'richtext',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_sequence_steps; CREATE UNIQUE INDEX idx_sequence_steps ON sequence_steps(sequence_id, position);
+
+-- progress of subscribers through sequences
+DROP TABLE IF EXISTS sequence_subscribers CASCADE;
+CREATE TABLE sequence_subscribers (
+    sequence_id      INTEGER NOT NULL REFERENCES sequences(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- Position of the next step to be sent and when.
+    step             INTEGER NOT NULL DEFAULT 0,
+    next_at          TIMESTAMP WITH TIME ZONE NULL,
+    status           sequence_subscriber_status NOT NULL DEFAULT 'active',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (sequence_id, subscriber_id)
+);
+DROP INDEX IF EXISTS idx_sequence_subs_next_at; CREATE INDEX idx_sequence_subs_next_at ON sequence_subscribers(next_at) WHERE status = 'active';
+DROP INDEX IF EXISTS idx_sequence_subs_sub_id; CREATE INDEX idx_sequence_subs_sub_id ON sequence_subscribers(subscriber_id);
+
 -- media
 DROP TABLE IF EXISTS media CASCADE;
 CREATE TABLE media (
@@ -152,8 +448,12 @@ DROP TABLE IF EXISTS link_clicks CASCADE;
 CREATE TABLE link_clicks (
     id               BIGSERIAL PRIMARY KEY,
     campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    variant_id       INTEGER NULL REFERENCES campaign_variants(id) ON DELETE SET NULL ON UPDATE CASCADE,
     link_id          INTEGER NOT NULL REFERENCES links(id) ON DELETE CASCADE ON UPDATE CASCADE,
 
+    -- The tx template of clicks in transactional messages.
+    template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
     -- Subscribers may be deleted, but the link counts should remain.
     subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
@@ -161,6 +461,8 @@ CREATE TABLE link_clicks (
 DROP INDEX IF EXISTS idx_clicks_camp_id; CREATE INDEX idx_clicks_camp_id ON link_clicks(campaign_id);
 DROP INDEX IF EXISTS idx_clicks_link_id; CREATE INDEX idx_clicks_link_id ON link_clicks(link_id);
 DROP INDEX IF EXISTS idx_clicks_sub_id; CREATE INDEX idx_clicks_sub_id ON link_clicks(subscriber_id);
+DROP INDEX IF EXISTS idx_clicks_variant_id; CREATE INDEX idx_clicks_variant_id ON link_clicks(variant_id);
+DROP INDEX IF EXISTS idx_clicks_template_id; CREATE INDEX idx_clicks_template_id ON link_clicks(template_id);
 DROP INDEX IF EXISTS idx_clicks_date; CREATE INDEX idx_clicks_date ON link_clicks((TIMEZONE('UTC', created_at)::DATE));
 
 -- settings
@@ -180,9 +482,12 @@ INSERT INTO settings (key, value) VALUES
     ('app.message_rate', '10'),
     ('app.batch_size', '1000'),
     ('app.max_send_errors', '1000'),
+    ('app.max_send_error_rate', '0'),
+    ('app.send_error_window', '1000'),
     ('app.message_sliding_window', 'false'),
     ('app.message_sliding_window_duration', '"1h"'),
     ('app.message_sliding_window_rate', '10000'),
+    ('app.domain_throttles', '[]'),
     ('app.enable_public_subscription_page', 'true'),
     ('app.send_optin_confirmation', 'true'),
     ('app.check_updates', 'true'),
@@ -209,18 +514,27 @@ INSERT INTO settings (key, value) VALUES
     ('upload.s3.bucket_type', '"public"'),
     ('upload.s3.expiry', '"14d"'),
     ('smtp',
-        '[{"enabled":true, "host":"smtp.yoursite.com","port":25,"auth_protocol":"cram","username":"username","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"STARTTLS","tls_skip_verify":false,"email_headers":[]},
-          {"enabled":false, "host":"smtp.gmail.com","port":465,"auth_protocol":"login","username":"username@gmail.com","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"TLS","tls_skip_verify":false,"email_headers":[]}]'),
+        '[{"enabled":true, "name":"", "weight":1, "host":"smtp.yoursite.com","port":25,"auth_protocol":"cram","username":"username","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"STARTTLS","tls_skip_verify":false,"email_headers":[],"dkim":[]},
+          {"enabled":false, "name":"", "weight":1, "host":"smtp.gmail.com","port":465,"auth_protocol":"login","username":"username@gmail.com","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"TLS","tls_skip_verify":false,"email_headers":[],"dkim":[]}]'),
     ('messengers', '[]'),
+    ('messenger.ses', '{"enabled": false, "region": "ap-south-1", "access_key": "", "secret_key": "", "endpoint": "", "configuration_set": "", "max_conns": 10, "max_rate": 14, "batch_size": 10, "max_msg_retries": 2, "timeout": "5s"}'),
+    ('messenger.sendgrid', '{"enabled": false, "api_key": "", "endpoint": "", "max_conns": 10, "max_rate": 0, "batch_size": 10, "max_msg_retries": 2, "timeout": "5s"}'),
     ('bounce.enabled', 'false'),
     ('bounce.webhooks_enabled', 'false'),
-    ('bounce.count', '2'),
-    ('bounce.action', '"blocklist"'),
+    ('bounce.actions', '{"soft": {"count": 5, "action": "unsubscribe", "days": 30}, "hard": {"count": 1, "action": "blocklist", "days": 0}, "complaint": {"count": 1, "action": "unsubscribe", "days": 0}}'),
     ('bounce.ses_enabled', 'false'),
     ('bounce.sendgrid_enabled', 'false'),
     ('bounce.sendgrid_key', '""'),
+    ('bounce.mailgun_enabled', 'false'),
+    ('bounce.mailgun_key', '""'),
+    ('bounce.postmark_enabled', 'false'),
+    ('bounce.postmark_username', '""'),
+    ('bounce.postmark_password', '""'),
+    ('bounce.sparkpost_enabled', 'false'),
+    ('bounce.sparkpost_username', '""'),
+    ('bounce.sparkpost_password', '""'),
     ('bounce.mailboxes',
-        '[{"enabled":false, "type": "pop", "host":"pop.yoursite.com","port":995,"auth_protocol":"userpass","username":"username","password":"password","return_path": "bounce@listmonk.yoursite.com","scan_interval":"15m","tls_enabled":true,"tls_skip_verify":false}]'),
+        '[{"enabled":false, "type": "pop", "host":"pop.yoursite.com","port":995,"auth_protocol":"userpass","username":"username","password":"password","return_path": "bounce@listmonk.yoursite.com","folder":"INBOX","processed_action":"delete","processed_folder":"","scan_interval":"15m","tls_enabled":true,"tls_skip_verify":false}]'),
     ('appearance.admin.custom_css', '""'),
     ('appearance.admin.custom_js', '""'),
     ('appearance.public.custom_css', '""'),
@@ -241,3 +555,53 @@ DROP INDEX IF EXISTS idx_bounces_sub_id; CREATE INDEX idx_bounces_sub_id ON boun
 DROP INDEX IF EXISTS idx_bounces_camp_id; CREATE INDEX idx_bounces_camp_id ON bounces(campaign_id);
 DROP INDEX IF EXISTS idx_bounces_source; CREATE INDEX idx_bounces_source ON bounces(source);
 DROP INDEX IF EXISTS idx_bounces_date; CREATE INDEX idx_bounces_date ON bounces((TIMEZONE('UTC', created_at)::DATE));
+
+-- incoming bounces that are staged for processing, and the failed (dead-letter) ones
+DROP TABLE IF EXISTS pending_bounces CASCADE;
+CREATE TABLE pending_bounces (
+    id               BIGSERIAL PRIMARY KEY,
+    payload          JSONB NOT NULL DEFAULT '{}',
+    source           TEXT NOT NULL DEFAULT '',
+    status           pending_bounce_status NOT NULL DEFAULT 'pending',
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    error            TEXT NOT NULL DEFAULT '',
+    next_attempt_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_pending_bounces_status; CREATE INDEX idx_pending_bounces_status ON pending_bounces(status, next_attempt_at);
+
+-- outgoing webhooks
+DROP TABLE IF EXISTS webhooks CASCADE;
+CREATE TABLE webhooks (
+    id               SERIAL PRIMARY KEY,
+    name             TEXT NOT NULL,
+    url              TEXT NOT NULL,
+    secret           TEXT NOT NULL DEFAULT '',
+    events           TEXT[] NOT NULL DEFAULT '{}',
+    enabled          BOOLEAN NOT NULL DEFAULT true,
+    max_retries      INTEGER NOT NULL DEFAULT 5,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+DROP TABLE IF EXISTS webhook_deliveries CASCADE;
+CREATE TABLE webhook_deliveries (
+    id               BIGSERIAL PRIMARY KEY,
+    webhook_id       INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    event            TEXT NOT NULL,
+    payload          JSONB NOT NULL DEFAULT '{}',
+    status           webhook_delivery_status NOT NULL DEFAULT 'pending',
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    response_code    INTEGER NOT NULL DEFAULT 0,
+    error            TEXT NOT NULL DEFAULT '',
+
+    -- Pending deliveries are (re)attempted once this is due.
+    next_attempt_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_webhook_deliveries_hook_id; CREATE INDEX idx_webhook_deliveries_hook_id ON webhook_deliveries(webhook_id);
+DROP INDEX IF EXISTS idx_webhook_deliveries_status; CREATE INDEX idx_webhook_deliveries_status ON webhook_deliveries(status, next_attempt_at);
+DROP INDEX IF EXISTS idx_webhook_deliveries_date; CREATE INDEX idx_webhook_deliveries_date ON webhook_deliveries((TIMEZONE('UTC', created_at)::DATE));